@@ -169,6 +169,57 @@ func (s *AIBasicPlatformDataService) GetAllTools() ([]Tool, error) {
 	return tools, nil
 }
 
+// SyncServerExecutorTools 把MCP服务器注册表中的工具同步到工具目录（按 tool_name 匹配）
+// 已有的工具只更新说明、输入参数和分类，保留管理员设置的启用状态、可用角色和优先级；
+// 新工具以 server_executor 类型写入，启用状态和优先级取 tool.Enabled、tool.Priority
+// 返回新增和更新的工具数量
+func (s *AIBasicPlatformDataService) SyncServerExecutorTools(tools []Tool) (int, int, error) {
+	inserted, updated := 0, 0
+	for _, tool := range tools {
+		schema, err := json.Marshal(tool.InputSchema)
+		if err != nil {
+			return inserted, updated, fmt.Errorf("序列化工具 %s 的输入参数失败: %v", tool.ToolName, err)
+		}
+
+		query := fmt.Sprintf(`SELECT id FROM %s.aibasicplatform_tools WHERE tool_name = ? LIMIT 1`, s.dbName)
+		opResult := s.readWrite.QueryDb(query, tool.ToolName)
+		if !opResult.IsSuccess() {
+			return inserted, updated, fmt.Errorf("查询工具 %s 失败: %v", tool.ToolName, opResult.Error)
+		}
+
+		if rows, ok := opResult.Data.([]map[string]interface{}); ok && len(rows) > 0 {
+			update := fmt.Sprintf(`
+				UPDATE %s.aibasicplatform_tools
+				SET tool_description = ?, input_schema = ?, category = ?, execution_type = 'server_executor', updated_at = NOW()
+				WHERE tool_name = ?
+			`, s.dbName)
+			opResult = s.readWrite.ExecuteDb(update, tool.ToolDescription, string(schema), tool.Category, tool.ToolName)
+			if !opResult.IsSuccess() {
+				return inserted, updated, fmt.Errorf("更新工具 %s 失败: %v", tool.ToolName, opResult.Error)
+			}
+			updated++
+			continue
+		}
+
+		enabled := 0
+		if tool.Enabled {
+			enabled = 1
+		}
+		insert := fmt.Sprintf(`
+			INSERT INTO %s.aibasicplatform_tools
+				(tool_name, tool_description, input_schema, category, execution_type, enabled, priority, created_at, updated_at)
+			VALUES (?, ?, ?, ?, 'server_executor', ?, ?, NOW(), NOW())
+		`, s.dbName)
+		opResult = s.readWrite.ExecuteDb(insert, tool.ToolName, tool.ToolDescription, string(schema), tool.Category, enabled, tool.Priority)
+		if !opResult.IsSuccess() {
+			return inserted, updated, fmt.Errorf("新增工具 %s 失败: %v", tool.ToolName, opResult.Error)
+		}
+		inserted++
+	}
+
+	return inserted, updated, nil
+}
+
 // ConvertToolsToOpenAIFormat 将客户端执行器工具转换为OpenAI tools格式
 func ConvertToolsToOpenAIFormat(tools []Tool) []map[string]interface{} {
 	var openaiTools []map[string]interface{}
@@ -0,0 +1,139 @@
+package apikey
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// reservationExpire 单条预占的有效期，进程异常退出未释放的预占到期后自动失效
+const reservationExpire = 30 * time.Minute
+
+// TokenReservation 令牌预占
+// 请求开始时按估算值预占余额，结束时按实际用量结算（CommitReservation）或释放（ReleaseReservation）
+type TokenReservation struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Amount int    `json:"amount"` // 实际预占的令牌数，0 表示未预占（如Redis不可用）
+}
+
+// reservedTokensKey 用户进行中预占的Redis有序集合键
+// 每条预占是一个成员（reservationMember），以到期时间为分数，进程异常退出未释放的预占到期后不再计入
+func reservedTokensKey(userId string) string {
+	return fmt.Sprintf("apikey:reserved:%s", userId)
+}
+
+// reservationMember 单条预占在有序集合中的成员值，格式为 <预占ID>:<预占令牌数>
+func reservationMember(id string, amount int) string {
+	return fmt.Sprintf("%s:%d", id, amount)
+}
+
+// sumReservations 汇总未到期预占的令牌数
+func sumReservations(members []string) int {
+	total := 0
+	for _, member := range members {
+		idx := strings.LastIndex(member, ":")
+		if idx < 0 {
+			continue
+		}
+		if amount, err := strconv.Atoi(member[idx+1:]); err == nil {
+			total += amount
+		}
+	}
+	return total
+}
+
+// ReserveTokens 预占令牌
+// 可用余额 = 账户余额 - 其他进行中请求的预占总额；可用余额不足 estimate 时只预占剩余部分，已无可用余额时拒绝
+// 返回：预占记录，预占后的可用余额，错误消息
+func (s *ApiKeyService) ReserveTokens(userId string, estimate int) (*TokenReservation, int, error) {
+	hasEnough, totalTokens, err, _ := s.CheckUserTokens(userId)
+	if !hasEnough {
+		if err == nil {
+			err = fmt.Errorf("令牌余额不足")
+		}
+		return nil, totalTokens, err
+	}
+
+	if estimate <= 0 {
+		estimate = 1
+	}
+
+	reservation := &TokenReservation{
+		ID:     uuid.New().String(),
+		UserID: userId,
+	}
+
+	if s.readWrite == nil {
+		return reservation, totalTokens, nil
+	}
+
+	// 先登记预占再汇总校验，登记和汇总在同一个Redis事务中，多个请求并发预占时不会漏算
+	key := reservedTokensKey(userId)
+	member := reservationMember(reservation.ID, estimate)
+	result := s.readWrite.AddRedisExpiringMember(key, member, reservationExpire, reservationExpire)
+	if !result.IsSuccess() {
+		logger.Printf("预占令牌失败，放行: user=%s, 错误=%v", userId, result.Error)
+		return reservation, totalTokens, nil
+	}
+	members, _ := result.Data.([]string)
+
+	available := totalTokens - (sumReservations(members) - estimate)
+	if available <= 0 {
+		s.readWrite.RemoveRedisMember(key, member)
+		return nil, 0, fmt.Errorf("令牌余额不足: 余额已被进行中的请求预占")
+	}
+
+	held := estimate
+	if held > available {
+		// 先登记缩减后的预占再删除原预占，中间时刻只会多算不会少算
+		held = available
+		reduced := reservationMember(reservation.ID, held)
+		if addResult := s.readWrite.AddRedisExpiringMember(key, reduced, reservationExpire, reservationExpire); !addResult.IsSuccess() {
+			s.readWrite.RemoveRedisMember(key, member)
+			logger.Printf("保存预占记录失败，放行: user=%s, 错误=%v", userId, addResult.Error)
+			return reservation, totalTokens, nil
+		}
+		s.readWrite.RemoveRedisMember(key, member)
+	}
+	reservation.Amount = held
+
+	logger.Printf("预占令牌: user=%s, reservation=%s, 预占=%d, 可用=%d", userId, reservation.ID, held, available-held)
+	return reservation, available - held, nil
+}
+
+// ReleaseReservation 释放预占（可重复调用，只有第一次生效）
+func (s *ApiKeyService) ReleaseReservation(reservation *TokenReservation) {
+	if reservation == nil || reservation.Amount <= 0 || s.readWrite == nil {
+		return
+	}
+
+	member := reservationMember(reservation.ID, reservation.Amount)
+	result := s.readWrite.RemoveRedisMember(reservedTokensKey(reservation.UserID), member)
+	if !result.IsSuccess() {
+		logger.Printf("释放预占失败: reservation=%s, 错误=%v", reservation.ID, result.Error)
+		return
+	}
+	if count, _ := result.Data.(int64); count != 1 {
+		return
+	}
+	logger.Printf("释放预占: user=%s, reservation=%s, 预占=%d", reservation.UserID, reservation.ID, reservation.Amount)
+}
+
+// CommitReservation 按实际用量结算预占：扣除实际令牌数并释放预占
+// 返回：扣除成功，剩余令牌，错误消息
+func (s *ApiKeyService) CommitReservation(reservation *TokenReservation, actualTokens int) (bool, int, error) {
+	if reservation == nil {
+		return false, 0, fmt.Errorf("预占记录不能为空")
+	}
+	// 先扣除再释放，避免释放后、扣除前的间隙被其他请求预占
+	defer s.ReleaseReservation(reservation)
+
+	if actualTokens <= 0 {
+		return true, 0, nil
+	}
+	return s.DeductTokens(reservation.UserID, actualTokens)
+}
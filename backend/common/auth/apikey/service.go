@@ -78,20 +78,27 @@ func NewApiKeyServiceWithDB(readWrite *datahandle.CommonReadWriteService) *ApiKe
 // VerifyApiKey 验证API密钥是否有效
 // 返回：是否有效，用户ID，错误消息
 func (s *ApiKeyService) VerifyApiKey(apiKey string) (bool, string, error) {
+	valid, userId, _, err := s.VerifyApiKeyWithID(apiKey)
+	return valid, userId, err
+}
+
+// VerifyApiKeyWithID 验证API密钥是否有效，同时返回密钥的ID（用于按密钥统计用量，不保存明文）
+// 返回：是否有效，用户ID，密钥ID，错误消息
+func (s *ApiKeyService) VerifyApiKeyWithID(apiKey string) (bool, string, int, error) {
 	if apiKey == "" {
-		return false, "", fmt.Errorf("API密钥不能为空")
+		return false, "", 0, fmt.Errorf("API密钥不能为空")
 	}
 
 	// 连接数据库
 	db, err := s.getDbConnection()
 	if err != nil {
 		logger.Printf("数据库连接失败: %v", err)
-		return false, "", fmt.Errorf("数据库连接失败: %v", err)
+		return false, "", 0, fmt.Errorf("数据库连接失败: %v", err)
 	}
 	defer db.Close()
 
 	// 查询API密钥
-	var id string
+	var id int
 	var userId string
 	var status int
 	var expiresAt sql.NullTime
@@ -104,10 +111,10 @@ func (s *ApiKeyService) VerifyApiKey(apiKey string) (bool, string, error) {
 	err = db.QueryRow(query, apiKey).Scan(&id, &userId, &status, &expiresAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, "", fmt.Errorf("无效的API密钥")
+			return false, "", 0, fmt.Errorf("无效的API密钥")
 		}
 		logger.Printf("查询API密钥失败: %v", err)
-		return false, "", fmt.Errorf("查询失败: %v", err)
+		return false, "", 0, fmt.Errorf("查询失败: %v", err)
 	}
 
 	// 更新最后使用时间
@@ -123,16 +130,16 @@ func (s *ApiKeyService) VerifyApiKey(apiKey string) (bool, string, error) {
 
 	// 验证状态
 	if status != 1 {
-		return false, "", fmt.Errorf("API密钥已禁用")
+		return false, "", 0, fmt.Errorf("API密钥已禁用")
 	}
 
 	// 检查是否过期
 	now := time.Now()
 	if expiresAt.Valid && expiresAt.Time.Before(now) {
-		return false, "", fmt.Errorf("API密钥已过期")
+		return false, "", 0, fmt.Errorf("API密钥已过期")
 	}
 
-	return true, userId, nil
+	return true, userId, id, nil
 }
 
 // CheckUserTokens 检查用户的令牌余额
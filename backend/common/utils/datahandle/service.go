@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -296,6 +297,43 @@ func (s *CommonReadWriteService) ExecuteDb(query string, params ...interface{})
 	return &OperationResult{Status: StatusSuccess, Data: affectedRows}
 }
 
+// DbStatement 事务中的一条更新语句
+type DbStatement struct {
+	Query  string
+	Params []interface{}
+}
+
+// ExecuteDbTransaction 在一个事务中依次执行更新语句，任一语句失败时回滚全部，Data 为受影响的总行数
+func (s *CommonReadWriteService) ExecuteDbTransaction(statements []DbStatement) *OperationResult {
+	db, err := s.getDbConnection()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	var affectedRows int64
+	for _, statement := range statements {
+		result, err := tx.Exec(statement.Query, statement.Params...)
+		if err != nil {
+			tx.Rollback()
+			return s.handleError(err)
+		}
+		if rows, err := result.RowsAffected(); err == nil {
+			affectedRows += rows
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return s.handleError(err)
+	}
+
+	return &OperationResult{Status: StatusSuccess, Data: affectedRows}
+}
+
 // ExecuteDbAsync 异步执行数据库更新操作
 func (s *CommonReadWriteService) ExecuteDbAsync(query string, params ...interface{}) chan *OperationResult {
 	resultChan := make(chan *OperationResult, 1)
@@ -394,6 +432,22 @@ func (s *CommonReadWriteService) SetRedis(key string, value string, expire time.
 	return &OperationResult{Status: StatusSuccess}
 }
 
+// SetRedisNX 仅在键不存在时设置Redis键值，过期时间只在设置成功时生效，返回是否设置成功
+func (s *CommonReadWriteService) SetRedisNX(key string, value string, expire time.Duration) *OperationResult {
+	client, err := s.getRedisConnection()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	// 原子地设置值和过期时间，键已存在时不修改
+	ok, err := client.SetNX(s.ctx, key, value, expire).Result()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	return &OperationResult{Status: StatusSuccess, Data: ok}
+}
+
 // DeleteRedis 删除Redis键
 func (s *CommonReadWriteService) DeleteRedis(key string) *OperationResult {
 	client, err := s.getRedisConnection()
@@ -410,6 +464,101 @@ func (s *CommonReadWriteService) DeleteRedis(key string) *OperationResult {
 	return &OperationResult{Status: StatusSuccess, Data: count}
 }
 
+// IncrRedis 原子增加Redis计数器并设置过期时间，返回增加后的值
+func (s *CommonReadWriteService) IncrRedis(key string, delta int64, expire time.Duration) *OperationResult {
+	client, err := s.getRedisConnection()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	// 增加计数并刷新过期时间
+	pipe := client.TxPipeline()
+	incr := pipe.IncrBy(s.ctx, key, delta)
+	if expire > 0 {
+		pipe.Expire(s.ctx, key, expire)
+	}
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return s.handleError(err)
+	}
+
+	return &OperationResult{Status: StatusSuccess, Data: incr.Val()}
+}
+
+// PushRedisList 将值插入Redis列表头部，只保留最新的 maxLen 个元素并刷新过期时间
+func (s *CommonReadWriteService) PushRedisList(key string, value string, maxLen int64, expire time.Duration) *OperationResult {
+	client, err := s.getRedisConnection()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	pipe := client.TxPipeline()
+	pipe.LPush(s.ctx, key, value)
+	if maxLen > 0 {
+		pipe.LTrim(s.ctx, key, 0, maxLen-1)
+	}
+	if expire > 0 {
+		pipe.Expire(s.ctx, key, expire)
+	}
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return s.handleError(err)
+	}
+
+	return &OperationResult{Status: StatusSuccess}
+}
+
+// GetRedisList 读取Redis列表的全部元素，Data 为 []string
+func (s *CommonReadWriteService) GetRedisList(key string) *OperationResult {
+	client, err := s.getRedisConnection()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	values, err := client.LRange(s.ctx, key, 0, -1).Result()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	return &OperationResult{Status: StatusSuccess, Data: values}
+}
+
+// AddRedisExpiringMember 向Redis有序集合添加成员，成员在 ttl 后到期（以到期时间作为分数）
+// 同一事务中清理已到期的成员并刷新集合的过期时间，返回当前未到期的全部成员，Data 为 []string
+func (s *CommonReadWriteService) AddRedisExpiringMember(key string, member string, ttl time.Duration, expire time.Duration) *OperationResult {
+	client, err := s.getRedisConnection()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	now := time.Now()
+	pipe := client.TxPipeline()
+	pipe.ZRemRangeByScore(s.ctx, key, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	pipe.ZAdd(s.ctx, key, &redis.Z{Score: float64(now.Add(ttl).UnixMilli()), Member: member})
+	members := pipe.ZRange(s.ctx, key, 0, -1)
+	if expire > 0 {
+		pipe.Expire(s.ctx, key, expire)
+	}
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return s.handleError(err)
+	}
+
+	return &OperationResult{Status: StatusSuccess, Data: members.Val()}
+}
+
+// RemoveRedisMember 从Redis有序集合删除成员，Data 为实际删除的成员数（int64）
+func (s *CommonReadWriteService) RemoveRedisMember(key string, member string) *OperationResult {
+	client, err := s.getRedisConnection()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	count, err := client.ZRem(s.ctx, key, member).Result()
+	if err != nil {
+		return s.handleError(err)
+	}
+
+	return &OperationResult{Status: StatusSuccess, Data: count}
+}
+
 // ProcessDbOperation 处理数据库操作
 func (s *CommonReadWriteService) ProcessDbOperation(operationType string, args ...interface{}) *OperationResult {
 	switch operationType {
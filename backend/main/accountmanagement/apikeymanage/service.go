@@ -29,6 +29,12 @@ func (s *ApiKeyManageService) VerifyApiKey(apiKey string) (bool, string, error)
 	return s.apiKeyService.VerifyApiKey(apiKey)
 }
 
+// VerifyApiKeyWithID 验证API密钥并返回密钥ID（供interceptor按密钥统计用量）
+// 返回：是否有效，用户ID，密钥ID，错误
+func (s *ApiKeyManageService) VerifyApiKeyWithID(apiKey string) (bool, string, int, error) {
+	return s.apiKeyService.VerifyApiKeyWithID(apiKey)
+}
+
 // CheckUserTokens 检查用户令牌余额（供interceptor使用）
 // 返回：是否有余额，剩余令牌，错误，令牌详情
 func (s *ApiKeyManageService) CheckUserTokens(userID string) (bool, int, error, map[string]int) {
@@ -41,6 +47,23 @@ func (s *ApiKeyManageService) DeductTokens(userID string, tokens int) (bool, int
 	return s.apiKeyService.DeductTokens(userID, tokens)
 }
 
+// ReserveTokens 按估算值预占用户令牌（供interceptor使用）
+// 返回：预占记录，预占后的可用余额，错误
+func (s *ApiKeyManageService) ReserveTokens(userID string, estimate int) (*apikey.TokenReservation, int, error) {
+	return s.apiKeyService.ReserveTokens(userID, estimate)
+}
+
+// CommitReservation 按实际用量结算预占（供interceptor使用）
+// 返回：是否成功，剩余令牌，错误
+func (s *ApiKeyManageService) CommitReservation(reservation *apikey.TokenReservation, tokens int) (bool, int, error) {
+	return s.apiKeyService.CommitReservation(reservation, tokens)
+}
+
+// ReleaseReservation 释放预占（供interceptor使用）
+func (s *ApiKeyManageService) ReleaseReservation(reservation *apikey.TokenReservation) {
+	s.apiKeyService.ReleaseReservation(reservation)
+}
+
 // ProcessRequest 处理API密钥管理请求
 func (s *ApiKeyManageService) ProcessRequest(clientID string, messageData map[string]interface{}, connectionID string, msgID string) (map[string]interface{}, error) {
 	log.Printf("[WS:%s:%s] 处理API密钥管理请求: %s", connectionID, msgID, jsonToString(messageData))
@@ -411,6 +411,8 @@ func processRequest(requestID string, data map[string]interface{}, nonceVerified
 		switch operation {
 		case "assets_tokens":
 			result = handleAssetsTokensRequest(requestID, data)
+		case "usage":
+			result = handleUsageRequest(requestID, action, data)
 		case "api_key_manage":
 			if action == "" {
 				result = map[string]interface{}{
@@ -62,6 +62,7 @@ func setupRoutes() http.Handler {
 	router.Handle("/api/aiBasicPlatform/translation/get", rateLimit(http.HandlerFunc(handleEncryptedRequest), 5, 180)).Methods("POST", "OPTIONS")
 	router.Handle("/api/aiBasicPlatform/translation/list", rateLimit(http.HandlerFunc(handleEncryptedRequest), 5, 180)).Methods("POST", "OPTIONS")
 	router.Handle("/api/aiBasicPlatform/assetsTokens", rateLimit(http.HandlerFunc(handleEncryptedRequest), 5, 180)).Methods("POST", "OPTIONS")
+	router.Handle("/api/aiBasicPlatform/usage", rateLimit(http.HandlerFunc(handleEncryptedRequest), 5, 180)).Methods("POST", "OPTIONS")
 	router.Handle("/api/aiBasicPlatform/apiKeyManage/list", rateLimit(http.HandlerFunc(handleEncryptedRequest), 5, 180)).Methods("POST", "OPTIONS")
 	router.Handle("/api/aiBasicPlatform/apiKeyManage/create", rateLimit(http.HandlerFunc(handleEncryptedRequest), 5, 180)).Methods("POST", "OPTIONS")
 	router.Handle("/api/aiBasicPlatform/apiKeyManage/delete", rateLimit(http.HandlerFunc(handleEncryptedRequest), 5, 180)).Methods("POST", "OPTIONS")
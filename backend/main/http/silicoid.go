@@ -10,6 +10,7 @@ import (
 	"sync"
 
 	silicoidhttp "digitalsingularity/backend/silicoid/http"
+	"digitalsingularity/backend/silicoid/models/manager"
 )
 
 var (
@@ -359,12 +360,48 @@ func handleSilicoidApiKeyGetAvailable(requestID string, data map[string]interfac
 		}
 	}
 
+	if breakerState := getSilicoidCircuitBreakerState(modelCode, info); breakerState != nil {
+		info["circuit_breaker"] = breakerState
+	}
+
 	return map[string]interface{}{
 		"status": "success",
 		"data":   info,
 	}
 }
 
+// getSilicoidCircuitBreakerState 获取模型密钥和 base_url 的熔断状态
+func getSilicoidCircuitBreakerState(modelCode string, info map[string]interface{}) map[string]interface{} {
+	modelManager := manager.GetModelManager()
+	if modelManager == nil {
+		return nil
+	}
+
+	breakerState := map[string]interface{}{}
+	if keyID, ok := parseIntFromInterface(info["id"]); ok {
+		breakerState["key"] = modelManager.GetKeyBreakerState(keyID)
+	}
+
+	if modelConfig, err := modelManager.GetModelConfig(modelCode); err == nil && modelConfig.BaseURL != "" {
+		breakerState["base_url"] = modelConfig.BaseURL
+		breakerState["base_url_state"] = modelManager.GetBaseURLBreakerState(modelConfig.BaseURL)
+	}
+
+	if apiKeys, err := modelManager.GetAvailableAPIKeys(modelCode); err == nil {
+		keys := make([]map[string]interface{}, 0, len(apiKeys))
+		for _, key := range apiKeys {
+			keys = append(keys, map[string]interface{}{
+				"id":       key.ID,
+				"key_name": key.KeyName,
+				"state":    modelManager.GetKeyBreakerState(key.ID),
+			})
+		}
+		breakerState["keys"] = keys
+	}
+
+	return breakerState
+}
+
 func handleSilicoidApiKeyCreate(requestID string, data map[string]interface{}) map[string]interface{} {
 	modelCode, _ := data["model_code"].(string)
 	if strings.TrimSpace(modelCode) == "" {
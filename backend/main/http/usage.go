@@ -0,0 +1,225 @@
+package http
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	silicoiddatabase "digitalsingularity/backend/silicoid/database"
+)
+
+const (
+	// usageDefaultPageSize 用量查询默认每页条数
+	usageDefaultPageSize = 20
+	// usageMaxPageSize 用量查询每页最大条数
+	usageMaxPageSize = 100
+	// usageMaxExportRows CSV 导出的最大行数
+	usageMaxExportRows = 10000
+	// usageDateLayout 查询日期格式
+	usageDateLayout = "2006-01-02"
+)
+
+// usageCSVColumns 各统计维度导出 CSV 的列（依次对应结果中的字段）
+var usageCSVColumns = map[string][]string{
+	silicoiddatabase.UsageGroupByDay:    {"day", "requests", "prompt_tokens", "cached_tokens", "completion_tokens", "amount"},
+	silicoiddatabase.UsageGroupByModel:  {"model", "requests", "prompt_tokens", "cached_tokens", "completion_tokens", "amount"},
+	silicoiddatabase.UsageGroupByAPIKey: {"api_key_id", "api_key_description", "requests", "prompt_tokens", "cached_tokens", "completion_tokens", "amount"},
+	"records":                           {"created_at", "request_id", "model_code", "api_key_id", "prompt_tokens", "cached_tokens", "completion_tokens", "amount"},
+}
+
+// handleUsageRequest 处理用户用量/账单查询请求（业务逻辑函数）
+// action: day（按天，默认）、model（按模型）、api_key（按API密钥）、records（流水明细）
+// 参数: start_date / end_date（YYYY-MM-DD，含结束日）、page / page_size、format=csv 导出全部结果
+func handleUsageRequest(requestID, action string, data map[string]interface{}) map[string]interface{} {
+	logger.Printf("[%s] 收到用量查询请求: %s", requestID, action)
+
+	userID, errResponse := usageUserID(requestID, data)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	if silicoidService == nil {
+		logger.Printf("[%s] Silicoid数据服务未初始化", requestID)
+		return map[string]interface{}{
+			"status":  "fail",
+			"message": "服务初始化失败",
+		}
+	}
+
+	if action == "" {
+		action = silicoiddatabase.UsageGroupByDay
+	}
+	columns, ok := usageCSVColumns[action]
+	if !ok {
+		logger.Printf("[%s] 未知的用量查询动作: %s", requestID, action)
+		return map[string]interface{}{
+			"status":  "fail",
+			"message": fmt.Sprintf("未知的用量查询动作: %s", action),
+		}
+	}
+
+	query := &silicoiddatabase.UsageQuery{UserID: userID}
+
+	startDate, _ := data["start_date"].(string)
+	if startDate = strings.TrimSpace(startDate); startDate != "" {
+		start, err := time.ParseInLocation(usageDateLayout, startDate, time.Local)
+		if err != nil {
+			return map[string]interface{}{
+				"status":  "fail",
+				"message": "start_date格式错误，应为YYYY-MM-DD",
+			}
+		}
+		query.StartTime = start
+	}
+	endDate, _ := data["end_date"].(string)
+	if endDate = strings.TrimSpace(endDate); endDate != "" {
+		end, err := time.ParseInLocation(usageDateLayout, endDate, time.Local)
+		if err != nil {
+			return map[string]interface{}{
+				"status":  "fail",
+				"message": "end_date格式错误，应为YYYY-MM-DD",
+			}
+		}
+		query.EndTime = end.AddDate(0, 0, 1)
+	}
+
+	format, _ := data["format"].(string)
+	export := strings.EqualFold(strings.TrimSpace(format), "csv")
+
+	page, pageSize := 1, usageDefaultPageSize
+	if export {
+		query.Limit = usageMaxExportRows
+	} else {
+		if v, ok := parseIntFromInterface(data["page"]); ok && v > 0 {
+			page = v
+		}
+		if v, ok := parseIntFromInterface(data["page_size"]); ok && v > 0 {
+			pageSize = v
+		}
+		if pageSize > usageMaxPageSize {
+			pageSize = usageMaxPageSize
+		}
+		query.Limit = pageSize
+		query.Offset = (page - 1) * pageSize
+	}
+
+	var rows []map[string]interface{}
+	var total int
+	var err error
+	if action == "records" {
+		rows, total, err = silicoidService.QueryBillingLedger(query)
+	} else {
+		rows, total, err = silicoidService.QueryUsageSummary(action, query)
+	}
+	if err != nil {
+		logger.Printf("[%s] 查询用量失败: %v", requestID, err)
+		return map[string]interface{}{
+			"status":  "fail",
+			"message": "查询用量失败",
+		}
+	}
+
+	if export {
+		content, err := usageToCSV(columns, rows)
+		if err != nil {
+			logger.Printf("[%s] 生成CSV失败: %v", requestID, err)
+			return map[string]interface{}{
+				"status":  "fail",
+				"message": "导出失败",
+			}
+		}
+		return map[string]interface{}{
+			"status":  "success",
+			"message": "导出成功",
+			"data": map[string]interface{}{
+				"filename":  fmt.Sprintf("usage_%s_%s.csv", action, time.Now().Format("20060102150405")),
+				"content":   content,
+				"rows":      len(rows),
+				"total":     total,
+				"truncated": total > len(rows),
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"status":  "success",
+		"message": "查询成功",
+		"data": map[string]interface{}{
+			"group_by":  action,
+			"list":      rows,
+			"total":     total,
+			"page":      page,
+			"page_size": pageSize,
+		},
+	}
+}
+
+// usageUserID 验证auth_token并获取用户ID，失败时返回错误响应
+func usageUserID(requestID string, data map[string]interface{}) (string, map[string]interface{}) {
+	authToken, ok := data["auth_token"].(string)
+	if !ok || authToken == "" {
+		logger.Printf("[%s] 缺少auth_token", requestID)
+		return "", map[string]interface{}{
+			"status":  "fail",
+			"message": "缺少auth_token",
+		}
+	}
+
+	valid, payload := authTokenService.VerifyAuthToken(authToken)
+	if !valid {
+		logger.Printf("[%s] auth_token验证失败", requestID)
+		return "", map[string]interface{}{
+			"status":  "fail",
+			"message": "无效的auth_token",
+		}
+	}
+
+	payloadMap, _ := payload.(map[string]interface{})
+	userID, _ := payloadMap["userId"].(string)
+	if userID == "" {
+		logger.Printf("[%s] 无法从auth_token获取用户ID", requestID)
+		return "", map[string]interface{}{
+			"status":  "fail",
+			"message": "无法获取用户ID",
+		}
+	}
+	return userID, nil
+}
+
+// usageToCSV 将查询结果按列转换为 CSV 文本
+func usageToCSV(columns []string, rows []map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err := writer.Write(columns); err != nil {
+		return "", err
+	}
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = usageCSVValue(row[column])
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
+
+func usageCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -49,6 +50,10 @@ func handleMainServiceConnection(w http.ResponseWriter, r *http.Request) {
 	done := make(chan struct{})
 	defer close(done)
 
+	// 连接关闭时取消该连接上进行中的预处理请求
+	connCtx, cancelConn := context.WithCancel(context.Background())
+	defer cancelConn()
+
 	go func() {
 		for {
 			select {
@@ -380,31 +385,10 @@ func handleMainServiceConnection(w http.ResponseWriter, r *http.Request) {
 							logger.Printf("用户 %s 发起Silicoid聊天请求", userID)
 
 							// 提取用户公钥（如果有）
-							userPublicKey := ""
-							// 处理 data 可能是字符串或 map 的情况
-							if dataStr, ok := messageData["data"].(string); ok {
-								// data 是 JSON 字符串，解析它
-								var chatData map[string]interface{}
-								if err := json.Unmarshal([]byte(dataStr), &chatData); err == nil {
-									// 优先使用新的字段名 userPublicKeyHex，向后兼容 userPublicKeyBase64
-									if pubKey, ok := chatData["userPublicKeyHex"].(string); ok {
-										userPublicKey = pubKey
-									} else if pubKey, ok := chatData["userPublicKeyBase64"].(string); ok {
-										userPublicKey = pubKey
-									}
-								}
-							} else if msgData, ok := messageData["data"].(map[string]interface{}); ok {
-								// data 已经是 map
-								// 优先使用新的字段名 userPublicKeyHex，向后兼容 userPublicKeyBase64
-								if pubKey, ok := msgData["userPublicKeyHex"].(string); ok {
-									userPublicKey = pubKey
-								} else if pubKey, ok := msgData["userPublicKeyBase64"].(string); ok {
-									userPublicKey = pubKey
-								}
-							}
+							userPublicKey := messageUserPublicKey(messageData)
 
 							// 在后台goroutine中处理聊天
-							go toAIProcessNonStreamingChat(conn, userID, messageData, userPublicKey)
+							go toAIProcessNonStreamingChat(connCtx, conn, userID, messageData, userPublicKey)
 
 							// 立即发送处理开始确认
 							response := map[string]interface{}{
@@ -416,6 +400,13 @@ func handleMainServiceConnection(w http.ResponseWriter, r *http.Request) {
 							}
 							responseBytes, _ := json.Marshal(response)
 							conn.WriteMessage(messageType, responseBytes)
+						case "resume_tool_call":
+							// 客户端重连后重新获取等待执行的工具调用
+							logger.Printf("用户 %s 恢复工具调用会话", userID)
+							go toAIResumeToolCall(conn, userID, messageData, messageUserPublicKey(messageData))
+						case "cancel_tool_call":
+							logger.Printf("用户 %s 取消工具调用会话", userID)
+							go toAICancelToolCall(conn, userID, messageData, messageUserPublicKey(messageData))
 						default:
 							response := map[string]interface{}{
 								"type": "error",
@@ -544,7 +535,7 @@ func handleMainServiceConnection(w http.ResponseWriter, r *http.Request) {
 
 						// 检查是否为 client executor 的回传
 						if rc, ok := messageData["response_category"].(string); ok && rc == "client_executor_result" {
-							go handleClientExecutorResult(conn, connectionID, userID, messageData)
+							go handleClientExecutorResult(connCtx, conn, connectionID, userID, messageData)
 							continue
 						}
 						// 其他 response 类型可继续扩展
@@ -606,7 +597,7 @@ func cleanupConnSessions(conn *websocket.Conn) {
 }
 
 // handleClientExecutorResult 处理前端回传的 client_executor_result（路由分发）
-func handleClientExecutorResult(conn *websocket.Conn, connectionID string, userID string, messageData map[string]interface{}) {
+func handleClientExecutorResult(ctx context.Context, conn *websocket.Conn, connectionID string, userID string, messageData map[string]interface{}) {
 	// 不信任外部传入的 userID，优先使用服务器维护的连接->userID 映射
 	if uid, ok := GetUserIDByConnection(conn); ok {
 		userID = uid
@@ -619,7 +610,7 @@ func handleClientExecutorResult(conn *websocket.Conn, connectionID string, userI
 	logger.Printf("路由 client_executor_result 到 silicoid (user=%s)", userID)
 
 	// 调用silicoid处理业务逻辑
-	go toAIProcessClientExecutorResult(conn, userID, messageData, "")
+	go toAIProcessClientExecutorResult(ctx, conn, userID, messageData, "")
 }
 
 // sendOfflineNotifications 发送用户的离线通知
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"digitalsingularity/backend/common/security/asymmetricencryption/encrypt"
 )
@@ -158,7 +159,8 @@ func extractClientExecutorCallsFromText(text string) []map[string]interface{} {
 }
 
 // prepareChatRequestData 准备聊天请求数据
-func prepareChatRequestData(messageData map[string]interface{}, userID string) (map[string]interface{}, error) {
+// ctx 随 WebSocket 连接关闭而取消，上下文摘要等预处理请求不会在连接断开后继续执行
+func prepareChatRequestData(ctx context.Context, messageData map[string]interface{}, userID string) (map[string]interface{}, error) {
 	// 解析data字段
 	var chatData map[string]interface{}
 
@@ -207,11 +209,27 @@ func prepareChatRequestData(messageData map[string]interface{}, userID string) (
 		requestData["thinking_enabled"] = true
 	}
 
+	// 请求级的服务端工具循环限制（只能收紧角色的限制）
+	for _, field := range []string{"max_tool_iterations", "max_tool_seconds", "max_loop_tokens"} {
+		if value, ok := chatData[field]; ok {
+			requestData[field] = value
+		}
+	}
+
+	// 消息超出模型上下文窗口时按策略裁剪或摘要较早的对话（context_strategy 可覆盖默认策略）
+	if contextStrategy, ok := chatData["context_strategy"].(string); ok {
+		requestData["context_strategy"] = contextStrategy
+	}
+	contextRequestID := fmt.Sprintf("CONTEXT_%s_%d", userID, time.Now().UnixNano())
+	if err := websocketInterceptorService.FitContextWindow(ctx, contextRequestID, requestData); err != nil {
+		return nil, fmt.Errorf("处理上下文窗口失败: %v", err)
+	}
+
 	return requestData, nil
 }
 
-// toAIProcessNonStreamingChat 发送非流式聊天请求给AI处理
-func toAIProcessNonStreamingChat(conn *websocket.Conn, userID string, messageData map[string]interface{}, userPublicKey string) {
+// toAIProcessNonStreamingChat 发送非流式聊天请求给AI处理，ctx 随连接关闭取消
+func toAIProcessNonStreamingChat(ctx context.Context, conn *websocket.Conn, userID string, messageData map[string]interface{}, userPublicKey string) {
 	// 添加 panic 恢复机制
 	defer func() {
 		if r := recover(); r != nil {
@@ -230,7 +248,7 @@ func toAIProcessNonStreamingChat(conn *websocket.Conn, userID string, messageDat
 	}
 
 	// 解析并构造请求数据
-	requestData, err := prepareChatRequestData(messageData, userID)
+	requestData, err := prepareChatRequestData(ctx, messageData, userID)
 	if err != nil {
 		logger.Printf("准备聊天请求数据失败: %v", err)
 		toClientChatError(conn, err.Error(), userPublicKey)
@@ -245,10 +263,10 @@ func toAIProcessNonStreamingChat(conn *websocket.Conn, userID string, messageDat
 		return toClientChatResponse(conn, data, userPublicKey)
 	}
 
-	// 调用interceptor处理AI聊天
-	requestID := fmt.Sprintf("CHAT_%s_%d", userID, time.Now().UnixNano())
+	// 调用interceptor处理AI聊天（requestID 同时用作工具调用会话ID，使用随机值避免被猜测）
+	requestID := fmt.Sprintf("CHAT_%s_%s", userID, strings.ReplaceAll(uuid.New().String(), "-", ""))
 	if err := websocketInterceptorService.ProcessNonStreamChat(
-		context.Background(),
+		ctx,
 		requestID,
 		userID,
 		requestData,
@@ -261,8 +279,8 @@ func toAIProcessNonStreamingChat(conn *websocket.Conn, userID string, messageDat
 
 
 // ===== AI 聊天处理函数 =====
-// toAIProcessStreamingChat 发送流式聊天请求给AI处理
-func toAIProcessStreamingChat(conn *websocket.Conn, userID string, requestData map[string]interface{}, userPublicKey string, enableTTS bool, voiceGender string) {
+// toAIProcessStreamingChat 发送流式聊天请求给AI处理，ctx 随连接关闭取消
+func toAIProcessStreamingChat(ctx context.Context, conn *websocket.Conn, userID string, requestData map[string]interface{}, userPublicKey string, enableTTS bool, voiceGender string) {
 	// 添加 panic 恢复机制
 	defer func() {
 		if r := recover(); r != nil {
@@ -334,7 +352,7 @@ func toAIProcessStreamingChat(conn *websocket.Conn, userID string, requestData m
 	// 调用interceptor处理流式AI聊天
 	requestID := fmt.Sprintf("STREAM_%s_%d", userID, time.Now().UnixNano())
 	if err := websocketInterceptorService.ProcessStreamChat(
-		context.Background(),
+		ctx,
 		requestID,
 		userID,
 		requestData,
@@ -349,8 +367,8 @@ func toAIProcessStreamingChat(conn *websocket.Conn, userID string, requestData m
 	logger.Printf("[%s] AI流式处理完成，用户: %s", requestID, userID)
 }
 
-// toAIProcessClientExecutorResult 发送客户端执行器结果给AI处理
-func toAIProcessClientExecutorResult(conn *websocket.Conn, userID string, messageData map[string]interface{}, userPublicKey string) {
+// toAIProcessClientExecutorResult 发送客户端执行器结果给AI处理，ctx 随连接关闭取消
+func toAIProcessClientExecutorResult(ctx context.Context, conn *websocket.Conn, userID string, messageData map[string]interface{}, userPublicKey string) {
 	// 添加 panic 恢复机制
 	defer func() {
 		if r := recover(); r != nil {
@@ -377,7 +395,7 @@ func toAIProcessClientExecutorResult(conn *websocket.Conn, userID string, messag
 
 	// 调用sessionmanagement处理业务逻辑
 	if err := websocketInterceptorService.ProcessClientExecutorResult(
-		context.Background(),
+		ctx,
 		requestID,
 		userID,
 		messageData,
@@ -388,6 +406,64 @@ func toAIProcessClientExecutorResult(conn *websocket.Conn, userID string, messag
 	}
 }
 
+// messageUserPublicKey 从 silicoid 消息的 data 中提取用户公钥（data 可能是字符串或 map）
+// 优先使用新的字段名 userPublicKeyHex，向后兼容 userPublicKeyBase64
+func messageUserPublicKey(messageData map[string]interface{}) string {
+	var data map[string]interface{}
+	if dataStr, ok := messageData["data"].(string); ok {
+		_ = json.Unmarshal([]byte(dataStr), &data)
+	} else if dataMap, ok := messageData["data"].(map[string]interface{}); ok {
+		data = dataMap
+	}
+	if pubKey, ok := data["userPublicKeyHex"].(string); ok {
+		return pubKey
+	}
+	pubKey, _ := data["userPublicKeyBase64"].(string)
+	return pubKey
+}
+
+// toolCallSessionID 从 resume_tool_call / cancel_tool_call 消息中提取 session_id（data 可能是字符串或 map）
+func toolCallSessionID(messageData map[string]interface{}) string {
+	if sid, ok := messageData["session_id"].(string); ok && sid != "" {
+		return sid
+	}
+	var data map[string]interface{}
+	if dataStr, ok := messageData["data"].(string); ok {
+		_ = json.Unmarshal([]byte(dataStr), &data)
+	} else if dataMap, ok := messageData["data"].(map[string]interface{}); ok {
+		data = dataMap
+	}
+	sid, _ := data["session_id"].(string)
+	return sid
+}
+
+// toAIResumeToolCall 客户端重连后重新获取等待执行的工具调用，重新发送 client_executor_call
+func toAIResumeToolCall(conn *websocket.Conn, userID string, messageData map[string]interface{}, userPublicKey string) {
+	sessionID := toolCallSessionID(messageData)
+	callData, err := websocketInterceptorService.ResumeToolCall(userID, sessionID)
+	if err != nil {
+		logger.Printf("[%s] 恢复工具调用会话失败: %v", sessionID, err)
+		toClientChatError(conn, fmt.Sprintf("恢复工具调用失败: %v", err), userPublicKey)
+		return
+	}
+	toClientChatResponse(conn, callData, userPublicKey)
+}
+
+// toAICancelToolCall 客户端取消等待执行的工具调用
+func toAICancelToolCall(conn *websocket.Conn, userID string, messageData map[string]interface{}, userPublicKey string) {
+	sessionID := toolCallSessionID(messageData)
+	if err := websocketInterceptorService.CancelToolCall(userID, sessionID); err != nil {
+		logger.Printf("[%s] 取消工具调用会话失败: %v", sessionID, err)
+		toClientChatError(conn, fmt.Sprintf("取消工具调用失败: %v", err), userPublicKey)
+		return
+	}
+	toClientChatResponse(conn, map[string]interface{}{
+		"type":       "tool_call_cancelled",
+		"session_id": sessionID,
+		"timestamp":  time.Now().Unix(),
+	}, userPublicKey)
+}
+
 // toClientChatResponse 发送聊天响应给客户端（支持加密）
 func toClientChatResponse(conn *websocket.Conn, data map[string]interface{}, userPublicKey string) error {
 	dataBytes, err := json.Marshal(data)
@@ -0,0 +1,114 @@
+package http
+
+// MCP工具授权：按请求的 Bearer 令牌判断是否拥有工具所需的权限范围
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+)
+
+// tokenScopesEnv 令牌和权限范围的配置，格式为 "token1=scope1|scope2;token2=*"
+// 未配置时只能调用不需要权限范围的工具
+const tokenScopesEnv = "MCP_TOKEN_SCOPES"
+
+// allowedOriginsEnv 允许访问 /mcp 的浏览器来源，逗号分隔，如 "https://app.example.com"
+// 按 Streamable HTTP 规范校验 Origin（防止 DNS 重绑定）；不带 Origin 的请求来自非浏览器客户端，不受限制
+const allowedOriginsEnv = "MCP_ALLOWED_ORIGINS"
+
+// tokenUsersEnv 令牌和用户的对应关系，格式为 "token1=userId1;token2=*"
+// 令牌绑定固定用户时工具以该用户身份执行；"*" 表示受信任的服务令牌（如 silicoid 后端），可以通过 _meta 指定发起调用的用户
+const tokenUsersEnv = "MCP_TOKEN_USERS"
+
+// delegateUser 服务令牌在 MCP_TOKEN_USERS 中的取值
+const delegateUser = "*"
+
+var (
+	tokenScopes     map[string][]string
+	tokenScopesOnce sync.Once
+
+	tokenUsers     map[string]string
+	tokenUsersOnce sync.Once
+)
+
+// loadTokenScopes 解析令牌配置
+func loadTokenScopes() map[string][]string {
+	tokenScopesOnce.Do(func() {
+		config := strings.TrimSpace(os.Getenv(tokenScopesEnv))
+		if config == "" {
+			logger.Printf("⚠️ 未配置 %s，需要权限范围的MCP工具全部拒绝调用", tokenScopesEnv)
+			return
+		}
+		tokenScopes = make(map[string][]string)
+		for _, entry := range strings.Split(config, ";") {
+			token, scopes, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || token == "" {
+				continue
+			}
+			tokenScopes[token] = strings.Split(scopes, "|")
+		}
+		logger.Printf("✅ 加载了 %d 个MCP访问令牌", len(tokenScopes))
+	})
+	return tokenScopes
+}
+
+// loadTokenUsers 解析令牌和用户的对应关系
+func loadTokenUsers() map[string]string {
+	tokenUsersOnce.Do(func() {
+		tokenUsers = make(map[string]string)
+		for _, entry := range strings.Split(os.Getenv(tokenUsersEnv), ";") {
+			token, userID, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || token == "" || userID == "" {
+				continue
+			}
+			tokenUsers[token] = userID
+		}
+		if len(tokenUsers) == 0 {
+			logger.Printf("⚠️ 未配置 %s，按用户限制的MCP工具没有调用用户", tokenUsersEnv)
+		}
+	})
+	return tokenUsers
+}
+
+// bearerToken 取出请求的 Bearer 令牌
+func bearerToken(r *http.Request) string {
+	return strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// requestUser 确定工具调用的用户：身份由令牌决定，_meta 中的用户只在受信任的服务令牌下生效
+func requestUser(r *http.Request, metaUserID string) string {
+	userID := loadTokenUsers()[bearerToken(r)]
+	if userID == delegateUser {
+		return metaUserID
+	}
+	return userID
+}
+
+// authorizeTool 请求是否有权调用工具
+func authorizeTool(r *http.Request, tool registry.Tool) bool {
+	if tool.Scope() == "" {
+		return true
+	}
+	scopes := loadTokenScopes()
+	if scopes == nil {
+		return false
+	}
+	return registry.HasScope(scopes[bearerToken(r)], tool.Scope())
+}
+
+// validOrigin 请求的 Origin 是否允许访问 /mcp
+func validOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(os.Getenv(allowedOriginsEnv), ",") {
+		allowed = strings.TrimSuffix(strings.TrimSpace(allowed), "/")
+		if allowed != "" && strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
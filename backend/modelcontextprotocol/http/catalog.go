@@ -0,0 +1,33 @@
+package http
+
+// 工具目录同步：启动时把注册表中的工具写入 aibasicplatform_tools，AddExecutorTools 据此把工具提供给模型
+import (
+	aibasicplatformdb "digitalsingularity/backend/aibasicplatform/database"
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+)
+
+// syncToolCatalog 同步工具目录
+// 需要授权范围的新工具默认不启用，由管理员设置可用角色后再开放
+func syncToolCatalog() {
+	var tools []aibasicplatformdb.Tool
+	for _, tool := range registry.Tools() {
+		catalogTool := aibasicplatformdb.Tool{
+			ToolName:        registry.CatalogName(tool),
+			ToolDescription: tool.Description(),
+			InputSchema:     tool.InputSchema(),
+			Enabled:         tool.Scope() == "",
+		}
+		if cataloged, ok := tool.(registry.Cataloged); ok {
+			catalogTool.Category = cataloged.Category()
+		}
+		tools = append(tools, catalogTool)
+	}
+
+	dataService := aibasicplatformdb.NewAIBasicPlatformDataService()
+	inserted, updated, err := dataService.SyncServerExecutorTools(tools)
+	if err != nil {
+		logger.Printf("⚠️ 同步MCP工具目录失败: %v", err)
+		return
+	}
+	logger.Printf("✅ 已同步MCP工具目录：新增 %d 个，更新 %d 个", inserted, updated)
+}
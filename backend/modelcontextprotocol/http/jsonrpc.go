@@ -0,0 +1,423 @@
+package http
+
+// MCP JSON-RPC 端点（Streamable HTTP）：POST /mcp 处理 initialize、ping、tools/list、tools/call
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+	"digitalsingularity/backend/silicoid/mcp"
+)
+
+const (
+	serverName    = "digitalsingularity-mcp"
+	serverVersion = "1.0.0"
+
+	// maxRequestBodySize 单个 JSON-RPC 请求体的上限
+	maxRequestBodySize = 4 << 20
+	// sessionIdleTimeout 会话空闲超过该时间后失效，客户端需要重新 initialize
+	sessionIdleTimeout = 1 * time.Hour
+
+	headerSessionID       = "Mcp-Session-Id"
+	headerProtocolVersion = "MCP-Protocol-Version"
+
+	// serverQueryParam /mcp?server=xxx 只暴露该服务器（对应 mcp.json 中的 name）的工具
+	// silicoid 的多个服务器条目共用同一个 /mcp 端点，不按服务器过滤时每个条目都会列出全部工具
+	serverQueryParam = "server"
+)
+
+// mcpSession initialize 建立的会话
+type mcpSession struct {
+	protocolVersion string
+	lastActive      time.Time
+}
+
+var (
+	sessions      = make(map[string]*mcpSession)
+	sessionsMutex sync.Mutex
+)
+
+// handleMCPRoot MCP根路由：POST 为 JSON-RPC 请求，DELETE 结束会话，其余请求返回服务信息
+func handleMCPRoot(w http.ResponseWriter, r *http.Request) {
+	logger.Printf("接收到MCP请求: %s %s", r.Method, r.URL.Path)
+	if !validOrigin(r) {
+		logger.Printf("拒绝来源 %s 的MCP请求", r.Header.Get("Origin"))
+		http.Error(w, "forbidden origin", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		handleJSONRPC(w, r)
+	case http.MethodDelete:
+		handleSessionDelete(w, r)
+	case http.MethodGet:
+		// 不提供服务器主动推送的 SSE 流
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeServerBanner(w)
+	default:
+		writeServerBanner(w)
+	}
+}
+
+// writeServerBanner 返回服务信息（兼容旧版客户端）
+func writeServerBanner(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"message": "Model Context Protocol HTTP Server", "version": "%s"}`, serverVersion)
+}
+
+// handleJSONRPC 处理一条或一批 JSON-RPC 消息
+func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err != nil {
+		writeJSONRPC(w, http.StatusBadRequest, mcp.NewErrorResponse(nil, mcp.ErrCodeParseError, fmt.Sprintf("读取请求失败: %v", err)))
+		return
+	}
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) == 0 {
+		// 旧版客户端 POST /mcp 不带请求体时只获取服务信息
+		writeServerBanner(w)
+		return
+	}
+
+	batch := data[0] == '['
+	var messages []*mcp.JSONRPCMessage
+	if batch {
+		err = json.Unmarshal(data, &messages)
+	} else {
+		var msg mcp.JSONRPCMessage
+		err = json.Unmarshal(data, &msg)
+		messages = []*mcp.JSONRPCMessage{&msg}
+	}
+	if err != nil {
+		writeJSONRPC(w, http.StatusBadRequest, mcp.NewErrorResponse(nil, mcp.ErrCodeParseError, fmt.Sprintf("解析JSON-RPC消息失败: %v", err)))
+		return
+	}
+	if len(messages) == 0 {
+		writeJSONRPC(w, http.StatusBadRequest, mcp.NewErrorResponse(nil, mcp.ErrCodeInvalidRequest, "空的批量请求"))
+		return
+	}
+
+	if version := r.Header.Get(headerProtocolVersion); version != "" && !isSupportedProtocolVersion(version) {
+		writeJSONRPC(w, http.StatusBadRequest, mcp.NewErrorResponse(nil, mcp.ErrCodeInvalidRequest, fmt.Sprintf("不支持的协议版本: %s", version)))
+		return
+	}
+
+	// 带会话 id 的请求必须属于有效会话；initialize 会创建新会话
+	if sessionID := r.Header.Get(headerSessionID); sessionID != "" && !isInitializeRequest(messages) {
+		if !touchSession(sessionID) {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	// 客户端接受 SSE 且带 progressToken 的单个 tools/call，以 SSE 流返回工具的增量输出
+	if !batch && messages[0].JSONRPC == mcp.JSONRPCVersion && messages[0].Method == "tools/call" && messages[0].IsRequest() &&
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		if token := progressToken(messages[0]); token != nil {
+			handleStreamingToolsCall(w, r, messages[0], token)
+			return
+		}
+	}
+
+	var responses []*mcp.JSONRPCMessage
+	for _, msg := range messages {
+		if msg == nil {
+			responses = append(responses, mcp.NewErrorResponse(nil, mcp.ErrCodeInvalidRequest, "无效的JSON-RPC消息"))
+			continue
+		}
+		if msg.JSONRPC != mcp.JSONRPCVersion {
+			responses = append(responses, mcp.NewErrorResponse(msg.ID, mcp.ErrCodeInvalidRequest, "无效的JSON-RPC消息"))
+			continue
+		}
+		// 通知和客户端回复的响应不需要应答
+		if !msg.IsRequest() {
+			continue
+		}
+		responses = append(responses, dispatchRequest(w, r, msg))
+	}
+
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if batch {
+		writeJSONRPC(w, http.StatusOK, responses)
+		return
+	}
+	writeJSONRPC(w, http.StatusOK, responses[0])
+}
+
+// dispatchRequest 按方法名分发请求
+func dispatchRequest(w http.ResponseWriter, r *http.Request, msg *mcp.JSONRPCMessage) *mcp.JSONRPCMessage {
+	var result interface{}
+	var rpcErr *mcp.MCPError
+
+	switch msg.Method {
+	case "initialize":
+		result, rpcErr = handleInitialize(w, msg)
+	case "ping":
+		result = map[string]interface{}{}
+	case "tools/list":
+		result = handleToolsList(r)
+	case "tools/call":
+		result, rpcErr = handleToolsCall(r.Context(), r, msg)
+	default:
+		rpcErr = &mcp.MCPError{Code: mcp.ErrCodeMethodNotFound, Message: fmt.Sprintf("未知方法: %s", msg.Method)}
+	}
+
+	if rpcErr != nil {
+		return mcp.NewErrorResponse(msg.ID, rpcErr.Code, rpcErr.Message)
+	}
+	response, err := mcp.NewResultResponse(msg.ID, result)
+	if err != nil {
+		return mcp.NewErrorResponse(msg.ID, mcp.ErrCodeInternalError, err.Error())
+	}
+	return response
+}
+
+// handleInitialize 协商协议版本并创建会话
+// 客户端请求的版本受支持时使用该版本，否则返回服务器支持的最新版本，由客户端决定是否断开
+func handleInitialize(w http.ResponseWriter, msg *mcp.JSONRPCMessage) (interface{}, *mcp.MCPError) {
+	var params struct {
+		ProtocolVersion string                 `json:"protocolVersion"`
+		ClientInfo      mcp.ImplementationInfo `json:"clientInfo"`
+	}
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &mcp.MCPError{Code: mcp.ErrCodeInvalidParams, Message: fmt.Sprintf("无效的initialize参数: %v", err)}
+		}
+	}
+
+	version := mcp.LatestProtocolVersion
+	if isSupportedProtocolVersion(params.ProtocolVersion) {
+		version = params.ProtocolVersion
+	}
+
+	sessionID, err := createSession(version)
+	if err != nil {
+		return nil, &mcp.MCPError{Code: mcp.ErrCodeInternalError, Message: err.Error()}
+	}
+	w.Header().Set(headerSessionID, sessionID)
+	logger.Printf("MCP客户端 %s %s 已初始化，协议版本 %s，会话 %s", params.ClientInfo.Name, params.ClientInfo.Version, version, sessionID)
+
+	return mcp.InitializeResult{
+		ProtocolVersion: version,
+		Capabilities: mcp.ServerCapabilities{
+			Tools: &mcp.ListChangedCapability{},
+		},
+		ServerInfo: mcp.ImplementationInfo{Name: serverName, Version: serverVersion},
+	}, nil
+}
+
+// handleToolsList 返回调用方有权使用的工具定义
+func handleToolsList(r *http.Request) interface{} {
+	tools := []mcp.MCPTool{}
+	for _, tool := range registry.Tools() {
+		if inRequestedServer(r, tool) && authorizeTool(r, tool) {
+			tools = append(tools, registry.Definition(tool))
+		}
+	}
+	return map[string]interface{}{"tools": tools}
+}
+
+// inRequestedServer 工具是否属于请求地址中指定的服务器，未指定时为全部工具
+func inRequestedServer(r *http.Request, tool registry.Tool) bool {
+	server := r.URL.Query().Get(serverQueryParam)
+	if server == "" {
+		return true
+	}
+	cataloged, ok := tool.(registry.Cataloged)
+	return ok && cataloged.Server() == server
+}
+
+// handleToolsCall 调用工具；未知工具返回协议错误，工具执行失败通过结果中的 isError 返回
+func handleToolsCall(ctx context.Context, r *http.Request, msg *mcp.JSONRPCMessage) (interface{}, *mcp.MCPError) {
+	var params mcp.MCPToolCall
+	if err := json.Unmarshal(msg.Params, &params); err != nil || params.Name == "" {
+		return nil, &mcp.MCPError{Code: mcp.ErrCodeInvalidParams, Message: "tools/call 缺少工具名称"}
+	}
+	tool := registry.Lookup(params.Name)
+	if tool == nil || !inRequestedServer(r, tool) {
+		return nil, &mcp.MCPError{Code: mcp.ErrCodeInvalidParams, Message: fmt.Sprintf("未知工具: %s", params.Name)}
+	}
+	if !authorizeTool(r, tool) {
+		return nil, &mcp.MCPError{Code: mcp.ErrCodeInvalidRequest, Message: fmt.Sprintf("无权调用工具 %s，需要权限范围 %s", params.Name, tool.Scope())}
+	}
+	if params.Arguments == nil {
+		params.Arguments = map[string]interface{}{}
+	}
+
+	ctx = registry.WithRequest(ctx, r)
+	var meta struct {
+		Meta map[string]interface{} `json:"_meta"`
+	}
+	json.Unmarshal(msg.Params, &meta)
+	metaUserID, _ := meta.Meta[mcp.UserMetaKey].(string)
+	userID := requestUser(r, metaUserID)
+	if userID != "" {
+		ctx = mcp.WithUserID(ctx, userID)
+	}
+
+	logger.Printf("调用MCP工具 %s (user=%s)", params.Name, userID)
+	result, err := tool.Handle(ctx, params.Arguments)
+	if err != nil {
+		logger.Printf("MCP工具 %s 执行失败: %v", params.Name, err)
+		return registry.ErrorResult(err.Error()), nil
+	}
+	return result, nil
+}
+
+// handleStreamingToolsCall 以 SSE 流执行 tools/call：工具的增量输出作为 notifications/progress 发送，最后发送响应
+func handleStreamingToolsCall(w http.ResponseWriter, r *http.Request, msg *mcp.JSONRPCMessage, token json.RawMessage) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var writeMutex sync.Mutex
+	writeEvent := func(event *mcp.JSONRPCMessage) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	progress := 0
+	ctx := registry.WithProgress(r.Context(), func(message string) {
+		writeMutex.Lock()
+		progress++
+		current := progress
+		writeMutex.Unlock()
+		notification, err := mcp.NewNotification("notifications/progress", map[string]interface{}{
+			"progressToken": token,
+			"progress":      current,
+			"message":       message,
+		})
+		if err == nil {
+			writeEvent(notification)
+		}
+	})
+
+	result, rpcErr := handleToolsCall(ctx, r, msg)
+	if rpcErr != nil {
+		writeEvent(mcp.NewErrorResponse(msg.ID, rpcErr.Code, rpcErr.Message))
+		return
+	}
+	response, err := mcp.NewResultResponse(msg.ID, result)
+	if err != nil {
+		response = mcp.NewErrorResponse(msg.ID, mcp.ErrCodeInternalError, err.Error())
+	}
+	writeEvent(response)
+}
+
+// progressToken 取出请求 _meta 中的 progressToken，没有时返回 nil
+func progressToken(msg *mcp.JSONRPCMessage) json.RawMessage {
+	var params struct {
+		Meta struct {
+			ProgressToken json.RawMessage `json:"progressToken"`
+		} `json:"_meta"`
+	}
+	if len(msg.Params) == 0 || json.Unmarshal(msg.Params, &params) != nil {
+		return nil
+	}
+	if token := params.Meta.ProgressToken; len(token) > 0 && string(token) != "null" {
+		return token
+	}
+	return nil
+}
+
+// handleSessionDelete 客户端主动结束会话
+func handleSessionDelete(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.Header.Get(headerSessionID)
+	sessionsMutex.Lock()
+	_, ok := sessions[sessionID]
+	delete(sessions, sessionID)
+	sessionsMutex.Unlock()
+
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createSession 创建会话并清理空闲过期的会话
+func createSession(protocolVersion string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("生成会话id失败: %v", err)
+	}
+	sessionID := hex.EncodeToString(buf)
+
+	now := time.Now()
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	for id, session := range sessions {
+		if now.Sub(session.lastActive) > sessionIdleTimeout {
+			delete(sessions, id)
+		}
+	}
+	sessions[sessionID] = &mcpSession{protocolVersion: protocolVersion, lastActive: now}
+	return sessionID, nil
+}
+
+// touchSession 会话有效时刷新活跃时间
+func touchSession(sessionID string) bool {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	session, ok := sessions[sessionID]
+	if !ok {
+		return false
+	}
+	if time.Since(session.lastActive) > sessionIdleTimeout {
+		delete(sessions, sessionID)
+		return false
+	}
+	session.lastActive = time.Now()
+	return true
+}
+
+// isInitializeRequest 消息中是否包含 initialize 请求
+func isInitializeRequest(messages []*mcp.JSONRPCMessage) bool {
+	for _, msg := range messages {
+		if msg != nil && msg.Method == "initialize" {
+			return true
+		}
+	}
+	return false
+}
+
+// isSupportedProtocolVersion 是否为支持的协议版本
+func isSupportedProtocolVersion(version string) bool {
+	for _, supported := range mcp.SupportedProtocolVersions {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONRPC 写出 JSON-RPC 响应
+func writeJSONRPC(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -2,39 +2,39 @@ package http
 
 // MCP HTTP路由配置
 import (
-	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 
-	"digitalsingularity/backend/modelcontextprotocol/server"
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+	_ "digitalsingularity/backend/modelcontextprotocol/server" // 注册工具
+	_ "digitalsingularity/backend/modelcontextprotocol/server/cybersecurity/container"
+	_ "digitalsingularity/backend/modelcontextprotocol/server/cybersecurity/vulnerability"
+	_ "digitalsingularity/backend/modelcontextprotocol/server/cybersecurity/web"
 )
 
-// MCP根路由处理
-func handleMCPRoot(w http.ResponseWriter, r *http.Request) {
-	log.Printf("接收到MCP请求: %s %s", r.Method, r.URL.Path)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"message": "Model Context Protocol HTTP Server", "version": "1.0.0"}`)
-}
-
 // 设置路由
 func setupRoutes() http.Handler {
 	router := mux.NewRouter()
 
-	// MCP路由
-	router.HandleFunc("/mcp", handleMCPRoot).Methods("GET", "POST", "OPTIONS")
-	router.HandleFunc("/mcp/current-time", server.CurrentTime).Methods("GET", "OPTIONS")
-	router.HandleFunc("/mcp/current-weather", server.CurrentWeather).Methods("GET", "OPTIONS")
-	router.HandleFunc("/mcp/storagebox-data-reading", server.StorageboxDataReading).Methods("GET", "OPTIONS")
-	router.HandleFunc("/mcp/storagebox-ip-storage", server.StorageboxIPStorage).Methods("POST", "OPTIONS")
+	// MCP路由：/mcp 为 JSON-RPC 端点，其余为兼容旧版客户端的REST接口
+	// 权限范围只在 /mcp 的 tools/call 上校验，REST接口保持旧版行为
+	router.HandleFunc("/mcp", handleMCPRoot).Methods("GET", "POST", "DELETE", "OPTIONS")
+	for _, tool := range registry.Tools() {
+		if routed, ok := tool.(registry.Routed); ok {
+			for _, route := range routed.Routes() {
+				router.HandleFunc(route.Path, route.Handler).Methods(route.Methods...)
+			}
+		}
+	}
 
 	// 添加CORS支持
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Content-Type", "Authorization", "X-MCP-Version"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "X-MCP-Version", headerSessionID, headerProtocolVersion, "Last-Event-ID"},
+		ExposedHeaders: []string{headerSessionID},
 	})
 
 	return corsHandler.Handler(router)
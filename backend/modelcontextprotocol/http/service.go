@@ -21,6 +21,9 @@ func HandleConnection(host string, port int, debug bool) {
 	// 设置路由
 	handler := setupRoutes()
 
+	// 同步工具目录，不阻塞服务启动
+	go syncToolCatalog()
+
 	// 创建服务地址
 	addr := fmt.Sprintf("%s:%d", host, port)
 
@@ -0,0 +1,20 @@
+package registry
+
+import "context"
+
+type progressContextKey struct{}
+
+// ProgressFunc 接收工具执行过程中的增量输出
+type ProgressFunc func(message string)
+
+// WithProgress 为本次工具调用设置增量输出的接收方（客户端在 tools/call 中带 progressToken 时由端点设置）
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, fn)
+}
+
+// ReportProgress 发送一条增量输出；客户端没有请求增量输出时忽略
+func ReportProgress(ctx context.Context, message string) {
+	if fn, ok := ctx.Value(progressContextKey{}).(ProgressFunc); ok && fn != nil {
+		fn(message)
+	}
+}
@@ -0,0 +1,129 @@
+// Package registry MCP服务器工具注册表
+//
+// 每个工具在自己的文件中通过 init 调用 Register 声明名称、输入 JSON Schema、处理函数和所需权限范围，
+// 注册表统一驱动：
+//   - MCP JSON-RPC 端点的 tools/list 和 tools/call
+//   - 兼容旧版客户端的 REST 路由（工具声明了 RESTPath 时）
+//   - aibasicplatform_tools 中的服务端执行器工具目录（AddExecutorTools 据此把工具提供给模型）
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"digitalsingularity/backend/silicoid/mcp"
+)
+
+// Tool MCP服务器工具
+type Tool interface {
+	// Name 工具名称，在注册表中唯一
+	Name() string
+	// Description 工具说明，提供给模型
+	Description() string
+	// InputSchema 输入参数的 JSON Schema
+	InputSchema() map[string]interface{}
+	// Scope 调用工具所需的权限范围，空字符串表示不需要授权
+	Scope() string
+	// Handle 执行工具；工具本身的失败通过结果的 IsError 返回，error 表示无法执行
+	Handle(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error)
+}
+
+// Route 工具对应的 REST 路由
+type Route struct {
+	Path    string
+	Methods []string
+	Handler http.HandlerFunc
+}
+
+// Routed 提供 REST 路由的工具（兼容旧版客户端）
+type Routed interface {
+	Routes() []Route
+}
+
+// Cataloged 需要写入工具目录的工具
+type Cataloged interface {
+	// Server 工具所属的MCP服务器名称，对应 mcp.json 中的 name
+	Server() string
+	// Category 工具分类
+	Category() string
+}
+
+var (
+	tools      []Tool
+	toolIndex  = make(map[string]Tool)
+	toolsMutex sync.RWMutex
+)
+
+// Register 注册工具，名称为空或重复时 panic（注册发生在 init 中，属于程序错误）
+func Register(tool Tool) {
+	name := tool.Name()
+	if name == "" {
+		panic("registry: 工具名称不能为空")
+	}
+
+	toolsMutex.Lock()
+	defer toolsMutex.Unlock()
+	if _, exists := toolIndex[name]; exists {
+		panic(fmt.Sprintf("registry: 工具 %s 重复注册", name))
+	}
+	tools = append(tools, tool)
+	toolIndex[name] = tool
+}
+
+// Tools 按注册顺序返回全部工具
+func Tools() []Tool {
+	toolsMutex.RLock()
+	defer toolsMutex.RUnlock()
+	return append([]Tool(nil), tools...)
+}
+
+// Lookup 按名称查找工具
+func Lookup(name string) Tool {
+	toolsMutex.RLock()
+	defer toolsMutex.RUnlock()
+	return toolIndex[name]
+}
+
+// Definition 工具在 tools/list 中的定义
+func Definition(tool Tool) mcp.MCPTool {
+	definition := mcp.MCPTool{
+		Name:        tool.Name(),
+		Description: tool.Description(),
+		Parameters:  tool.InputSchema(),
+	}
+	if titled, ok := tool.(interface{ Title() string }); ok {
+		definition.Title = titled.Title()
+	}
+	return definition
+}
+
+// CatalogName 工具在 aibasicplatform_tools 中的名称
+// silicoid 按 mcp_{server}_{tool} 的格式把调用路由到 mcp.json 中的服务器，名称不是该格式时加上前缀
+func CatalogName(tool Tool) string {
+	name := tool.Name()
+	cataloged, ok := tool.(Cataloged)
+	if !ok || cataloged.Server() == "" {
+		return name
+	}
+	prefix := "mcp_" + cataloged.Server() + "_"
+	if strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + name
+}
+
+// HasScope 授予的权限范围是否满足工具要求，"*" 表示全部权限
+func HasScope(granted []string, required string) bool {
+	if required == "" {
+		return true
+	}
+	for _, scope := range granted {
+		if scope == "*" || scope == required {
+			return true
+		}
+	}
+	return false
+}
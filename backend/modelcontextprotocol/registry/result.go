@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"digitalsingularity/backend/silicoid/mcp"
+)
+
+type requestContextKey struct{}
+
+// WithRequest 把 tools/call 的原始 HTTP 请求放入上下文，供需要客户端信息的工具使用
+func WithRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, r)
+}
+
+// RequestFromContext 取出 tools/call 的原始 HTTP 请求，没有时返回 nil
+func RequestFromContext(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestContextKey{}).(*http.Request)
+	return r
+}
+
+// TextResult 文本结果
+func TextResult(text string) *mcp.CallToolResult {
+	return &mcp.CallToolResult{Content: []mcp.MCPContent{{Type: "text", Text: text}}}
+}
+
+// JSONResult 把结构化数据序列化为文本结果，同时放入 structuredContent
+func JSONResult(data interface{}) (*mcp.CallToolResult, error) {
+	text, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("序列化工具结果失败: %v", err)
+	}
+	result := TextResult(string(text))
+	result.StructuredContent = data
+	return result, nil
+}
+
+// ErrorResult 工具执行失败的结果
+func ErrorResult(message string) *mcp.CallToolResult {
+	result := TextResult(message)
+	result.IsError = true
+	return result
+}
+
+// ObjectSchema 构造 object 类型的 JSON Schema
+func ObjectSchema(properties map[string]interface{}, required ...string) map[string]interface{} {
+	if properties == nil {
+		properties = map[string]interface{}{}
+	}
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// StringSchema 构造 string 类型的 JSON Schema
+func StringSchema(description string) map[string]interface{} {
+	schema := map[string]interface{}{"type": "string"}
+	if description != "" {
+		schema["description"] = description
+	}
+	return schema
+}
+
+// ArraySchema 构造 array 类型的 JSON Schema
+func ArraySchema(description string, items map[string]interface{}) map[string]interface{} {
+	schema := map[string]interface{}{"type": "array", "items": items}
+	if description != "" {
+		schema["description"] = description
+	}
+	return schema
+}
+
+// CallHTTPHandler 在内存中调用 REST 处理函数，并把响应转换为 tools/call 的结果，用于把现有处理函数注册为工具
+// 状态码 >= 400、响应中带 error 或 status 为 error 时视为工具执行失败
+func CallHTTPHandler(ctx context.Context, handler http.HandlerFunc, method, path string, query url.Values, body interface{}) *mcp.CallToolResult {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return ErrorResult(fmt.Sprintf("序列化工具参数失败: %v", err))
+		}
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(data))
+	if err != nil {
+		return ErrorResult(fmt.Sprintf("创建工具请求失败: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if original := RequestFromContext(ctx); original != nil {
+		req.RemoteAddr = original.RemoteAddr
+		if forwarded := original.Header.Get("X-Forwarded-For"); forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+	}
+
+	recorder := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	handler(recorder, req)
+
+	text := strings.TrimSpace(recorder.body.String())
+	isError := recorder.status >= http.StatusBadRequest
+
+	var payload map[string]interface{}
+	if json.Unmarshal([]byte(text), &payload) == nil {
+		// storagebox 存储工具的响应包在 {"id", "result"/"error"} 中，只返回里面的内容
+		if errObj, ok := payload["error"]; ok && errObj != nil {
+			isError = true
+			if errMap, ok := errObj.(map[string]interface{}); ok {
+				if message, ok := errMap["message"].(string); ok {
+					text = message
+				}
+			}
+		} else if result, ok := payload["result"]; ok {
+			if data, err := json.Marshal(result); err == nil {
+				text = string(data)
+			}
+			if resultMap, ok := result.(map[string]interface{}); ok && resultMap["status"] == "error" {
+				isError = true
+			}
+		} else if payload["status"] == "error" {
+			isError = true
+		}
+	}
+
+	result := TextResult(text)
+	result.IsError = isError
+	return result
+}
+
+// responseRecorder 记录REST处理函数写出的状态码和响应体
+type responseRecorder struct {
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.body.Write(data)
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+}
@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+
+	"digitalsingularity/backend/silicoid/mcp"
+)
+
+// ToolSpec 声明式的工具定义，实现 Tool、Routed 和 Cataloged
+//
+// 使用示例：
+//
+//	func init() {
+//		registry.Register(&registry.ToolSpec{
+//			ToolName:    "current_time",
+//			Desc:        "Get the current server time.",
+//			Schema:      registry.ObjectSchema(nil),
+//			Handler:     currentTimeTool,
+//			ServerName:  "current-time",
+//			RESTPath:    "/mcp/current-time",
+//			RESTMethods: []string{"GET"},
+//			RESTHandler: CurrentTime,
+//		})
+//	}
+type ToolSpec struct {
+	ToolName      string
+	ToolTitle     string
+	Desc          string
+	Schema        map[string]interface{}
+	RequiredScope string
+	Handler       func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error)
+
+	// ServerName、ToolCategory 用于工具目录
+	ServerName   string
+	ToolCategory string
+
+	// RESTPath 非空时同时注册 REST 路由，RESTMethods 为空时默认 POST
+	RESTPath    string
+	RESTMethods []string
+	RESTHandler http.HandlerFunc
+}
+
+// Name 实现 Tool
+func (t *ToolSpec) Name() string { return t.ToolName }
+
+// Title 工具的显示名称
+func (t *ToolSpec) Title() string { return t.ToolTitle }
+
+// Description 实现 Tool
+func (t *ToolSpec) Description() string { return t.Desc }
+
+// InputSchema 实现 Tool，未设置时为不带参数的 object
+func (t *ToolSpec) InputSchema() map[string]interface{} {
+	if t.Schema == nil {
+		return ObjectSchema(nil)
+	}
+	return t.Schema
+}
+
+// Scope 实现 Tool
+func (t *ToolSpec) Scope() string { return t.RequiredScope }
+
+// Handle 实现 Tool
+func (t *ToolSpec) Handle(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+	return t.Handler(ctx, args)
+}
+
+// Server 实现 Cataloged
+func (t *ToolSpec) Server() string { return t.ServerName }
+
+// Category 实现 Cataloged
+func (t *ToolSpec) Category() string { return t.ToolCategory }
+
+// Routes 实现 Routed
+func (t *ToolSpec) Routes() []Route {
+	if t.RESTPath == "" || t.RESTHandler == nil {
+		return nil
+	}
+	methods := t.RESTMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost}
+	}
+	return []Route{{Path: t.RESTPath, Methods: methods, Handler: t.RESTHandler}}
+}
@@ -3,11 +3,29 @@ package server
 // 当前时间MCP服务器
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"time"
+
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+	"digitalsingularity/backend/silicoid/mcp"
 )
 
+func init() {
+	registry.Register(&registry.ToolSpec{
+		ToolName:     "current_time",
+		ToolTitle:    "Current Time",
+		Desc:         "Get the current server time in RFC3339 format.",
+		Handler:      currentTimeTool,
+		ServerName:   "current-time",
+		ToolCategory: "utility",
+		RESTPath:     "/mcp/current-time",
+		RESTMethods:  []string{"GET", "OPTIONS"},
+		RESTHandler:  CurrentTime,
+	})
+}
+
 // CurrentTimeResponse 当前时间响应结构
 type CurrentTimeResponse struct {
 	Time    string `json:"time"`
@@ -16,11 +34,17 @@ type CurrentTimeResponse struct {
 
 func CurrentTime(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentTime())
+}
 
-	response := CurrentTimeResponse{
+// currentTimeTool current_time 工具
+func currentTimeTool(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+	return registry.JSONResult(currentTime())
+}
+
+func currentTime() CurrentTimeResponse {
+	return CurrentTimeResponse{
 		Time:    time.Now().Format(time.RFC3339),
 		Message: "Current time retrieved successfully",
 	}
-
-	json.NewEncoder(w).Encode(response)
 }
\ No newline at end of file
@@ -2,12 +2,32 @@ package server
 
 // 当前天气MCP服务器
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+	"digitalsingularity/backend/silicoid/mcp"
 )
 
+func init() {
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "current_weather",
+		ToolTitle: "Current Weather",
+		Desc:      "Get the current weather near the caller.",
+		Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+			return registry.CallHTTPHandler(ctx, CurrentWeather, http.MethodGet, "/mcp/current-weather", nil, nil), nil
+		},
+		ServerName:   "current-weather",
+		ToolCategory: "utility",
+		RESTPath:     "/mcp/current-weather",
+		RESTMethods:  []string{"GET", "OPTIONS"},
+		RESTHandler:  CurrentWeather,
+	})
+}
+
 // CurrentWeatherResponse 当前天气响应结构
 type CurrentWeatherResponse struct {
 	Weather string `json:"weather"`
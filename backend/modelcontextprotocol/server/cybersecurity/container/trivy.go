@@ -2,3 +2,809 @@
 package container
 
 // Trivy 容器漏洞扫描工具实现
+//
+// 调用本机安装的 trivy（路径由环境变量 TRIVY_PATH 指定，默认从 PATH 查找），以离线模式扫描用户通过 userfiles 上传的文件：
+//   - image：docker save / OCI 镜像 tar 包（trivy image --input）
+//   - sbom：CycloneDX 或 SPDX 格式的 SBOM（trivy sbom）
+//   - lockfile：package-lock.json、go.sum、requirements.txt 等依赖锁文件（trivy fs）
+//   - archive：zip / tar / tar.gz 源码包，解压到临时目录后扫描（trivy fs）
+//
+// 漏洞库需要预先放在 TRIVY_CACHE_DIR 中，扫描时不联网更新。
+// 扫描结果写入 storagebox 的 container_scans 和 container_scan_vulnerabilities 表，trivy_diff 据此比较同一制品的两次扫描
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"digitalsingularity/backend/common/userfiles"
+	"digitalsingularity/backend/common/utils/datahandle"
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+	"digitalsingularity/backend/modelcontextprotocol/server/cybersecurity/targets"
+	"digitalsingularity/backend/silicoid/mcp"
+)
+
+const (
+	// TrivyPathEnv trivy 可执行文件路径的环境变量
+	TrivyPathEnv = "TRIVY_PATH"
+	// TrivyCacheDirEnv trivy 漏洞库缓存目录的环境变量
+	TrivyCacheDirEnv = "TRIVY_CACHE_DIR"
+
+	defaultTrivyTimeout = 10 * time.Minute
+	maxTrivyTimeout     = 30 * time.Minute
+	// maxReturnedVulnerabilities 返回给模型的漏洞数量上限，全部漏洞都会写入 storagebox
+	maxReturnedVulnerabilities = 300
+	// 解压源码包的限制
+	maxArchiveFiles = 50000
+	maxArchiveBytes = 2 << 30
+)
+
+// 扫描对象类型
+const (
+	TrivyKindImage    = "image"
+	TrivyKindSBOM     = "sbom"
+	TrivyKindLockfile = "lockfile"
+	TrivyKindArchive  = "archive"
+)
+
+// trivySeverities trivy 的严重程度，按从高到低排列
+var trivySeverities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+// TrivyScanRequest trivy 扫描请求
+type TrivyScanRequest struct {
+	FileID         string   `json:"file_id"`        // userfiles 中的文件ID
+	Kind           string   `json:"kind,omitempty"` // 为空时根据文件名和内容判断
+	Severity       []string `json:"severity,omitempty"`
+	IgnoreUnfixed  bool     `json:"ignore_unfixed,omitempty"`
+	BaselineScanID string   `json:"baseline_scan_id,omitempty"` // 与之前的扫描比较
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+}
+
+// TrivyVulnerability 一条漏洞
+type TrivyVulnerability struct {
+	VulnerabilityID  string `json:"vulnerability_id"`
+	PkgName          string `json:"pkg_name"`
+	InstalledVersion string `json:"installed_version"`
+	FixedVersion     string `json:"fixed_version,omitempty"`
+	Severity         string `json:"severity"`
+	Target           string `json:"target"`
+	Title            string `json:"title,omitempty"`
+	PrimaryURL       string `json:"primary_url,omitempty"`
+}
+
+// TrivyPackageGroup 同一个包的漏洞
+type TrivyPackageGroup struct {
+	PkgName          string               `json:"pkg_name"`
+	InstalledVersion string               `json:"installed_version"`
+	Target           string               `json:"target"`
+	Vulnerabilities  []TrivyVulnerability `json:"vulnerabilities"`
+}
+
+// TrivySeverityGroup 同一严重程度的漏洞，按包分组
+type TrivySeverityGroup struct {
+	Severity string              `json:"severity"`
+	Count    int                 `json:"count"`
+	Packages []TrivyPackageGroup `json:"packages"`
+}
+
+// TrivyScanResult trivy 扫描结果
+type TrivyScanResult struct {
+	ScanID     string               `json:"scan_id"`
+	FileID     string               `json:"file_id"`
+	Artifact   string               `json:"artifact"`
+	Kind       string               `json:"kind"`
+	Total      int                  `json:"total"`
+	BySeverity map[string]int       `json:"by_severity"`
+	Groups     []TrivySeverityGroup `json:"groups"`
+	Truncated  bool                 `json:"truncated,omitempty"`
+	Stored     bool                 `json:"stored"`
+	Diff       *TrivyDiff           `json:"diff,omitempty"`
+	Message    string               `json:"message"`
+}
+
+// TrivyDiff 同一制品两次扫描的差异
+type TrivyDiff struct {
+	BaseScanID string               `json:"base_scan_id"`
+	ScanID     string               `json:"scan_id"`
+	Added      []TrivyVulnerability `json:"added"`
+	Removed    []TrivyVulnerability `json:"removed"`
+	Changed    []TrivyChange        `json:"changed"`
+	Unchanged  int                  `json:"unchanged"`
+	Note       string               `json:"note,omitempty"`
+}
+
+// TrivyChange 两次扫描中都存在但严重程度或修复版本有变化的漏洞
+type TrivyChange struct {
+	Before TrivyVulnerability `json:"before"`
+	After  TrivyVulnerability `json:"after"`
+}
+
+// trivyReport trivy --format json 的输出
+type trivyReport struct {
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Severity         string `json:"Severity"`
+			Title            string `json:"Title"`
+			PrimaryURL       string `json:"PrimaryURL"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// trivyScan 已保存的扫描
+type trivyScan struct {
+	ScanID          string
+	Artifact        string
+	Kind            string
+	Vulnerabilities []TrivyVulnerability
+}
+
+func init() {
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "trivy_scan",
+		ToolTitle: "Trivy Vulnerability Scan",
+		Desc: "Scan an uploaded container image tarball, SBOM, dependency lockfile or source archive for known vulnerabilities with trivy (offline). " +
+			"Returns vulnerabilities grouped by severity and package; pass baseline_scan_id to also report what changed since an earlier scan of the same artifact.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"file_id": registry.StringSchema("ID of the uploaded file in userfiles"),
+			"kind": map[string]interface{}{
+				"type":        "string",
+				"enum":        []string{TrivyKindImage, TrivyKindSBOM, TrivyKindLockfile, TrivyKindArchive},
+				"description": "What the file is; detected from the file name and content when omitted",
+			},
+			"severity": registry.ArraySchema("Only report these severities", map[string]interface{}{
+				"type": "string",
+				"enum": trivySeverities,
+			}),
+			"ignore_unfixed":   map[string]interface{}{"type": "boolean", "description": "Skip vulnerabilities without a fixed version"},
+			"baseline_scan_id": registry.StringSchema("scan_id of an earlier trivy_scan of the same artifact to diff against"),
+			"timeout_seconds":  map[string]interface{}{"type": "integer", "minimum": 1, "maximum": int(maxTrivyTimeout.Seconds()), "description": "Maximum scan duration in seconds"},
+		}, "file_id"),
+		RequiredScope: targets.ScopeScan,
+		Handler:       trivyTool,
+		ServerName:    "cybersecurity",
+		ToolCategory:  "cybersecurity",
+	})
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "trivy_diff",
+		ToolTitle: "Trivy Scan Diff",
+		Desc:      "Compare two stored trivy_scan results of the same artifact and report added, removed and changed vulnerabilities.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"base_scan_id": registry.StringSchema("scan_id of the earlier scan"),
+			"scan_id":      registry.StringSchema("scan_id of the later scan"),
+		}, "base_scan_id", "scan_id"),
+		RequiredScope: targets.ScopeScan,
+		Handler:       trivyDiffTool,
+		ServerName:    "cybersecurity",
+		ToolCategory:  "cybersecurity",
+	})
+}
+
+// trivyTool trivy_scan 工具
+func trivyTool(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+	var req TrivyScanRequest
+	data, _ := json.Marshal(args)
+	if err := json.Unmarshal(data, &req); err != nil {
+		return registry.ErrorResult(fmt.Sprintf("参数格式错误: %v", err)), nil
+	}
+
+	result, err := RunTrivyScan(ctx, mcp.UserIDFromContext(ctx), &req)
+	if err != nil {
+		return registry.ErrorResult(err.Error()), nil
+	}
+	return registry.JSONResult(result)
+}
+
+// trivyDiffTool trivy_diff 工具
+func trivyDiffTool(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+	baseScanID, _ := args["base_scan_id"].(string)
+	scanID, _ := args["scan_id"].(string)
+	if baseScanID == "" || scanID == "" {
+		return registry.ErrorResult("base_scan_id 和 scan_id 不能为空"), nil
+	}
+
+	userID := mcp.UserIDFromContext(ctx)
+	base, err := loadTrivyScan(userID, baseScanID)
+	if err != nil {
+		return registry.ErrorResult(err.Error()), nil
+	}
+	current, err := loadTrivyScan(userID, scanID)
+	if err != nil {
+		return registry.ErrorResult(err.Error()), nil
+	}
+	diff, err := diffTrivyScans(base, current)
+	if err != nil {
+		return registry.ErrorResult(err.Error()), nil
+	}
+	return registry.JSONResult(diff)
+}
+
+// RunTrivyScan 取出用户上传的文件并执行 trivy 扫描
+func RunTrivyScan(ctx context.Context, userID string, req *TrivyScanRequest) (*TrivyScanResult, error) {
+	if req.FileID == "" {
+		return nil, fmt.Errorf("file_id 不能为空")
+	}
+	for _, severity := range req.Severity {
+		if !isTrivySeverity(severity) {
+			return nil, fmt.Errorf("无效的严重程度: %s，可选值: %s", severity, strings.Join(trivySeverities, ", "))
+		}
+	}
+
+	// 只能扫描自己上传的文件
+	file, err := userfiles.NewFileService().DownloadFile(userID, &userfiles.DownloadFileRequest{FileId: req.FileID})
+	if err != nil || file == nil || !file.Success {
+		message := "文件不存在"
+		if file != nil && file.Message != "" {
+			message = file.Message
+		}
+		return nil, fmt.Errorf("获取文件 %s 失败: %s", req.FileID, message)
+	}
+
+	var baseline *trivyScan
+	if req.BaselineScanID != "" {
+		if baseline, err = loadTrivyScan(userID, req.BaselineScanID); err != nil {
+			return nil, err
+		}
+	}
+
+	kind := req.Kind
+	if kind == "" {
+		kind = detectTrivyKind(file.FilePath, file.OriginalName)
+	}
+
+	workDir, err := os.MkdirTemp("", "trivy-*")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	args, err := buildTrivyArgs(kind, file.FilePath, file.OriginalName, workDir, req)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultTrivyTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+		if timeout > maxTrivyTimeout {
+			timeout = maxTrivyTimeout
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	binary := os.Getenv(TrivyPathEnv)
+	if binary == "" {
+		binary = "trivy"
+	}
+	result := &TrivyScanResult{
+		ScanID:     fmt.Sprintf("trivy-%d", time.Now().UnixNano()),
+		FileID:     req.FileID,
+		Artifact:   file.OriginalName,
+		Kind:       kind,
+		BySeverity: make(map[string]int),
+		Groups:     []TrivySeverityGroup{},
+	}
+	log.Printf("Trivy scan %s started: user=%s, file=%s (%s), args=%v", result.ScanID, userID, req.FileID, kind, args)
+	registry.ReportProgress(ctx, fmt.Sprintf("trivy %s started on %s (%s)", result.ScanID, file.OriginalName, kind))
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			return nil, fmt.Errorf("扫描超过 %v 被终止", timeout)
+		case ctx.Err() != nil:
+			return nil, fmt.Errorf("扫描已取消")
+		}
+		tail := strings.TrimSpace(stderr.String())
+		if len(tail) > 4096 {
+			tail = tail[len(tail)-4096:]
+		}
+		return nil, fmt.Errorf("trivy执行失败: %v %s", err, tail)
+	}
+
+	var report trivyReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		return nil, fmt.Errorf("解析trivy输出失败: %v", err)
+	}
+	var vulnerabilities []TrivyVulnerability
+	for _, r := range report.Results {
+		for _, v := range r.Vulnerabilities {
+			severity := strings.ToUpper(v.Severity)
+			if !isTrivySeverity(severity) {
+				severity = "UNKNOWN"
+			}
+			vulnerabilities = append(vulnerabilities, TrivyVulnerability{
+				VulnerabilityID:  v.VulnerabilityID,
+				PkgName:          v.PkgName,
+				InstalledVersion: v.InstalledVersion,
+				FixedVersion:     v.FixedVersion,
+				Severity:         severity,
+				Target:           trivyTarget(r.Target, file.FilePath, file.OriginalName, workDir),
+				Title:            v.Title,
+				PrimaryURL:       v.PrimaryURL,
+			})
+		}
+	}
+	result.Total = len(vulnerabilities)
+	result.Groups, result.Truncated = groupTrivyVulnerabilities(vulnerabilities, result.BySeverity)
+
+	current := &trivyScan{ScanID: result.ScanID, Artifact: result.Artifact, Kind: kind, Vulnerabilities: vulnerabilities}
+	if err := storeTrivyScan(userID, req.FileID, current, result.BySeverity); err != nil {
+		log.Printf("Failed to store trivy scan %s: %v", result.ScanID, err)
+	} else {
+		result.Stored = true
+	}
+
+	if baseline != nil {
+		diff, err := diffTrivyScans(baseline, current)
+		if err != nil {
+			return nil, err
+		}
+		result.Diff = diff
+	}
+
+	result.Message = fmt.Sprintf("扫描完成，发现 %d 个漏洞", result.Total)
+	if !result.Stored {
+		result.Message += "（结果未能保存，不能用于之后的比较）"
+	}
+	log.Printf("Trivy scan %s finished: vulnerabilities=%d, stored=%v", result.ScanID, result.Total, result.Stored)
+	return result, nil
+}
+
+// trivyTarget 把 trivy 报告中的扫描目标换成与服务器存储路径无关的名称
+// 镜像和 SBOM 的目标以存储路径开头（如 <userId>_<fileId>.tar (alpine 3.18)），换成上传时的文件名；
+// 解压目录是临时目录，只保留相对路径。同一制品的多次扫描因此可以分组和比较
+func trivyTarget(target, filePath, originalName, workDir string) string {
+	for _, prefix := range []string{filePath, filepath.Base(filePath)} {
+		if prefix != "" && prefix != "." && strings.HasPrefix(target, prefix) {
+			return originalName + strings.TrimPrefix(target, prefix)
+		}
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(target, workDir), string(filepath.Separator))
+}
+
+// buildTrivyArgs 生成 trivy 参数；lockfile 和 archive 会先放到 workDir 中
+func buildTrivyArgs(kind, filePath, originalName, workDir string, req *TrivyScanRequest) ([]string, error) {
+	var args []string
+	switch kind {
+	case TrivyKindImage:
+		args = []string{"image", "--input", filePath}
+	case TrivyKindSBOM:
+		args = []string{"sbom"}
+	case TrivyKindLockfile:
+		// trivy 根据文件名识别锁文件，按原文件名放入临时目录
+		name := filepath.Base(originalName)
+		if name == "." || name == string(filepath.Separator) || strings.HasPrefix(name, "-") {
+			return nil, fmt.Errorf("无效的文件名: %s", originalName)
+		}
+		if err := copyFile(filePath, filepath.Join(workDir, name)); err != nil {
+			return nil, fmt.Errorf("准备锁文件失败: %v", err)
+		}
+		args = []string{"fs", "--scanners", "vuln"}
+	case TrivyKindArchive:
+		if err := extractArchive(filePath, originalName, workDir); err != nil {
+			return nil, fmt.Errorf("解压文件失败: %v", err)
+		}
+		args = []string{"fs", "--scanners", "vuln"}
+	default:
+		return nil, fmt.Errorf("无效的类型: %s，可选值: %s, %s, %s, %s", kind, TrivyKindImage, TrivyKindSBOM, TrivyKindLockfile, TrivyKindArchive)
+	}
+
+	args = append(args, "--format", "json", "--quiet", "--offline-scan", "--skip-db-update", "--skip-java-db-update")
+	if cacheDir := os.Getenv(TrivyCacheDirEnv); cacheDir != "" {
+		args = append(args, "--cache-dir", cacheDir)
+	}
+	if len(req.Severity) > 0 {
+		args = append(args, "--severity", strings.Join(req.Severity, ","))
+	}
+	if req.IgnoreUnfixed {
+		args = append(args, "--ignore-unfixed")
+	}
+
+	switch kind {
+	case TrivyKindSBOM:
+		args = append(args, filePath)
+	case TrivyKindLockfile, TrivyKindArchive:
+		args = append(args, workDir)
+	}
+	return args, nil
+}
+
+// detectTrivyKind 根据文件名和内容判断扫描类型
+func detectTrivyKind(filePath, originalName string) string {
+	name := strings.ToLower(originalName)
+	switch {
+	case strings.HasSuffix(name, ".zip"), strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return TrivyKindArchive
+	case strings.HasSuffix(name, ".tar"):
+		if isImageTarball(filePath) {
+			return TrivyKindImage
+		}
+		return TrivyKindArchive
+	case strings.HasSuffix(name, ".spdx"), strings.HasSuffix(name, ".cdx"),
+		strings.HasSuffix(name, ".spdx.json"), strings.HasSuffix(name, ".cdx.json"):
+		return TrivyKindSBOM
+	case strings.HasSuffix(name, ".json") && isSBOMDocument(filePath):
+		return TrivyKindSBOM
+	}
+	return TrivyKindLockfile
+}
+
+// isImageTarball tar 包根目录中是否有 docker save 的 manifest.json 或 OCI 的 index.json
+func isImageTarball(filePath string) bool {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	reader := tar.NewReader(f)
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			return false
+		}
+		switch strings.TrimPrefix(header.Name, "./") {
+		case "manifest.json", "index.json", "oci-layout":
+			return true
+		}
+	}
+}
+
+// isSBOMDocument JSON 文件是否为 CycloneDX 或 SPDX 文档
+func isSBOMDocument(filePath string) bool {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(f, head)
+	text := string(head[:n])
+	return strings.Contains(text, `"bomFormat"`) || strings.Contains(text, `"spdxVersion"`)
+}
+
+// extractArchive 把 zip / tar / tar.gz 解压到 dest，拒绝越出 dest 的路径和链接，限制文件数和总大小
+func extractArchive(filePath, originalName, dest string) error {
+	name := strings.ToLower(originalName)
+	if strings.HasSuffix(name, ".zip") {
+		return extractZip(filePath, dest)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	tr := tar.NewReader(reader)
+	files := 0
+	var total int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue // 目录按需创建，链接和设备文件跳过
+		}
+		if files++; files > maxArchiveFiles {
+			return fmt.Errorf("文件数量超过 %d", maxArchiveFiles)
+		}
+		if total += header.Size; total > maxArchiveBytes {
+			return fmt.Errorf("解压后大小超过 %d 字节", int64(maxArchiveBytes))
+		}
+		if err := writeArchiveEntry(dest, header.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extractZip 解压 zip 文件
+func extractZip(filePath, dest string) error {
+	zr, err := zip.OpenReader(filePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	if len(zr.File) > maxArchiveFiles {
+		return fmt.Errorf("文件数量超过 %d", maxArchiveFiles)
+	}
+	var total int64
+	for _, entry := range zr.File {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		if total += int64(entry.UncompressedSize64); total > maxArchiveBytes {
+			return fmt.Errorf("解压后大小超过 %d 字节", int64(maxArchiveBytes))
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = writeArchiveEntry(dest, entry.Name, io.LimitReader(rc, int64(entry.UncompressedSize64)))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArchiveEntry 把压缩包中的一个文件写到 dest 下
+func writeArchiveEntry(dest, name string, content io.Reader) error {
+	target := filepath.Join(dest, filepath.Clean("/"+name))
+	if !strings.HasPrefix(target, filepath.Clean(dest)+string(filepath.Separator)) {
+		return fmt.Errorf("无效的文件路径: %s", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, content)
+	return err
+}
+
+// copyFile 复制文件
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// isTrivySeverity 是否为 trivy 的严重程度
+func isTrivySeverity(severity string) bool {
+	for _, s := range trivySeverities {
+		if severity == s {
+			return true
+		}
+	}
+	return false
+}
+
+// groupTrivyVulnerabilities 按严重程度、再按包分组，同时统计各严重程度的数量；超过返回上限的漏洞只计数
+func groupTrivyVulnerabilities(vulnerabilities []TrivyVulnerability, bySeverity map[string]int) ([]TrivySeverityGroup, bool) {
+	groups := []TrivySeverityGroup{}
+	returned := 0
+	truncated := false
+	for _, severity := range trivySeverities {
+		group := TrivySeverityGroup{Severity: severity, Packages: []TrivyPackageGroup{}}
+		packageIndex := make(map[string]int)
+		for _, v := range vulnerabilities {
+			if v.Severity != severity {
+				continue
+			}
+			group.Count++
+			if returned >= maxReturnedVulnerabilities {
+				truncated = true
+				continue
+			}
+			returned++
+			key := v.Target + "\x00" + v.PkgName + "\x00" + v.InstalledVersion
+			index, ok := packageIndex[key]
+			if !ok {
+				index = len(group.Packages)
+				packageIndex[key] = index
+				group.Packages = append(group.Packages, TrivyPackageGroup{
+					PkgName:          v.PkgName,
+					InstalledVersion: v.InstalledVersion,
+					Target:           v.Target,
+				})
+			}
+			group.Packages[index].Vulnerabilities = append(group.Packages[index].Vulnerabilities, v)
+		}
+		if group.Count == 0 {
+			continue
+		}
+		sort.SliceStable(group.Packages, func(i, j int) bool {
+			return len(group.Packages[i].Vulnerabilities) > len(group.Packages[j].Vulnerabilities)
+		})
+		bySeverity[severity] = group.Count
+		groups = append(groups, group)
+	}
+	return groups, truncated
+}
+
+// diffTrivyScans 比较同一制品的两次扫描，漏洞按 漏洞ID + 包名 + 扫描目标 对应
+func diffTrivyScans(base, current *trivyScan) (*TrivyDiff, error) {
+	if base.Kind != current.Kind {
+		return nil, fmt.Errorf("两次扫描的类型不同（%s / %s），不是同一制品", base.Kind, current.Kind)
+	}
+	diff := &TrivyDiff{
+		BaseScanID: base.ScanID,
+		ScanID:     current.ScanID,
+		Added:      []TrivyVulnerability{},
+		Removed:    []TrivyVulnerability{},
+		Changed:    []TrivyChange{},
+	}
+	if base.Artifact != current.Artifact {
+		diff.Note = fmt.Sprintf("两次扫描的文件名不同：%s / %s", base.Artifact, current.Artifact)
+	}
+
+	key := func(v TrivyVulnerability) string {
+		return v.VulnerabilityID + "\x00" + v.PkgName + "\x00" + v.Target
+	}
+	before := make(map[string]TrivyVulnerability, len(base.Vulnerabilities))
+	for _, v := range base.Vulnerabilities {
+		before[key(v)] = v
+	}
+	seen := make(map[string]bool, len(current.Vulnerabilities))
+	for _, v := range current.Vulnerabilities {
+		k := key(v)
+		seen[k] = true
+		old, ok := before[k]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, v)
+		case old.Severity != v.Severity || old.FixedVersion != v.FixedVersion || old.InstalledVersion != v.InstalledVersion:
+			diff.Changed = append(diff.Changed, TrivyChange{Before: old, After: v})
+		default:
+			diff.Unchanged++
+		}
+	}
+	for _, v := range base.Vulnerabilities {
+		if !seen[key(v)] {
+			diff.Removed = append(diff.Removed, v)
+		}
+	}
+	return diff, nil
+}
+
+var (
+	scansService     *datahandle.CommonReadWriteService
+	scansServiceOnce sync.Once
+)
+
+// getScansService 获取 storagebox 数据服务
+func getScansService() *datahandle.CommonReadWriteService {
+	scansServiceOnce.Do(func() {
+		service, err := datahandle.NewCommonReadWriteService("storagebox")
+		if err != nil {
+			log.Printf("Failed to create storagebox data service for trivy: %v", err)
+			return
+		}
+		scansService = service
+	})
+	return scansService
+}
+
+// storeTrivyScan 在一个事务中把扫描和全部漏洞写入 storagebox，避免留下漏洞不完整的扫描
+func storeTrivyScan(userID, fileID string, scan *trivyScan, bySeverity map[string]int) error {
+	service := getScansService()
+	if service == nil {
+		return fmt.Errorf("storagebox 数据服务不可用")
+	}
+
+	summary, _ := json.Marshal(bySeverity)
+	statements := make([]datahandle.DbStatement, 0, len(scan.Vulnerabilities)+1)
+	statements = append(statements, datahandle.DbStatement{
+		Query: `
+		INSERT INTO container_scans (scan_id, user_id, file_id, artifact, kind, total, summary, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NOW())
+	`,
+		Params: []interface{}{scan.ScanID, userID, fileID, scan.Artifact, scan.Kind, len(scan.Vulnerabilities), string(summary)},
+	})
+	for _, v := range scan.Vulnerabilities {
+		statements = append(statements, datahandle.DbStatement{
+			Query: `
+			INSERT INTO container_scan_vulnerabilities
+				(scan_id, vulnerability_id, pkg_name, installed_version, fixed_version, severity, target, title, primary_url)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			Params: []interface{}{scan.ScanID, v.VulnerabilityID, v.PkgName, v.InstalledVersion, v.FixedVersion, v.Severity, v.Target, v.Title, v.PrimaryURL},
+		})
+	}
+
+	if result := service.ExecuteDbTransaction(statements); !result.IsSuccess() {
+		return fmt.Errorf("写入扫描结果失败: %v", result.Error)
+	}
+	return nil
+}
+
+// loadTrivyScan 读取用户保存的扫描
+func loadTrivyScan(userID, scanID string) (*trivyScan, error) {
+	service := getScansService()
+	if service == nil {
+		return nil, fmt.Errorf("storagebox 数据服务不可用")
+	}
+
+	result := service.QueryDb("SELECT artifact, kind FROM container_scans WHERE scan_id = ? AND user_id = ? LIMIT 1", scanID, userID)
+	if !result.IsSuccess() {
+		return nil, fmt.Errorf("查询 container_scans 失败: %v", result.Error)
+	}
+	rows, _ := result.Data.([]map[string]interface{})
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("扫描 %s 不存在", scanID)
+	}
+	scan := &trivyScan{
+		ScanID:          scanID,
+		Artifact:        columnString(rows[0]["artifact"]),
+		Kind:            columnString(rows[0]["kind"]),
+		Vulnerabilities: []TrivyVulnerability{},
+	}
+
+	result = service.QueryDb(`
+		SELECT vulnerability_id, pkg_name, installed_version, fixed_version, severity, target, title, primary_url
+		FROM container_scan_vulnerabilities
+		WHERE scan_id = ?
+	`, scanID)
+	if !result.IsSuccess() {
+		return nil, fmt.Errorf("查询 container_scan_vulnerabilities 失败: %v", result.Error)
+	}
+	rows, _ = result.Data.([]map[string]interface{})
+	for _, row := range rows {
+		scan.Vulnerabilities = append(scan.Vulnerabilities, TrivyVulnerability{
+			VulnerabilityID:  columnString(row["vulnerability_id"]),
+			PkgName:          columnString(row["pkg_name"]),
+			InstalledVersion: columnString(row["installed_version"]),
+			FixedVersion:     columnString(row["fixed_version"]),
+			Severity:         columnString(row["severity"]),
+			Target:           columnString(row["target"]),
+			Title:            columnString(row["title"]),
+			PrimaryURL:       columnString(row["primary_url"]),
+		})
+	}
+	return scan, nil
+}
+
+// columnString 数据库列值转字符串
+func columnString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,152 @@
+// targets.go - 扫描目标授权
+package targets
+
+// 扫描类工具只能作用于授权的目标：
+//   - 环境变量 MCP_ALLOWED_TARGETS 中配置的 IP、CIDR、主机名或 *.example.com 形式的域名（对所有用户有效）
+//   - storagebox user_scan_targets 表中为发起调用的用户登记的目标（格式同上）
+//
+// storagebox ip_addresses 表是所有用户共用的资产数据，任何有写权限的调用都能登记，不作为授权来源
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"digitalsingularity/backend/common/utils/datahandle"
+)
+
+const (
+	// AllowedTargetsEnv 允许扫描的目标配置，逗号分隔
+	AllowedTargetsEnv = "MCP_ALLOWED_TARGETS"
+	// ScopeScan 扫描类工具所需的权限范围
+	ScopeScan = "cybersecurity:scan"
+)
+
+var (
+	storageboxService     *datahandle.CommonReadWriteService
+	storageboxServiceOnce sync.Once
+)
+
+// getStorageboxService 获取 storagebox 数据服务
+func getStorageboxService() *datahandle.CommonReadWriteService {
+	storageboxServiceOnce.Do(func() {
+		service, err := datahandle.NewCommonReadWriteService("storagebox")
+		if err != nil {
+			log.Printf("Failed to create storagebox data service for target checks: %v", err)
+			return
+		}
+		storageboxService = service
+	})
+	return storageboxService
+}
+
+// Host 从目标中取出主机名或 IP，目标可以是 URL、host、host:port 或 IP
+func Host(target string) (string, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", fmt.Errorf("目标不能为空")
+	}
+	if strings.HasPrefix(target, "-") {
+		return "", fmt.Errorf("无效的目标: %s", target)
+	}
+
+	host := target
+	if strings.Contains(target, "://") {
+		parsed, err := url.Parse(target)
+		if err != nil || parsed.Hostname() == "" {
+			return "", fmt.Errorf("无效的目标URL: %s", target)
+		}
+		host = parsed.Hostname()
+	} else if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return "", fmt.Errorf("无效的目标: %s", target)
+	}
+	return host, nil
+}
+
+// Check 检查目标是否允许用户扫描，返回目标的主机名或 IP；userID 为空时不检查用户白名单
+func Check(userID, target string) (string, error) {
+	host, err := Host(target)
+	if err != nil {
+		return "", err
+	}
+	if allowedByConfig(host) {
+		return host, nil
+	}
+	if userID != "" {
+		allowed, err := allowedForUser(userID, host)
+		if err != nil {
+			return "", fmt.Errorf("检查目标 %s 失败: %v", host, err)
+		}
+		if allowed {
+			return host, nil
+		}
+	}
+	return "", fmt.Errorf("目标 %s 不在允许扫描的范围内", host)
+}
+
+// allowedByConfig 目标是否在 MCP_ALLOWED_TARGETS 中
+func allowedByConfig(host string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(os.Getenv(AllowedTargetsEnv), ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if MatchEntry(entry, host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedForUser 目标是否在用户的扫描目标白名单中
+func allowedForUser(userID, host string) (bool, error) {
+	service := getStorageboxService()
+	if service == nil {
+		return false, fmt.Errorf("storagebox 数据服务不可用")
+	}
+	result := service.QueryDb("SELECT target FROM user_scan_targets WHERE user_id = ?", userID)
+	if !result.IsSuccess() {
+		return false, fmt.Errorf("查询 user_scan_targets 失败: %v", result.Error)
+	}
+	rows, _ := result.Data.([]map[string]interface{})
+	ip := net.ParseIP(host)
+	for _, row := range rows {
+		entry := ""
+		switch v := row["target"].(type) {
+		case string:
+			entry = v
+		case []byte:
+			entry = string(v)
+		}
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" && MatchEntry(entry, host, ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MatchEntry 主机是否匹配一条允许规则：IP、CIDR、主机名或 *.example.com（匹配其所有子域名）
+func MatchEntry(entry, host string, ip net.IP) bool {
+	if ip != nil {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			return network.Contains(ip)
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			return entryIP.Equal(ip)
+		}
+		return false
+	}
+	if strings.HasPrefix(entry, "*.") {
+		return strings.HasSuffix(host, entry[1:])
+	}
+	return host == entry
+}
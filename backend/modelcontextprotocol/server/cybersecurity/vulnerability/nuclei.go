@@ -2,3 +2,398 @@
 package vulnerability
 
 // Nuclei 快速漏洞扫描器实现
+//
+// 调用本机安装的 nuclei（路径由环境变量 NUCLEI_PATH 指定，默认从 PATH 查找），
+// 逐行读取 -jsonl 输出：每条发现作为增量输出返回给客户端，并写入 storagebox 的 vulnerability_findings 表，
+// 与 nmap 扫描登记的 ip_addresses、ip_ports 数据按 ip_address 关联
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"digitalsingularity/backend/common/utils/datahandle"
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+	"digitalsingularity/backend/modelcontextprotocol/server/cybersecurity/targets"
+	"digitalsingularity/backend/silicoid/mcp"
+)
+
+const (
+	// NucleiPathEnv nuclei 可执行文件路径的环境变量，测试时可指向假的可执行文件
+	NucleiPathEnv = "NUCLEI_PATH"
+
+	defaultNucleiTimeout = 10 * time.Minute
+	maxNucleiTimeout     = 30 * time.Minute
+	maxNucleiTargets     = 20
+	// maxReturnedFindings 返回给模型的发现数量上限，全部发现都会写入 storagebox
+	maxReturnedFindings = 100
+)
+
+// nucleiSeverities nuclei 支持的严重程度
+var nucleiSeverities = []string{"info", "low", "medium", "high", "critical", "unknown"}
+
+// NucleiScanRequest nuclei 扫描请求
+type NucleiScanRequest struct {
+	Targets        []string `json:"targets"`
+	Templates      []string `json:"templates,omitempty"` // 模板路径或目录（相对于 nuclei 模板目录）
+	Tags           []string `json:"tags,omitempty"`
+	Severity       []string `json:"severity,omitempty"`
+	RateLimit      int      `json:"rate_limit,omitempty"` // 每秒请求数
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+}
+
+// NucleiFinding 一条 nuclei 发现
+type NucleiFinding struct {
+	TemplateID       string   `json:"template_id"`
+	Name             string   `json:"name"`
+	Severity         string   `json:"severity"`
+	Type             string   `json:"type"`
+	Host             string   `json:"host"`
+	IP               string   `json:"ip,omitempty"`
+	MatchedAt        string   `json:"matched_at"`
+	MatcherName      string   `json:"matcher_name,omitempty"`
+	ExtractedResults []string `json:"extracted_results,omitempty"`
+	Description      string   `json:"description,omitempty"`
+	CVE              []string `json:"cve,omitempty"`
+	Timestamp        string   `json:"timestamp,omitempty"`
+}
+
+// nucleiOutput nuclei -jsonl 的一行
+type nucleiOutput struct {
+	TemplateID string `json:"template-id"`
+	Info       struct {
+		Name           string `json:"name"`
+		Severity       string `json:"severity"`
+		Description    string `json:"description"`
+		Classification struct {
+			CVEID []string `json:"cve-id"`
+		} `json:"classification"`
+	} `json:"info"`
+	Type             string   `json:"type"`
+	Host             string   `json:"host"`
+	IP               string   `json:"ip"`
+	MatchedAt        string   `json:"matched-at"`
+	MatcherName      string   `json:"matcher-name"`
+	ExtractedResults []string `json:"extracted-results"`
+	Timestamp        string   `json:"timestamp"`
+}
+
+// NucleiScanResult nuclei 扫描结果
+type NucleiScanResult struct {
+	ScanID     string          `json:"scan_id"`
+	Targets    []string        `json:"targets"`
+	Total      int             `json:"total"`
+	BySeverity map[string]int  `json:"by_severity"`
+	Findings   []NucleiFinding `json:"findings"`
+	Truncated  bool            `json:"truncated,omitempty"`
+	Stored     int             `json:"stored"`
+	Message    string          `json:"message"`
+}
+
+func init() {
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "nuclei_scan",
+		ToolTitle: "Nuclei Vulnerability Scan",
+		Desc: "Scan authorized targets (URLs, hosts or IPs) for known vulnerabilities with nuclei templates. " +
+			"Findings are streamed as they are found and stored in storagebox.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"targets":   registry.ArraySchema("Targets to scan; must be in the allowed target list", registry.StringSchema("")),
+			"templates": registry.ArraySchema("Template paths or directories relative to the nuclei templates directory, e.g. http/cves/2024/", registry.StringSchema("")),
+			"tags":      registry.ArraySchema("Only run templates with these tags, e.g. cve, rce", registry.StringSchema("")),
+			"severity": registry.ArraySchema("Only run templates with these severities", map[string]interface{}{
+				"type": "string",
+				"enum": nucleiSeverities,
+			}),
+			"rate_limit":      map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 1000, "description": "Maximum requests per second"},
+			"timeout_seconds": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": int(maxNucleiTimeout.Seconds()), "description": "Maximum scan duration in seconds"},
+		}, "targets"),
+		RequiredScope: targets.ScopeScan,
+		Handler:       nucleiTool,
+		ServerName:    "cybersecurity",
+		ToolCategory:  "cybersecurity",
+	})
+}
+
+// nucleiTool nuclei_scan 工具
+func nucleiTool(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+	var req NucleiScanRequest
+	data, _ := json.Marshal(args)
+	if err := json.Unmarshal(data, &req); err != nil {
+		return registry.ErrorResult(fmt.Sprintf("参数格式错误: %v", err)), nil
+	}
+
+	result, err := RunNucleiScan(ctx, &req)
+	if err != nil {
+		return registry.ErrorResult(err.Error()), nil
+	}
+	return registry.JSONResult(result)
+}
+
+// RunNucleiScan 校验请求并执行 nuclei 扫描
+func RunNucleiScan(ctx context.Context, req *NucleiScanRequest) (*NucleiScanResult, error) {
+	userID := mcp.UserIDFromContext(ctx)
+	args, err := buildNucleiArgs(userID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultNucleiTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+		if timeout > maxNucleiTimeout {
+			timeout = maxNucleiTimeout
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	binary := os.Getenv(NucleiPathEnv)
+	if binary == "" {
+		binary = "nuclei"
+	}
+	cmd := exec.CommandContext(ctx, binary, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("创建stdout管道失败: %v", err)
+	}
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("启动nuclei失败: %v", err)
+	}
+
+	result := &NucleiScanResult{
+		ScanID:     fmt.Sprintf("nuclei-%d", time.Now().UnixNano()),
+		Targets:    req.Targets,
+		BySeverity: make(map[string]int),
+		Findings:   []NucleiFinding{},
+	}
+	log.Printf("Nuclei scan %s started: targets=%v, args=%v", result.ScanID, req.Targets, args)
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var output nucleiOutput
+		if err := json.Unmarshal(scanner.Bytes(), &output); err != nil || output.TemplateID == "" {
+			continue
+		}
+		finding := output.toFinding()
+
+		result.Total++
+		result.BySeverity[finding.Severity]++
+		if len(result.Findings) < maxReturnedFindings {
+			result.Findings = append(result.Findings, finding)
+		} else {
+			result.Truncated = true
+		}
+		if err := storeFinding(result.ScanID, userID, &finding); err != nil {
+			log.Printf("Failed to store nuclei finding %s at %s: %v", finding.TemplateID, finding.MatchedAt, err)
+		} else {
+			result.Stored++
+		}
+		registry.ReportProgress(ctx, fmt.Sprintf("[%s] %s %s", finding.Severity, finding.TemplateID, finding.MatchedAt))
+	}
+	io.Copy(io.Discard, stdout)
+
+	waitErr := cmd.Wait()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result.Message = fmt.Sprintf("扫描超过 %v 被终止，返回已发现的 %d 条结果", timeout, result.Total)
+	case ctx.Err() != nil:
+		return nil, fmt.Errorf("扫描已取消，已发现的 %d 条结果已写入 storagebox", result.Stored)
+	case waitErr != nil && result.Total == 0:
+		return nil, fmt.Errorf("nuclei执行失败: %v %s", waitErr, strings.TrimSpace(stderr.String()))
+	default:
+		result.Message = fmt.Sprintf("扫描完成，发现 %d 条结果", result.Total)
+	}
+	log.Printf("Nuclei scan %s finished: findings=%d, stored=%d", result.ScanID, result.Total, result.Stored)
+	return result, nil
+}
+
+// buildNucleiArgs 校验请求并生成 nuclei 参数
+func buildNucleiArgs(userID string, req *NucleiScanRequest) ([]string, error) {
+	if len(req.Targets) == 0 {
+		return nil, fmt.Errorf("targets 不能为空")
+	}
+	if len(req.Targets) > maxNucleiTargets {
+		return nil, fmt.Errorf("一次最多扫描 %d 个目标", maxNucleiTargets)
+	}
+
+	args := []string{"-jsonl", "-silent", "-no-color", "-disable-update-check"}
+	for _, target := range req.Targets {
+		if _, err := targets.Check(userID, target); err != nil {
+			return nil, err
+		}
+		args = append(args, "-target", strings.TrimSpace(target))
+	}
+
+	for _, template := range req.Templates {
+		template = strings.TrimSpace(template)
+		if template == "" || strings.HasPrefix(template, "-") || strings.HasPrefix(template, "/") || strings.Contains(template, "..") {
+			return nil, fmt.Errorf("无效的模板路径: %s", template)
+		}
+		args = append(args, "-t", template)
+	}
+
+	if len(req.Tags) > 0 {
+		for _, tag := range req.Tags {
+			if tag == "" || strings.ContainsAny(tag, ", ") || strings.HasPrefix(tag, "-") {
+				return nil, fmt.Errorf("无效的标签: %s", tag)
+			}
+		}
+		args = append(args, "-tags", strings.Join(req.Tags, ","))
+	}
+
+	if len(req.Severity) > 0 {
+		for _, severity := range req.Severity {
+			if !isNucleiSeverity(severity) {
+				return nil, fmt.Errorf("无效的严重程度: %s，可选值: %s", severity, strings.Join(nucleiSeverities, ", "))
+			}
+		}
+		args = append(args, "-severity", strings.Join(req.Severity, ","))
+	}
+
+	if req.RateLimit > 0 {
+		args = append(args, "-rate-limit", fmt.Sprintf("%d", req.RateLimit))
+	}
+	return args, nil
+}
+
+// isNucleiSeverity 是否为 nuclei 支持的严重程度
+func isNucleiSeverity(severity string) bool {
+	for _, s := range nucleiSeverities {
+		if severity == s {
+			return true
+		}
+	}
+	return false
+}
+
+// toFinding 转换为对外的发现结构
+func (o *nucleiOutput) toFinding() NucleiFinding {
+	severity := strings.ToLower(o.Info.Severity)
+	if severity == "" {
+		severity = "unknown"
+	}
+	return NucleiFinding{
+		TemplateID:       o.TemplateID,
+		Name:             o.Info.Name,
+		Severity:         severity,
+		Type:             o.Type,
+		Host:             o.Host,
+		IP:               o.IP,
+		MatchedAt:        o.MatchedAt,
+		MatcherName:      o.MatcherName,
+		ExtractedResults: o.ExtractedResults,
+		Description:      strings.TrimSpace(o.Info.Description),
+		CVE:              o.Info.Classification.CVEID,
+		Timestamp:        o.Timestamp,
+	}
+}
+
+var (
+	findingsService     *datahandle.CommonReadWriteService
+	findingsServiceOnce sync.Once
+
+	// storeFinding 保存一条发现，测试时替换为不访问数据库的实现
+	storeFinding = storeNucleiFinding
+)
+
+// storeNucleiFinding 把发现写入 storagebox，发现按用户隔离，同一用户重复扫描到的发现只更新不新增
+// 发现中的 IP 不登记到 ip_addresses：扫描的主机名可能解析或重定向到其他地址，这些地址不应成为资产
+//
+// 表结构：
+//
+//	CREATE TABLE vulnerability_findings (
+//		id                BIGINT AUTO_INCREMENT PRIMARY KEY,
+//		scan_id           VARCHAR(64)  NOT NULL,
+//		user_id           VARCHAR(64)  NOT NULL,
+//		tool              VARCHAR(32)  NOT NULL,
+//		finding_key       CHAR(64)     NOT NULL, -- sha256(template_id, matched_at, matcher_name)
+//		ip_address        VARCHAR(45),
+//		host              VARCHAR(512),
+//		template_id       VARCHAR(255) NOT NULL,
+//		name              VARCHAR(512),
+//		severity          VARCHAR(16),
+//		type              VARCHAR(32),
+//		matched_at        TEXT,
+//		matcher_name      VARCHAR(255),
+//		extracted_results JSON,
+//		cve               JSON,
+//		description       TEXT,
+//		created_at        DATETIME     NOT NULL,
+//		updated_at        DATETIME     NOT NULL,
+//		UNIQUE KEY uk_user_finding (user_id, tool, finding_key),
+//		KEY idx_user_scan (user_id, scan_id),
+//		KEY idx_ip_address (ip_address)
+//	);
+func storeNucleiFinding(scanID string, userID string, finding *NucleiFinding) error {
+	findingsServiceOnce.Do(func() {
+		service, err := datahandle.NewCommonReadWriteService("storagebox")
+		if err != nil {
+			log.Printf("Failed to create storagebox data service for nuclei: %v", err)
+			return
+		}
+		findingsService = service
+	})
+	if findingsService == nil {
+		return fmt.Errorf("storagebox 数据服务不可用")
+	}
+
+	extracted, _ := json.Marshal(finding.ExtractedResults)
+	cve, _ := json.Marshal(finding.CVE)
+	result := findingsService.ExecuteDb(`
+		INSERT INTO vulnerability_findings
+			(scan_id, user_id, tool, finding_key, ip_address, host, template_id, name, severity, type, matched_at, matcher_name,
+			 extracted_results, cve, description, created_at, updated_at)
+		VALUES (?, ?, 'nuclei', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE
+			scan_id = VALUES(scan_id),
+			severity = VALUES(severity),
+			extracted_results = VALUES(extracted_results),
+			updated_at = NOW()
+	`, scanID, userID, nucleiFindingKey(finding), finding.IP, finding.Host, finding.TemplateID, finding.Name, finding.Severity, finding.Type,
+		finding.MatchedAt, finding.MatcherName, string(extracted), string(cve), finding.Description)
+	if !result.IsSuccess() {
+		return fmt.Errorf("写入 vulnerability_findings 失败: %v", result.Error)
+	}
+	return nil
+}
+
+// nucleiFindingKey 发现的去重键：同一模板在同一位置由同一匹配器命中视为同一条发现
+func nucleiFindingKey(finding *NucleiFinding) string {
+	sum := sha256.Sum256([]byte(finding.TemplateID + "\x00" + finding.MatchedAt + "\x00" + finding.MatcherName))
+	return hex.EncodeToString(sum[:])
+}
+
+// tailBuffer 只保留最后 4KB 的输出，用于错误信息
+type tailBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > 4096 {
+		b.data = b.data[len(b.data)-4096:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.data)
+}
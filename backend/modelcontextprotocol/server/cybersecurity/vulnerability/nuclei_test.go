@@ -0,0 +1,138 @@
+package vulnerability
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"digitalsingularity/backend/modelcontextprotocol/server/cybersecurity/targets"
+)
+
+// fakeNucleiOutput 假 nuclei 输出的 -jsonl 结果，包含无法解析和没有 template-id 的行
+const fakeNucleiOutput = `{"template-id":"cve-2024-0001","info":{"name":"Test RCE","severity":"CRITICAL","description":" remote code execution ","classification":{"cve-id":["CVE-2024-0001"]}},"type":"http","host":"https://app.example.com","ip":"192.0.2.10","matched-at":"https://app.example.com/login","matcher-name":"body","extracted-results":["v1.2.3"],"timestamp":"2024-01-01T00:00:00Z"}
+not json
+{"template-id":"tech-detect","info":{"name":"Tech Detect","severity":"info"},"type":"http","host":"https://app.example.com","matched-at":"https://app.example.com/"}
+{"info":{"name":"missing template id","severity":"high"}}
+{"template-id":"no-severity","info":{"name":"No Severity"},"type":"dns","host":"app.example.com","matched-at":"app.example.com"}
+`
+
+// fakeNuclei 把 NUCLEI_PATH 指向输出 fakeNucleiOutput 的脚本
+func fakeNuclei(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("假 nuclei 脚本需要 /bin/sh")
+	}
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output.jsonl")
+	if err := os.WriteFile(output, []byte(fakeNucleiOutput), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "nuclei")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncat '"+output+"'\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(NucleiPathEnv, script)
+}
+
+// stubStoreFinding 替换发现的保存，记录写入的用户
+func stubStoreFinding(t *testing.T) *[]string {
+	t.Helper()
+	var users []string
+	original := storeFinding
+	storeFinding = func(scanID string, userID string, finding *NucleiFinding) error {
+		users = append(users, userID)
+		return nil
+	}
+	t.Cleanup(func() { storeFinding = original })
+	return &users
+}
+
+func TestRunNucleiScanParsesFindings(t *testing.T) {
+	fakeNuclei(t)
+	stored := stubStoreFinding(t)
+	t.Setenv(targets.AllowedTargetsEnv, "*.example.com")
+
+	result, err := RunNucleiScan(context.Background(), &NucleiScanRequest{Targets: []string{"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("RunNucleiScan: %v", err)
+	}
+
+	if result.Total != 3 || len(result.Findings) != 3 || result.Stored != 3 || len(*stored) != 3 {
+		t.Fatalf("total=%d findings=%d stored=%d, want 3", result.Total, len(result.Findings), result.Stored)
+	}
+	wantSeverity := map[string]int{"critical": 1, "info": 1, "unknown": 1}
+	if len(result.BySeverity) != len(wantSeverity) {
+		t.Fatalf("by_severity = %v, want %v", result.BySeverity, wantSeverity)
+	}
+	for severity, count := range wantSeverity {
+		if result.BySeverity[severity] != count {
+			t.Fatalf("by_severity = %v, want %v", result.BySeverity, wantSeverity)
+		}
+	}
+
+	finding := result.Findings[0]
+	if finding.TemplateID != "cve-2024-0001" || finding.Severity != "critical" || finding.IP != "192.0.2.10" ||
+		finding.MatchedAt != "https://app.example.com/login" || finding.MatcherName != "body" ||
+		finding.Description != "remote code execution" {
+		t.Fatalf("unexpected finding: %+v", finding)
+	}
+	if len(finding.CVE) != 1 || finding.CVE[0] != "CVE-2024-0001" {
+		t.Fatalf("cve = %v", finding.CVE)
+	}
+	if len(finding.ExtractedResults) != 1 || finding.ExtractedResults[0] != "v1.2.3" {
+		t.Fatalf("extracted_results = %v", finding.ExtractedResults)
+	}
+}
+
+func TestRunNucleiScanRejectsTargetOutsideAllowlist(t *testing.T) {
+	fakeNuclei(t)
+	stored := stubStoreFinding(t)
+	t.Setenv(targets.AllowedTargetsEnv, "*.example.com")
+
+	if _, err := RunNucleiScan(context.Background(), &NucleiScanRequest{Targets: []string{"https://evil.test"}}); err == nil {
+		t.Fatal("expected target outside the allowlist to be rejected")
+	}
+	if len(*stored) != 0 {
+		t.Fatalf("stored %d findings for a rejected scan", len(*stored))
+	}
+}
+
+func TestBuildNucleiArgs(t *testing.T) {
+	t.Setenv(targets.AllowedTargetsEnv, "192.0.2.0/24,*.example.com")
+
+	args, err := buildNucleiArgs("", &NucleiScanRequest{
+		Targets:   []string{"192.0.2.5", "https://app.example.com"},
+		Templates: []string{"http/cves/2024/"},
+		Tags:      []string{"cve", "rce"},
+		Severity:  []string{"high", "critical"},
+		RateLimit: 50,
+	})
+	if err != nil {
+		t.Fatalf("buildNucleiArgs: %v", err)
+	}
+	want := "-jsonl -silent -no-color -disable-update-check -target 192.0.2.5 -target https://app.example.com " +
+		"-t http/cves/2024/ -tags cve,rce -severity high,critical -rate-limit 50"
+	if got := strings.Join(args, " "); got != want {
+		t.Fatalf("args = %q, want %q", got, want)
+	}
+
+	rejected := []*NucleiScanRequest{
+		{Targets: []string{"198.51.100.1"}},
+		{Targets: []string{"example.com"}},
+		{Targets: []string{"https://app.example.com.evil.test"}},
+		{Targets: []string{"-u"}},
+		{Targets: []string{}},
+		{Targets: []string{"app.example.com"}, Templates: []string{"../secrets"}},
+		{Targets: []string{"app.example.com"}, Templates: []string{"/etc/passwd"}},
+		{Targets: []string{"app.example.com"}, Tags: []string{"cve,rce"}},
+		{Targets: []string{"app.example.com"}, Severity: []string{"severe"}},
+	}
+	for _, req := range rejected {
+		if _, err := buildNucleiArgs("", req); err == nil {
+			t.Errorf("expected %+v to be rejected", req)
+		}
+	}
+}
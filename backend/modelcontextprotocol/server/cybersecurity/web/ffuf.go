@@ -2,3 +2,475 @@
 package web
 
 // FFUF 快速Web模糊测试工具实现
+//
+// 调用本机安装的 ffuf（路径由环境变量 FFUF_PATH 指定，默认从 PATH 查找）做目录和参数发现：
+//   - 字典从 FFUF_WORDLIST_DIR（默认 /usr/share/seclists）下按相对路径选择
+//   - 目标必须在发起调用的用户的扫描目标白名单内（见 targets 包）
+//   - 每秒请求数和最长运行时间有上限，超时后强制结束
+//   - 结果从 ffuf 的 JSON 输出解析，写入 storagebox 的 web_fuzz_results 表，之后的对话中可用 ffuf_results 按 scan_id 查询
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"digitalsingularity/backend/common/utils/datahandle"
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+	"digitalsingularity/backend/modelcontextprotocol/server/cybersecurity/targets"
+	"digitalsingularity/backend/silicoid/mcp"
+)
+
+const (
+	// FfufPathEnv ffuf 可执行文件路径的环境变量
+	FfufPathEnv = "FFUF_PATH"
+	// FfufWordlistDirEnv 字典目录的环境变量
+	FfufWordlistDirEnv = "FFUF_WORDLIST_DIR"
+
+	defaultWordlistDir  = "/usr/share/seclists"
+	defaultFfufDuration = 5 * time.Minute
+	maxFfufDuration     = 30 * time.Minute
+	defaultFfufRate     = 50
+	maxFfufRate         = 500
+	defaultMatchCodes   = "200-299,301,302,307,401,403,405,500"
+	// maxReturnedResults 返回给模型的结果数量上限，全部结果都会写入 storagebox
+	maxReturnedResults = 200
+	maxQueryResults    = 500
+)
+
+// 模糊测试模式
+const (
+	FfufModeDirectory = "directory" // 目录和文件发现：{url}/FUZZ
+	FfufModeParameter = "parameter" // 参数名发现：{url}?FUZZ=1
+)
+
+// defaultWordlists 各模式的默认字典（SecLists 目录结构）
+var defaultWordlists = map[string]string{
+	FfufModeDirectory: "Discovery/Web-Content/common.txt",
+	FfufModeParameter: "Discovery/Web-Content/burp-parameter-names.txt",
+}
+
+// statusCodesPattern 状态码列表，如 200,301-302 或 all
+var statusCodesPattern = regexp.MustCompile(`^(all|[1-5][0-9]{2}(-[1-5][0-9]{2})?(,[1-5][0-9]{2}(-[1-5][0-9]{2})?)*)$`)
+
+// FfufRequest ffuf 模糊测试请求
+type FfufRequest struct {
+	URL                string `json:"url"`  // 目标URL，可以包含 FUZZ 关键字指定注入位置
+	Mode               string `json:"mode"` // directory 或 parameter，URL 和 data 中没有 FUZZ 时决定注入位置
+	Wordlist           string `json:"wordlist,omitempty"`
+	Method             string `json:"method,omitempty"`
+	Data               string `json:"data,omitempty"` // POST 请求体，可以包含 FUZZ
+	MatchCodes         string `json:"match_codes,omitempty"`
+	FilterCodes        string `json:"filter_codes,omitempty"`
+	RateLimit          int    `json:"rate_limit,omitempty"`
+	MaxDurationSeconds int    `json:"max_duration_seconds,omitempty"`
+}
+
+// FfufFinding 一条 ffuf 结果
+type FfufFinding struct {
+	Input            string `json:"input"`
+	URL              string `json:"url"`
+	Status           int    `json:"status"`
+	Length           int64  `json:"length"`
+	Words            int64  `json:"words"`
+	Lines            int64  `json:"lines"`
+	ContentType      string `json:"content_type,omitempty"`
+	RedirectLocation string `json:"redirect_location,omitempty"`
+	DurationMs       int64  `json:"duration_ms,omitempty"`
+}
+
+// FfufResult ffuf 模糊测试结果
+type FfufResult struct {
+	ScanID    string         `json:"scan_id"`
+	Target    string         `json:"target"`
+	Mode      string         `json:"mode"`
+	Wordlist  string         `json:"wordlist"`
+	Total     int            `json:"total"`
+	ByStatus  map[string]int `json:"by_status"`
+	Findings  []FfufFinding  `json:"findings"`
+	Truncated bool           `json:"truncated,omitempty"`
+	Stored    int            `json:"stored"`
+	Message   string         `json:"message"`
+}
+
+// ffufOutput ffuf -of json 的输出
+type ffufOutput struct {
+	Results []struct {
+		Input            map[string]string `json:"input"`
+		Status           int               `json:"status"`
+		Length           int64             `json:"length"`
+		Words            int64             `json:"words"`
+		Lines            int64             `json:"lines"`
+		ContentType      string            `json:"content-type"`
+		RedirectLocation string            `json:"redirectlocation"`
+		URL              string            `json:"url"`
+		Duration         int64             `json:"duration"` // 纳秒
+	} `json:"results"`
+}
+
+func init() {
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "ffuf_fuzz",
+		ToolTitle: "ffuf Web Fuzzing",
+		Desc: "Discover hidden directories, files or query parameters on an authorized web target with ffuf. " +
+			"Results are stored and can be fetched later with ffuf_results using the returned scan_id.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"url": registry.StringSchema("Target URL; may contain the FUZZ keyword to mark where words are injected"),
+			"mode": map[string]interface{}{
+				"type":        "string",
+				"enum":        []string{FfufModeDirectory, FfufModeParameter},
+				"description": "Where to inject words when url and data contain no FUZZ keyword: directory appends /FUZZ, parameter adds ?FUZZ=1",
+			},
+			"wordlist":             registry.StringSchema("Wordlist path relative to the wordlist directory, e.g. Discovery/Web-Content/common.txt"),
+			"method":               map[string]interface{}{"type": "string", "enum": []string{"GET", "POST", "HEAD", "PUT", "OPTIONS"}},
+			"data":                 registry.StringSchema("Request body for POST requests; may contain FUZZ"),
+			"match_codes":          registry.StringSchema("Status codes to report, e.g. 200,301-302 or all (default " + defaultMatchCodes + ")"),
+			"filter_codes":         registry.StringSchema("Status codes to drop from the results, e.g. 404,403"),
+			"rate_limit":           map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxFfufRate, "description": "Maximum requests per second"},
+			"max_duration_seconds": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": int(maxFfufDuration.Seconds()), "description": "Hard limit on the run time in seconds"},
+		}, "url"),
+		RequiredScope: targets.ScopeScan,
+		Handler:       ffufTool,
+		ServerName:    "cybersecurity",
+		ToolCategory:  "cybersecurity",
+	})
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "ffuf_results",
+		ToolTitle: "ffuf Stored Results",
+		Desc:      "Fetch stored ffuf results of the current user by scan_id and/or target URL.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"scan_id": registry.StringSchema("scan_id returned by ffuf_fuzz"),
+			"target":  registry.StringSchema("Only results whose target URL contains this text"),
+			"status":  map[string]interface{}{"type": "integer", "description": "Only results with this status code"},
+			"limit":   map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxQueryResults},
+		}),
+		RequiredScope: targets.ScopeScan,
+		Handler:       ffufResultsTool,
+		ServerName:    "cybersecurity",
+		ToolCategory:  "cybersecurity",
+	})
+}
+
+// ffufTool ffuf_fuzz 工具
+func ffufTool(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+	var req FfufRequest
+	data, _ := json.Marshal(args)
+	if err := json.Unmarshal(data, &req); err != nil {
+		return registry.ErrorResult(fmt.Sprintf("参数格式错误: %v", err)), nil
+	}
+
+	result, err := RunFfuf(ctx, mcp.UserIDFromContext(ctx), &req)
+	if err != nil {
+		return registry.ErrorResult(err.Error()), nil
+	}
+	return registry.JSONResult(result)
+}
+
+// RunFfuf 校验请求并执行 ffuf
+func RunFfuf(ctx context.Context, userID string, req *FfufRequest) (*FfufResult, error) {
+	outputFile, err := os.CreateTemp("", "ffuf-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	outputFile.Close()
+	defer os.Remove(outputFile.Name())
+
+	args, target, wordlist, duration, err := buildFfufArgs(userID, req, outputFile.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	// ffuf 自身按 -maxtime 停止，超出后再等待一段时间仍未退出时强制结束
+	ctx, cancel := context.WithTimeout(ctx, duration+30*time.Second)
+	defer cancel()
+
+	binary := os.Getenv(FfufPathEnv)
+	if binary == "" {
+		binary = "ffuf"
+	}
+	result := &FfufResult{
+		ScanID:   fmt.Sprintf("ffuf-%d", time.Now().UnixNano()),
+		Target:   target,
+		Mode:     req.Mode,
+		Wordlist: wordlist,
+		ByStatus: make(map[string]int),
+		Findings: []FfufFinding{},
+	}
+	log.Printf("ffuf scan %s started: user=%s, target=%s, args=%v", result.ScanID, userID, target, args)
+	registry.ReportProgress(ctx, fmt.Sprintf("ffuf %s started against %s", result.ScanID, target))
+
+	output, runErr := exec.CommandContext(ctx, binary, args...).CombinedOutput()
+	if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+		return nil, fmt.Errorf("扫描已取消")
+	}
+
+	data, readErr := os.ReadFile(outputFile.Name())
+	if runErr != nil && (readErr != nil || len(data) == 0) {
+		tail := strings.TrimSpace(string(output))
+		if len(tail) > 2048 {
+			tail = tail[len(tail)-2048:]
+		}
+		return nil, fmt.Errorf("ffuf执行失败: %v %s", runErr, tail)
+	}
+
+	var parsed ffufOutput
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			return nil, fmt.Errorf("解析ffuf输出失败: %v", err)
+		}
+	}
+
+	for _, r := range parsed.Results {
+		finding := FfufFinding{
+			Input:            r.Input["FUZZ"],
+			URL:              r.URL,
+			Status:           r.Status,
+			Length:           r.Length,
+			Words:            r.Words,
+			Lines:            r.Lines,
+			ContentType:      r.ContentType,
+			RedirectLocation: r.RedirectLocation,
+			DurationMs:       r.Duration / int64(time.Millisecond),
+		}
+		result.Total++
+		result.ByStatus[strconv.Itoa(finding.Status)]++
+		if len(result.Findings) < maxReturnedResults {
+			result.Findings = append(result.Findings, finding)
+		} else {
+			result.Truncated = true
+		}
+	}
+
+	stored, err := storeFfufFindings(result.ScanID, userID, req.Mode, target, parsed)
+	if err != nil {
+		log.Printf("Failed to store ffuf results of %s: %v", result.ScanID, err)
+	}
+	result.Stored = stored
+
+	if ctx.Err() == context.DeadlineExceeded || runErr != nil {
+		result.Message = fmt.Sprintf("ffuf 未正常结束（%v），返回已发现的 %d 条结果", runErr, result.Total)
+	} else {
+		result.Message = fmt.Sprintf("完成，发现 %d 条结果", result.Total)
+	}
+	log.Printf("ffuf scan %s finished: results=%d, stored=%d", result.ScanID, result.Total, result.Stored)
+	return result, nil
+}
+
+// buildFfufArgs 校验请求并生成 ffuf 参数，返回参数、目标URL、字典路径和最长运行时间
+func buildFfufArgs(userID string, req *FfufRequest, outputPath string) ([]string, string, string, time.Duration, error) {
+	fail := func(format string, a ...interface{}) ([]string, string, string, time.Duration, error) {
+		return nil, "", "", 0, fmt.Errorf(format, a...)
+	}
+
+	parsed, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fail("无效的目标URL: %s，只支持 http 和 https", req.URL)
+	}
+	if _, err := targets.Check(userID, parsed.Host); err != nil {
+		return fail("%v", err)
+	}
+
+	if req.Mode == "" {
+		req.Mode = FfufModeDirectory
+	}
+	if _, ok := defaultWordlists[req.Mode]; !ok {
+		return fail("无效的模式: %s，可选值: %s, %s", req.Mode, FfufModeDirectory, FfufModeParameter)
+	}
+
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = "GET"
+	}
+	switch method {
+	case "GET", "POST", "HEAD", "PUT", "OPTIONS":
+	default:
+		return fail("不支持的请求方法: %s", req.Method)
+	}
+
+	// 确定注入位置
+	target := parsed.String()
+	data := req.Data
+	if !strings.Contains(target, "FUZZ") && !strings.Contains(data, "FUZZ") {
+		switch req.Mode {
+		case FfufModeDirectory:
+			parsed.Path = strings.TrimRight(parsed.Path, "/") + "/FUZZ"
+			target = parsed.String()
+		case FfufModeParameter:
+			if method == "POST" || method == "PUT" {
+				data = strings.TrimLeft(data+"&FUZZ=1", "&")
+			} else {
+				query := parsed.RawQuery
+				if query != "" {
+					query += "&"
+				}
+				parsed.RawQuery = query + "FUZZ=1"
+				target = parsed.String()
+			}
+		}
+	}
+
+	// 字典只能从字典目录中选择
+	wordlistDir := os.Getenv(FfufWordlistDirEnv)
+	if wordlistDir == "" {
+		wordlistDir = defaultWordlistDir
+	}
+	wordlistName := req.Wordlist
+	if wordlistName == "" {
+		wordlistName = defaultWordlists[req.Mode]
+	}
+	wordlist := filepath.Join(wordlistDir, filepath.Clean("/"+wordlistName))
+	if info, err := os.Stat(wordlist); err != nil || info.IsDir() {
+		return fail("字典不存在: %s", wordlistName)
+	}
+
+	matchCodes := req.MatchCodes
+	if matchCodes == "" {
+		matchCodes = defaultMatchCodes
+	}
+	if !statusCodesPattern.MatchString(matchCodes) {
+		return fail("无效的 match_codes: %s", matchCodes)
+	}
+	if req.FilterCodes != "" && !statusCodesPattern.MatchString(req.FilterCodes) {
+		return fail("无效的 filter_codes: %s", req.FilterCodes)
+	}
+
+	rate := req.RateLimit
+	if rate <= 0 {
+		rate = defaultFfufRate
+	}
+	if rate > maxFfufRate {
+		rate = maxFfufRate
+	}
+	duration := defaultFfufDuration
+	if req.MaxDurationSeconds > 0 {
+		duration = time.Duration(req.MaxDurationSeconds) * time.Second
+	}
+	if duration > maxFfufDuration {
+		duration = maxFfufDuration
+	}
+
+	args := []string{
+		"-u", target,
+		"-w", wordlist,
+		"-X", method,
+		"-mc", matchCodes,
+		"-rate", strconv.Itoa(rate),
+		"-maxtime", strconv.Itoa(int(duration.Seconds())),
+		"-o", outputPath,
+		"-of", "json",
+		"-s",
+		"-noninteractive",
+	}
+	if req.FilterCodes != "" {
+		args = append(args, "-fc", req.FilterCodes)
+	}
+	if data != "" {
+		args = append(args, "-d", data, "-H", "Content-Type: application/x-www-form-urlencoded")
+	}
+	return args, target, wordlistName, duration, nil
+}
+
+var (
+	resultsService     *datahandle.CommonReadWriteService
+	resultsServiceOnce sync.Once
+)
+
+// getResultsService 获取 storagebox 数据服务
+func getResultsService() *datahandle.CommonReadWriteService {
+	resultsServiceOnce.Do(func() {
+		service, err := datahandle.NewCommonReadWriteService("storagebox")
+		if err != nil {
+			log.Printf("Failed to create storagebox data service for ffuf: %v", err)
+			return
+		}
+		resultsService = service
+	})
+	return resultsService
+}
+
+// storeFfufFindings 把全部结果写入 storagebox（包括没有返回给模型的部分），返回写入的数量
+func storeFfufFindings(scanID, userID, mode, target string, parsed ffufOutput) (int, error) {
+	service := getResultsService()
+	if service == nil {
+		return 0, fmt.Errorf("storagebox 数据服务不可用")
+	}
+
+	stored := 0
+	for _, r := range parsed.Results {
+		result := service.ExecuteDb(`
+			INSERT INTO web_fuzz_results
+				(scan_id, user_id, tool, mode, target, input, url, status, length, words, lines,
+				 content_type, redirect_location, created_at)
+			VALUES (?, ?, 'ffuf', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+		`, scanID, userID, mode, target, r.Input["FUZZ"], r.URL, r.Status, r.Length, r.Words, r.Lines,
+			r.ContentType, r.RedirectLocation)
+		if !result.IsSuccess() {
+			return stored, fmt.Errorf("写入 web_fuzz_results 失败: %v", result.Error)
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+// ffufResultsTool ffuf_results 工具：查询当前用户保存的结果
+func ffufResultsTool(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+	service := getResultsService()
+	if service == nil {
+		return registry.ErrorResult("storagebox 数据服务不可用"), nil
+	}
+
+	query := `
+		SELECT scan_id, mode, target, input, url, status, length, words, lines, content_type, redirect_location, created_at
+		FROM web_fuzz_results
+		WHERE user_id = ?`
+	params := []interface{}{mcp.UserIDFromContext(ctx)}
+	if scanID, _ := args["scan_id"].(string); scanID != "" {
+		query += " AND scan_id = ?"
+		params = append(params, scanID)
+	}
+	if target, _ := args["target"].(string); target != "" {
+		query += " AND target LIKE ?"
+		params = append(params, "%"+target+"%")
+	}
+	if status, ok := args["status"].(float64); ok {
+		query += " AND status = ?"
+		params = append(params, int(status))
+	}
+	limit := 100
+	if l, ok := args["limit"].(float64); ok && l > 0 {
+		limit = int(l)
+	}
+	if limit > maxQueryResults {
+		limit = maxQueryResults
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
+	result := service.QueryDb(query, params...)
+	if !result.IsSuccess() {
+		return registry.ErrorResult(fmt.Sprintf("查询 web_fuzz_results 失败: %v", result.Error)), nil
+	}
+	rows, _ := result.Data.([]map[string]interface{})
+	for _, row := range rows {
+		for key, value := range row {
+			if b, ok := value.([]byte); ok {
+				row[key] = string(b)
+			}
+		}
+	}
+	if rows == nil {
+		rows = []map[string]interface{}{}
+	}
+	return registry.JSONResult(map[string]interface{}{
+		"count":   len(rows),
+		"results": rows,
+	})
+}
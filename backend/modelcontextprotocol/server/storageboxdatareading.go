@@ -2,15 +2,40 @@ package server
 
 // 数据读取MCP服务器
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 
+	"digitalsingularity/backend/modelcontextprotocol/registry"
+	"digitalsingularity/backend/silicoid/mcp"
 	_ "github.com/go-sql-driver/mysql"
 )
 
+func init() {
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "storagebox_data_reading",
+		ToolTitle: "Storagebox Data Reading",
+		Desc:      "Run a read-only SELECT query against the storagebox database and return the rows.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"query": registry.StringSchema("SELECT statement to execute"),
+		}, "query"),
+		RequiredScope: ScopeStorageboxRead,
+		Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+			query, _ := args["query"].(string)
+			return registry.CallHTTPHandler(ctx, StorageboxDataReading, http.MethodGet, "/mcp/storagebox-data-reading", url.Values{"query": {query}}, nil), nil
+		},
+		ServerName:   "storagebox",
+		ToolCategory: "storagebox",
+		RESTPath:     "/mcp/storagebox-data-reading",
+		RESTMethods:  []string{"GET", "OPTIONS"},
+		RESTHandler:  StorageboxDataReading,
+	})
+}
+
 
 // StorageboxDataReadingResponse Storagebox数据读取响应结构
 type StorageboxDataReadingResponse struct {
@@ -2,6 +2,7 @@ package server
 
 // Storagebox IP存储MCP服务器
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -11,10 +12,80 @@ import (
 	"strings"
 
 	"digitalsingularity/backend/common/utils/datahandle"
+	"digitalsingularity/backend/modelcontextprotocol/registry"
 	"digitalsingularity/backend/modelcontextprotocol/server/cybersecurity/network"
+	"digitalsingularity/backend/silicoid/mcp"
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// storagebox 工具所需的权限范围
+const (
+	ScopeStorageboxRead  = "storagebox:read"
+	ScopeStorageboxWrite = "storagebox:write"
+)
+
+// init 注册 storagebox 存储工具，三个工具共用 /mcp/storagebox-ip-storage 路由（由第一个工具声明，按写入权限校验）
+func init() {
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "mcp_storagebox_ip_address",
+		ToolTitle: "Store IP Addresses",
+		Desc:      "Scan the given IPv4 addresses for open ports and store the addresses and discovered ports in storagebox.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"ip":          registry.ArraySchema("IPv4 addresses to store", registry.StringSchema("")),
+			"description": registry.StringSchema("Description saved with the addresses"),
+		}, "ip"),
+		RequiredScope: ScopeStorageboxWrite,
+		Handler:       storageboxTool("mcp_storagebox_ip_address"),
+		ServerName:    "storagebox",
+		ToolCategory:  "storagebox",
+		RESTPath:      "/mcp/storagebox-ip-storage",
+		RESTMethods:   []string{"POST", "OPTIONS"},
+		RESTHandler:   StorageboxIPStorage,
+	})
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "mcp_storagebox_ip_port",
+		ToolTitle: "Store IP Ports",
+		Desc:      "Store IPv4 address and port combinations in storagebox, together with other open ports found by a scan.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"ip_port_list": registry.ArraySchema("IP addresses and their ports", registry.ObjectSchema(map[string]interface{}{
+				"ip":    registry.StringSchema("IPv4 address"),
+				"ports": registry.ArraySchema("", registry.StringSchema("")),
+			}, "ip", "ports")),
+			"service": registry.StringSchema("Service name saved with the ports"),
+		}, "ip_port_list"),
+		RequiredScope: ScopeStorageboxWrite,
+		Handler:       storageboxTool("mcp_storagebox_ip_port"),
+		ServerName:    "storagebox",
+		ToolCategory:  "storagebox",
+	})
+	registry.Register(&registry.ToolSpec{
+		ToolName:  "mcp_query_storagebox_data",
+		ToolTitle: "Query Storagebox Data",
+		Desc:      "Run a read-only SELECT query against the storagebox database.",
+		Schema: registry.ObjectSchema(map[string]interface{}{
+			"query": registry.StringSchema("SELECT statement to execute"),
+		}, "query"),
+		RequiredScope: ScopeStorageboxRead,
+		Handler:       storageboxTool("mcp_query_storagebox_data"),
+		ServerName:    "storagebox",
+		ToolCategory:  "storagebox",
+	})
+}
+
+// storageboxTool 按 /mcp/storagebox-ip-storage 的请求格式调用 storagebox 存储工具
+func storageboxTool(name string) func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+		body := map[string]interface{}{
+			"id": "mcp",
+			"params": map[string]interface{}{
+				"name":      name,
+				"arguments": args,
+			},
+		}
+		return registry.CallHTTPHandler(ctx, StorageboxIPStorage, http.MethodPost, "/mcp/storagebox-ip-storage", nil, body), nil
+	}
+}
+
 // StorageboxDataService 处理Storagebox相关的数据服务
 // 参考 backend/silicoid/database/service.go 的设计模式
 type StorageboxDataService struct {
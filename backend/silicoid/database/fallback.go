@@ -0,0 +1,46 @@
+package database
+
+import (
+	"fmt"
+	"log"
+)
+
+// GetModelFallbackChain 获取模型的降级链（按降级模型的 priority 升序排列）
+// 降级链配置在 model_fallback_chains 表中：model_code -> fallback_model_code
+// 只返回启用状态的降级配置，且降级模型本身也必须是启用状态
+func (s *SilicoidDataService) GetModelFallbackChain(modelCode string) ([]string, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("获取模型降级链异常: %v", r)
+		}
+	}()
+
+	query := fmt.Sprintf(`
+		SELECT f.fallback_model_code
+		FROM %s.model_fallback_chains f
+		JOIN %s.silicoid_models m ON f.fallback_model_code = m.model_code
+		WHERE f.model_code = ? AND f.status = 1 AND m.status = 1
+		GROUP BY f.fallback_model_code
+		ORDER BY MIN(m.priority) ASC, MIN(f.id) ASC
+	`, s.dbName, s.dbName)
+
+	opResult := s.readWrite.QueryDb(query, modelCode)
+	if !opResult.IsSuccess() {
+		return nil, fmt.Errorf("查询模型降级链失败: %v", opResult.Error)
+	}
+
+	rows, ok := opResult.Data.([]map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("查询结果格式错误")
+	}
+
+	chain := make([]string, 0, len(rows))
+	for _, row := range rows {
+		fallbackCode := getStringValue(row["fallback_model_code"])
+		if fallbackCode != "" && fallbackCode != modelCode {
+			chain = append(chain, fallbackCode)
+		}
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// BillingLedgerEntry 计费流水记录
+type BillingLedgerEntry struct {
+	RequestID        string  `json:"request_id"`
+	UserID           string  `json:"user_id"`
+	APIKeyID         int     `json:"api_key_id"` // 用户调用时使用的平台认证 Key 的ID，使用 auth_token 调用时为0
+	ModelCode        string  `json:"model_code"`
+	KeyID            int     `json:"key_id"` // 平台API密钥ID，未知时为0
+	PromptTokens     int     `json:"prompt_tokens"`
+	CachedTokens     int     `json:"cached_tokens"`
+	CacheWriteTokens int     `json:"cache_write_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostPer1kInput   float64 `json:"cost_per_1k_input"`
+	CostPer1kOutput  float64 `json:"cost_per_1k_output"`
+	Amount           int     `json:"amount"` // 实际扣除的令牌数
+}
+
+// InsertBillingLedger 写入一条计费流水到 billing_ledger 表
+// api_key_id 为用户平台认证 Key 在 aibasicplatform_user_api_keys 中的ID，使用 auth_token 调用时为0
+func (s *SilicoidDataService) InsertBillingLedger(entry *BillingLedgerEntry) error {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("写入计费流水异常: %v", r)
+		}
+	}()
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s.billing_ledger
+		(request_id, user_id, api_key_id, model_code, key_id, prompt_tokens, cached_tokens, cache_write_tokens,
+		 completion_tokens, cost_per_1k_input, cost_per_1k_output, amount, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`, s.dbName)
+
+	opResult := s.readWrite.ExecuteDb(query,
+		entry.RequestID, entry.UserID, entry.APIKeyID, entry.ModelCode, entry.KeyID,
+		entry.PromptTokens, entry.CachedTokens, entry.CacheWriteTokens, entry.CompletionTokens,
+		entry.CostPer1kInput, entry.CostPer1kOutput, entry.Amount)
+	if !opResult.IsSuccess() {
+		return fmt.Errorf("写入计费流水失败: %v", opResult.Error)
+	}
+
+	return nil
+}
+
+// 用量统计维度
+const (
+	UsageGroupByDay    = "day"
+	UsageGroupByModel  = "model"
+	UsageGroupByAPIKey = "api_key"
+)
+
+// usageGroupColumns 统计维度对应的分组表达式
+var usageGroupColumns = map[string]string{
+	UsageGroupByDay:    "DATE(l.created_at)",
+	UsageGroupByModel:  "l.model_code",
+	UsageGroupByAPIKey: "l.api_key_id",
+}
+
+// UsageQuery 用量查询条件
+type UsageQuery struct {
+	UserID    string
+	StartTime time.Time // 包含
+	EndTime   time.Time // 不包含
+	Limit     int       // 0 表示不分页
+	Offset    int
+}
+
+// where 构造用量查询的 WHERE 条件
+func (q *UsageQuery) where() (string, []interface{}) {
+	clause := "l.user_id = ?"
+	params := []interface{}{q.UserID}
+	if !q.StartTime.IsZero() {
+		clause += " AND l.created_at >= ?"
+		params = append(params, q.StartTime)
+	}
+	if !q.EndTime.IsZero() {
+		clause += " AND l.created_at < ?"
+		params = append(params, q.EndTime)
+	}
+	return clause, params
+}
+
+// pagination 构造分页子句
+func (q *UsageQuery) pagination() (string, []interface{}) {
+	if q.Limit <= 0 {
+		return "", nil
+	}
+	return " LIMIT ? OFFSET ?", []interface{}{q.Limit, q.Offset}
+}
+
+// QueryUsageSummary 按维度（day / model / api_key）汇总用户的用量
+// 返回：当前页的汇总行，维度取值总数，错误
+func (s *SilicoidDataService) QueryUsageSummary(groupBy string, q *UsageQuery) ([]map[string]interface{}, int, error) {
+	groupColumn, ok := usageGroupColumns[groupBy]
+	if !ok {
+		return nil, 0, fmt.Errorf("不支持的统计维度: %s", groupBy)
+	}
+	where, params := q.where()
+
+	countQuery := fmt.Sprintf(`
+		SELECT COUNT(DISTINCT %s) AS total
+		FROM %s.billing_ledger l
+		WHERE %s
+	`, groupColumn, s.dbName, where)
+	countResult := s.readWrite.QueryDb(countQuery, params...)
+	if !countResult.IsSuccess() {
+		return nil, 0, fmt.Errorf("查询用量统计失败: %v", countResult.Error)
+	}
+	total := 0
+	if rows, ok := countResult.Data.([]map[string]interface{}); ok && len(rows) > 0 {
+		total = getIntValue(rows[0]["total"])
+	}
+
+	// 按 API Key 统计时附带 Key 的描述，便于前端展示
+	selectExtra := ""
+	join := ""
+	if groupBy == UsageGroupByAPIKey {
+		selectExtra = ", MAX(k.description) AS api_key_description"
+		join = "LEFT JOIN aibasicplatform.aibasicplatform_user_api_keys k ON k.id = l.api_key_id"
+	}
+	orderBy := "amount DESC"
+	if groupBy == UsageGroupByDay {
+		orderBy = "dimension DESC"
+	}
+
+	page, pageParams := q.pagination()
+	query := fmt.Sprintf(`
+		SELECT %s AS dimension,
+		       COUNT(*) AS requests,
+		       SUM(l.prompt_tokens) AS prompt_tokens,
+		       SUM(l.cached_tokens) AS cached_tokens,
+		       SUM(l.completion_tokens) AS completion_tokens,
+		       SUM(l.amount) AS amount%s
+		FROM %s.billing_ledger l
+		%s
+		WHERE %s
+		GROUP BY dimension
+		ORDER BY %s%s
+	`, groupColumn, selectExtra, s.dbName, join, where, orderBy, page)
+
+	opResult := s.readWrite.QueryDb(query, append(params, pageParams...)...)
+	if !opResult.IsSuccess() {
+		return nil, 0, fmt.Errorf("查询用量统计失败: %v", opResult.Error)
+	}
+	rows, ok := opResult.Data.([]map[string]interface{})
+	if !ok {
+		return []map[string]interface{}{}, total, nil
+	}
+
+	result := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		dimension := row["dimension"]
+		if t, ok := dimension.(time.Time); ok {
+			dimension = t.Format("2006-01-02")
+		}
+		item := map[string]interface{}{
+			groupBy:             dimension,
+			"requests":          getIntValue(row["requests"]),
+			"prompt_tokens":     getSumValue(row["prompt_tokens"]),
+			"cached_tokens":     getSumValue(row["cached_tokens"]),
+			"completion_tokens": getSumValue(row["completion_tokens"]),
+			"amount":            getSumValue(row["amount"]),
+		}
+		if groupBy == UsageGroupByAPIKey {
+			item["api_key_id"] = getIntValue(row["dimension"])
+			item["api_key_description"] = getStringValue(row["api_key_description"])
+			delete(item, groupBy)
+		}
+		result = append(result, item)
+	}
+	return result, total, nil
+}
+
+// QueryBillingLedger 查询用户的计费流水明细（按时间倒序）
+// 返回：当前页的流水记录，记录总数，错误
+func (s *SilicoidDataService) QueryBillingLedger(q *UsageQuery) ([]map[string]interface{}, int, error) {
+	where, params := q.where()
+
+	countQuery := fmt.Sprintf(`
+		SELECT COUNT(*) AS total
+		FROM %s.billing_ledger l
+		WHERE %s
+	`, s.dbName, where)
+	countResult := s.readWrite.QueryDb(countQuery, params...)
+	if !countResult.IsSuccess() {
+		return nil, 0, fmt.Errorf("查询计费流水失败: %v", countResult.Error)
+	}
+	total := 0
+	if rows, ok := countResult.Data.([]map[string]interface{}); ok && len(rows) > 0 {
+		total = getIntValue(rows[0]["total"])
+	}
+
+	page, pageParams := q.pagination()
+	query := fmt.Sprintf(`
+		SELECT l.request_id, l.model_code, l.api_key_id, l.prompt_tokens, l.cached_tokens,
+		       l.completion_tokens, l.amount, l.created_at
+		FROM %s.billing_ledger l
+		WHERE %s
+		ORDER BY l.created_at DESC, l.id DESC%s
+	`, s.dbName, where, page)
+
+	opResult := s.readWrite.QueryDb(query, append(params, pageParams...)...)
+	if !opResult.IsSuccess() {
+		return nil, 0, fmt.Errorf("查询计费流水失败: %v", opResult.Error)
+	}
+	rows, ok := opResult.Data.([]map[string]interface{})
+	if !ok {
+		return []map[string]interface{}{}, total, nil
+	}
+
+	result := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		createdAt := row["created_at"]
+		if t, ok := createdAt.(time.Time); ok {
+			createdAt = t.Format("2006-01-02 15:04:05")
+		}
+		result = append(result, map[string]interface{}{
+			"request_id":        getStringValue(row["request_id"]),
+			"model_code":        getStringValue(row["model_code"]),
+			"api_key_id":        getIntValue(row["api_key_id"]),
+			"prompt_tokens":     getIntValue(row["prompt_tokens"]),
+			"cached_tokens":     getIntValue(row["cached_tokens"]),
+			"completion_tokens": getIntValue(row["completion_tokens"]),
+			"amount":            getIntValue(row["amount"]),
+			"created_at":        createdAt,
+		})
+	}
+	return result, total, nil
+}
+
+// getSumValue SUM() 的结果由驱动以 DECIMAL 字符串返回，转换为整数
+func getSumValue(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseFloat(v, 64)
+		return int64(n)
+	}
+	return 0
+}
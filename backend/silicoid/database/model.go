@@ -48,17 +48,24 @@ func (s *SilicoidDataService) GetModelConfigByCode(modelCode string) (map[string
 		}
 	}()
 
-	query := fmt.Sprintf(`
+	queryColumns := func(columns string) string {
+		return fmt.Sprintf(`
 		SELECT id, model_code, endpoint, models_endpoint, base_url, upload_base_url,
 		       model_type, provider, status, priority, max_tokens,
-		       cost_per_1k_input, cost_per_1k_output
+		       %s
 		FROM %s.silicoid_models
 		WHERE model_code = ? AND status = 1
 		ORDER BY id DESC
 		LIMIT 1
-	`, s.dbName)
+	`, columns, s.dbName)
+	}
 
-	opResult := s.readWrite.QueryDb(query, modelCode)
+	opResult := s.readWrite.QueryDb(queryColumns("cost_per_1k_input, cost_per_1k_output, cached_input_ratio, cache_write_ratio"), modelCode)
+	if !opResult.IsSuccess() && isUnknownColumnError(opResult.Error) {
+		// 尚未添加缓存价格列的库按原来的列查询，缓存价格使用默认比例
+		log.Printf("⚠️ silicoid_models 缺少 cached_input_ratio / cache_write_ratio 列，缓存价格使用默认比例: %v", opResult.Error)
+		opResult = s.readWrite.QueryDb(queryColumns("cost_per_1k_input, cost_per_1k_output"), modelCode)
+	}
 	if !opResult.IsSuccess() {
 		return nil, fmt.Errorf("查询模型配置失败: %v", opResult.Error)
 	}
@@ -113,6 +120,11 @@ func (s *SilicoidDataService) GetModelConfigByCode(modelCode string) (map[string
 	return row, nil
 }
 
+// isUnknownColumnError 是否为查询了不存在的列的错误（MySQL 1054）
+func isUnknownColumnError(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "Error 1054") || strings.Contains(err.Error(), "Unknown column"))
+}
+
 // GetAllModels 获取所有启用的模型列表
 func (s *SilicoidDataService) GetAllModels() ([]map[string]interface{}, error) {
 	defer func() {
@@ -294,6 +306,39 @@ func (s *SilicoidDataService) FindModelCodeByModelName(modelName string) (string
 	return "", fmt.Errorf("未找到对应的 model_code: %s", modelName)
 }
 
+// GetContextWindowByModelName 通过 model_name 查找模型的上下文窗口（提供商模型表同步的 context_window）
+func (s *SilicoidDataService) GetContextWindowByModelName(modelName string) (int, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("查找模型上下文窗口异常: %v", r)
+		}
+	}()
+
+	for _, tableName := range []string{
+		"models_anthropic", "models_openai", "models_deepseek", "models_moonshot", "models_xai", "models_meta",
+		"models_digitalsingularity", "models_bytedance", "models_google", "models_alibaba", "models_openrouter",
+	} {
+		query := fmt.Sprintf(`
+			SELECT context_window
+			FROM %s.%s
+			WHERE model_name = ? AND is_available = 1 AND context_window IS NOT NULL
+			LIMIT 1
+		`, s.dbName, tableName)
+
+		opResult := s.readWrite.QueryDb(query, modelName)
+		if !opResult.IsSuccess() {
+			continue
+		}
+		if rows, ok := opResult.Data.([]map[string]interface{}); ok && len(rows) > 0 {
+			if contextWindow := getIntValue(rows[0]["context_window"]); contextWindow > 0 {
+				return contextWindow, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("未找到模型 %s 的上下文窗口", modelName)
+}
+
 // GetAllProviderModelsFromAllProviders 获取所有公司模型表中的所有可用模型
 func (s *SilicoidDataService) GetAllProviderModelsFromAllProviders() ([]map[string]interface{}, error) {
 	defer func() {
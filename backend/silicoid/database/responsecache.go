@@ -0,0 +1,70 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// defaultResponseCacheRole 未单独配置的角色使用 role_name = '*' 的默认策略
+const defaultResponseCacheRole = "*"
+
+// ResponseCachePolicy 角色的响应缓存策略
+type ResponseCachePolicy struct {
+	RoleName   string `json:"role_name"`
+	Enabled    bool   `json:"enabled"`     // 精确匹配缓存（temperature=0 的请求）开关
+	TTLSeconds int    `json:"ttl_seconds"` // 缓存有效期（秒），0 表示使用默认有效期
+	// SemanticThreshold 语义缓存的余弦相似度阈值（0~1），0 表示不启用语义缓存
+	SemanticThreshold float64 `json:"semantic_threshold"`
+}
+
+// GetResponseCachePolicy 获取角色的响应缓存策略
+// 策略配置在 response_cache_policies 表中：role_name -> enabled, ttl_seconds, semantic_threshold
+// 角色没有单独配置时使用 role_name = '*' 的默认策略，都没有配置时返回未启用的策略
+func (s *SilicoidDataService) GetResponseCachePolicy(roleName string) (*ResponseCachePolicy, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("获取响应缓存策略异常: %v", r)
+		}
+	}()
+
+	query := fmt.Sprintf(`
+		SELECT role_name, enabled, ttl_seconds, semantic_threshold
+		FROM %s.response_cache_policies
+		WHERE role_name IN (?, ?)
+		ORDER BY role_name = ? ASC
+		LIMIT 1
+	`, s.dbName)
+
+	opResult := s.readWrite.QueryDb(query, roleName, defaultResponseCacheRole, defaultResponseCacheRole)
+	if !opResult.IsSuccess() {
+		return nil, fmt.Errorf("查询响应缓存策略失败: %v", opResult.Error)
+	}
+
+	policy := &ResponseCachePolicy{RoleName: roleName}
+	rows, ok := opResult.Data.([]map[string]interface{})
+	if !ok || len(rows) == 0 {
+		return policy, nil
+	}
+
+	policy.Enabled = getIntValue(rows[0]["enabled"]) == 1
+	policy.TTLSeconds = getIntValue(rows[0]["ttl_seconds"])
+	policy.SemanticThreshold = getDecimalValue(rows[0]["semantic_threshold"])
+	return policy, nil
+}
+
+// getDecimalValue DECIMAL 字段由驱动以字符串返回，转换为浮点数
+func getDecimalValue(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"fmt"
+	"log"
+)
+
+// defaultToolLoopRole 未单独配置的角色使用 role_name = '*' 的默认限制
+const defaultToolLoopRole = "*"
+
+// ToolLoopPolicy 角色的服务端工具循环限制（0 表示使用默认值或不限制）
+type ToolLoopPolicy struct {
+	RoleName          string `json:"role_name"`
+	MaxToolIterations int    `json:"max_tool_iterations"` // 最多执行的工具调用轮数
+	MaxToolSeconds    int    `json:"max_tool_seconds"`    // 工具执行的累计耗时上限（秒）
+	MaxLoopTokens     int    `json:"max_loop_tokens"`     // 循环中模型调用累计消耗的 token 上限
+}
+
+// GetToolLoopPolicy 获取角色的服务端工具循环限制
+// 限制配置在 tool_loop_policies 表中：role_name -> max_tool_iterations, max_tool_seconds, max_loop_tokens
+// 角色没有单独配置时使用 role_name = '*' 的默认限制，都没有配置时返回全 0 的限制
+func (s *SilicoidDataService) GetToolLoopPolicy(roleName string) (*ToolLoopPolicy, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("获取工具循环限制异常: %v", r)
+		}
+	}()
+
+	query := fmt.Sprintf(`
+		SELECT role_name, max_tool_iterations, max_tool_seconds, max_loop_tokens
+		FROM %s.tool_loop_policies
+		WHERE role_name IN (?, ?)
+		ORDER BY role_name = ? ASC
+		LIMIT 1
+	`, s.dbName)
+
+	opResult := s.readWrite.QueryDb(query, roleName, defaultToolLoopRole, defaultToolLoopRole)
+	if !opResult.IsSuccess() {
+		return nil, fmt.Errorf("查询工具循环限制失败: %v", opResult.Error)
+	}
+
+	policy := &ToolLoopPolicy{RoleName: roleName}
+	rows, ok := opResult.Data.([]map[string]interface{})
+	if !ok || len(rows) == 0 {
+		return policy, nil
+	}
+
+	policy.MaxToolIterations = getIntValue(rows[0]["max_tool_iterations"])
+	policy.MaxToolSeconds = getIntValue(rows[0]["max_tool_seconds"])
+	policy.MaxLoopTokens = getIntValue(rows[0]["max_loop_tokens"])
+	return policy, nil
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"fmt"
+	"log"
+)
+
+// defaultToolSessionTool 未单独配置的工具使用 tool_name = '*' 的默认有效期
+const defaultToolSessionTool = "*"
+
+// 工具调用会话的状态
+const (
+	ToolSessionPending   = "pending"   // 等待客户端回传执行结果
+	ToolSessionCompleted = "completed" // 已返回最终回答
+	ToolSessionCancelled = "cancelled" // 客户端已取消
+)
+
+// ToolSessionPolicy 工具调用会话的有效期配置（0 表示使用默认值）
+type ToolSessionPolicy struct {
+	ToolName   string `json:"tool_name"`
+	TTLSeconds int    `json:"ttl_seconds"` // 等待客户端回传结果的最长时间（秒）
+}
+
+// ToolCallSession 持久化的工具调用会话（长时间等待客户端结果的会话在 Redis 过期或丢失后从这里恢复）
+type ToolCallSession struct {
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	Status    string `json:"status"`
+	Context   string `json:"context"`    // 会话上下文（JSON）
+	ExpiresAt int64  `json:"expires_at"` // 过期时间（Unix 秒）
+}
+
+// GetToolSessionPolicy 获取工具调用会话的有效期配置
+// 配置在 tool_session_policies 表中：tool_name -> ttl_seconds
+// 工具没有单独配置时使用 tool_name = '*' 的默认配置，都没有配置时返回 0
+func (s *SilicoidDataService) GetToolSessionPolicy(toolName string) (*ToolSessionPolicy, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("获取工具会话有效期异常: %v", r)
+		}
+	}()
+
+	query := fmt.Sprintf(`
+		SELECT tool_name, ttl_seconds
+		FROM %s.tool_session_policies
+		WHERE tool_name IN (?, ?)
+		ORDER BY tool_name = ? ASC
+		LIMIT 1
+	`, s.dbName)
+
+	opResult := s.readWrite.QueryDb(query, toolName, defaultToolSessionTool, defaultToolSessionTool)
+	if !opResult.IsSuccess() {
+		return nil, fmt.Errorf("查询工具会话有效期失败: %v", opResult.Error)
+	}
+
+	policy := &ToolSessionPolicy{ToolName: toolName}
+	rows, ok := opResult.Data.([]map[string]interface{})
+	if !ok || len(rows) == 0 {
+		return policy, nil
+	}
+
+	policy.TTLSeconds = getIntValue(rows[0]["ttl_seconds"])
+	return policy, nil
+}
+
+// SaveToolCallSession 写入或覆盖工具调用会话（tool_call_sessions 表，session_id 为主键）
+func (s *SilicoidDataService) SaveToolCallSession(session *ToolCallSession) error {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("保存工具调用会话异常: %v", r)
+		}
+	}()
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s.tool_call_sessions
+		(session_id, user_id, status, context, expires_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE
+		user_id = VALUES(user_id), status = VALUES(status), context = VALUES(context),
+		expires_at = VALUES(expires_at), updated_at = NOW()
+	`, s.dbName)
+
+	opResult := s.readWrite.ExecuteDb(query,
+		session.SessionID, session.UserID, session.Status, session.Context, session.ExpiresAt)
+	if !opResult.IsSuccess() {
+		return fmt.Errorf("保存工具调用会话失败: %v", opResult.Error)
+	}
+	return nil
+}
+
+// GetToolCallSession 获取工具调用会话，不存在时返回 nil
+func (s *SilicoidDataService) GetToolCallSession(sessionID string) (*ToolCallSession, error) {
+	query := fmt.Sprintf(`
+		SELECT session_id, user_id, status, context, expires_at
+		FROM %s.tool_call_sessions
+		WHERE session_id = ?
+		LIMIT 1
+	`, s.dbName)
+
+	opResult := s.readWrite.QueryDb(query, sessionID)
+	if !opResult.IsSuccess() {
+		return nil, fmt.Errorf("查询工具调用会话失败: %v", opResult.Error)
+	}
+
+	rows, ok := opResult.Data.([]map[string]interface{})
+	if !ok || len(rows) == 0 {
+		return nil, nil
+	}
+
+	return &ToolCallSession{
+		SessionID: getStringValue(rows[0]["session_id"]),
+		UserID:    getStringValue(rows[0]["user_id"]),
+		Status:    getStringValue(rows[0]["status"]),
+		Context:   getStringValue(rows[0]["context"]),
+		ExpiresAt: int64(getIntValue(rows[0]["expires_at"])),
+	}, nil
+}
+
+// UpdateToolCallSessionStatus 更新工具调用会话的状态
+func (s *SilicoidDataService) UpdateToolCallSessionStatus(sessionID string, status string) error {
+	query := fmt.Sprintf(`
+		UPDATE %s.tool_call_sessions
+		SET status = ?, updated_at = NOW()
+		WHERE session_id = ?
+	`, s.dbName)
+
+	opResult := s.readWrite.ExecuteDb(query, status, sessionID)
+	if !opResult.IsSuccess() {
+		return fmt.Errorf("更新工具调用会话状态失败: %v", opResult.Error)
+	}
+	return nil
+}
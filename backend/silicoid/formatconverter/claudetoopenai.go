@@ -15,6 +15,9 @@ func (s *SilicoidFormatConverterService) ResponseClaudeToOpenAI(claudeResponse m
 
 	// 获取Claude Messages API响应中的内容
 	content := ""
+	// thinking 内容块连同签名原样保留，回传给 Claude 时需要签名校验
+	var thinkingBlocks []interface{}
+	var reasoning []string
 	// 从content列表中获取文本内容
 	if contentList, ok := claudeResponse["content"].([]interface{}); ok {
 		for _, item := range contentList {
@@ -22,15 +25,27 @@ func (s *SilicoidFormatConverterService) ResponseClaudeToOpenAI(claudeResponse m
 			if !ok {
 				continue
 			}
-			if itemMap["type"] == "text" {
-				content, _ = itemMap["text"].(string)
-				break
+			switch itemMap["type"] {
+			case "text":
+				if content == "" {
+					content, _ = itemMap["text"].(string)
+				}
+			case "thinking", "redacted_thinking":
+				thinkingBlocks = append(thinkingBlocks, itemMap)
+				if thinking, _ := itemMap["thinking"].(string); thinking != "" {
+					reasoning = append(reasoning, thinking)
+				}
 			}
 		}
 	}
 
 	// 获取模型和stop_reason
 	stopReason, _ := claudeResponse["stop_reason"].(string)
+	// 结构化输出工具的参数即回答内容，按普通文本回复返回
+	if structured, ok := claudeStructuredOutput(claudeResponse); ok {
+		content = structured
+		stopReason = ""
+	}
 	model, _ := claudeResponse["model"].(string)
 
 	// 构建OpenAI格式的响应
@@ -42,6 +57,12 @@ func (s *SilicoidFormatConverterService) ResponseClaudeToOpenAI(claudeResponse m
 		"role":    "assistant",
 		"content": content,
 	}
+	if len(thinkingBlocks) > 0 {
+		choiceMessage["thinking_blocks"] = thinkingBlocks
+		if len(reasoning) > 0 {
+			choiceMessage["reasoning_content"] = strings.Join(reasoning, "\n")
+		}
+	}
 
 	// 如果存在工具调用，添加到消息中
 	if toolCalls, ok := claudeResponse["tool_calls"].([]interface{}); ok && len(toolCalls) > 0 {
@@ -107,11 +128,9 @@ func (s *SilicoidFormatConverterService) ResponseClaudeToOpenAI(claudeResponse m
 	if usageData, ok := claudeResponse["usage"].(map[string]interface{}); ok {
 		inputTokens, _ := usageData["input_tokens"].(float64)
 		outputTokens, _ := usageData["output_tokens"].(float64)
-		usage = map[string]interface{}{
-			"prompt_tokens":     int(inputTokens),
-			"completion_tokens": int(outputTokens),
-			"total_tokens":      int(inputTokens + outputTokens),
-		}
+		cacheReadTokens, _ := usageData["cache_read_input_tokens"].(float64)
+		cacheCreationTokens, _ := usageData["cache_creation_input_tokens"].(float64)
+		usage = claudeUsageToOpenAI(int(inputTokens), int(cacheReadTokens), int(cacheCreationTokens), int(outputTokens))
 	}
 
 	// 最终构建OpenAI响应
@@ -142,72 +161,459 @@ func (s *SilicoidFormatConverterService) ResponseClaudeToOpenAI(claudeResponse m
 }
 
 // HandleResponseClaudeStream 处理Claude Messages API流式响应并转换为OpenAI流式格式
+// claudeStream 为 ClaudeService.CreateChatCompletionStream 返回的事件通道（每个元素是一条 Claude 事件 JSON）
+// 输出为 OpenAI SSE 格式（data: {...}\n\n），以 data: [DONE]\n\n 结束
 func (s *SilicoidFormatConverterService) HandleResponseClaudeStream(claudeStream interface{}) (chan string, error) {
+	var events <-chan string
+	switch ch := claudeStream.(type) {
+	case chan string:
+		events = ch
+	case <-chan string:
+		events = ch
+	default:
+		return nil, fmt.Errorf("不支持的Claude流类型: %T", claudeStream)
+	}
+
 	responseID := fmt.Sprintf("chatcmpl-%s", strings.ReplaceAll(uuid.New().String(), "-", ""))
 	currentTime := int(time.Now().Unix())
 	stream := make(chan string)
 
-	// Go协程处理流式数据
 	go func() {
 		defer close(stream)
 
-		// 实际实现需要根据Claude的流式接口进行适配
-		// 这里只是一个基本框架
-		// 以下是将Claude的事件转换为OpenAI格式的处理逻辑
-
-		// 示例：当收到Claude事件时
-		/*
-		   处理每个事件，将其转换为OpenAI格式
-		   例如：
-		   当接收到Claude的文本数据时:
-		   openaiChunk := map[string]interface{}{
-		       "id": responseID,
-		       "object": "chat.completion.chunk",
-		       "created": currentTime,
-		       "model": "claude-3-7-sonnet-20250219",
-		       "choices": []map[string]interface{}{
-		           {
-		               "index": 0,
-		               "delta": map[string]interface{}{
-		                   "content": deltaText,
-		               },
-		               "finish_reason": nil,
-		           },
-		       },
-		   }
-		   jsonBytes, _ := json.Marshal(openaiChunk)
-		   stream <- fmt.Sprintf("data: %s\n\n", string(jsonBytes))
-
-		   当流结束时:
-		   finalChunk := map[string]interface{}{...}
-		   jsonBytes, _ := json.Marshal(finalChunk)
-		   stream <- fmt.Sprintf("data: %s\n\n", string(jsonBytes))
-		   stream <- "data: [DONE]\n\n"
-		*/
-
-		// 发送一个示例事件（完整实现需要根据实际的Claude流事件进行处理）
-		message := map[string]interface{}{
-			"id":      responseID,
-			"object":  "chat.completion.chunk",
-			"created": currentTime,
-			"model":   "claude-3-7-sonnet-20250219",
-			"choices": []map[string]interface{}{
-				{
-					"index": 0,
-					"delta": map[string]interface{}{
-						"content": "这是一个示例响应",
+		model := ""
+		inputTokens := 0
+		outputTokens := 0
+		cacheReadTokens := 0
+		cacheCreationTokens := 0
+		// Claude 内容块索引 -> OpenAI tool_calls 索引
+		toolIndexes := make(map[int]int)
+		nextToolIndex := 0
+		// structured_output 工具的内容块索引（参数按文本输出），-1 表示没有
+		structuredIndex := -1
+
+		emit := func(delta map[string]interface{}, finishReason interface{}, usage map[string]interface{}) {
+			chunk := map[string]interface{}{
+				"id":      responseID,
+				"object":  "chat.completion.chunk",
+				"created": currentTime,
+				"model":   model,
+				"choices": []map[string]interface{}{
+					{
+						"index":         0,
+						"delta":         delta,
+						"finish_reason": finishReason,
 					},
-					"finish_reason": nil,
 				},
-			},
+			}
+			if usage != nil {
+				chunk["usage"] = usage
+			}
+			jsonBytes, _ := json.Marshal(chunk)
+			stream <- fmt.Sprintf("data: %s\n\n", string(jsonBytes))
+		}
+
+		for raw := range events {
+			raw = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(raw), "data:"))
+			if raw == "" {
+				continue
+			}
+
+			var event map[string]interface{}
+			if err := json.Unmarshal([]byte(raw), &event); err != nil {
+				logger.Printf("解析Claude流事件失败: %v", err)
+				continue
+			}
+
+			// 服务层返回的错误块或 Claude 的 error 事件，原样透传给上层做错误检测
+			eventType, _ := event["type"].(string)
+			if _, hasError := event["error"]; hasError && (eventType == "" || eventType == "error") {
+				stream <- fmt.Sprintf("data: %s\n\n", raw)
+				continue
+			}
+
+			switch eventType {
+			case "message_start":
+				message, _ := event["message"].(map[string]interface{})
+				if m, ok := message["model"].(string); ok {
+					model = m
+				}
+				if usage, ok := message["usage"].(map[string]interface{}); ok {
+					if v, ok := usage["input_tokens"].(float64); ok {
+						inputTokens = int(v)
+					}
+					if v, ok := usage["cache_read_input_tokens"].(float64); ok {
+						cacheReadTokens = int(v)
+					}
+					if v, ok := usage["cache_creation_input_tokens"].(float64); ok {
+						cacheCreationTokens = int(v)
+					}
+				}
+				emit(map[string]interface{}{"role": "assistant", "content": ""}, nil, nil)
+
+			case "content_block_start":
+				block, _ := event["content_block"].(map[string]interface{})
+				blockType, _ := block["type"].(string)
+				if blockType == "redacted_thinking" {
+					// 加密的思考内容没有增量，整块通过 thinking_blocks 传递
+					emit(map[string]interface{}{"thinking_blocks": []interface{}{block}}, nil, nil)
+				}
+				if blockType == "tool_use" {
+					index, _ := event["index"].(float64)
+					if block["name"] == structuredOutputToolName {
+						structuredIndex = int(index)
+						continue
+					}
+					toolIndexes[int(index)] = nextToolIndex
+					id, _ := block["id"].(string)
+					name, _ := block["name"].(string)
+					emit(map[string]interface{}{
+						"tool_calls": []map[string]interface{}{
+							{
+								"index": nextToolIndex,
+								"id":    id,
+								"type":  "function",
+								"function": map[string]interface{}{
+									"name":      name,
+									"arguments": "",
+								},
+							},
+						},
+					}, nil, nil)
+					nextToolIndex++
+				}
+
+			case "content_block_delta":
+				delta, _ := event["delta"].(map[string]interface{})
+				deltaType, _ := delta["type"].(string)
+				switch deltaType {
+				case "text_delta":
+					text, _ := delta["text"].(string)
+					emit(map[string]interface{}{"content": text}, nil, nil)
+				case "thinking_delta":
+					thinking, _ := delta["thinking"].(string)
+					emit(map[string]interface{}{"reasoning_content": thinking}, nil, nil)
+				case "signature_delta":
+					// thinking 内容块的签名，通过 thinking_blocks 传递给 Claude 格式的客户端
+					signature, _ := delta["signature"].(string)
+					emit(map[string]interface{}{
+						"thinking_blocks": []interface{}{
+							map[string]interface{}{"type": "thinking", "signature": signature},
+						},
+					}, nil, nil)
+				case "input_json_delta":
+					index, _ := event["index"].(float64)
+					partial, _ := delta["partial_json"].(string)
+					if int(index) == structuredIndex {
+						emit(map[string]interface{}{"content": partial}, nil, nil)
+						continue
+					}
+					emit(map[string]interface{}{
+						"tool_calls": []map[string]interface{}{
+							{
+								"index": toolIndexes[int(index)],
+								"function": map[string]interface{}{
+									"arguments": partial,
+								},
+							},
+						},
+					}, nil, nil)
+				}
+
+			case "message_delta":
+				delta, _ := event["delta"].(map[string]interface{})
+				if usage, ok := event["usage"].(map[string]interface{}); ok {
+					if v, ok := usage["output_tokens"].(float64); ok {
+						outputTokens = int(v)
+					}
+				}
+				stopReason, _ := delta["stop_reason"].(string)
+				if stopReason == "" {
+					continue
+				}
+				if stopReason == "tool_use" && structuredIndex >= 0 && nextToolIndex == 0 {
+					stopReason = "end_turn"
+				}
+				emit(map[string]interface{}{}, claudeStopReasonToOpenAI(stopReason),
+					claudeUsageToOpenAI(inputTokens, cacheReadTokens, cacheCreationTokens, outputTokens))
+			}
 		}
-		
-		jsonBytes, _ := json.Marshal(message)
-		stream <- fmt.Sprintf("data: %s\n\n", string(jsonBytes))
 
 		// 发送结束标记
 		stream <- "data: [DONE]\n\n"
 	}()
 
 	return stream, nil
+}
+
+// claudeUsageToOpenAI 将Claude的用量转换为OpenAI格式
+// Claude 的 input_tokens 不含缓存读写部分，OpenAI 的 prompt_tokens 包含缓存命中部分（在 prompt_tokens_details.cached_tokens 中单独给出）
+func claudeUsageToOpenAI(inputTokens, cacheReadTokens, cacheCreationTokens, outputTokens int) map[string]interface{} {
+	promptTokens := inputTokens + cacheReadTokens + cacheCreationTokens
+	usage := map[string]interface{}{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": outputTokens,
+		"total_tokens":      promptTokens + outputTokens,
+	}
+	// 写入缓存的部分单独给出（cache_creation_tokens，非 OpenAI 标准字段），按写入价计费
+	if cacheReadTokens > 0 || cacheCreationTokens > 0 {
+		details := map[string]interface{}{
+			"cached_tokens": cacheReadTokens,
+		}
+		if cacheCreationTokens > 0 {
+			details["cache_creation_tokens"] = cacheCreationTokens
+		}
+		usage["prompt_tokens_details"] = details
+	}
+	return usage
+}
+
+// claudeStopReasonToOpenAI 将Claude的stop_reason映射为OpenAI的finish_reason
+func claudeStopReasonToOpenAI(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return stopReason
+	}
+}
+
+// RequestClaudeToOpenAI 将Claude Messages API格式的请求转换为OpenAI格式
+// 用于 /v1/messages 接口：Claude 格式的请求转换后可以路由到任意提供商
+// tool_use / tool_result 内容块分别转换为 assistant 的 tool_calls 和 tool 消息，图片、文档块原样保留由后续流程处理
+func (s *SilicoidFormatConverterService) RequestClaudeToOpenAI(claudeRequest map[string]interface{}) (map[string]interface{}, error) {
+	logger.Println("开始转换Claude Messages API请求为OpenAI格式")
+
+	model, _ := claudeRequest["model"].(string)
+	if model == "" {
+		return nil, fmt.Errorf("模型参数不能为空")
+	}
+	claudeMessages, ok := claudeRequest["messages"].([]interface{})
+	if !ok || len(claudeMessages) == 0 {
+		return nil, fmt.Errorf("messages 不能为空")
+	}
+
+	openaiRequest := map[string]interface{}{
+		"model": model,
+	}
+	for _, key := range []string{"max_tokens", "temperature", "top_p"} {
+		if value, ok := claudeRequest[key]; ok {
+			openaiRequest[key] = value
+		}
+	}
+	if stopSequences, ok := claudeRequest["stop_sequences"].([]interface{}); ok && len(stopSequences) > 0 {
+		openaiRequest["stop"] = stopSequences
+	}
+	if stream, _ := claudeRequest["stream"].(bool); stream {
+		openaiRequest["stream"] = true
+		// Claude 的流式事件总是带有用量，要求 OpenAI 兼容接口在最后一个数据块中返回 usage
+		openaiRequest["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+
+	// 思考模式转换为内部参数，由 Claude 适配器还原
+	if thinking, ok := claudeRequest["thinking"].(map[string]interface{}); ok {
+		if thinkingType, _ := thinking["type"].(string); thinkingType == "enabled" {
+			openaiRequest["thinking_enabled"] = true
+			if budget, ok := thinking["budget_tokens"].(float64); ok && budget > 0 {
+				openaiRequest["thinking_budget"] = budget
+			}
+		}
+	}
+
+	var messages []interface{}
+
+	// 顶级 system 参数（字符串或文本块数组）转换为第一条 system 消息
+	if system := claudeTextContent(claudeRequest["system"]); system != "" {
+		messages = append(messages, map[string]interface{}{
+			"role":    "system",
+			"content": system,
+		})
+	}
+
+	for _, msg := range claudeMessages {
+		msgMap, ok := msg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := msgMap["role"].(string)
+		blocks, isBlocks := msgMap["content"].([]interface{})
+		if !isBlocks {
+			messages = append(messages, map[string]interface{}{
+				"role":    role,
+				"content": msgMap["content"],
+			})
+			continue
+		}
+
+		switch role {
+		case "user":
+			// tool_result 必须紧跟在对应的 tool_calls 之后，先输出 tool 消息再输出其余内容
+			var parts []interface{}
+			for _, block := range blocks {
+				blockMap, ok := block.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				blockType, _ := blockMap["type"].(string)
+				switch blockType {
+				case "tool_result":
+					toolCallID, _ := blockMap["tool_use_id"].(string)
+					content := claudeTextContent(blockMap["content"])
+					if isError, _ := blockMap["is_error"].(bool); isError {
+						content = "Error: " + content
+					}
+					messages = append(messages, map[string]interface{}{
+						"role":         "tool",
+						"tool_call_id": toolCallID,
+						"content":      content,
+					})
+				case "text", "image", "document":
+					parts = append(parts, blockMap)
+				default:
+					logger.Printf("不支持的用户内容块类型: %s，已跳过", blockType)
+				}
+			}
+			if len(parts) > 0 {
+				messages = append(messages, map[string]interface{}{
+					"role":    "user",
+					"content": parts,
+				})
+			}
+
+		case "assistant":
+			var texts []string
+			var toolCalls []interface{}
+			var thinkingBlocks []interface{}
+			for _, block := range blocks {
+				blockMap, ok := block.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				blockType, _ := blockMap["type"].(string)
+				switch blockType {
+				case "text":
+					if text, _ := blockMap["text"].(string); text != "" {
+						texts = append(texts, text)
+					}
+				case "tool_use":
+					id, _ := blockMap["id"].(string)
+					name, _ := blockMap["name"].(string)
+					input := blockMap["input"]
+					if input == nil {
+						input = map[string]interface{}{}
+					}
+					argsJSON, err := json.Marshal(input)
+					if err != nil {
+						logger.Printf("序列化工具参数失败: %v", err)
+						continue
+					}
+					toolCalls = append(toolCalls, map[string]interface{}{
+						"id":   id,
+						"type": "function",
+						"function": map[string]interface{}{
+							"name":      name,
+							"arguments": string(argsJSON),
+						},
+					})
+				case "thinking", "redacted_thinking":
+					// 思考内容块连同签名原样保留，路由到 Claude 时回传给模型
+					thinkingBlocks = append(thinkingBlocks, blockMap)
+				default:
+					logger.Printf("助手内容块类型 %s 不转换，已跳过", blockType)
+				}
+			}
+			assistantMsg := map[string]interface{}{
+				"role":    "assistant",
+				"content": strings.Join(texts, "\n"),
+			}
+			if len(toolCalls) > 0 {
+				assistantMsg["tool_calls"] = toolCalls
+			}
+			if len(thinkingBlocks) > 0 {
+				assistantMsg["thinking_blocks"] = thinkingBlocks
+			}
+			messages = append(messages, assistantMsg)
+
+		default:
+			logger.Printf("不支持的消息角色: %s，已跳过", role)
+		}
+	}
+	openaiRequest["messages"] = messages
+
+	// 转换工具定义，Anthropic 服务端工具（带 type 的内置工具）无法路由到其他提供商，跳过
+	if tools, ok := claudeRequest["tools"].([]interface{}); ok && len(tools) > 0 {
+		var openaiTools []interface{}
+		for _, tool := range tools {
+			toolMap, ok := tool.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if toolType, _ := toolMap["type"].(string); toolType != "" && toolType != "custom" {
+				logger.Printf("不支持的Claude工具类型: %s，已跳过", toolType)
+				continue
+			}
+			function := map[string]interface{}{
+				"name": toolMap["name"],
+			}
+			if description, ok := toolMap["description"].(string); ok && description != "" {
+				function["description"] = description
+			}
+			if schema, ok := toolMap["input_schema"].(map[string]interface{}); ok {
+				function["parameters"] = schema
+			}
+			openaiTools = append(openaiTools, map[string]interface{}{
+				"type":     "function",
+				"function": function,
+			})
+		}
+		if len(openaiTools) > 0 {
+			openaiRequest["tools"] = openaiTools
+		}
+	}
+
+	if toolChoice, ok := claudeRequest["tool_choice"].(map[string]interface{}); ok {
+		choiceType, _ := toolChoice["type"].(string)
+		switch choiceType {
+		case "auto", "none":
+			openaiRequest["tool_choice"] = choiceType
+		case "any":
+			openaiRequest["tool_choice"] = "required"
+		case "tool":
+			openaiRequest["tool_choice"] = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": toolChoice["name"]},
+			}
+		}
+		if disable, _ := toolChoice["disable_parallel_tool_use"].(bool); disable {
+			openaiRequest["parallel_tool_calls"] = false
+		}
+	}
+
+	logger.Printf("转换完成: Claude Messages API -> OpenAI, 模型: %s, 消息数: %d", model, len(messages))
+	return openaiRequest, nil
+}
+
+// claudeTextContent 提取 Claude 内容（字符串或内容块数组）中的文本
+func claudeTextContent(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var texts []string
+		for _, block := range v {
+			blockMap, ok := block.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if text, ok := blockMap["text"].(string); ok && text != "" {
+				texts = append(texts, text)
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	return ""
 }
\ No newline at end of file
@@ -1,8 +1,12 @@
 package formatconverter
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
+
+	"github.com/google/uuid"
 )
 
 // RequestOpenAIToClaude 将OpenAI格式的请求转换为Claude Messages API格式
@@ -117,6 +121,15 @@ func (s *SilicoidFormatConverterService) RequestOpenAIToClaude(openaiRequest map
 				"content": claudeContent,
 			})
 		} else if role == "assistant" {
+			// 带签名的 thinking 内容块需要原样放在助手消息开头回传给 Claude
+			if thinkingBlocks, ok := msgMap["thinking_blocks"].([]interface{}); ok && len(thinkingBlocks) > 0 {
+				blocks := append([]interface{}{}, thinkingBlocks...)
+				if text, _ := content.(string); text != "" {
+					blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+				}
+				content = blocks
+			}
+
 			// 检查是否有工具调用信息
 			toolCalls, hasToolCalls := msgMap["tool_calls"].([]interface{})
 			if hasToolCalls && len(toolCalls) > 0 {
@@ -174,7 +187,8 @@ func (s *SilicoidFormatConverterService) RequestOpenAIToClaude(openaiRequest map
 	if len(validClaudeMessages) > 0 && validClaudeMessages[len(validClaudeMessages)-1]["role"] == "assistant" {
 		// 如果最后一条消息是助手消息，且内容为空或只有空白字符
 		lastContent, _ := validClaudeMessages[len(validClaudeMessages)-1]["content"].(string)
-		if strings.TrimSpace(lastContent) == "" {
+		lastBlocks, _ := validClaudeMessages[len(validClaudeMessages)-1]["content"].([]interface{})
+		if strings.TrimSpace(lastContent) == "" && len(lastBlocks) == 0 {
 			// 更新为一个有意义的内容
 			validClaudeMessages[len(validClaudeMessages)-1]["content"] = "我会继续帮助您。"
 		} else {
@@ -307,6 +321,9 @@ func (s *SilicoidFormatConverterService) RequestOpenAIToClaude(openaiRequest map
 		logger.Printf("添加了 %d 个工具结果到消息中", len(toolResults))
 	}
 
+	// response_format 转换为强制工具或 JSON 输出说明
+	applyClaudeStructuredOutput(openaiRequest, claudeRequest)
+
 	logger.Printf("转换完成: OpenAI -> Claude Messages API, 模型: %s", model)
 	return claudeRequest, nil
 }
@@ -353,4 +370,378 @@ func (s *SilicoidFormatConverterService) convertToolsToClaudeFormat(openaiTools
 	}
 
 	return claudeTools, nil
-}
\ No newline at end of file
+}
+
+// ResponseOpenAIToClaude 将OpenAI格式的响应转换为Claude Messages API格式
+// thinking_blocks（Claude 返回的带签名思考内容块）原样输出，其它提供商的 reasoning_content 转换为 thinking 内容块，
+// tool_calls 转换为 tool_use 内容块
+func (s *SilicoidFormatConverterService) ResponseOpenAIToClaude(openaiResponse map[string]interface{}, claudeRequest map[string]interface{}) (map[string]interface{}, error) {
+	logger.Println("开始转换OpenAI响应为Claude Messages API格式")
+
+	choice := openAIFirstChoice(openaiResponse["choices"])
+	if choice == nil {
+		return nil, fmt.Errorf("OpenAI响应中没有 choices")
+	}
+	message, _ := choice["message"].(map[string]interface{})
+	finishReason, _ := choice["finish_reason"].(string)
+
+	content := []interface{}{}
+	if thinkingBlocks, ok := message["thinking_blocks"].([]interface{}); ok && len(thinkingBlocks) > 0 {
+		content = append(content, thinkingBlocks...)
+	} else if reasoning, _ := message["reasoning_content"].(string); reasoning != "" {
+		// 其它提供商的推理内容没有签名
+		content = append(content, map[string]interface{}{
+			"type":      "thinking",
+			"thinking":  reasoning,
+			"signature": "",
+		})
+	}
+	if text, _ := message["content"].(string); text != "" {
+		content = append(content, map[string]interface{}{
+			"type": "text",
+			"text": text,
+		})
+	}
+	for _, toolCall := range openAIToolCalls(message["tool_calls"]) {
+		function, _ := toolCall["function"].(map[string]interface{})
+		id, _ := toolCall["id"].(string)
+		if id == "" {
+			id = newClaudeToolUseID()
+		}
+		content = append(content, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    id,
+			"name":  function["name"],
+			"input": parseToolArguments(function["arguments"]),
+		})
+	}
+
+	model, _ := openaiResponse["model"].(string)
+	if claudeRequest != nil {
+		if requestModel, ok := claudeRequest["model"].(string); ok && requestModel != "" {
+			model = requestModel
+		}
+	}
+
+	usage, _ := openaiResponse["usage"].(map[string]interface{})
+	claudeResponse := map[string]interface{}{
+		"id":            newClaudeMessageID(),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         model,
+		"content":       content,
+		"stop_reason":   openAIFinishReasonToClaude(finishReason),
+		"stop_sequence": nil,
+		"usage":         openAIUsageToClaude(usage),
+	}
+
+	logger.Println("转换完成: OpenAI -> Claude Messages API")
+	return claudeResponse, nil
+}
+
+// HandleResponseOpenAIStreamToClaude 将OpenAI流式响应转换为Claude Messages API的流式事件
+// 输入为 OpenAI SSE 格式的数据块（data: {...}\n\n，以 data: [DONE]\n\n 结束）
+// 输出为 Claude SSE 事件（event: xxx\ndata: {...}\n\n）：message_start、content_block_start/delta/stop、message_delta、message_stop
+// ctx 结束（客户端断开）后不再输出，但会继续读完输入，避免上游阻塞
+func (s *SilicoidFormatConverterService) HandleResponseOpenAIStreamToClaude(ctx context.Context, openaiStream chan string, model string) chan string {
+	stream := make(chan string)
+
+	go func() {
+		defer close(stream)
+
+		clientGone := false
+		emit := func(eventType string, event map[string]interface{}) {
+			if clientGone {
+				return
+			}
+			event["type"] = eventType
+			jsonBytes, _ := json.Marshal(event)
+			select {
+			case stream <- fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, string(jsonBytes)):
+			case <-ctx.Done():
+				clientGone = true
+			}
+		}
+
+		started := false
+		failed := false
+		stopReason := "end_turn"
+		var usage map[string]interface{}
+
+		// 当前打开的内容块；OpenAI tool_calls 索引 -> Claude 内容块索引
+		blockIndex := -1
+		blockType := ""
+		toolBlocks := make(map[int]int)
+
+		startMessage := func() {
+			if started {
+				return
+			}
+			started = true
+			emit("message_start", map[string]interface{}{
+				"message": map[string]interface{}{
+					"id":            newClaudeMessageID(),
+					"type":          "message",
+					"role":          "assistant",
+					"model":         model,
+					"content":       []interface{}{},
+					"stop_reason":   nil,
+					"stop_sequence": nil,
+					"usage":         map[string]interface{}{"input_tokens": 0, "output_tokens": 0},
+				},
+			})
+			emit("ping", map[string]interface{}{})
+		}
+		stopBlock := func() {
+			if blockType == "" {
+				return
+			}
+			emit("content_block_stop", map[string]interface{}{"index": blockIndex})
+			blockType = ""
+		}
+		startBlock := func(contentBlock map[string]interface{}) {
+			stopBlock()
+			blockIndex++
+			blockType, _ = contentBlock["type"].(string)
+			emit("content_block_start", map[string]interface{}{
+				"index":         blockIndex,
+				"content_block": contentBlock,
+			})
+		}
+		delta := func(index int, blockDelta map[string]interface{}) {
+			emit("content_block_delta", map[string]interface{}{
+				"index": index,
+				"delta": blockDelta,
+			})
+		}
+
+		for raw := range openaiStream {
+			if failed || clientGone {
+				continue
+			}
+			raw = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(raw), "data:"))
+			if raw == "" || raw == "[DONE]" {
+				continue
+			}
+
+			var chunk map[string]interface{}
+			if err := json.Unmarshal([]byte(raw), &chunk); err != nil {
+				logger.Printf("解析OpenAI流数据块失败: %v", err)
+				continue
+			}
+
+			// 上游错误转换为 Claude 的 error 事件，之后不再输出内容
+			if errObj, hasError := chunk["error"]; hasError {
+				message := fmt.Sprintf("%v", errObj)
+				if errMap, ok := errObj.(map[string]interface{}); ok {
+					if msg, ok := errMap["message"].(string); ok {
+						message = msg
+					}
+				}
+				emit("error", map[string]interface{}{
+					"error": map[string]interface{}{
+						"type":    "api_error",
+						"message": message,
+					},
+				})
+				failed = true
+				continue
+			}
+
+			startMessage()
+			if chunkUsage, ok := chunk["usage"].(map[string]interface{}); ok {
+				usage = chunkUsage
+			}
+
+			choice := openAIFirstChoice(chunk["choices"])
+			if choice == nil {
+				continue
+			}
+			choiceDelta, _ := choice["delta"].(map[string]interface{})
+
+			if reasoning, _ := choiceDelta["reasoning_content"].(string); reasoning != "" {
+				if blockType != "thinking" {
+					startBlock(map[string]interface{}{"type": "thinking", "thinking": ""})
+				}
+				delta(blockIndex, map[string]interface{}{"type": "thinking_delta", "thinking": reasoning})
+			}
+
+			// Claude 返回的思考内容签名和加密的思考内容块
+			if thinkingBlocks, ok := choiceDelta["thinking_blocks"].([]interface{}); ok {
+				for _, item := range thinkingBlocks {
+					block, _ := item.(map[string]interface{})
+					switch block["type"] {
+					case "thinking":
+						signature, _ := block["signature"].(string)
+						if signature == "" {
+							continue
+						}
+						if blockType != "thinking" {
+							startBlock(map[string]interface{}{"type": "thinking", "thinking": ""})
+						}
+						delta(blockIndex, map[string]interface{}{"type": "signature_delta", "signature": signature})
+					case "redacted_thinking":
+						startBlock(block)
+					}
+				}
+			}
+
+			if text, _ := choiceDelta["content"].(string); text != "" {
+				if blockType != "text" {
+					startBlock(map[string]interface{}{"type": "text", "text": ""})
+				}
+				delta(blockIndex, map[string]interface{}{"type": "text_delta", "text": text})
+			}
+
+			for _, toolCall := range openAIToolCalls(choiceDelta["tool_calls"]) {
+				toolIndex := 0
+				if index, ok := toolCall["index"].(float64); ok {
+					toolIndex = int(index)
+				}
+				function, _ := toolCall["function"].(map[string]interface{})
+				index, exists := toolBlocks[toolIndex]
+				if !exists {
+					id, _ := toolCall["id"].(string)
+					if id == "" {
+						id = newClaudeToolUseID()
+					}
+					name, _ := function["name"].(string)
+					startBlock(map[string]interface{}{
+						"type":  "tool_use",
+						"id":    id,
+						"name":  name,
+						"input": map[string]interface{}{},
+					})
+					index = blockIndex
+					toolBlocks[toolIndex] = index
+				}
+				if arguments, _ := function["arguments"].(string); arguments != "" {
+					delta(index, map[string]interface{}{"type": "input_json_delta", "partial_json": arguments})
+				}
+			}
+
+			if finishReason, _ := choice["finish_reason"].(string); finishReason != "" {
+				stopReason = openAIFinishReasonToClaude(finishReason)
+			}
+		}
+
+		if failed || !started {
+			return
+		}
+		stopBlock()
+		emit("message_delta", map[string]interface{}{
+			"delta": map[string]interface{}{
+				"stop_reason":   stopReason,
+				"stop_sequence": nil,
+			},
+			"usage": openAIUsageToClaude(usage),
+		})
+		emit("message_stop", map[string]interface{}{})
+	}()
+
+	return stream
+}
+
+// openAIFirstChoice 获取 choices 中的第一个元素（兼容 JSON 解析结果和直接构造的响应）
+func openAIFirstChoice(choices interface{}) map[string]interface{} {
+	switch v := choices.(type) {
+	case []interface{}:
+		if len(v) > 0 {
+			choice, _ := v[0].(map[string]interface{})
+			return choice
+		}
+	case []map[string]interface{}:
+		if len(v) > 0 {
+			return v[0]
+		}
+	}
+	return nil
+}
+
+// openAIToolCalls 获取 tool_calls 列表（兼容 JSON 解析结果和直接构造的响应）
+func openAIToolCalls(toolCalls interface{}) []map[string]interface{} {
+	switch v := toolCalls.(type) {
+	case []interface{}:
+		var result []map[string]interface{}
+		for _, item := range v {
+			if toolCall, ok := item.(map[string]interface{}); ok {
+				result = append(result, toolCall)
+			}
+		}
+		return result
+	case []map[string]interface{}:
+		return v
+	}
+	return nil
+}
+
+// parseToolArguments 解析工具调用的 JSON 参数，解析失败时返回空对象
+func parseToolArguments(arguments interface{}) map[string]interface{} {
+	input := map[string]interface{}{}
+	if argsStr, ok := arguments.(string); ok && strings.TrimSpace(argsStr) != "" {
+		if err := json.Unmarshal([]byte(argsStr), &input); err != nil {
+			logger.Printf("解析工具参数失败: %v", err)
+			return map[string]interface{}{}
+		}
+	}
+	return input
+}
+
+// openAIFinishReasonToClaude 将OpenAI的finish_reason映射为Claude的stop_reason
+func openAIFinishReasonToClaude(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// openAIUsageToClaude 将OpenAI的用量转换为Claude格式（claudeUsageToOpenAI 的逆向转换）
+// OpenAI 的 prompt_tokens 包含缓存命中部分，Claude 的 input_tokens 不包含
+func openAIUsageToClaude(usage map[string]interface{}) map[string]interface{} {
+	promptTokens := usageTokens(usage["prompt_tokens"])
+	cachedTokens := 0
+	cacheCreationTokens := 0
+	if details, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+		cachedTokens = usageTokens(details["cached_tokens"])
+		cacheCreationTokens = usageTokens(details["cache_creation_tokens"])
+	}
+
+	claudeUsage := map[string]interface{}{
+		"input_tokens":  promptTokens - cachedTokens - cacheCreationTokens,
+		"output_tokens": usageTokens(usage["completion_tokens"]),
+	}
+	if cachedTokens > 0 {
+		claudeUsage["cache_read_input_tokens"] = cachedTokens
+	}
+	if cacheCreationTokens > 0 {
+		claudeUsage["cache_creation_input_tokens"] = cacheCreationTokens
+	}
+	return claudeUsage
+}
+
+// usageTokens 读取用量中的token数（JSON 解析结果为 float64，直接构造的响应为 int）
+func usageTokens(value interface{}) int {
+	switch v := value.(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// newClaudeMessageID 生成 Claude 格式的消息ID
+func newClaudeMessageID() string {
+	return "msg_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
+
+// newClaudeToolUseID 生成 Claude 格式的工具调用ID
+func newClaudeToolUseID() string {
+	return "toolu_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
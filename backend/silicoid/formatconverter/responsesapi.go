@@ -0,0 +1,615 @@
+// OpenAI Responses API（/v1/responses）与内部 Chat Completions 格式之间的转换
+// 请求的 input 条目转换为 messages，响应的 choices 转换为 output 条目，流式数据块转换为带类型的事件
+
+package formatconverter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RequestResponsesToOpenAI 将 Responses API 请求转换为 OpenAI Chat Completions 格式
+// history 为 previous_response_id 对应的历史消息（不含 instructions），放在本次 input 之前
+func (s *SilicoidFormatConverterService) RequestResponsesToOpenAI(request map[string]interface{}, history []interface{}) (map[string]interface{}, error) {
+	logger.Println("开始转换Responses API请求为OpenAI格式")
+
+	model, _ := request["model"].(string)
+	if model == "" {
+		return nil, fmt.Errorf("模型参数不能为空")
+	}
+	input := ResponsesInputToMessages(request["input"])
+	if len(input) == 0 {
+		return nil, fmt.Errorf("input 不能为空")
+	}
+
+	var messages []interface{}
+	// instructions 只对本次请求生效，不随 previous_response_id 延续
+	if instructions, _ := request["instructions"].(string); instructions != "" {
+		messages = append(messages, map[string]interface{}{
+			"role":    "system",
+			"content": instructions,
+		})
+	}
+	messages = append(messages, history...)
+	messages = append(messages, input...)
+
+	openaiRequest := map[string]interface{}{
+		"model":    model,
+		"messages": messages,
+	}
+	if maxTokens, ok := request["max_output_tokens"]; ok && maxTokens != nil {
+		openaiRequest["max_tokens"] = maxTokens
+	}
+	for _, key := range []string{"temperature", "top_p", "parallel_tool_calls"} {
+		if value, ok := request[key]; ok && value != nil {
+			openaiRequest[key] = value
+		}
+	}
+	if stream, _ := request["stream"].(bool); stream {
+		openaiRequest["stream"] = true
+		// response.completed 事件需要用量，要求 OpenAI 兼容接口在最后一个数据块中返回 usage
+		openaiRequest["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+
+	// text.format 转换为 response_format
+	if text, ok := request["text"].(map[string]interface{}); ok {
+		format, _ := text["format"].(map[string]interface{})
+		switch formatType, _ := format["type"].(string); formatType {
+		case "json_schema":
+			jsonSchema := map[string]interface{}{
+				"name":   format["name"],
+				"schema": format["schema"],
+			}
+			for _, key := range []string{"description", "strict"} {
+				if value, ok := format[key]; ok {
+					jsonSchema[key] = value
+				}
+			}
+			openaiRequest["response_format"] = map[string]interface{}{
+				"type":        "json_schema",
+				"json_schema": jsonSchema,
+			}
+		case "json_object":
+			openaiRequest["response_format"] = map[string]interface{}{"type": "json_object"}
+		}
+	}
+
+	// 只转换函数工具，web_search、file_search 等内置工具无法路由到其他提供商
+	if tools, ok := request["tools"].([]interface{}); ok && len(tools) > 0 {
+		var openaiTools []interface{}
+		for _, tool := range tools {
+			toolMap, ok := tool.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if toolType, _ := toolMap["type"].(string); toolType != "function" {
+				logger.Printf("不支持的Responses工具类型: %s，已跳过", toolType)
+				continue
+			}
+			function := map[string]interface{}{
+				"name": toolMap["name"],
+			}
+			for _, key := range []string{"description", "parameters", "strict"} {
+				if value, ok := toolMap[key]; ok && value != nil {
+					function[key] = value
+				}
+			}
+			openaiTools = append(openaiTools, map[string]interface{}{
+				"type":     "function",
+				"function": function,
+			})
+		}
+		if len(openaiTools) > 0 {
+			openaiRequest["tools"] = openaiTools
+		}
+	}
+
+	switch toolChoice := request["tool_choice"].(type) {
+	case string:
+		openaiRequest["tool_choice"] = toolChoice
+	case map[string]interface{}:
+		if choiceType, _ := toolChoice["type"].(string); choiceType == "function" {
+			openaiRequest["tool_choice"] = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": toolChoice["name"]},
+			}
+		}
+	}
+
+	logger.Printf("转换完成: Responses API -> OpenAI, 模型: %s, 消息数: %d", model, len(messages))
+	return openaiRequest, nil
+}
+
+// ResponsesInputToMessages 将 Responses API 的 input（字符串或条目数组）转换为 OpenAI messages
+// 响应的 output 条目同样适用，用于把本轮回复追加到会话历史
+func ResponsesInputToMessages(input interface{}) []interface{} {
+	switch v := input.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []interface{}{map[string]interface{}{"role": "user", "content": v}}
+	case []interface{}:
+		var messages []interface{}
+		for _, item := range v {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			itemType, _ := itemMap["type"].(string)
+			if itemType == "" && itemMap["role"] != nil {
+				itemType = "message"
+			}
+
+			switch itemType {
+			case "message":
+				role, _ := itemMap["role"].(string)
+				if role == "developer" {
+					role = "system"
+				}
+				messages = append(messages, map[string]interface{}{
+					"role":    role,
+					"content": responsesContentToOpenAI(itemMap["content"]),
+				})
+
+			case "function_call":
+				toolCall := map[string]interface{}{
+					"id":   itemMap["call_id"],
+					"type": "function",
+					"function": map[string]interface{}{
+						"name":      itemMap["name"],
+						"arguments": itemMap["arguments"],
+					},
+				}
+				// 紧跟在助手消息之后的 function_call 合并到同一条 assistant 消息（并行工具调用）
+				if len(messages) > 0 {
+					if last, ok := messages[len(messages)-1].(map[string]interface{}); ok && last["role"] == "assistant" {
+						toolCalls, _ := last["tool_calls"].([]interface{})
+						last["tool_calls"] = append(toolCalls, toolCall)
+						continue
+					}
+				}
+				messages = append(messages, map[string]interface{}{
+					"role":       "assistant",
+					"content":    "",
+					"tool_calls": []interface{}{toolCall},
+				})
+
+			case "function_call_output":
+				output := itemMap["output"]
+				if _, isString := output.(string); !isString {
+					output = responsesContentToOpenAI(output)
+				}
+				messages = append(messages, map[string]interface{}{
+					"role":         "tool",
+					"tool_call_id": itemMap["call_id"],
+					"content":      output,
+				})
+
+			default:
+				// reasoning、item_reference 等条目不回传给模型
+				logger.Printf("Responses条目类型 %s 不转换，已跳过", itemType)
+			}
+		}
+		return messages
+	}
+	return nil
+}
+
+// responsesContentToOpenAI 将 Responses API 的消息内容转换为 OpenAI 格式
+// 只有文本时拼接为字符串；包含图片、文件时转换为内容数组，平台文件ID使用 file_read 从文件服务器读取
+func responsesContentToOpenAI(content interface{}) interface{} {
+	parts, ok := content.([]interface{})
+	if !ok {
+		return content
+	}
+
+	var texts []string
+	var contentParts []interface{}
+	textOnly := true
+	for _, part := range parts {
+		partMap, ok := part.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		partType, _ := partMap["type"].(string)
+		switch partType {
+		case "input_text", "output_text", "text":
+			text, _ := partMap["text"].(string)
+			texts = append(texts, text)
+			contentParts = append(contentParts, map[string]interface{}{"type": "text", "text": text})
+		case "refusal":
+			text, _ := partMap["refusal"].(string)
+			texts = append(texts, text)
+			contentParts = append(contentParts, map[string]interface{}{"type": "text", "text": text})
+		case "input_image", "input_file":
+			if fileID, _ := partMap["file_id"].(string); fileID != "" {
+				textOnly = false
+				contentParts = append(contentParts, map[string]interface{}{"type": "file_read", "file_id": fileID})
+			} else if imageURL, _ := partMap["image_url"].(string); imageURL != "" {
+				textOnly = false
+				contentParts = append(contentParts, map[string]interface{}{
+					"type":      "image_url",
+					"image_url": map[string]interface{}{"url": imageURL},
+				})
+			} else {
+				logger.Printf("%s 内容缺少 file_id 或 image_url，已跳过", partType)
+			}
+		default:
+			logger.Printf("不支持的Responses内容类型: %s，已跳过", partType)
+		}
+	}
+
+	if textOnly {
+		return strings.Join(texts, "\n")
+	}
+	return contentParts
+}
+
+// ResponseOpenAIToResponses 将 OpenAI Chat Completions 响应转换为 Responses API 的 response 对象
+func (s *SilicoidFormatConverterService) ResponseOpenAIToResponses(openaiResponse map[string]interface{}, request map[string]interface{}) (map[string]interface{}, error) {
+	logger.Println("开始转换OpenAI响应为Responses API格式")
+
+	choice := openAIFirstChoice(openaiResponse["choices"])
+	if choice == nil {
+		return nil, fmt.Errorf("OpenAI响应中没有 choices")
+	}
+	message, _ := choice["message"].(map[string]interface{})
+	finishReason, _ := choice["finish_reason"].(string)
+
+	output := []interface{}{}
+	if reasoning, _ := message["reasoning_content"].(string); reasoning != "" {
+		output = append(output, responsesReasoningItem(newResponsesItemID("rs"), reasoning))
+	}
+	if text, _ := message["content"].(string); text != "" {
+		output = append(output, responsesMessageItem(newResponsesItemID("msg"), text, "completed"))
+	}
+	for _, toolCall := range openAIToolCalls(message["tool_calls"]) {
+		function, _ := toolCall["function"].(map[string]interface{})
+		callID, _ := toolCall["id"].(string)
+		name, _ := function["name"].(string)
+		arguments, _ := function["arguments"].(string)
+		output = append(output, responsesFunctionCallItem(newResponsesItemID("fc"), callID, name, arguments, "completed"))
+	}
+
+	usage, _ := openaiResponse["usage"].(map[string]interface{})
+	response := newResponsesObject(request)
+	finishResponsesObject(response, output, finishReason, usage)
+
+	logger.Println("转换完成: OpenAI -> Responses API")
+	return response, nil
+}
+
+// HandleResponseOpenAIStreamToResponses 将OpenAI流式响应转换为 Responses API 的流式事件
+// 输入为 OpenAI SSE 格式的数据块，输出为带类型的 SSE 事件（event: response.xxx\ndata: {...}\n\n），
+// 依次为 response.created、各输出条目的 added/delta/done 事件，最后是 response.completed（或 incomplete / failed）
+// onCompleted 在发送最终事件前以完整的 response 对象调用，用于保存会话状态
+// ctx 结束（客户端断开）后不再输出，但会继续读完输入，避免上游阻塞
+func (s *SilicoidFormatConverterService) HandleResponseOpenAIStreamToResponses(ctx context.Context, openaiStream chan string, request map[string]interface{}, onCompleted func(response map[string]interface{})) chan string {
+	stream := make(chan string)
+
+	go func() {
+		defer close(stream)
+
+		clientGone := false
+		sequence := 0
+		emit := func(eventType string, event map[string]interface{}) {
+			if clientGone {
+				return
+			}
+			event["type"] = eventType
+			event["sequence_number"] = sequence
+			sequence++
+			jsonBytes, _ := json.Marshal(event)
+			select {
+			case stream <- fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, string(jsonBytes)):
+			case <-ctx.Done():
+				clientGone = true
+			}
+		}
+
+		response := newResponsesObject(request)
+		emit("response.created", map[string]interface{}{"response": response})
+		emit("response.in_progress", map[string]interface{}{"response": response})
+
+		output := []interface{}{}
+		finishReason := ""
+		var usage map[string]interface{}
+
+		// 当前打开的输出条目；OpenAI tool_calls 索引 -> 条目在 output 中的位置
+		var item map[string]interface{}
+		itemType := ""
+		var itemText strings.Builder
+		toolItems := make(map[int]int)
+
+		itemEvent := func(extra map[string]interface{}) map[string]interface{} {
+			event := map[string]interface{}{
+				"item_id":      item["id"],
+				"output_index": len(output),
+			}
+			for key, value := range extra {
+				event[key] = value
+			}
+			return event
+		}
+		openItem := func(newItem map[string]interface{}) {
+			item = newItem
+			itemType, _ = newItem["type"].(string)
+			itemText.Reset()
+			emit("response.output_item.added", map[string]interface{}{
+				"output_index": len(output),
+				"item":         newItem,
+			})
+		}
+		closeItem := func() {
+			if itemType == "" {
+				return
+			}
+			text := itemText.String()
+			var done map[string]interface{}
+			switch itemType {
+			case "reasoning":
+				part := map[string]interface{}{"type": "summary_text", "text": text}
+				emit("response.reasoning_summary_text.done", itemEvent(map[string]interface{}{"summary_index": 0, "text": text}))
+				emit("response.reasoning_summary_part.done", itemEvent(map[string]interface{}{"summary_index": 0, "part": part}))
+				done = responsesReasoningItem(item["id"].(string), text)
+			case "message":
+				part := map[string]interface{}{"type": "output_text", "text": text, "annotations": []interface{}{}}
+				emit("response.output_text.done", itemEvent(map[string]interface{}{"content_index": 0, "text": text}))
+				emit("response.content_part.done", itemEvent(map[string]interface{}{"content_index": 0, "part": part}))
+				done = responsesMessageItem(item["id"].(string), text, "completed")
+			case "function_call":
+				emit("response.function_call_arguments.done", itemEvent(map[string]interface{}{"arguments": text}))
+				done = responsesFunctionCallItem(item["id"].(string), item["call_id"].(string), item["name"].(string), text, "completed")
+			}
+			emit("response.output_item.done", map[string]interface{}{
+				"output_index": len(output),
+				"item":         done,
+			})
+			output = append(output, done)
+			itemType = ""
+		}
+
+		failed := false
+		for raw := range openaiStream {
+			if failed || clientGone {
+				continue
+			}
+			raw = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(raw), "data:"))
+			if raw == "" || raw == "[DONE]" {
+				continue
+			}
+
+			var chunk map[string]interface{}
+			if err := json.Unmarshal([]byte(raw), &chunk); err != nil {
+				logger.Printf("解析OpenAI流数据块失败: %v", err)
+				continue
+			}
+
+			// 上游错误转换为 response.failed 事件，之后不再输出内容
+			if errObj, hasError := chunk["error"]; hasError {
+				message := fmt.Sprintf("%v", errObj)
+				if errMap, ok := errObj.(map[string]interface{}); ok {
+					if msg, ok := errMap["message"].(string); ok {
+						message = msg
+					}
+				}
+				response["status"] = "failed"
+				response["output"] = output
+				response["error"] = map[string]interface{}{
+					"code":    "server_error",
+					"message": message,
+				}
+				emit("response.failed", map[string]interface{}{"response": response})
+				failed = true
+				continue
+			}
+
+			if chunkUsage, ok := chunk["usage"].(map[string]interface{}); ok {
+				usage = chunkUsage
+			}
+			choice := openAIFirstChoice(chunk["choices"])
+			if choice == nil {
+				continue
+			}
+			delta, _ := choice["delta"].(map[string]interface{})
+
+			if reasoning, _ := delta["reasoning_content"].(string); reasoning != "" {
+				if itemType != "reasoning" {
+					closeItem()
+					openItem(map[string]interface{}{
+						"type":    "reasoning",
+						"id":      newResponsesItemID("rs"),
+						"summary": []interface{}{},
+					})
+					emit("response.reasoning_summary_part.added", itemEvent(map[string]interface{}{
+						"summary_index": 0,
+						"part":          map[string]interface{}{"type": "summary_text", "text": ""},
+					}))
+				}
+				itemText.WriteString(reasoning)
+				emit("response.reasoning_summary_text.delta", itemEvent(map[string]interface{}{"summary_index": 0, "delta": reasoning}))
+			}
+
+			if text, _ := delta["content"].(string); text != "" {
+				if itemType != "message" {
+					closeItem()
+					openItem(responsesMessageItem(newResponsesItemID("msg"), "", "in_progress"))
+					emit("response.content_part.added", itemEvent(map[string]interface{}{
+						"content_index": 0,
+						"part":          map[string]interface{}{"type": "output_text", "text": "", "annotations": []interface{}{}},
+					}))
+				}
+				itemText.WriteString(text)
+				emit("response.output_text.delta", itemEvent(map[string]interface{}{"content_index": 0, "delta": text}))
+			}
+
+			for _, toolCall := range openAIToolCalls(delta["tool_calls"]) {
+				toolIndex := 0
+				if index, ok := toolCall["index"].(float64); ok {
+					toolIndex = int(index)
+				}
+				function, _ := toolCall["function"].(map[string]interface{})
+				outputIndex, exists := toolItems[toolIndex]
+				if !exists {
+					closeItem()
+					callID, _ := toolCall["id"].(string)
+					name, _ := function["name"].(string)
+					openItem(responsesFunctionCallItem(newResponsesItemID("fc"), callID, name, "", "in_progress"))
+					outputIndex = len(output)
+					toolItems[toolIndex] = outputIndex
+				}
+				// 工具调用按顺序输出，参数只追加到当前打开的条目
+				arguments, _ := function["arguments"].(string)
+				if arguments != "" && itemType == "function_call" && outputIndex == len(output) {
+					itemText.WriteString(arguments)
+					emit("response.function_call_arguments.delta", itemEvent(map[string]interface{}{"delta": arguments}))
+				}
+			}
+
+			if reason, _ := choice["finish_reason"].(string); reason != "" {
+				finishReason = reason
+			}
+		}
+
+		if failed {
+			return
+		}
+		closeItem()
+		finishResponsesObject(response, output, finishReason, usage)
+		if onCompleted != nil {
+			onCompleted(response)
+		}
+		if response["status"] == "incomplete" {
+			emit("response.incomplete", map[string]interface{}{"response": response})
+		} else {
+			emit("response.completed", map[string]interface{}{"response": response})
+		}
+	}()
+
+	return stream
+}
+
+// newResponsesObject 按请求参数创建状态为 in_progress 的 response 对象
+func newResponsesObject(request map[string]interface{}) map[string]interface{} {
+	valueOr := func(key string, defaultValue interface{}) interface{} {
+		if value, ok := request[key]; ok && value != nil {
+			return value
+		}
+		return defaultValue
+	}
+	return map[string]interface{}{
+		"id":                   newResponsesItemID("resp"),
+		"object":               "response",
+		"created_at":           time.Now().Unix(),
+		"status":               "in_progress",
+		"model":                request["model"],
+		"output":               []interface{}{},
+		"error":                nil,
+		"incomplete_details":   nil,
+		"instructions":         valueOr("instructions", nil),
+		"previous_response_id": valueOr("previous_response_id", nil),
+		"max_output_tokens":    valueOr("max_output_tokens", nil),
+		"temperature":          valueOr("temperature", 1.0),
+		"top_p":                valueOr("top_p", 1.0),
+		"tools":                valueOr("tools", []interface{}{}),
+		"tool_choice":          valueOr("tool_choice", "auto"),
+		"parallel_tool_calls":  valueOr("parallel_tool_calls", true),
+		"text":                 valueOr("text", map[string]interface{}{"format": map[string]interface{}{"type": "text"}}),
+		"metadata":             valueOr("metadata", map[string]interface{}{}),
+		"store":                valueOr("store", true),
+		"usage":                nil,
+	}
+}
+
+// finishResponsesObject 填充输出条目和用量，按 finish_reason 设置最终状态
+func finishResponsesObject(response map[string]interface{}, output []interface{}, finishReason string, usage map[string]interface{}) {
+	response["output"] = output
+	response["status"] = "completed"
+	if finishReason == "length" {
+		response["status"] = "incomplete"
+		response["incomplete_details"] = map[string]interface{}{"reason": "max_output_tokens"}
+	} else if finishReason == "content_filter" {
+		response["status"] = "incomplete"
+		response["incomplete_details"] = map[string]interface{}{"reason": "content_filter"}
+	}
+	if usage != nil {
+		response["usage"] = openAIUsageToResponses(usage)
+	}
+}
+
+// openAIUsageToResponses 将 Chat Completions 的用量转换为 Responses API 格式
+func openAIUsageToResponses(usage map[string]interface{}) map[string]interface{} {
+	cachedTokens := 0
+	if details, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+		cachedTokens = usageTokens(details["cached_tokens"])
+	}
+	reasoningTokens := 0
+	if details, ok := usage["completion_tokens_details"].(map[string]interface{}); ok {
+		reasoningTokens = usageTokens(details["reasoning_tokens"])
+	}
+	inputTokens := usageTokens(usage["prompt_tokens"])
+	outputTokens := usageTokens(usage["completion_tokens"])
+	return map[string]interface{}{
+		"input_tokens":          inputTokens,
+		"input_tokens_details":  map[string]interface{}{"cached_tokens": cachedTokens},
+		"output_tokens":         outputTokens,
+		"output_tokens_details": map[string]interface{}{"reasoning_tokens": reasoningTokens},
+		"total_tokens":          inputTokens + outputTokens,
+	}
+}
+
+// responsesMessageItem 构造助手消息输出条目
+func responsesMessageItem(id string, text string, status string) map[string]interface{} {
+	content := []interface{}{}
+	if status == "completed" {
+		content = append(content, map[string]interface{}{
+			"type":        "output_text",
+			"text":        text,
+			"annotations": []interface{}{},
+		})
+	}
+	return map[string]interface{}{
+		"type":    "message",
+		"id":      id,
+		"status":  status,
+		"role":    "assistant",
+		"content": content,
+	}
+}
+
+// responsesReasoningItem 构造推理输出条目（思考内容作为摘要返回）
+func responsesReasoningItem(id string, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "reasoning",
+		"id":   id,
+		"summary": []interface{}{
+			map[string]interface{}{"type": "summary_text", "text": text},
+		},
+	}
+}
+
+// responsesFunctionCallItem 构造函数调用输出条目
+func responsesFunctionCallItem(id string, callID string, name string, arguments string, status string) map[string]interface{} {
+	if callID == "" {
+		callID = "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+	}
+	return map[string]interface{}{
+		"type":      "function_call",
+		"id":        id,
+		"call_id":   callID,
+		"name":      name,
+		"arguments": arguments,
+		"status":    status,
+	}
+}
+
+// newResponsesItemID 生成 Responses API 格式的ID（resp_、msg_、fc_、rs_ 等前缀）
+func newResponsesItemID(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
@@ -38,8 +38,14 @@ func (s *SilicoidFormatConverterService) loadMCPServerConfigs() ([]interface{},
 	}
 
 	// 为每个服务器配置设置授权令牌（如果未设置）
+	// stdio 服务器是本服务托管的本地进程（配置中可能包含命令和密钥环境变量），只由服务端调用，不加入请求
+	remoteServers := make([]interface{}, 0, len(mcpServers))
 	for _, server := range mcpServers {
 		if serverMap, ok := server.(map[string]interface{}); ok {
+			if serverType, _ := serverMap["type"].(string); serverType == "stdio" {
+				continue
+			}
+			remoteServers = append(remoteServers, serverMap)
 			serverName, _ := serverMap["name"].(string)
 
 			// 检查是否已有authorization_token
@@ -56,8 +62,8 @@ func (s *SilicoidFormatConverterService) loadMCPServerConfigs() ([]interface{},
 		}
 	}
 
-	logger.Printf("✅ 加载了 %d 个MCP服务器配置", len(mcpServers))
-	return mcpServers, nil
+	logger.Printf("✅ 加载了 %d 个MCP服务器配置", len(remoteServers))
+	return remoteServers, nil
 }
 // replaceEnvironmentVariables 替换字符串中的环境变量
 func (s *SilicoidFormatConverterService) replaceEnvironmentVariables(input string) string {
@@ -152,6 +158,18 @@ func (s *SilicoidFormatConverterService) AddExecutorTools(requestData map[string
 	existingTools, _ := requestData["tools"].([]interface{})
 	var mcpServers []interface{} // MCP服务器配置列表
 
+	// 记录已存在的工具名称，多轮调用（如 ServerCalls 循环）重复转换时避免工具定义重复
+	existingToolNames := make(map[string]bool)
+	for _, tool := range existingTools {
+		if toolMap, ok := tool.(map[string]interface{}); ok {
+			if funcData, ok := toolMap["function"].(map[string]interface{}); ok {
+				if name, ok := funcData["name"].(string); ok {
+					existingToolNames[name] = true
+				}
+			}
+		}
+	}
+
 	// 添加数据库中的工具（客户端执行器工具和MCP工具集）
 	if s.dataService != nil {
 		// 获取角色名称
@@ -178,6 +196,9 @@ func (s *SilicoidFormatConverterService) AddExecutorTools(requestData map[string
 
 				// 转换为 OpenAI 格式（通用格式）
 				for _, tool := range allTools {
+					if existingToolNames[tool.ToolName] {
+						continue
+					}
 					if tool.ExecutionType == "client_executor" || tool.ExecutionType == "server_executor" {
 						// 客户端执行器工具和服务器执行器工具（包括MCP工具）
 						openaiTool := map[string]interface{}{
@@ -615,9 +615,9 @@ func (s *SilicoidFormatConverterService) NormalizeOpenAIRequest(openaiRequest ma
 				"content": contentStr,
 			}
 			
-			// 保留其他字段（如 name, tool_calls 等）
+			// 保留其他字段（如 name, tool_calls 等），thinking_blocks 只有 Claude 支持
 			for key, value := range msgMap {
-				if key != "role" && key != "content" {
+				if key != "role" && key != "content" && key != "thinking_blocks" {
 					normalizedMsg[key] = value
 				}
 			}
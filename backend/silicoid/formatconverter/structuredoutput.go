@@ -0,0 +1,85 @@
+package formatconverter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// structuredOutputToolName Claude 没有 response_format，json_schema 通过强制调用该工具实现，
+// 工具参数即结构化输出，响应转换时还原为 message.content
+const structuredOutputToolName = "structured_output"
+
+// ResponseFormatSchema 解析 OpenAI 请求中的 response_format
+// 返回 JSON Schema（json_object 时为 nil）、schema 名称；未要求 JSON 输出时 ok 为 false
+func ResponseFormatSchema(openaiRequest map[string]interface{}) (schema map[string]interface{}, name string, ok bool) {
+	responseFormat, _ := openaiRequest["response_format"].(map[string]interface{})
+	switch formatType, _ := responseFormat["type"].(string); formatType {
+	case "json_object":
+		return nil, "", true
+	case "json_schema":
+		jsonSchema, _ := responseFormat["json_schema"].(map[string]interface{})
+		schema, _ = jsonSchema["schema"].(map[string]interface{})
+		name, _ = jsonSchema["name"].(string)
+		return schema, name, true
+	}
+	return nil, "", false
+}
+
+// applyClaudeStructuredOutput 将 response_format 转换为 Claude 请求的强制工具或提示词
+// schema 根类型为 object 且未启用思考模式时强制调用 structured_output 工具（思考模式不允许强制工具），
+// 其他情况在 system 中追加只输出 JSON 的说明
+func applyClaudeStructuredOutput(openaiRequest map[string]interface{}, claudeRequest map[string]interface{}) {
+	schema, name, ok := ResponseFormatSchema(openaiRequest)
+	if !ok {
+		return
+	}
+
+	_, thinking := claudeRequest["thinking"]
+	if schema != nil && !thinking && (schema["type"] == nil || schema["type"] == "object") {
+		description := "按要求的 JSON Schema 输出最终回答，参数即回答内容"
+		if name != "" {
+			description = fmt.Sprintf("%s（%s）", description, name)
+		}
+		tools, _ := claudeRequest["tools"].([]map[string]interface{})
+		claudeRequest["tools"] = append(tools, map[string]interface{}{
+			"name":         structuredOutputToolName,
+			"description":  description,
+			"input_schema": schema,
+		})
+		// 同时提供了其他工具时允许模型先调用这些工具
+		if len(tools) > 0 {
+			claudeRequest["tool_choice"] = map[string]interface{}{"type": "any"}
+		} else {
+			claudeRequest["tool_choice"] = map[string]interface{}{"type": "tool", "name": structuredOutputToolName}
+		}
+		logger.Printf("response_format 转换为强制工具 %s", structuredOutputToolName)
+		return
+	}
+
+	instruction := "只输出一个合法的 JSON 值，不要输出 Markdown 代码块或任何解释文字。"
+	if schema != nil {
+		schemaJSON, _ := json.Marshal(schema)
+		instruction = fmt.Sprintf("%s输出必须符合以下 JSON Schema：\n%s", instruction, string(schemaJSON))
+	}
+	system, _ := claudeRequest["system"].(string)
+	claudeRequest["system"] = strings.TrimSpace(system + "\n\n" + instruction)
+	logger.Println("response_format 转换为 system 中的 JSON 输出说明")
+}
+
+// claudeStructuredOutput 返回 Claude 响应中 structured_output 工具的参数（JSON 字符串）
+func claudeStructuredOutput(claudeResponse map[string]interface{}) (string, bool) {
+	contentList, _ := claudeResponse["content"].([]interface{})
+	for _, item := range contentList {
+		itemMap, _ := item.(map[string]interface{})
+		if itemMap["type"] != "tool_use" || itemMap["name"] != structuredOutputToolName {
+			continue
+		}
+		inputJSON, err := json.Marshal(itemMap["input"])
+		if err != nil {
+			return "", false
+		}
+		return string(inputJSON), true
+	}
+	return "", false
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"digitalsingularity/backend/silicoid/interceptor"
+)
+
+// SilicoID OpenAI兼容接口 - 批量任务（/v1/batches）
+// 路由: POST /v1/batches
+func silicoidCreateBatch(w http.ResponseWriter, r *http.Request) {
+	requestID := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+	logger.Printf("[%s] 收到创建批量任务请求", requestID)
+
+	if !ensureBatchInterceptor(w, requestID) {
+		return
+	}
+	interceptorService.HandleHTTPCreateBatch(createGinContext(w, r))
+}
+
+// 路由: GET /v1/batches
+func silicoidListBatches(w http.ResponseWriter, r *http.Request) {
+	requestID := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+
+	if !ensureBatchInterceptor(w, requestID) {
+		return
+	}
+	interceptorService.HandleHTTPListBatches(createGinContext(w, r))
+}
+
+// 路由: GET /v1/batches/{batch_id}
+func silicoidGetBatch(w http.ResponseWriter, r *http.Request) {
+	requestID := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+
+	if !ensureBatchInterceptor(w, requestID) {
+		return
+	}
+	interceptorService.HandleHTTPGetBatch(createGinContext(w, r), mux.Vars(r)["batch_id"])
+}
+
+// 路由: POST /v1/batches/{batch_id}/cancel
+func silicoidCancelBatch(w http.ResponseWriter, r *http.Request) {
+	requestID := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+	batchID := mux.Vars(r)["batch_id"]
+	logger.Printf("[%s] 收到取消批量任务请求: %s", requestID, batchID)
+
+	if !ensureBatchInterceptor(w, requestID) {
+		return
+	}
+	interceptorService.HandleHTTPCancelBatch(createGinContext(w, r), batchID)
+}
+
+// ensureBatchInterceptor 确保拦截器已初始化（线程安全），不可用时返回错误响应
+func ensureBatchInterceptor(w http.ResponseWriter, requestID string) bool {
+	interceptorOnce.Do(func() {
+		interceptorService = interceptor.CreateInterceptor()
+		if interceptorService == nil {
+			logger.Printf("❌ SilicoID拦截器初始化失败")
+		}
+	})
+
+	if interceptorService == nil {
+		logger.Printf("[%s] 拦截器服务不可用", requestID)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"message":"服务不可用","type":"internal_error","code":"service_unavailable"}}`))
+		return false
+	}
+	return true
+}
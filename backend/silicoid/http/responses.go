@@ -0,0 +1,64 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"digitalsingularity/backend/silicoid/interceptor"
+)
+
+// SilicoID OpenAI兼容接口 - Responses API（/v1/responses）
+func silicoidResponses(w http.ResponseWriter, r *http.Request) {
+	requestID := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+	logger.Printf("[%s] 收到Responses请求", requestID)
+
+	// 确保拦截器已初始化（线程安全）
+	interceptorOnce.Do(func() {
+		interceptorService = interceptor.CreateInterceptor()
+		if interceptorService == nil {
+			logger.Printf("❌ SilicoID拦截器初始化失败")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":{"message":"服务初始化失败","type":"internal_error","code":"service_initialization_failed"}}`))
+			return
+		}
+		logger.Printf("✅ SilicoID拦截器初始化成功")
+	})
+
+	// 确保拦截器服务可用
+	if interceptorService == nil {
+		logger.Printf("[%s] 拦截器服务不可用", requestID)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"message":"服务不可用","type":"internal_error","code":"service_unavailable"}}`))
+		return
+	}
+
+	// input 条目和 previous_response_id 由拦截器转换为聊天请求，认证、模型路由和计费与聊天接口相同
+	interceptorService.HandleHTTPResponses(createGinContext(w, r))
+}
+
+// 路由: GET /v1/responses/{response_id}
+func silicoidGetResponse(w http.ResponseWriter, r *http.Request) {
+	requestID := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+	responseID := mux.Vars(r)["response_id"]
+	logger.Printf("[%s] 收到获取响应请求: %s", requestID, responseID)
+
+	// 确保拦截器已初始化（线程安全）
+	interceptorOnce.Do(func() {
+		interceptorService = interceptor.CreateInterceptor()
+		if interceptorService == nil {
+			logger.Printf("❌ SilicoID拦截器初始化失败")
+		}
+	})
+
+	if interceptorService == nil {
+		logger.Printf("[%s] 拦截器服务不可用", requestID)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"message":"服务不可用","type":"internal_error","code":"service_unavailable"}}`))
+		return
+	}
+
+	interceptorService.HandleHTTPGetResponse(createGinContext(w, r), responseID)
+}
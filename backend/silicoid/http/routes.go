@@ -16,6 +16,14 @@ func setupRoutes() http.Handler {
 	
 	// 注册OpenAI兼容接口
 	router.HandleFunc("/v1/chat/completions", silicoidChatCompletions).Methods("POST", "OPTIONS")
+	router.HandleFunc("/v1/embeddings", silicoidEmbeddings).Methods("POST", "OPTIONS")
+	router.HandleFunc("/v1/messages", silicoidMessages).Methods("POST", "OPTIONS")
+	router.HandleFunc("/v1/responses", silicoidResponses).Methods("POST", "OPTIONS")
+	router.HandleFunc("/v1/responses/{response_id}", silicoidGetResponse).Methods("GET", "OPTIONS")
+	router.HandleFunc("/v1/batches", silicoidCreateBatch).Methods("POST", "OPTIONS")
+	router.HandleFunc("/v1/batches", silicoidListBatches).Methods("GET")
+	router.HandleFunc("/v1/batches/{batch_id}", silicoidGetBatch).Methods("GET", "OPTIONS")
+	router.HandleFunc("/v1/batches/{batch_id}/cancel", silicoidCancelBatch).Methods("POST", "OPTIONS")
 	router.HandleFunc("/v1/models", silicoidModels).Methods("GET", "OPTIONS")
 	
 	// 注册模型维护接口
@@ -27,7 +35,7 @@ func setupRoutes() http.Handler {
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "x-api-key", "anthropic-version", "anthropic-beta"},
 	})
 	
 	return corsHandler.Handler(router)
@@ -21,16 +21,16 @@ func silicoidChatCompletions(w http.ResponseWriter, r *http.Request) {
 		logger.Printf("✅ SilicoID拦截器初始化成功")
 	})
 
-	// 解析请求体
-	var data map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		logger.Printf("[%s] 解析请求体失败: %v", requestID, err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error":{"message":"无效的JSON格式","type":"invalid_request","code":"invalid_request"}}`))
+	// 确保拦截器服务可用
+	if interceptorService == nil {
+		logger.Printf("[%s] 拦截器服务不可用", requestID)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"message":"服务不可用","type":"internal_error","code":"service_unavailable"}}`))
 		return
 	}
 
-	SilicoidChatCompletions(w, r, data, requestID)
+	// 认证、模型路由和计费由拦截器处理，按认证的用户和平台 Key 统计用量
+	interceptorService.HandleHTTPChatCompletions(createGinContext(w, r))
 }
 	
 // SilicoidChatCompletions直接处理聊天完成请求（不通过service.go的中间层）
@@ -0,0 +1,721 @@
+package interceptor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"digitalsingularity/backend/common/userfiles"
+	"digitalsingularity/backend/common/utils/datahandle"
+)
+
+// 批量任务（/v1/batches）：输入为通过 userfiles 上传的 JSONL 文件，每行一个聊天请求，
+// 后台按工作池并行处理，结果写入输出 JSONL 文件，每条请求与普通请求一样计费
+const (
+	batchKeyPrefix      = "silicoid:batch:"
+	batchListKeyPrefix  = "silicoid:batches:"
+	batchLeaseKeyPrefix = "silicoid:batch:lease:"
+	// batchRecordExpire 批量任务记录的保存时间
+	batchRecordExpire = 30 * 24 * time.Hour
+	// batchListMaxEntries 每个用户保留的批量任务记录数
+	batchListMaxEntries = 1000
+	// batchCompletionWindow 批量任务的完成时限，超时未处理的请求记为 batch_expired
+	batchCompletionWindow = 24 * time.Hour
+	// batchMaxRequests 单个批量任务的最大请求数
+	batchMaxRequests = 50000
+	// batchMaxWorkers 单个批量任务的并行请求数
+	batchMaxWorkers = 8
+	// batchRateLimitRetries 密钥达到速率限制时的最大重试次数（每次等到下一分钟）
+	batchRateLimitRetries = 10
+	// batchProgressInterval 每处理多少条请求保存一次进度（同时检查其他实例发起的取消）
+	batchProgressInterval = 20
+	// batchLeaseTTL 处理任务的实例持有的租约有效期，处理期间每 batchLeaseRenewInterval 续期一次；
+	// 租约过期（处理的实例已退出）时任务视为处理中断，速率限制等待再久也不会误判
+	batchLeaseTTL           = 2 * time.Minute
+	batchLeaseRenewInterval = 30 * time.Second
+	// batchEndpoint 批量任务支持的接口
+	batchEndpoint = "/v1/chat/completions"
+)
+
+// BatchRequestCounts 批量任务的请求统计
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// BatchJob 批量任务（OpenAI Batch 对象）
+type BatchJob struct {
+	ID               string                 `json:"id"`
+	Object           string                 `json:"object"`
+	Endpoint         string                 `json:"endpoint"`
+	InputFileID      string                 `json:"input_file_id"`
+	CompletionWindow string                 `json:"completion_window"`
+	Status           string                 `json:"status"`
+	OutputFileID     string                 `json:"output_file_id,omitempty"`
+	ErrorFileID      string                 `json:"error_file_id,omitempty"`
+	Errors           map[string]interface{} `json:"errors,omitempty"`
+	CreatedAt        int64                  `json:"created_at"`
+	InProgressAt     int64                  `json:"in_progress_at,omitempty"`
+	ExpiresAt        int64                  `json:"expires_at"`
+	FinalizingAt     int64                  `json:"finalizing_at,omitempty"`
+	CompletedAt      int64                  `json:"completed_at,omitempty"`
+	FailedAt         int64                  `json:"failed_at,omitempty"`
+	ExpiredAt        int64                  `json:"expired_at,omitempty"`
+	CancellingAt     int64                  `json:"cancelling_at,omitempty"`
+	CancelledAt      int64                  `json:"cancelled_at,omitempty"`
+	RequestCounts    BatchRequestCounts     `json:"request_counts"`
+	Metadata         map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// batchRecord Redis 中保存的批量任务，包含不返回给客户端的所有者和计费信息
+type batchRecord struct {
+	BatchJob
+	UserID    string `json:"user_id"`
+	APIKeyID  int    `json:"api_key_id,omitempty"` // 创建任务使用的平台 Key 的ID，每条请求按该 Key 统计用量
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// batchLine 输入文件中的一条请求
+type batchLine struct {
+	Index    int
+	CustomID string
+	Body     json.RawMessage
+}
+
+// batchLineResult 一条请求的处理结果（输出文件中的一行）
+type batchLineResult struct {
+	Output map[string]interface{}
+	Failed bool
+}
+
+// runningBatches 当前实例正在处理的批量任务：任务ID -> 取消函数
+var runningBatches sync.Map
+
+// HandleHTTPCreateBatch 创建批量任务（POST /v1/batches）
+func (s *SilicoIDInterceptor) HandleHTTPCreateBatch(c *gin.Context) {
+	userID, apiKeyID, err := s.batchUser(c)
+	if err != nil {
+		openAIError(c, http.StatusUnauthorized, err.Error(), "authentication_error", "invalid_api_key")
+		return
+	}
+
+	var request struct {
+		InputFileID      string                 `json:"input_file_id"`
+		Endpoint         string                 `json:"endpoint"`
+		CompletionWindow string                 `json:"completion_window"`
+		Metadata         map[string]interface{} `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		openAIError(c, http.StatusBadRequest, "无效的请求数据: "+err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	if request.InputFileID == "" {
+		openAIError(c, http.StatusBadRequest, "缺少 input_file_id 参数", "invalid_request_error", "invalid_request")
+		return
+	}
+	if request.Endpoint != batchEndpoint {
+		openAIError(c, http.StatusBadRequest, "endpoint 只支持 "+batchEndpoint, "invalid_request_error", "invalid_endpoint")
+		return
+	}
+	if request.CompletionWindow != "" && request.CompletionWindow != "24h" {
+		openAIError(c, http.StatusBadRequest, "completion_window 只支持 24h", "invalid_request_error", "invalid_completion_window")
+		return
+	}
+
+	if hasTokens, _, err, _ := s.apiKeyManageService.CheckUserTokens(userID); !hasTokens {
+		message := "令牌余额不足"
+		if err != nil {
+			message += ": " + err.Error()
+		}
+		openAIError(c, http.StatusPaymentRequired, message, "insufficient_quota", "insufficient_quota")
+		return
+	}
+
+	lines, err := s.readBatchInput(userID, request.InputFileID)
+	if err != nil {
+		logger.Printf("读取批量任务输入文件失败: %s, %v", request.InputFileID, err)
+		openAIError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_input_file")
+		return
+	}
+
+	now := time.Now()
+	record := &batchRecord{
+		BatchJob: BatchJob{
+			ID:               "batch_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Object:           "batch",
+			Endpoint:         batchEndpoint,
+			InputFileID:      request.InputFileID,
+			CompletionWindow: "24h",
+			Status:           "in_progress",
+			CreatedAt:        now.Unix(),
+			InProgressAt:     now.Unix(),
+			ExpiresAt:        now.Add(batchCompletionWindow).Unix(),
+			RequestCounts:    BatchRequestCounts{Total: len(lines)},
+			Metadata:         request.Metadata,
+		},
+		UserID:   userID,
+		APIKeyID: apiKeyID,
+	}
+	// 先取得处理租约再保存任务，查询时不会把尚未开始处理的任务视为中断
+	releaseLease := s.holdBatchLease(record.ID)
+	if err := s.saveBatch(record); err != nil {
+		releaseLease()
+		openAIError(c, http.StatusInternalServerError, "保存批量任务失败: "+err.Error(), "server_error", "batch_creation_failed")
+		return
+	}
+	if result := s.readWrite.PushRedisList(batchListKeyPrefix+userID, record.ID, batchListMaxEntries, batchRecordExpire); !result.IsSuccess() {
+		logger.Printf("[%s] ⚠️ 写入用户批量任务列表失败: %v", record.ID, result.Error)
+	}
+
+	go s.runBatch(record, lines, releaseLease)
+
+	logger.Printf("[%s] 批量任务已创建: 用户=%s, 请求数=%d", record.ID, userID, len(lines))
+	c.JSON(http.StatusOK, record.BatchJob)
+}
+
+// HandleHTTPGetBatch 查询批量任务状态（GET /v1/batches/{batch_id}）
+func (s *SilicoIDInterceptor) HandleHTTPGetBatch(c *gin.Context, batchID string) {
+	record, ok := s.ownedBatch(c, batchID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, record.BatchJob)
+}
+
+// HandleHTTPCancelBatch 取消批量任务（POST /v1/batches/{batch_id}/cancel）
+// 已完成的请求结果仍会写入输出文件
+func (s *SilicoIDInterceptor) HandleHTTPCancelBatch(c *gin.Context, batchID string) {
+	record, ok := s.ownedBatch(c, batchID)
+	if !ok {
+		return
+	}
+	if record.Status != "in_progress" && record.Status != "validating" {
+		openAIError(c, http.StatusConflict, fmt.Sprintf("批量任务当前状态为 %s，无法取消", record.Status), "invalid_request_error", "batch_not_cancellable")
+		return
+	}
+
+	record.Status = "cancelling"
+	record.CancellingAt = time.Now().Unix()
+	if err := s.saveBatch(record); err != nil {
+		openAIError(c, http.StatusInternalServerError, "保存批量任务失败: "+err.Error(), "server_error", "batch_update_failed")
+		return
+	}
+	// 本实例正在处理时立即停止，其他实例在下次保存进度时检查到取消状态
+	if cancel, running := runningBatches.Load(batchID); running {
+		cancel.(context.CancelFunc)()
+	}
+	logger.Printf("[%s] 批量任务取消中", batchID)
+	c.JSON(http.StatusOK, record.BatchJob)
+}
+
+// HandleHTTPListBatches 列出当前用户的批量任务（GET /v1/batches），支持 limit 和 after 分页
+func (s *SilicoIDInterceptor) HandleHTTPListBatches(c *gin.Context) {
+	userID, _, err := s.batchUser(c)
+	if err != nil {
+		openAIError(c, http.StatusUnauthorized, err.Error(), "authentication_error", "invalid_api_key")
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	after := c.Query("after")
+
+	var ids []string
+	if result := s.readWrite.GetRedisList(batchListKeyPrefix + userID); result.IsSuccess() {
+		ids, _ = result.Data.([]string)
+	}
+	if after != "" {
+		for i, id := range ids {
+			if id == after {
+				ids = ids[i+1:]
+				break
+			}
+		}
+	}
+
+	data := make([]interface{}, 0, limit)
+	hasMore := false
+	for _, id := range ids {
+		record, err := s.loadBatch(id)
+		if err != nil || record.UserID != userID {
+			continue
+		}
+		if len(data) == limit {
+			hasMore = true
+			break
+		}
+		data = append(data, record.BatchJob)
+	}
+
+	response := gin.H{"object": "list", "data": data, "has_more": hasMore}
+	if len(data) > 0 {
+		response["first_id"] = data[0].(BatchJob).ID
+		response["last_id"] = data[len(data)-1].(BatchJob).ID
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// batchUser 批量任务只支持平台用户（平台 Key 或 AuthToken），输入输出文件保存在用户的 userfiles 中
+// 使用平台 Key 时同时返回 Key 的ID（任务记录中不保存明文 Key）
+func (s *SilicoIDInterceptor) batchUser(c *gin.Context) (userID string, apiKeyID int, err error) {
+	if apiKey := s.extractApiKey(c); apiKey != "" {
+		if strings.HasPrefix(apiKey, "sk-") && !strings.HasPrefix(apiKey, "sk-potagi-") {
+			return "", 0, fmt.Errorf("批量任务不支持使用自己的 Key，请使用平台 API Key")
+		}
+		valid, id, keyID, err := s.apiKeyManageService.VerifyApiKeyWithID(apiKey)
+		if !valid {
+			return "", 0, fmt.Errorf("API密钥验证失败: %v", err)
+		}
+		return id, keyID, nil
+	}
+	if authToken := s.extractAuthToken(c); authToken != "" {
+		valid, id, errorMessage := s.verifyAuthToken(authToken)
+		if !valid {
+			return "", 0, fmt.Errorf("AuthToken验证失败: %s", errorMessage)
+		}
+		return id, 0, nil
+	}
+	return "", 0, fmt.Errorf("请提供有效的API密钥或Token")
+}
+
+// ownedBatch 加载属于当前用户的批量任务，失败时返回错误响应
+func (s *SilicoIDInterceptor) ownedBatch(c *gin.Context, batchID string) (*batchRecord, bool) {
+	userID, _, err := s.batchUser(c)
+	if err != nil {
+		openAIError(c, http.StatusUnauthorized, err.Error(), "authentication_error", "invalid_api_key")
+		return nil, false
+	}
+	record, err := s.loadBatch(batchID)
+	if err != nil || record.UserID != userID {
+		openAIError(c, http.StatusNotFound, "未找到批量任务: "+batchID, "invalid_request_error", "batch_not_found")
+		return nil, false
+	}
+	return record, true
+}
+
+// readBatchInput 读取并校验输入 JSONL 文件
+// 每行格式：{"custom_id": "...", "method": "POST", "url": "/v1/chat/completions", "body": {...}}
+func (s *SilicoIDInterceptor) readBatchInput(userID string, fileID string) ([]*batchLine, error) {
+	file, err := s.fileService.DownloadFile(userID, &userfiles.DownloadFileRequest{FileId: fileID})
+	if err != nil || !file.Success {
+		message := "文件不存在"
+		if file != nil && file.Message != "" {
+			message = file.Message
+		}
+		return nil, fmt.Errorf("无法读取输入文件 %s: %s", fileID, message)
+	}
+	content, err := os.ReadFile(file.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取输入文件 %s: %v", fileID, err)
+	}
+
+	var lines []*batchLine
+	customIDs := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var entry struct {
+			CustomID string          `json:"custom_id"`
+			Method   string          `json:"method"`
+			URL      string          `json:"url"`
+			Body     json.RawMessage `json:"body"`
+		}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("第 %d 行不是合法的 JSON: %v", lineNumber, err)
+		}
+		if entry.CustomID == "" {
+			return nil, fmt.Errorf("第 %d 行缺少 custom_id", lineNumber)
+		}
+		if customIDs[entry.CustomID] {
+			return nil, fmt.Errorf("第 %d 行的 custom_id 重复: %s", lineNumber, entry.CustomID)
+		}
+		if entry.Method != "" && !strings.EqualFold(entry.Method, http.MethodPost) {
+			return nil, fmt.Errorf("第 %d 行的 method 只支持 POST", lineNumber)
+		}
+		if entry.URL != batchEndpoint {
+			return nil, fmt.Errorf("第 %d 行的 url 必须与任务的 endpoint 一致: %s", lineNumber, batchEndpoint)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(entry.Body, &body); err != nil || body == nil {
+			return nil, fmt.Errorf("第 %d 行的 body 必须是 JSON 对象", lineNumber)
+		}
+		if model, _ := body["model"].(string); model == "" {
+			return nil, fmt.Errorf("第 %d 行缺少模型参数", lineNumber)
+		}
+
+		customIDs[entry.CustomID] = true
+		lines = append(lines, &batchLine{Index: len(lines), CustomID: entry.CustomID, Body: entry.Body})
+		if len(lines) > batchMaxRequests {
+			return nil, fmt.Errorf("请求数超过上限 %d", batchMaxRequests)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取输入文件失败: %v", err)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("输入文件中没有请求")
+	}
+	return lines, nil
+}
+
+// runBatch 后台处理批量任务：固定数量的工作协程并行处理所有请求，结束后写入输出文件并更新任务状态
+// releaseLease 释放创建任务时取得的处理租约，任务结束后调用
+func (s *SilicoIDInterceptor) runBatch(record *batchRecord, lines []*batchLine, releaseLease func()) {
+	defer releaseLease()
+	ctx, cancel := context.WithDeadline(context.Background(), time.Unix(record.ExpiresAt, 0))
+	defer cancel()
+	runningBatches.Store(record.ID, cancel)
+	defer runningBatches.Delete(record.ID)
+
+	results := make([]*batchLineResult, len(lines))
+	var completed, failed, processed int64
+	var progressMu sync.Mutex
+
+	handleLine := func(line *batchLine) {
+		if ctx.Err() != nil {
+			return
+		}
+		result := s.processBatchLineSafely(ctx, record, line)
+		if ctx.Err() != nil && result.Failed {
+			// 取消或超时中断的请求不计入结果
+			return
+		}
+		results[line.Index] = result
+		if result.Failed {
+			atomic.AddInt64(&failed, 1)
+		} else {
+			atomic.AddInt64(&completed, 1)
+		}
+
+		if atomic.AddInt64(&processed, 1)%batchProgressInterval == 0 {
+			progressMu.Lock()
+			defer progressMu.Unlock()
+			// 已取消时不再保存进度，避免覆盖取消状态；其他实例发起的取消只能通过 Redis 中的状态感知
+			if ctx.Err() != nil {
+				return
+			}
+			if latest, err := s.loadBatch(record.ID); err == nil && latest.Status == "cancelling" {
+				record.Status = latest.Status
+				record.CancellingAt = latest.CancellingAt
+				cancel()
+				return
+			}
+			record.RequestCounts.Completed = int(atomic.LoadInt64(&completed))
+			record.RequestCounts.Failed = int(atomic.LoadInt64(&failed))
+			if err := s.saveBatch(record); err != nil {
+				logger.Printf("[%s] ⚠️ 保存批量任务进度失败: %v", record.ID, err)
+			}
+		}
+	}
+
+	lineChan := make(chan *batchLine)
+	var wg sync.WaitGroup
+	for i := 0; i < batchMaxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range lineChan {
+				handleLine(line)
+			}
+		}()
+	}
+	for _, line := range lines {
+		select {
+		case lineChan <- line:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(lineChan)
+	wg.Wait()
+
+	record.RequestCounts.Completed = int(completed)
+	record.RequestCounts.Failed = int(failed)
+
+	// 读取最新状态：处理期间可能已被取消
+	if latest, err := s.loadBatch(record.ID); err == nil && latest.Status == "cancelling" {
+		record.Status = latest.Status
+		record.CancellingAt = latest.CancellingAt
+	}
+	cancelled := record.Status == "cancelling" || ctx.Err() == context.Canceled
+	expired := !cancelled && ctx.Err() == context.DeadlineExceeded
+
+	// 未处理的请求：超时时记为 batch_expired，取消时不写入
+	if expired {
+		for i, line := range lines {
+			if results[i] == nil {
+				results[i] = batchErrorResult(line, nil, "batch_expired", "批量任务在完成时限内未处理该请求")
+			}
+		}
+	}
+
+	now := time.Now().Unix()
+	if !cancelled && !expired {
+		record.Status = "finalizing"
+		record.FinalizingAt = now
+		s.saveBatch(record)
+	}
+
+	if err := s.writeBatchOutput(record, results); err != nil {
+		logger.Printf("[%s] ❌ 写入批量任务输出文件失败: %v", record.ID, err)
+		record.Status = "failed"
+		record.FailedAt = time.Now().Unix()
+		record.Errors = batchErrors("output_write_failed", err.Error())
+	} else {
+		switch {
+		case cancelled:
+			record.Status = "cancelled"
+			record.CancelledAt = time.Now().Unix()
+		case expired:
+			record.Status = "expired"
+			record.ExpiredAt = time.Now().Unix()
+		default:
+			record.Status = "completed"
+			record.CompletedAt = time.Now().Unix()
+		}
+	}
+	if err := s.saveBatch(record); err != nil {
+		logger.Printf("[%s] ⚠️ 保存批量任务状态失败: %v", record.ID, err)
+	}
+	logger.Printf("[%s] 批量任务结束: 状态=%s, 成功=%d, 失败=%d, 总数=%d",
+		record.ID, record.Status, record.RequestCounts.Completed, record.RequestCounts.Failed, record.RequestCounts.Total)
+}
+
+// processBatchLineSafely 处理一条请求，处理过程中的 panic 记为该请求失败，不影响其他请求和服务进程
+func (s *SilicoIDInterceptor) processBatchLineSafely(ctx context.Context, record *batchRecord, line *batchLine) (result *batchLineResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Printf("[%s-%d] ❌ 处理批量请求异常: %v", record.ID, line.Index, r)
+			result = batchErrorResult(line, nil, "internal_error", fmt.Sprintf("处理请求异常: %v", r))
+		}
+	}()
+	return s.processBatchLine(ctx, record, line)
+}
+
+// processBatchLine 处理一条请求：与普通非流式请求走相同的路由、降级、缓存和计费流程
+// 所有可用密钥都达到速率限制时等到下一分钟重试
+func (s *SilicoIDInterceptor) processBatchLine(ctx context.Context, record *batchRecord, line *batchLine) *batchLineResult {
+	requestID := fmt.Sprintf("%s-%d", record.ID, line.Index)
+
+	for attempt := 0; ; attempt++ {
+		// 每次尝试重新解析请求体，处理流程会修改请求数据
+		var data map[string]interface{}
+		json.Unmarshal(line.Body, &data)
+		stripInternalFields(data)
+		data["stream"] = false
+		delete(data, "stream_options")
+		if record.APIKeyID > 0 {
+			data[apiKeyIDField] = record.APIKeyID
+		}
+
+		data, err := s.processFilesInRequest(data, record.UserID, requestID)
+		if err != nil {
+			return batchErrorResult(line, nil, "invalid_request", "处理文件失败: "+err.Error())
+		}
+
+		response, err := s.createNonStreamResponse(ctx, requestID, record.UserID, false, data)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "令牌余额不足") {
+				return batchErrorResult(line, nil, "insufficient_quota", err.Error())
+			}
+			return batchErrorResult(line, nil, "request_failed", err.Error())
+		}
+
+		errObj, hasError := response["error"]
+		if !hasError {
+			return &batchLineResult{Output: map[string]interface{}{
+				"id":        "batch_req_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+				"custom_id": line.CustomID,
+				"response": map[string]interface{}{
+					"status_code": http.StatusOK,
+					"request_id":  requestID,
+					"body":        response,
+				},
+				"error": nil,
+			}}
+		}
+
+		if !isRateLimitError(errObj) || attempt >= batchRateLimitRetries {
+			return batchErrorResult(line, response, "request_failed", fmt.Sprintf("%v", errObj))
+		}
+		// 速率限制按分钟计数，等到下一分钟再试
+		wait := time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)) + time.Duration(line.Index%10)*100*time.Millisecond
+		logger.Printf("[%s] 密钥达到速率限制，%v 后重试 (第 %d 次)", requestID, wait.Round(time.Second), attempt+1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return batchErrorResult(line, response, "request_failed", fmt.Sprintf("%v", errObj))
+		}
+	}
+}
+
+// isRateLimitError 判断错误是否由密钥速率限制引起（密钥池的限额或上游 429）
+func isRateLimitError(errValue interface{}) bool {
+	errMap, _ := errValue.(map[string]interface{})
+	if code, _ := errMap["code"].(string); code == "rate_limit_exceeded" {
+		return true
+	}
+	message := strings.ToLower(fmt.Sprintf("%v", errValue))
+	return strings.Contains(message, "速率限制") || strings.Contains(message, "rate limit")
+}
+
+// batchErrorResult 生成失败请求的输出行，response 为上游返回的错误响应（没有时为 nil）
+func batchErrorResult(line *batchLine, response map[string]interface{}, code string, message string) *batchLineResult {
+	output := map[string]interface{}{
+		"id":        "batch_req_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		"custom_id": line.CustomID,
+		"response":  nil,
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+	}
+	if response != nil {
+		output["response"] = map[string]interface{}{
+			"status_code": http.StatusBadRequest,
+			"body":        response,
+		}
+	}
+	return &batchLineResult{Output: output, Failed: true}
+}
+
+// batchErrors 生成 Batch 对象的 errors 字段
+func batchErrors(code string, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"object": "list",
+		"data": []interface{}{
+			map[string]interface{}{"code": code, "message": message},
+		},
+	}
+}
+
+// writeBatchOutput 按输入顺序将成功和失败的结果分别写入输出文件和错误文件（上传到用户的 userfiles）
+func (s *SilicoIDInterceptor) writeBatchOutput(record *batchRecord, results []*batchLineResult) error {
+	var output, errorOutput bytes.Buffer
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		encoded, err := json.Marshal(result.Output)
+		if err != nil {
+			continue
+		}
+		target := &output
+		if result.Failed {
+			target = &errorOutput
+		}
+		target.Write(encoded)
+		target.WriteByte('\n')
+	}
+
+	upload := func(content []byte, name string) (string, error) {
+		if len(content) == 0 {
+			return "", nil
+		}
+		result, err := s.fileService.UploadFile(record.UserID, &userfiles.UploadFileRequest{
+			FileData: base64.StdEncoding.EncodeToString(content),
+			FileName: name,
+			FileType: "batch",
+			MimeType: "application/jsonl",
+			FileSize: int64(len(content)),
+		})
+		if err != nil {
+			return "", err
+		}
+		if !result.Success {
+			return "", fmt.Errorf("%s", result.Message)
+		}
+		return result.FileId, nil
+	}
+
+	var err error
+	if record.OutputFileID, err = upload(output.Bytes(), record.ID+"_output.jsonl"); err != nil {
+		return fmt.Errorf("上传输出文件失败: %v", err)
+	}
+	if record.ErrorFileID, err = upload(errorOutput.Bytes(), record.ID+"_errors.jsonl"); err != nil {
+		return fmt.Errorf("上传错误文件失败: %v", err)
+	}
+	return nil
+}
+
+// saveBatch 保存批量任务记录
+func (s *SilicoIDInterceptor) saveBatch(record *batchRecord) error {
+	record.UpdatedAt = time.Now().Unix()
+	if result := s.readWrite.RedisWrite(batchKeyPrefix+record.ID, record, batchRecordExpire); !result.IsSuccess() {
+		return fmt.Errorf("%v", result.Error)
+	}
+	return nil
+}
+
+// holdBatchLease 取得任务的处理租约并在后台定期续期，返回停止续期并释放租约的函数
+func (s *SilicoIDInterceptor) holdBatchLease(batchID string) func() {
+	key := batchLeaseKeyPrefix + batchID
+	s.readWrite.SetRedis(key, "1", batchLeaseTTL)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(batchLeaseRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.readWrite.SetRedis(key, "1", batchLeaseTTL)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			s.readWrite.DeleteRedis(key)
+		})
+	}
+}
+
+// loadBatch 加载批量任务记录
+// 处理中的任务的租约已过期且不在本实例处理时（处理的实例已退出），标记为失败
+func (s *SilicoIDInterceptor) loadBatch(batchID string) (*batchRecord, error) {
+	result := s.readWrite.GetRedis(batchKeyPrefix + batchID)
+	if !result.IsSuccess() {
+		return nil, fmt.Errorf("批量任务不存在: %s", batchID)
+	}
+	value, _ := result.Data.(string)
+	var record batchRecord
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return nil, fmt.Errorf("批量任务记录格式错误: %v", err)
+	}
+
+	if record.Status == "in_progress" || record.Status == "cancelling" {
+		_, running := runningBatches.Load(batchID)
+		if !running && s.readWrite.GetRedis(batchLeaseKeyPrefix+batchID).Status == datahandle.StatusNotFound {
+			logger.Printf("[%s] 批量任务的处理租约已过期，标记为失败", batchID)
+			record.Status = "failed"
+			record.FailedAt = time.Now().Unix()
+			record.Errors = batchErrors("processing_interrupted", "批量任务处理中断，请重新提交")
+			s.saveBatch(&record)
+		}
+	}
+	return &record, nil
+}
@@ -0,0 +1,63 @@
+package interceptor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerProbeInterval 熔断探测的检查间隔
+	breakerProbeInterval = 30 * time.Second
+	// breakerProbeRequestTimeout 单个探测请求的超时时间
+	breakerProbeRequestTimeout = 15 * time.Second
+)
+
+// breakerProberOnce 拦截器可能被多次创建，探测任务只启动一次
+var breakerProberOnce sync.Once
+
+// startBreakerProber 启动熔断探测任务
+// 定期对冷却结束（半开状态）的密钥和 base_url 发送轻量的模型列表请求，成功则恢复，失败则以更长的冷却时间重新熔断
+func (s *SilicoIDInterceptor) startBreakerProber() {
+	if s.modelManager == nil {
+		return
+	}
+
+	breakerProberOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(breakerProbeInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				s.probeBreakers()
+			}
+		}()
+		logger.Printf("✅ 熔断探测任务已启动 (间隔 %v)", breakerProbeInterval)
+	})
+}
+
+// probeBreakers 对所有需要探测的目标发送一次探测请求
+func (s *SilicoIDInterceptor) probeBreakers() {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Printf("熔断探测异常: %v", r)
+		}
+	}()
+
+	for _, target := range s.modelManager.ProbeTargets() {
+		adapter := s.adapterForProvider(target.Model.Provider)
+
+		ctx, cancel := context.WithTimeout(context.Background(), breakerProbeRequestTimeout)
+		_, err := adapter.ListModels(ctx, target.Model.BaseURL, target.Key.APIKey, target.Model.ModelsEndpoint)
+		cancel()
+
+		if err != nil {
+			logger.Printf("⚠️ 熔断探测失败: model=%s, key=%d, base_url=%s, 错误: %v",
+				target.Model.ModelCode, target.Key.ID, target.Model.BaseURL, err)
+		} else {
+			logger.Printf("✅ 熔断探测成功: model=%s, key=%d, base_url=%s",
+				target.Model.ModelCode, target.Key.ID, target.Model.BaseURL)
+		}
+		s.modelManager.ReportProbeResult(target, err)
+	}
+}
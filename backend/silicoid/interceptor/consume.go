@@ -1,30 +1,353 @@
 package interceptor
 
-// deductTokensIfNeeded 通用token扣除方法
-// 检查是否需要扣除token，并在需要时执行扣除操作
-func (s *SilicoIDInterceptor) deductTokensIfNeeded(data map[string]interface{}, userID string, requestID string) {
-	// 解析并记录令牌使用情况
-	usage, _ := data["usage"].(map[string]interface{})
-	totalTokens := 0
-	if usage != nil {
-		if total, ok := usage["total_tokens"].(int); ok {
-			totalTokens = total
-		} else if totalFloat, ok := usage["total_tokens"].(float64); ok {
-			totalTokens = int(totalFloat)
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+
+	"digitalsingularity/backend/common/auth/apikey"
+	"digitalsingularity/backend/silicoid/database"
+	"digitalsingularity/backend/silicoid/models/manager"
+)
+
+// 服务层/适配器附加在响应中的内部计费字段，扣费后从响应中移除
+const (
+	keyIDField     = "_key_id"     // 实际使用的平台API密钥ID
+	modelCodeField = "_model_code" // 实际提供服务的模型代码（降级后可能与请求的模型不同）
+	apiKeyIDField  = "_api_key_id" // 用户调用时使用的平台认证 Key 的ID（认证时写入）
+)
+
+// defaultReserveMaxTokens 请求和模型都未指定 max_tokens 时，预占按该输出长度估算
+const defaultReserveMaxTokens = 4096
+
+// billingContext 一次请求的计费上下文
+type billingContext struct {
+	RequestID      string
+	UserID         string
+	APIKeyID       int                      // 用户使用的平台认证 Key 的ID，用于按 Key 统计用量
+	UseUserKey     bool                     // 使用用户自己的 Key 时不扣费
+	Model          *manager.ModelConfig     // 请求的模型配置
+	Reservation    *apikey.TokenReservation // 请求开始时的余额预占，结算或释放后失效
+	PromptEstimate int                      // 预占时估算的输入token，流式请求中断且未收到 usage 时用于结算
+}
+
+// estimateReservation 按 max_tokens 估算请求最多消耗的令牌数
+// 输入token按消息内容字符数粗略估算
+func estimateReservation(data map[string]interface{}, modelConfig *manager.ModelConfig) int {
+	// 向量请求没有输出，按 input 的字符数估算
+	if modelConfig != nil && modelConfig.IsEmbedding() {
+		promptTokens := 0
+		if inputJSON, err := json.Marshal(data["input"]); err == nil {
+			promptTokens = utf8.RuneCount(inputJSON) / 2
 		}
+		return modelConfig.CalculateCost(promptTokens, 0, 0, 0)
+	}
+
+	maxTokens := toInt(data["max_tokens"])
+	if maxTokens <= 0 {
+		maxTokens = toInt(data["max_completion_tokens"])
+	}
+	if maxTokens <= 0 && modelConfig != nil {
+		maxTokens = modelConfig.MaxTokens
+	}
+	if maxTokens <= 0 {
+		maxTokens = defaultReserveMaxTokens
+	}
+
+	promptTokens := estimatePromptTokens(data)
+	if modelConfig == nil {
+		return promptTokens + maxTokens
+	}
+	return modelConfig.CalculateCost(promptTokens, 0, 0, maxTokens)
+}
+
+// estimatePromptTokens 按消息内容字符数粗略估算输入token
+func estimatePromptTokens(data map[string]interface{}) int {
+	messagesJSON, err := json.Marshal(data["messages"])
+	if err != nil {
+		return 0
+	}
+	return utf8.RuneCount(messagesJSON) / 2
+}
+
+// reserveTokens 请求开始时按估算值预占用户余额
+// 余额（扣除其他进行中请求的预占后）已用完时返回错误
+func (s *SilicoIDInterceptor) reserveTokens(billing *billingContext, data map[string]interface{}) error {
+	if billing.UseUserKey || billing.UserID == "" {
+		return nil
+	}
+
+	estimate := estimateReservation(data, billing.Model)
+	billing.PromptEstimate = estimatePromptTokens(data)
+	reservation, available, err := s.apiKeyManageService.ReserveTokens(billing.UserID, estimate)
+	if err != nil {
+		logger.Printf("[%s] 预占令牌失败: %v", billing.RequestID, err)
+		return err
+	}
+	billing.Reservation = reservation
+	logger.Printf("[%s] 预占令牌: 估算=%d, 预占=%d, 剩余可用=%d", billing.RequestID, estimate, reservation.Amount, available)
+	return nil
+}
+
+// releaseReservation 释放请求的余额预占（已结算或已释放时无操作）
+func (s *SilicoIDInterceptor) releaseReservation(billing *billingContext) {
+	if billing == nil || billing.Reservation == nil {
+		return
 	}
+	s.apiKeyManageService.ReleaseReservation(billing.Reservation)
+	billing.Reservation = nil
+}
+
+// billingUsage 从 OpenAI 格式的 usage 中解析出的用量
+type billingUsage struct {
+	PromptTokens     int // 包含缓存命中和写入缓存的输入token
+	CachedTokens     int // 缓存命中的输入token（prompt_tokens_details.cached_tokens）
+	CacheWriteTokens int // 写入缓存的输入token（prompt_tokens_details.cache_creation_tokens，Claude 返回）
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// toInt 将 JSON 数值转换为 int
+func toInt(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// parseBillingUsage 解析 OpenAI 格式的 usage
+func parseBillingUsage(usage map[string]interface{}) billingUsage {
+	result := billingUsage{
+		PromptTokens:     toInt(usage["prompt_tokens"]),
+		CompletionTokens: toInt(usage["completion_tokens"]),
+		TotalTokens:      toInt(usage["total_tokens"]),
+	}
+	if details, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+		result.CachedTokens = toInt(details["cached_tokens"])
+		result.CacheWriteTokens = toInt(details["cache_creation_tokens"])
+	}
+	if result.TotalTokens == 0 {
+		result.TotalTokens = result.PromptTokens + result.CompletionTokens
+	}
+	return result
+}
+
+// popBillingFields 读取并移除响应中的内部计费字段
+func popBillingFields(data map[string]interface{}) (keyID int, modelCode string) {
+	keyID = toInt(data[keyIDField])
+	modelCode, _ = data[modelCodeField].(string)
+	delete(data, keyIDField)
+	delete(data, modelCodeField)
+	return keyID, modelCode
+}
+
+// deductTokensIfNeeded 通用token扣除方法
+// 按实际提供服务的模型价格分别计算输入/输出费用，扣除用户令牌并写入计费流水
+// 请求有余额预占时按实际费用结算预占，未产生费用时释放预占
+func (s *SilicoIDInterceptor) deductTokensIfNeeded(data map[string]interface{}, billing *billingContext) {
+	defer s.releaseReservation(billing)
+
+	keyID, modelCode := popBillingFields(data)
+	requestID := billing.RequestID
 
 	// 只有在使用平台 Key 时才扣除用户令牌
-	useUserKey, _ := data["_use_user_key"].(bool)
-	if !useUserKey && totalTokens > 0 {
-		success, remaining, err := s.apiKeyManageService.DeductTokens(userID, totalTokens)
-		if !success {
-			logger.Printf("[%s] 扣除令牌失败: %v", requestID, err)
+	if billing.UseUserKey {
+		logger.Printf("[%s] 使用用户自己的 Key，不扣除平台令牌", requestID)
+		return
+	}
+
+	usage, _ := data["usage"].(map[string]interface{})
+	if usage == nil {
+		return
+	}
+	used := parseBillingUsage(usage)
+	if used.TotalTokens <= 0 {
+		return
+	}
+
+	// 降级后按实际提供服务的模型计价
+	modelConfig := billing.Model
+	if modelCode != "" && (modelConfig == nil || modelConfig.ModelCode != modelCode) {
+		if servedConfig, err := s.modelManager.GetModelConfig(modelCode); err == nil {
+			modelConfig = servedConfig
 		} else {
-			logger.Printf("[%s] 扣除令牌成功，剩余: %d", requestID, remaining)
+			logger.Printf("[%s] ⚠️ 获取模型 %s 的价格失败: %v", requestID, modelCode, err)
 		}
-	} else if useUserKey {
-		logger.Printf("[%s] 使用用户自己的 Key，不扣除平台令牌", requestID)
+	}
+
+	amount := used.TotalTokens
+	entry := &database.BillingLedgerEntry{
+		RequestID:        requestID,
+		UserID:           billing.UserID,
+		APIKeyID:         billing.APIKeyID,
+		ModelCode:        modelCode,
+		KeyID:            keyID,
+		PromptTokens:     used.PromptTokens,
+		CachedTokens:     used.CachedTokens,
+		CacheWriteTokens: used.CacheWriteTokens,
+		CompletionTokens: used.CompletionTokens,
+	}
+	if modelConfig != nil {
+		amount = modelConfig.CalculateCost(used.PromptTokens, used.CachedTokens, used.CacheWriteTokens, used.CompletionTokens)
+		entry.ModelCode = modelConfig.ModelCode
+		entry.CostPer1kInput = modelConfig.CostPer1kInput
+		entry.CostPer1kOutput = modelConfig.CostPer1kOutput
+	}
+	entry.Amount = amount
+	if amount <= 0 {
+		return
+	}
+
+	var success bool
+	var remaining int
+	var err error
+	if billing.Reservation != nil {
+		success, remaining, err = s.apiKeyManageService.CommitReservation(billing.Reservation, amount)
+		billing.Reservation = nil
+	} else {
+		success, remaining, err = s.apiKeyManageService.DeductTokens(billing.UserID, amount)
+	}
+	if !success {
+		logger.Printf("[%s] 扣除令牌失败: %v", requestID, err)
+		return
+	}
+	logger.Printf("[%s] 扣除令牌成功: 模型=%s, 输入=%d (缓存命中 %d, 写入缓存 %d), 输出=%d, 扣除=%d, 剩余: %d",
+		requestID, entry.ModelCode, used.PromptTokens, used.CachedTokens, used.CacheWriteTokens, used.CompletionTokens, amount, remaining)
+
+	if err := s.dataService.InsertBillingLedger(entry); err != nil {
+		logger.Printf("[%s] ⚠️ %v", requestID, err)
+	}
+}
+
+// platformAPIKeyID 返回认证时写入的平台认证 Key 的ID，没有时返回0
+func platformAPIKeyID(data map[string]interface{}) int {
+	return toInt(data[apiKeyIDField])
+}
+
+// requestStreamUsage 需要计费的流式请求要求 OpenAI 兼容接口在最后一个数据块中返回 usage
+func requestStreamUsage(data map[string]interface{}, billing *billingContext) {
+	if billing.UseUserKey || billing.UserID == "" {
+		return
+	}
+	streamOptions, _ := data["stream_options"].(map[string]interface{})
+	if streamOptions == nil {
+		streamOptions = make(map[string]interface{})
+	}
+	streamOptions["include_usage"] = true
+	data["stream_options"] = streamOptions
+}
+
+// billStream 转发流式响应并在结束时按最后一个 usage 数据块结算
+// 客户端断开（ctx 取消）时停止转发，按已转发的内容估算用量结算；流正常结束但没有 usage 时只释放预占
+func (s *SilicoIDInterceptor) billStream(ctx context.Context, stream chan string, billing *billingContext) chan string {
+	outputChan := make(chan string)
+
+	go func() {
+		defer close(outputChan)
+
+		var usage map[string]interface{}
+		servedBy := ""
+		completionRunes := 0
+		cancelled := false
+	forward:
+		for chunk := range stream {
+			chunkUsage, chunkServedBy, contentRunes := parseStreamBilling(chunk)
+			if chunkUsage != nil {
+				usage = chunkUsage
+			}
+			if chunkServedBy != "" {
+				servedBy = chunkServedBy
+			}
+			completionRunes += contentRunes
+
+			select {
+			case outputChan <- chunk:
+			case <-ctx.Done():
+				cancelled = true
+				// 排空上游，避免上游 goroutine 阻塞
+				go func() {
+					for range stream {
+					}
+				}()
+				break forward
+			}
+		}
+
+		if usage == nil && cancelled && completionRunes > 0 {
+			// 上游已生成的内容同样计费：客户端断开时尚未收到 usage，按已转发的内容估算用量结算
+			logger.Printf("[%s] 流式请求已取消，按已转发的内容结算", billing.RequestID)
+			usage = estimatedStreamUsage(billing.PromptEstimate, completionRunes)
+		}
+
+		if usage == nil {
+			if !billing.UseUserKey && billing.UserID != "" {
+				logger.Printf("[%s] ⚠️ 流式响应未返回 usage，无法计费", billing.RequestID)
+			}
+			s.releaseReservation(billing)
+			return
+		}
+
+		data := map[string]interface{}{"usage": usage}
+		if servedBy != "" {
+			data[modelCodeField] = servedBy
+		}
+		s.deductTokensIfNeeded(data, billing)
+	}()
+
+	return outputChan
+}
+
+// parseStreamBilling 解析流式数据块中的 usage、x_silicoid_served_by 和增量内容的字符数
+func parseStreamBilling(chunk string) (map[string]interface{}, string, int) {
+	data := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(chunk), "data:"))
+	if data == "" || data == "[DONE]" {
+		return nil, "", 0
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return nil, "", 0
+	}
+	usage, _ := payload["usage"].(map[string]interface{})
+	servedBy, _ := payload[servedByField].(string)
+
+	contentRunes := 0
+	choices, _ := payload["choices"].([]interface{})
+	for _, item := range choices {
+		choice, _ := item.(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		if delta == nil {
+			continue
+		}
+		for _, field := range []string{"content", "reasoning_content"} {
+			if text, ok := delta[field].(string); ok {
+				contentRunes += utf8.RuneCountInString(text)
+			}
+		}
+		if toolCalls, ok := delta["tool_calls"]; ok {
+			if toolCallsJSON, err := json.Marshal(toolCalls); err == nil {
+				contentRunes += utf8.RuneCount(toolCallsJSON)
+			}
+		}
+	}
+	return usage, servedBy, contentRunes
+}
+
+// estimatedStreamUsage 流式请求中断时按估算的输入token和已转发内容的字符数构造 usage
+func estimatedStreamUsage(promptTokens int, completionRunes int) map[string]interface{} {
+	completionTokens := completionRunes / 2
+	if completionTokens <= 0 {
+		completionTokens = 1
+	}
+	return map[string]interface{}{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
 	}
 }
 
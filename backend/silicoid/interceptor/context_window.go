@@ -0,0 +1,347 @@
+package interceptor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// 上下文窗口：请求的消息超过模型上下文窗口时，分发前按策略裁剪或摘要较早的对话，
+// 避免长会话最终被上游以 400（上下文超长）拒绝
+const (
+	ContextStrategyNone       = "none"        // 不处理，超长时由上游返回错误
+	ContextStrategyDropOldest = "drop_oldest" // 从最早的对话开始丢弃，直到放得下
+	ContextStrategyKeepLastN  = "keep_last_n" // 只保留 system 和最近 N 条消息（仍超长时继续丢弃最早的）
+	ContextStrategySummarize  = "summarize"   // 最近 N 条之前的对话由摘要模型压缩为一条 system 消息
+
+	// contextStrategyField 请求中覆盖默认策略的字段，分发前移除
+	contextStrategyField = "context_strategy"
+	// defaultContextReserveTokens 请求未指定 max_tokens 时为回复预留的 token 数
+	defaultContextReserveTokens = 4096
+	// contextSummaryMaxTokens 摘要回复的最大 token 数
+	contextSummaryMaxTokens = 1024
+)
+
+// ContextPolicy 上下文窗口策略
+type ContextPolicy struct {
+	Strategy      string // 策略，见 ContextStrategy* 常量
+	KeepLastN     int    // keep_last_n 保留的最近消息数；summarize 时保留原文的最近消息数
+	SummaryModel  string // summarize 使用的模型（model_name 或 model_code），为空时使用请求的模型
+	ReserveTokens int    // 请求未指定 max_tokens 时为回复（以及分发时注入的角色提示词、工具定义）预留的 token 数
+}
+
+// DefaultContextPolicy 默认策略：只保留 system 和最近 10 条消息
+// 摘要每次超长都要额外调用一次模型，需要时通过 context_strategy 或 SetContextPolicy 启用
+func DefaultContextPolicy() ContextPolicy {
+	return ContextPolicy{
+		Strategy:      ContextStrategyKeepLastN,
+		KeepLastN:     10,
+		ReserveTokens: defaultContextReserveTokens,
+	}
+}
+
+// SetContextPolicy 替换默认的上下文窗口策略
+func (s *SilicoIDInterceptor) SetContextPolicy(policy ContextPolicy) {
+	s.contextPolicy = policy
+}
+
+// TokenEstimator 消息 token 数估算接口
+// 各提供商的分词器不同，同样的文本 token 数差异较大，按 ModelConfig.Provider 注册不同的实现
+type TokenEstimator interface {
+	// EstimateMessages 估算 OpenAI 格式消息列表的 token 数
+	EstimateMessages(messages []interface{}) int
+}
+
+// RatioTokenEstimator 按字符类别比例估算 token 数，不需要加载分词器
+type RatioTokenEstimator struct {
+	CJKTokens       float64 // 每个中日韩字符的 token 数
+	OtherTokens     float64 // 其他每个字符的 token 数
+	MessageOverhead int     // 每条消息的角色、分隔符等固定开销
+	ImageTokens     int     // 每张图片/文件按固定 token 数计算
+}
+
+func (e *RatioTokenEstimator) EstimateMessages(messages []interface{}) int {
+	total := 0
+	for _, item := range messages {
+		msg, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		total += e.MessageOverhead
+		switch content := msg["content"].(type) {
+		case string:
+			total += e.estimateText(content)
+		case []interface{}:
+			for _, part := range content {
+				partMap, _ := part.(map[string]interface{})
+				if text, ok := partMap["text"].(string); ok {
+					total += e.estimateText(text)
+				} else {
+					total += e.ImageTokens
+				}
+			}
+		}
+		// 工具调用的参数和函数名同样占用上下文
+		for _, field := range []string{"tool_calls", "function_call"} {
+			if value, ok := msg[field]; ok {
+				if valueJSON, err := json.Marshal(value); err == nil {
+					total += e.estimateText(string(valueJSON))
+				}
+			}
+		}
+	}
+	return total
+}
+
+func (e *RatioTokenEstimator) estimateText(text string) int {
+	var tokens float64
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r) {
+			tokens += e.CJKTokens
+		} else {
+			tokens += e.OtherTokens
+		}
+	}
+	return int(tokens + 0.5)
+}
+
+// defaultTokenEstimators 各提供商的默认估算比例（按提供商公开的换算说明粗略取值，宁可偏大）
+func defaultTokenEstimators() map[string]TokenEstimator {
+	return map[string]TokenEstimator{
+		defaultProviderName: &RatioTokenEstimator{CJKTokens: 1.0, OtherTokens: 0.3, MessageOverhead: 4, ImageTokens: 1000},
+		"anthropic":         &RatioTokenEstimator{CJKTokens: 1.3, OtherTokens: 0.33, MessageOverhead: 4, ImageTokens: 1600},
+		"claude":            &RatioTokenEstimator{CJKTokens: 1.3, OtherTokens: 0.33, MessageOverhead: 4, ImageTokens: 1600},
+		"deepseek":          &RatioTokenEstimator{CJKTokens: 0.6, OtherTokens: 0.3, MessageOverhead: 4, ImageTokens: 1000},
+		"moonshot":          &RatioTokenEstimator{CJKTokens: 0.7, OtherTokens: 0.3, MessageOverhead: 4, ImageTokens: 1000},
+		"alibaba":           &RatioTokenEstimator{CJKTokens: 0.7, OtherTokens: 0.3, MessageOverhead: 4, ImageTokens: 1000},
+		"google":            &RatioTokenEstimator{CJKTokens: 1.0, OtherTokens: 0.3, MessageOverhead: 4, ImageTokens: 300},
+	}
+}
+
+// SetTokenEstimator 为提供商注册 token 估算实现（提供商名称大小写不敏感）
+func (s *SilicoIDInterceptor) SetTokenEstimator(provider string, estimator TokenEstimator) {
+	s.tokenEstimators[strings.ToLower(strings.TrimSpace(provider))] = estimator
+}
+
+// tokenEstimatorFor 按提供商获取 token 估算实现，未注册的提供商使用 OpenAI 的比例
+func (s *SilicoIDInterceptor) tokenEstimatorFor(provider string) TokenEstimator {
+	if estimator, ok := s.tokenEstimators[strings.ToLower(strings.TrimSpace(provider))]; ok {
+		return estimator
+	}
+	return s.tokenEstimators[defaultProviderName]
+}
+
+// FitContextWindow 按上下文窗口策略处理请求的消息（在 prepareChatRequestData 中分发前调用）
+// 消息放得下时不做修改；请求中的 context_strategy 可覆盖默认策略
+func (s *SilicoIDInterceptor) FitContextWindow(ctx context.Context, requestID string, requestData map[string]interface{}) error {
+	policy := s.contextPolicy
+	if strategy, ok := requestData[contextStrategyField].(string); ok {
+		policy.Strategy = strategy
+		delete(requestData, contextStrategyField)
+	}
+	if policy.Strategy == "" || policy.Strategy == ContextStrategyNone {
+		return nil
+	}
+	switch policy.Strategy {
+	case ContextStrategyDropOldest, ContextStrategyKeepLastN, ContextStrategySummarize:
+	default:
+		return fmt.Errorf("不支持的上下文策略: %s", policy.Strategy)
+	}
+
+	messages, _ := requestData["messages"].([]interface{})
+	modelName, _ := requestData["model"].(string)
+	modelConfig, err := s.modelManager.GetModelConfig(modelName)
+	if err != nil {
+		return fmt.Errorf("获取模型配置失败: %v", err)
+	}
+	contextWindow := s.modelManager.GetContextWindow(modelName)
+	if contextWindow <= 0 || len(messages) == 0 {
+		return nil
+	}
+
+	reserve := toInt(requestData["max_tokens"])
+	if reserve <= 0 {
+		reserve = policy.ReserveTokens
+	}
+	// 预留量不能吃掉整个窗口，至少留一半给消息
+	if reserve <= 0 || reserve > contextWindow/2 {
+		reserve = contextWindow / 2
+	}
+	budget := contextWindow - reserve
+	estimator := s.tokenEstimatorFor(modelConfig.Provider)
+	estimated := estimator.EstimateMessages(messages)
+	if estimated <= budget {
+		return nil
+	}
+	logger.Printf("[%s] 消息超出上下文窗口: 估算 %d tokens, 可用 %d (窗口 %d), 策略: %s",
+		requestID, estimated, budget, contextWindow, policy.Strategy)
+
+	system, turns := splitContextTurns(messages)
+	switch policy.Strategy {
+	case ContextStrategyKeepLastN:
+		turns = lastContextTurns(turns, policy.KeepLastN)
+	case ContextStrategySummarize:
+		recent := lastContextTurns(turns, policy.KeepLastN)
+		older := flattenContextTurns(turns[:len(turns)-len(recent)])
+		if len(older) > 0 {
+			summary, err := s.summarizeContext(ctx, requestID, requestData, policy, older)
+			if err != nil {
+				logger.Printf("[%s] ⚠️ 摘要较早的对话失败，改为丢弃: %v", requestID, err)
+			} else {
+				system = append(system, map[string]interface{}{
+					"role":    "system",
+					"content": "以下是之前对话的摘要：\n" + summary,
+				})
+			}
+		}
+		turns = recent
+	}
+
+	// 仍然超长时从最早的对话开始丢弃，最后一轮始终保留
+	fitted := append(append([]interface{}{}, system...), flattenContextTurns(turns)...)
+	for len(turns) > 1 && estimator.EstimateMessages(fitted) > budget {
+		turns = turns[1:]
+		fitted = append(append([]interface{}{}, system...), flattenContextTurns(turns)...)
+	}
+	requestData["messages"] = fitted
+	logger.Printf("[%s] 上下文处理完成: 消息数 %d -> %d, 估算 %d tokens",
+		requestID, len(messages), len(fitted), estimator.EstimateMessages(fitted))
+	return nil
+}
+
+// splitContextTurns 将消息分为开头的 system 消息和对话单元
+// assistant 的工具调用与其后的 tool 结果属于同一单元，裁剪时不会被拆开
+func splitContextTurns(messages []interface{}) ([]interface{}, [][]interface{}) {
+	var system []interface{}
+	var turns [][]interface{}
+	for i, item := range messages {
+		msg, _ := item.(map[string]interface{})
+		role, _ := msg["role"].(string)
+		if len(turns) == 0 && (role == "system" || role == "developer") {
+			system = append(system, item)
+			continue
+		}
+		if (role == "tool" || role == "function") && len(turns) > 0 {
+			turns[len(turns)-1] = append(turns[len(turns)-1], messages[i])
+			continue
+		}
+		turns = append(turns, []interface{}{item})
+	}
+	return system, turns
+}
+
+// lastContextTurns 返回包含最近 n 条消息的对话单元（n <= 0 时只保留最后一个单元）
+func lastContextTurns(turns [][]interface{}, n int) [][]interface{} {
+	count := 0
+	for i := len(turns) - 1; i >= 0; i-- {
+		count += len(turns[i])
+		if count >= n {
+			return turns[i:]
+		}
+	}
+	return turns
+}
+
+func flattenContextTurns(turns [][]interface{}) []interface{} {
+	var messages []interface{}
+	for _, turn := range turns {
+		messages = append(messages, turn...)
+	}
+	return messages
+}
+
+// summarizeContext 调用摘要模型将较早的对话压缩为一段摘要
+// 摘要请求与聊天请求使用相同的 Key 和计费方式
+func (s *SilicoIDInterceptor) summarizeContext(ctx context.Context, requestID string, requestData map[string]interface{}, policy ContextPolicy, messages []interface{}) (string, error) {
+	modelName := policy.SummaryModel
+	if modelName == "" {
+		modelName, _ = requestData["model"].(string)
+	}
+	modelConfig, err := s.modelManager.GetModelConfig(modelName)
+	if err != nil {
+		return "", fmt.Errorf("获取摘要模型配置失败: %v", err)
+	}
+
+	var transcript strings.Builder
+	for _, item := range messages {
+		msg, _ := item.(map[string]interface{})
+		role, _ := msg["role"].(string)
+		text := contextMessageText(msg)
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&transcript, "[%s]\n%s\n\n", role, text)
+	}
+
+	summaryRequest := map[string]interface{}{
+		"model":      modelName,
+		"model_code": modelConfig.ModelCode,
+		"_base_url":  modelConfig.BaseURL,
+		"_endpoint":  modelConfig.Endpoint,
+		"stream":     false,
+		"max_tokens": contextSummaryMaxTokens,
+		"messages": []interface{}{
+			map[string]interface{}{
+				"role":    "system",
+				"content": "你负责压缩对话历史。用简洁的中文总结以下对话中的关键事实、用户的需求和偏好、已经得出的结论以及尚未解决的问题，只输出摘要本身。",
+			},
+			map[string]interface{}{"role": "user", "content": transcript.String()},
+		},
+	}
+	for _, field := range []string{"_use_user_key", "_user_openai_key", "_user_claude_key"} {
+		if value, ok := requestData[field]; ok {
+			summaryRequest[field] = value
+		}
+	}
+
+	userID, _ := requestData["user_id"].(string)
+	apiKey, _ := requestData["api_key"].(string)
+	billing := s.webSocketBillingContext(userID, apiKey, modelConfig, requestID)
+	if err := s.reserveTokens(billing, summaryRequest); err != nil {
+		return "", err
+	}
+	defer s.releaseReservation(billing)
+
+	response, err := s.chatCompletionWithFallback(ctx, summaryRequest, modelConfig, requestID)
+	if err != nil {
+		return "", err
+	}
+	if errValue, hasError := response["error"]; hasError {
+		popBillingFields(response)
+		return "", fmt.Errorf("%v", errValue)
+	}
+	s.deductTokensIfNeeded(response, billing)
+
+	summary, _ := openAIResponseMessage(response)["content"].(string)
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return "", fmt.Errorf("摘要模型返回了空内容")
+	}
+	logger.Printf("[%s] 已将 %d 条较早的消息摘要为 %d 个字符 (模型: %s)", requestID, len(messages), len([]rune(summary)), modelConfig.ModelCode)
+	return summary, nil
+}
+
+// contextMessageText 提取消息中用于摘要的文本，图片/文件以占位说明代替
+func contextMessageText(msg map[string]interface{}) string {
+	var parts []string
+	switch content := msg["content"].(type) {
+	case string:
+		parts = append(parts, content)
+	case []interface{}:
+		for _, part := range content {
+			partMap, _ := part.(map[string]interface{})
+			if text, ok := partMap["text"].(string); ok {
+				parts = append(parts, text)
+			} else {
+				parts = append(parts, fmt.Sprintf("[%v]", partMap["type"]))
+			}
+		}
+	}
+	if calls, ok := msg["tool_calls"]; ok {
+		callsJSON, _ := json.Marshal(calls)
+		parts = append(parts, "调用工具: "+string(callsJSON))
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n"))
+}
@@ -0,0 +1,120 @@
+package interceptor
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// embeddingRequestFields 转发给提供商的 OpenAI 向量请求参数
+var embeddingRequestFields = []string{"input", "model", "encoding_format", "dimensions", "user"}
+
+// HandleHTTPEmbeddings 处理 OpenAI 兼容的向量请求（/v1/embeddings）
+// 与聊天请求使用相同的 API Key 认证、模型路由、Key 池和计费；
+// 不同模型的向量不可互相替代，因此不走降级链
+func (s *SilicoIDInterceptor) HandleHTTPEmbeddings(c *gin.Context) {
+	authData, err := s.authenticateAndPreprocessRequest(c)
+	if err != nil {
+		logger.Printf("向量请求认证失败: %v", err)
+		openAIAuthError(c, err)
+		return
+	}
+	requestID := authData.RequestID
+	data := authData.Data
+
+	modelName, _ := data["model"].(string)
+	modelConfig, err := s.modelManager.GetModelConfig(modelName)
+	if err != nil {
+		logger.Printf("[%s] ⚠️ 获取模型配置失败: %v", requestID, err)
+		openAIError(c, http.StatusBadRequest, "模型配置不存在: "+modelName, "invalid_request", "model_not_found")
+		return
+	}
+	if !modelConfig.IsEmbedding() {
+		logger.Printf("[%s] 模型 %s 不是向量模型 (model_type: %s)", requestID, modelName, modelConfig.ModelType)
+		openAIError(c, http.StatusBadRequest, "模型 "+modelName+" 不是向量模型", "invalid_request", "model_not_supported")
+		return
+	}
+	if _, ok := data["input"]; !ok {
+		openAIError(c, http.StatusBadRequest, "缺少 input 参数", "invalid_request", "invalid_request")
+		return
+	}
+
+	// 只转发向量接口的参数，认证信息等其他字段不发送给提供商
+	request := make(map[string]interface{})
+	for _, field := range embeddingRequestFields {
+		if value, ok := data[field]; ok {
+			request[field] = value
+		}
+	}
+	useUserKey := authData.UsesOwnKey()
+	if useUserKey {
+		request["_use_user_key"] = true
+		request["_user_openai_key"] = data["_user_openai_key"]
+	}
+	request["model_code"] = modelConfig.ModelCode
+	request["_base_url"] = modelConfig.BaseURL
+	request["_endpoint"] = modelConfig.Endpoint
+
+	billing := &billingContext{
+		RequestID:  requestID,
+		UserID:     authData.UserID,
+		APIKeyID:   authData.APIKeyID,
+		UseUserKey: useUserKey,
+		Model:      modelConfig,
+	}
+	if err := s.reserveTokens(billing, request); err != nil {
+		openAIError(c, http.StatusPaymentRequired, "令牌余额不足: "+err.Error(), "insufficient_quota", "insufficient_quota")
+		return
+	}
+	defer s.releaseReservation(billing)
+
+	adapter := s.adapterForProvider(modelConfig.Provider)
+	logger.Printf("[%s] 创建向量请求，模型: %s, 适配器: %s", requestID, modelName, adapter.Name())
+
+	response, err := adapter.Embeddings(c.Request.Context(), request)
+	if err != nil {
+		logger.Printf("[%s] %s 向量请求失败: %v", requestID, adapter.Name(), err)
+		if errors.Is(err, errEmbeddingsNotSupported) {
+			openAIError(c, http.StatusBadRequest, err.Error(), "invalid_request", "model_not_supported")
+			return
+		}
+		openAIError(c, http.StatusInternalServerError, err.Error(), "server_error", "embeddings_failed")
+		return
+	}
+
+	if errorData, hasError := response["error"]; hasError {
+		logger.Printf("[%s] 向量请求返回错误: %v", requestID, errorData)
+		status := embeddingsErrorStatus(response)
+		stripUpstreamStatus(response)
+		popBillingFields(response)
+		c.JSON(status, response)
+		return
+	}
+
+	s.deductTokensIfNeeded(response, billing)
+	logger.Printf("[%s] 向量请求处理完成", requestID)
+	c.JSON(http.StatusOK, response)
+}
+
+// embeddingsErrorStatus 按上游错误的原因返回 HTTP 状态码：上游限流返回 429，上游 5xx 或请求失败返回 502，
+// 其它上游 4xx（请求本身的问题）返回 400，取密钥等服务端内部错误返回 500
+func embeddingsErrorStatus(response map[string]interface{}) int {
+	errObj, _ := response["error"].(map[string]interface{})
+	code, ok := parseStatusCode(errObj[upstreamStatusField])
+	if !ok {
+		code, ok = parseStatusCode(response[upstreamStatusField])
+	}
+	switch {
+	case !ok:
+		if errObj["type"] == "api_error" {
+			return http.StatusBadGateway
+		}
+		return http.StatusInternalServerError
+	case code == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests
+	case code >= 500:
+		return http.StatusBadGateway
+	}
+	return http.StatusBadRequest
+}
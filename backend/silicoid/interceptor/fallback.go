@@ -0,0 +1,338 @@
+package interceptor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"digitalsingularity/backend/silicoid/models/manager"
+)
+
+// servedByField 响应中标记实际提供服务的模型代码的字段
+const servedByField = "x_silicoid_served_by"
+
+// upstreamStatusField 服务层在错误中记录的上游 HTTP 状态码，只用于判断是否降级，返回给调用方前移除
+const upstreamStatusField = "status_code"
+
+// upstream5xxPattern 匹配服务层错误消息中的上游 5xx 状态码（如 "API错误 (状态码 503)"）
+var upstream5xxPattern = regexp.MustCompile(`状态码 5\d\d`)
+
+// keyExhaustedKeywords 平台密钥耗尽时服务层返回的错误关键字
+var keyExhaustedKeywords = []string{
+	"无法获取API密钥",
+	"所有API密钥",
+	"没有可用的API密钥",
+	"无可用API密钥",
+}
+
+// fallbackTargets 返回模型及其降级链（第一个元素为模型本身）
+// 使用用户自己的 Key 时不降级（用户 Key 只对应其所属提供商）
+func (s *SilicoIDInterceptor) fallbackTargets(modelConfig *manager.ModelConfig, data map[string]interface{}, requestID string) []*manager.ModelConfig {
+	targets := []*manager.ModelConfig{modelConfig}
+	if useUserKey, _ := data["_use_user_key"].(bool); useUserKey {
+		return targets
+	}
+
+	chain, err := s.modelManager.GetFallbackChain(modelConfig.ModelCode)
+	if err != nil {
+		logger.Printf("[%s] ⚠️ 获取模型 %s 的降级链失败: %v", requestID, modelConfig.ModelCode, err)
+		return targets
+	}
+	if len(chain) > 0 {
+		codes := make([]string, 0, len(chain))
+		for _, cfg := range chain {
+			codes = append(codes, cfg.ModelCode)
+		}
+		logger.Printf("[%s] 模型 %s 的降级链: %v", requestID, modelConfig.ModelCode, codes)
+	}
+	return append(targets, chain...)
+}
+
+// requestDataForTarget 为降级目标构造请求数据
+// 第一个目标直接使用原始请求数据；降级目标使用浅拷贝并替换模型相关字段
+func requestDataForTarget(data map[string]interface{}, target *manager.ModelConfig, isFallback bool) map[string]interface{} {
+	attemptData := data
+	if isFallback {
+		attemptData = make(map[string]interface{}, len(data))
+		for k, v := range data {
+			attemptData[k] = v
+		}
+		if target.ModelName != "" {
+			attemptData["model"] = target.ModelName
+		}
+	}
+	attemptData["model_code"] = target.ModelCode
+	attemptData["_base_url"] = target.BaseURL
+	attemptData["_endpoint"] = target.Endpoint
+	return attemptData
+}
+
+// isFallbackError 判断错误是否应触发降级（平台密钥耗尽或上游 5xx / 连接失败）
+func isFallbackError(errValue interface{}) bool {
+	switch e := errValue.(type) {
+	case nil:
+		return false
+	case string:
+		return containsKeyExhausted(e)
+	case map[string]interface{}:
+		if code, ok := parseStatusCode(e["status_code"]); ok {
+			return code >= 500
+		}
+		message, _ := e["message"].(string)
+		errType, _ := e["type"].(string)
+		if containsKeyExhausted(message) || upstream5xxPattern.MatchString(message) {
+			return true
+		}
+		switch errType {
+		case "server_error", "overloaded_error":
+			return true
+		case "api_error":
+			// 服务层的 api_error 表示请求未能到达上游或上游返回非 JSON 错误，4xx 不降级
+			return !strings.Contains(message, "状态码 4")
+		}
+	}
+	return false
+}
+
+func containsKeyExhausted(message string) bool {
+	for _, keyword := range keyExhaustedKeywords {
+		if strings.Contains(message, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseStatusCode(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// stripUpstreamStatus 移除错误响应中的上游状态码
+// 上游 429 且没有错误代码时补充 rate_limit_exceeded，调用方（如批处理）据此判断速率限制
+func stripUpstreamStatus(response map[string]interface{}) {
+	delete(response, upstreamStatusField)
+	errObj, ok := response["error"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if code, ok := parseStatusCode(errObj[upstreamStatusField]); ok && code == http.StatusTooManyRequests {
+		if _, hasCode := errObj["code"]; !hasCode {
+			errObj["code"] = "rate_limit_exceeded"
+		}
+	}
+	delete(errObj, upstreamStatusField)
+}
+
+// stripUpstreamStatusChunk 移除流式错误数据块中的上游状态码
+func stripUpstreamStatusChunk(chunk string) string {
+	if !strings.Contains(chunk, `"`+upstreamStatusField+`"`) || !IsErrorChunk(chunk) {
+		return chunk
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(chunk), "data:"))
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return chunk
+	}
+	stripUpstreamStatus(payload)
+	stripped, err := json.Marshal(payload)
+	if err != nil {
+		return chunk
+	}
+	return fmt.Sprintf("data: %s\n\n", string(stripped))
+}
+
+// isFallbackChunk 判断流式数据块是否为应触发降级的错误
+func isFallbackChunk(chunk string) bool {
+	if !IsErrorChunk(chunk) {
+		return false
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(chunk), "data:"))
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return false
+	}
+	if errValue, ok := payload["error"]; ok {
+		return isFallbackError(errValue)
+	}
+	return isFallbackError(payload)
+}
+
+// chunkHasTokens 判断 OpenAI 流式数据块是否已包含输出内容（文本、思考内容或工具调用）
+func chunkHasTokens(chunk string) bool {
+	data := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(chunk), "data:"))
+	if data == "" || data == "[DONE]" {
+		return false
+	}
+	var payload struct {
+		Choices []struct {
+			Delta struct {
+				Content          string        `json:"content"`
+				ReasoningContent string        `json:"reasoning_content"`
+				ToolCalls        []interface{} `json:"tool_calls"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		// 非 JSON 数据块无法判断，视为已输出
+		return true
+	}
+	for _, choice := range payload.Choices {
+		if choice.Delta.Content != "" || choice.Delta.ReasoningContent != "" || len(choice.Delta.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// annotateServedBy 在 OpenAI 流式数据块中加入 x_silicoid_served_by 字段
+func annotateServedBy(chunk string, servedBy string) string {
+	if !strings.HasPrefix(chunk, "data: {") {
+		return chunk
+	}
+	name, _ := json.Marshal(servedBy)
+	return fmt.Sprintf("data: {\"%s\":%s,%s", servedByField, string(name), strings.TrimPrefix(chunk, "data: {"))
+}
+
+// chatCompletionWithFallback 非流式聊天，主模型失败（密钥耗尽或上游 5xx）时按降级链依次重试
+func (s *SilicoIDInterceptor) chatCompletionWithFallback(ctx context.Context, data map[string]interface{}, modelConfig *manager.ModelConfig, requestID string) (map[string]interface{}, error) {
+	targets := s.fallbackTargets(modelConfig, data, requestID)
+
+	var response map[string]interface{}
+	for i, target := range targets {
+		adapter := s.adapterForProvider(target.Provider)
+		attemptData := requestDataForTarget(data, target, i > 0)
+		if i > 0 {
+			logger.Printf("[%s] 🔁 降级到模型 %s (%s 适配器)", requestID, target.ModelCode, adapter.Name())
+		}
+
+		var err error
+		response, err = adapter.ChatCompletion(ctx, attemptData)
+		if err != nil {
+			if i < len(targets)-1 {
+				logger.Printf("[%s] ⚠️ %s 请求失败: %v，尝试降级", requestID, target.ModelCode, err)
+				continue
+			}
+			return nil, err
+		}
+
+		response[servedByField] = target.ModelCode
+		response[modelCodeField] = target.ModelCode
+
+		if errValue, hasError := response["error"]; hasError && i < len(targets)-1 && isFallbackError(errValue) {
+			logger.Printf("[%s] ⚠️ 模型 %s 返回可降级错误: %v", requestID, target.ModelCode, errValue)
+			continue
+		}
+		stripUpstreamStatus(response)
+		return response, nil
+	}
+	return response, nil
+}
+
+// chatCompletionStreamWithFallback 流式聊天，在尚未输出任何内容前遇到可降级错误时按降级链依次重试
+// 已输出内容后出现的错误直接透传，不再降级；所有模型都失败时以错误块和 [DONE] 结束
+func (s *SilicoIDInterceptor) chatCompletionStreamWithFallback(ctx context.Context, data map[string]interface{}, modelConfig *manager.ModelConfig, requestID string) (chan string, error) {
+	targets := s.fallbackTargets(modelConfig, data, requestID)
+
+	// 主模型同步创建，保持请求转换错误直接返回给调用方
+	firstData := requestDataForTarget(data, targets[0], false)
+	firstStream, err := s.adapterForProvider(targets[0].Provider).ChatCompletionStream(ctx, firstData)
+	if err != nil {
+		return nil, err
+	}
+
+	outputChan := make(chan string)
+	go func() {
+		defer close(outputChan)
+
+		stream := firstStream
+		lastErr := ""
+		for i, target := range targets {
+			if i > 0 {
+				adapter := s.adapterForProvider(target.Provider)
+				logger.Printf("[%s] 🔁 流式请求降级到模型 %s (%s 适配器)", requestID, target.ModelCode, adapter.Name())
+				stream, err = adapter.ChatCompletionStream(ctx, requestDataForTarget(data, target, true))
+				if err != nil {
+					logger.Printf("[%s] ⚠️ 降级模型 %s 流式请求创建失败: %v", requestID, target.ModelCode, err)
+					lastErr = err.Error()
+					continue
+				}
+			}
+
+			servedBy := target.ModelCode
+			canFallback := i < len(targets)-1
+			emitted := false
+			fallback := false
+			failed := false
+			done := false
+			send := func(chunk string) {
+				if strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(chunk), "data:")) == "[DONE]" {
+					done = true
+				} else if IsErrorChunk(chunk) {
+					failed = true
+				}
+				outputChan <- chunk
+			}
+			// 输出内容前的数据块（如 role 块）先缓存，降级时丢弃，避免重复
+			var pending []string
+
+			for chunk := range stream {
+				if !emitted {
+					if canFallback && isFallbackChunk(chunk) {
+						logger.Printf("[%s] ⚠️ 模型 %s 流式返回可降级错误: %s", requestID, target.ModelCode, truncateString(chunk, 200))
+						fallback = true
+						break
+					}
+					if !chunkHasTokens(chunk) {
+						pending = append(pending, annotateServedBy(stripUpstreamStatusChunk(chunk), servedBy))
+						continue
+					}
+					emitted = true
+					for _, p := range pending {
+						send(p)
+					}
+					pending = nil
+				}
+				send(annotateServedBy(stripUpstreamStatusChunk(chunk), servedBy))
+			}
+
+			if fallback {
+				// 排空旧的流，避免上游 goroutine 阻塞
+				go func(old chan string) {
+					for range old {
+					}
+				}(stream)
+				continue
+			}
+
+			for _, p := range pending {
+				send(p)
+			}
+			// 上游以错误块结束时不会发送 [DONE]，补发以便客户端结束读取
+			if failed && !done {
+				outputChan <- "data: [DONE]\n\n"
+			}
+			return
+		}
+
+		// 所有模型都未能创建流式请求
+		errorJSON, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": "所有可用模型均请求失败: " + lastErr,
+				"type":    "server_error",
+			},
+		})
+		outputChan <- fmt.Sprintf("data: %s\n\n", string(errorJSON))
+		outputChan <- "data: [DONE]\n\n"
+	}()
+
+	return outputChan, nil
+}
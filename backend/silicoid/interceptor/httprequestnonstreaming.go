@@ -1,6 +1,7 @@
 package interceptor
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"github.com/gin-gonic/gin"
@@ -8,6 +9,12 @@ import (
 
 // CreateHTTPNonStreamResponse 创建HTTP非流式AI响应
 func (s *SilicoIDInterceptor) CreateHTTPNonStreamResponse(c *gin.Context, requestID string, userID string, data map[string]interface{}) (map[string]interface{}, error) {
+	return s.createNonStreamResponse(c.Request.Context(), requestID, userID, authenticatedUsesOwnKey(c), data)
+}
+
+// createNonStreamResponse 创建非流式AI响应（ServerCalls 循环、缓存、结构化输出和计费），
+// 不依赖 HTTP 请求，批量任务也通过它处理每一条请求；useUserKey 来自认证结果
+func (s *SilicoIDInterceptor) createNonStreamResponse(ctx context.Context, requestID string, userID string, useUserKey bool, data map[string]interface{}) (map[string]interface{}, error) {
 	// 获取模型名称
 	modelName, ok := data["model"].(string)
 	if !ok {
@@ -20,6 +27,9 @@ func (s *SilicoIDInterceptor) CreateHTTPNonStreamResponse(c *gin.Context, reques
 		logger.Printf("[%s] ⚠️ 获取模型配置失败: %v", requestID, err)
 		return nil, fmt.Errorf("获取模型配置失败: %v", err)
 	}
+	if modelConfig.IsEmbedding() {
+		return nil, fmt.Errorf("模型 %s 是向量模型，请使用 /v1/embeddings 接口", modelName)
+	}
 
 	// 将获取到的配置存储到requestData中
 	modelCode := modelConfig.ModelCode
@@ -31,303 +41,291 @@ func (s *SilicoIDInterceptor) CreateHTTPNonStreamResponse(c *gin.Context, reques
 	logger.Printf("[%s] ✅ 成功获取模型配置: model_code=%s, base_url=%s, endpoint=%s",
 		requestID, modelCode, baseURL, endpoint)
 
-	// 判断是否是 Claude 模型
-	isClaudeModel := s.isClaudeModel(modelName)
-	logger.Printf("[%s] 创建HTTP非流式响应，模型: %s, Claude模型: %v", requestID, modelName, isClaudeModel)
+	// 根据模型配置的提供商选择适配器
+	adapter := s.adapterForProvider(modelConfig.Provider)
+	logger.Printf("[%s] 创建HTTP非流式响应，模型: %s, 适配器: %s", requestID, modelName, adapter.Name())
 
 	// 将 userId 添加到请求数据中，供 formatconverter 使用
 	data["_user_id"] = userID
+	applyOwnKeyAuth(data, useUserKey)
 
-	if isClaudeModel {
-		// 处理Claude非流式请求
-		logger.Printf("[%s] 处理Claude非流式请求", requestID)
+	// 工具循环预算（角色限制 + 请求中的 max_tool_iterations 等，这些字段不发送给模型）
+	budget := s.toolLoopBudgetFor(data, requestID)
 
-	// 检查并纠正模型名称
-		if modelName == "claude-3-7-sonnet-20250222" {
-		data["model"] = "claude-3-7-sonnet-20250219"
-		logger.Printf("[%s] 模型名称更正: claude-3-7-sonnet-20250222 -> claude-3-7-sonnet-20250219", requestID)
+	// temperature=0 的确定性请求命中响应缓存时直接返回，不调用模型、不扣费
+	cache := s.responseCacheFor(data, userID, modelConfig, requestID)
+	if cached := s.lookupCachedResponse(cache, requestID); cached != nil {
+		return cached, nil
 	}
 
-	// 处理思考模式参数
-	thinkingEnabled, _ := data["thinking_enabled"].(bool)
-		if thinkingEnabled {
-	thinkingBudget := 16000
-		if budget, ok := data["thinking_budget"].(float64); ok {
-			thinkingBudget = int(budget)
-		}
-		logger.Printf("[%s] 已启用Claude思考模式，预算令牌数: %d", requestID, thinkingBudget)
+	// 语义缓存按用户（或平台 Key）和角色隔离，命中近似问题时直接返回
+	data, _ = s.processSemanticCache(data, userID, requestID)
+	semanticHit, semantic := takeSemanticCache(data)
+	if semanticHit != nil {
+		return semanticHit, nil
+	}
+	cache = withSemanticCache(cache, semantic)
+
+	// 计费上下文
+	billing := &billingContext{
+		RequestID:  requestID,
+		UserID:     userID,
+		APIKeyID:   platformAPIKeyID(data),
+		UseUserKey: useUserKey,
+		Model:      modelConfig,
 	}
 
+	// 按 max_tokens 预占余额，请求结束时按实际用量结算；提前返回时释放预占
+	if err := s.reserveTokens(billing, data); err != nil {
+		return nil, fmt.Errorf("令牌余额不足: %v", err)
+	}
+	defer s.releaseReservation(billing)
+
+	// ServerCalls 循环处理 - 使用新的分批处理机制，循环受工具循环预算限制
+	// 只有支持 ServerCalls 循环的适配器（Claude）执行服务端调用，其它适配器只调用一次模型
+	serverCallsLoop := runsServerCallsLoop(adapter)
+	iteration := 0
+	var response map[string]interface{}
+	// 循环中每次模型调用（含分批投喂的确认调用）都消耗令牌，累计后统一计费
+	usage := map[string]interface{}{}
+
+	// 获取原始 messages (OpenAI 格式) 并确保都有 id
+	messages, _ := data["messages"].([]interface{})
+	messages = ensureMessagesHaveID(messages)
+
+	for {
+		iteration++
+		logger.Printf("[%s] 📍 ServerCalls 循环第 %d 次", requestID, iteration)
+
+		// 更新请求数据并通过适配器调用模型（失败时按降级链重试）
+		data["messages"] = messages
+		response, err = s.chatCompletionWithFallback(ctx, data, modelConfig, requestID)
+		if err != nil {
+			logger.Printf("[%s] %s 请求失败: %v", requestID, adapter.Name(), err)
+			return nil, fmt.Errorf("模型格式转换失败: %v", err)
+		}
+		budget.addUsage(response)
+		mergeUsage(usage, response["usage"])
 
-		// ServerCalls 循环处理 - 使用新的分批处理机制
-		const maxServerCallsIterations = 5
-		iteration := 0
-		var response map[string]interface{}
-
-		// 获取原始 messages (OpenAI 格式) 并确保都有 id
-		messages, _ := data["messages"].([]interface{})
-		messages = ensureMessagesHaveID(messages)
-
-		for iteration < maxServerCallsIterations {
-			iteration++
-			logger.Printf("[%s] 📍 ServerCalls 循环第 %d 次", requestID, iteration)
-
-			// 更新请求数据并转换为 Claude 格式
-			data["messages"] = messages
-			claudeData, err := s.formatConverter.RequestOpenAIToClaude(data)
-			if err != nil {
-				logger.Printf("[%s] OpenAI转Claude格式转换失败: %v", requestID, err)
-				return nil, fmt.Errorf("模型格式转换失败: %v", err)
-			}
-
-			// 调用Claude API
-			claudeResponse := s.claudeService.CreateChatCompletionNonStream(c.Request.Context(), claudeData)
-
-			// 将Claude响应转换为OpenAI格式
-			response, err = s.formatConverter.ResponseClaudeToOpenAI(claudeResponse, data)
-			if err != nil {
-				logger.Printf("[%s] Claude转OpenAI格式转换失败: %v", requestID, err)
-				return nil, fmt.Errorf("响应格式转换失败: %v", err)
-			}
-
-			// 检查是否有错误
-			if errObj, exists := response["error"]; exists {
-				logger.Printf("[%s] Claude API 返回错误: %v", requestID, errObj)
-				break
-			}
+		// 检查是否有错误
+		if errObj, exists := response["error"]; exists {
+			logger.Printf("[%s] %s API 返回错误: %v", requestID, adapter.Name(), errObj)
+			break
+		}
 
-			// 提取助手的回复
-			choices, _ := response["choices"].([]interface{})
-			if len(choices) == 0 {
-				logger.Printf("[%s] 没有收到响应内容", requestID)
-				break
-			}
+		// 提取助手的回复
+		choices, _ := response["choices"].([]interface{})
+		if len(choices) == 0 {
+			logger.Printf("[%s] 没有收到响应内容", requestID)
+			break
+		}
 
-			firstChoice, _ := choices[0].(map[string]interface{})
-			message, _ := firstChoice["message"].(map[string]interface{})
-			content, _ := message["content"].(string)
+		firstChoice, _ := choices[0].(map[string]interface{})
+		message, _ := firstChoice["message"].(map[string]interface{})
+		content, _ := message["content"].(string)
 
-			logger.Printf("[%s] 📝 AI 响应内容长度: %d", requestID, len(content))
+		logger.Printf("[%s] 📝 AI 响应内容长度: %d", requestID, len(content))
 
-			// 优先尝试从结构化响应中解析工具调用（function_call / tool_calls）
-			serverCalls := s.extractStructuredCallsFromResponse(response, requestID)
+		// 优先尝试从结构化响应中解析工具调用（function_call / tool_calls）
+		serverCalls := s.extractStructuredCallsFromResponse(response, requestID)
 
-			if len(serverCalls) == 0 {
-				logger.Printf("[%s] ✅ 没有检测到 ServerCalls 调用，结束循环", requestID)
-				break
-			}
+		if len(serverCalls) == 0 {
+			logger.Printf("[%s] ✅ 没有检测到 ServerCalls 调用，结束循环", requestID)
+			break
+		}
+		if !serverCallsLoop {
+			logger.Printf("[%s] %s 适配器不执行 ServerCalls 调用，结束循环", requestID, adapter.Name())
+			break
+		}
 
-			logger.Printf("[%s] 🔍 检测到 %d 个 ServerCalls 调用", requestID, len(serverCalls))
+		logger.Printf("[%s] 🔍 检测到 %d 个 ServerCalls 调用", requestID, len(serverCalls))
 
-			// 执行所有 ServerCalls 调用并处理分批
-			for _, call := range serverCalls {
-				result, err := s.executeServerCall(c.Request.Context(), call, requestID)
-				if err != nil {
-					result = fmt.Sprintf("执行失败: %v", err)
-				}
+		// 超出工具循环预算时不再执行，返回说明原因的最终回复
+		if reason := budget.exceeded(); reason != "" {
+			response = s.toolBudgetExceededResponse(response, reason, requestID)
+			break
+		}
 
-				// 检查是否需要分批处理
-				const maxContentSize = 100000 // 10万字符限制
+		// 并发执行所有 ServerCalls 调用，再按原始顺序处理结果（含分批）
+		results := s.executeBudgetedServerCalls(ctx, budget, serverCalls, requestID, func(ctx context.Context, call ServerCall) (string, error) {
+			return s.executeServerCall(ctx, call, requestID)
+		})
+		for i, call := range serverCalls {
+			result := results[i]
 
-				if isLargeContent(result, maxContentSize) {
-					logger.Printf("[%s] 📦 检测到大内容 (%d 字符)，开始分批处理", requestID, len(result))
+			// 检查是否需要分批处理
+			const maxContentSize = 100000 // 10万字符限制
 
-					// 分批处理大内容
-					chunks := chunkContent(result, call.Name, maxContentSize)
-					logger.Printf("[%s] 📦 内容已分为 %d 个批次", requestID, len(chunks))
+			if isLargeContent(result, maxContentSize) {
+				logger.Printf("[%s] 📦 检测到大内容 (%d 字符)，开始分批处理", requestID, len(result))
 
-					// 使用改进的分批投喂机制（Claude版本）
-					feedResults := make([]*BatchFeedResult, 0, len(chunks))
+				// 分批处理大内容
+				chunks := chunkContent(result, call.Name, maxContentSize)
+				logger.Printf("[%s] 📦 内容已分为 %d 个批次", requestID, len(chunks))
 
-					// 将助手的回复（包含 ServerCalls 调用）添加到消息历史（只在第一批次时添加）
-					messages = append(messages, map[string]interface{}{
-						"id":      generateMessageID(),
-						"role":    "assistant",
-						"content": content,
-					})
+				// 使用改进的分批投喂机制
+				feedResults := make([]*BatchFeedResult, 0, len(chunks))
 
-					// 分批投喂给AI，带重试机制
-					for i, chunk := range chunks {
-						logger.Printf("[%s] 📤 开始投喂第 %d/%d 批次内容 (长度: %d)", requestID, i+1, len(chunks), len(chunk.Content))
+				// 将助手的回复（包含 ServerCalls 调用）添加到消息历史（只在第一批次时添加）
+				messages = append(messages, map[string]interface{}{
+					"id":      generateMessageID(),
+					"role":    "assistant",
+					"content": content,
+				})
 
-						// 使用重试机制投喂单个数据块（Claude版本）
-						feedResult := s.feedBatchWithRetryClaude(c.Request.Context(), chunk, requestID, data, 3)
-						feedResults = append(feedResults, feedResult)
+				// 分批投喂给AI，带重试机制
+				for i, chunk := range chunks {
+					logger.Printf("[%s] 📤 开始投喂第 %d/%d 批次内容 (长度: %d)", requestID, i+1, len(chunks), len(chunk.Content))
 
-						if !feedResult.Success {
-							logger.Printf("[%s] ❌ 第 %d 批次投喂失败，但继续处理后续批次", requestID, chunk.Index)
-							// 继续处理后续批次，不中断整个流程
-						}
-					}
+					// 使用重试机制投喂单个数据块
+					feedResult := s.feedBatchWithRetry(ctx, adapter, chunk, requestID, data, 3)
+					feedResults = append(feedResults, feedResult)
+					mergeUsage(usage, feedResult.Usage)
 
-					// 验证所有数据块是否都已投喂
-					if err := s.validateAllBatchesFed(feedResults, requestID); err != nil {
-						logger.Printf("[%s] ⚠️ 数据块投喂验证失败: %v", requestID, err)
-						// 可以选择继续或返回错误，这里选择继续
+					if !feedResult.Success {
+						logger.Printf("[%s] ❌ 第 %d 批次投喂失败，但继续处理后续批次", requestID, chunk.Index)
+						// 继续处理后续批次，不中断整个流程
 					}
+				}
 
-					// 如果是最后一批，让AI基于所有数据回答
-					if len(chunks) > 0 {
-						lastChunk := chunks[len(chunks)-1]
-						if lastChunk.IsLast {
-							logger.Printf("[%s] 📤 所有批次已投喂完毕，让AI基于所有数据回答", requestID)
-
-							// 更新请求数据并转换为 Claude 格式
-							data["messages"] = messages
-							claudeData, err := s.formatConverter.RequestOpenAIToClaude(data)
-							if err != nil {
-								logger.Printf("[%s] 最终回答格式转换失败: %v", requestID, err)
-								return nil, fmt.Errorf("最终回答格式转换失败: %v", err)
-							}
-
-							// 调用Claude API最终回答
-							finalClaudeResponse := s.claudeService.CreateChatCompletionNonStream(c.Request.Context(), claudeData)
-
-							// 将Claude响应转换为OpenAI格式
-							response, err = s.formatConverter.ResponseClaudeToOpenAI(finalClaudeResponse, data)
-							if err != nil {
-								logger.Printf("[%s] 最终回答响应转换失败: %v", requestID, err)
-								return nil, fmt.Errorf("最终回答响应转换失败: %v", err)
-							}
-
-							// 提取最终响应
-							if finalChoices, ok := response["choices"].([]interface{}); ok && len(finalChoices) > 0 {
-								if finalChoice, ok := finalChoices[0].(map[string]interface{}); ok {
-									if finalMessage, ok := finalChoice["message"].(map[string]interface{}); ok {
-										if finalContent, ok := finalMessage["content"].(string); ok {
-											logger.Printf("[%s] ✅ AI 最终响应成功，长度: %d", requestID, len(finalContent))
+				// 验证所有数据块是否都已投喂
+				if err := s.validateAllBatchesFed(feedResults, requestID); err != nil {
+					logger.Printf("[%s] ⚠️ 数据块投喂验证失败: %v", requestID, err)
+					// 可以选择继续或返回错误，这里选择继续
+				}
 
-											// 更新content为最终响应
-											content = finalContent
-										}
+				// 如果是最后一批，让AI基于所有数据回答
+				if len(chunks) > 0 {
+					lastChunk := chunks[len(chunks)-1]
+					if lastChunk.IsLast {
+						logger.Printf("[%s] 📤 所有批次已投喂完毕，让AI基于所有数据回答", requestID)
+
+						// 更新请求数据并通过适配器获取最终回答
+						data["messages"] = messages
+						finalResponse, err := s.chatCompletionWithFallback(ctx, data, modelConfig, requestID)
+						if err != nil {
+							logger.Printf("[%s] 最终回答请求失败: %v", requestID, err)
+							return nil, fmt.Errorf("最终回答格式转换失败: %v", err)
+						}
+						mergeUsage(usage, finalResponse["usage"])
+						response = finalResponse
+
+						// 提取最终响应
+						if finalChoices, ok := response["choices"].([]interface{}); ok && len(finalChoices) > 0 {
+							if finalChoice, ok := finalChoices[0].(map[string]interface{}); ok {
+								if finalMessage, ok := finalChoice["message"].(map[string]interface{}); ok {
+									if finalContent, ok := finalMessage["content"].(string); ok {
+										logger.Printf("[%s] ✅ AI 最终响应成功，长度: %d", requestID, len(finalContent))
+
+										// 更新content为最终响应
+										content = finalContent
 									}
 								}
 							}
 						}
 					}
-				} else {
-					// 内容不大，正常处理
-					logger.Printf("[%s] 📝 内容大小正常 (%d 字符)，直接处理", requestID, len(result))
-
-					// 将助手的回复（包含 ServerCalls 调用）添加到消息历史
-					messages = append(messages, map[string]interface{}{
-						"id":      generateMessageID(),
-						"role":    "assistant",
-						"content": content,
-					})
-
-					// 将 ServerCalls 执行结果添加到消息历史
-					messages = s.appendServerCallResultToMessages(messages, []ServerCall{call}, []string{result})
 				}
+			} else {
+				// 内容不大，正常处理
+				logger.Printf("[%s] 📝 内容大小正常 (%d 字符)，直接处理", requestID, len(result))
+
+				// 将助手的回复（包含 ServerCalls 调用）添加到消息历史
+				messages = append(messages, map[string]interface{}{
+					"id":      generateMessageID(),
+					"role":    "assistant",
+					"content": content,
+				})
+
+				// 将 ServerCalls 执行结果添加到消息历史
+				messages = s.appendServerCallResultToMessages(messages, []ServerCall{call}, []string{result})
 			}
-
-			logger.Printf("[%s] 📌 将 ServerCalls 结果追加到消息历史，继续下一轮", requestID)
 		}
 
-		if iteration >= maxServerCallsIterations {
-			logger.Printf("[%s] ⚠️  达到最大 ServerCalls 循环次数 (%d)，停止", requestID, maxServerCallsIterations)
-		}
+		logger.Printf("[%s] 📌 将 ServerCalls 结果追加到消息历史，继续下一轮", requestID)
+	}
+
+	// 最终回复携带整个循环的累计用量，结构化输出重试的用量在此基础上继续累加
+	if response != nil && toInt(usage["total_tokens"]) > 0 {
+		response["usage"] = usage
+	}
 
-		// 确保最终响应对应的 assistant 消息已添加到 messages 历史中
-		// 如果还没有添加，则添加它（这种情况发生在 ServerCalls 循环结束时，最终响应没有 ServerCalls 调用）
-		if response != nil {
-			if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
-				if firstChoice, ok := choices[0].(map[string]interface{}); ok {
-					if message, ok := firstChoice["message"].(map[string]interface{}); ok {
-						if content, ok := message["content"].(string); ok && content != "" {
-							// 检查 messages 历史中最后一条消息是否已经是这条消息
-							needAdd := true
-							if len(messages) > 0 {
-								if lastMsg, ok := messages[len(messages)-1].(map[string]interface{}); ok {
-									if lastRole, _ := lastMsg["role"].(string); lastRole == "assistant" {
-										if lastContent, _ := lastMsg["content"].(string); lastContent == content {
-											needAdd = false
-										}
+	// response_format 要求结构化输出时校验最终回复，不符合时带着校验错误重新生成
+	response = s.enforceStructuredOutput(ctx, data, response, modelConfig, requestID)
+
+	// 确保最终响应对应的 assistant 消息已添加到 messages 历史中
+	// 如果还没有添加，则添加它（这种情况发生在 ServerCalls 循环结束时，最终响应没有 ServerCalls 调用）
+	if response != nil {
+		if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
+			if firstChoice, ok := choices[0].(map[string]interface{}); ok {
+				if message, ok := firstChoice["message"].(map[string]interface{}); ok {
+					if content, ok := message["content"].(string); ok && content != "" {
+						// 检查 messages 历史中最后一条消息是否已经是这条消息
+						needAdd := true
+						if len(messages) > 0 {
+							if lastMsg, ok := messages[len(messages)-1].(map[string]interface{}); ok {
+								if lastRole, _ := lastMsg["role"].(string); lastRole == "assistant" {
+									if lastContent, _ := lastMsg["content"].(string); lastContent == content {
+										needAdd = false
 									}
 								}
 							}
+						}
 
-							// 如果需要添加，则添加到 messages 历史中
-							if needAdd {
-								msgID := generateMessageID()
-								// 如果响应中的 message 已经有 id，使用它；否则使用新生成的 id
-								if existingID, hasID := message["id"].(string); hasID && existingID != "" {
-									msgID = existingID
-								} else {
-									message["id"] = msgID
-									firstChoice["message"] = message
-									choices[0] = firstChoice
-									response["choices"] = choices
-								}
-
-								messages = append(messages, map[string]interface{}{
-									"id":      msgID,
-									"role":    "assistant",
-									"content": content,
-								})
-								logger.Printf("[%s] ✅ 已将最终响应添加到 messages 历史，id: %s", requestID, msgID)
+						// 如果需要添加，则添加到 messages 历史中
+						if needAdd {
+							msgID := generateMessageID()
+							// 如果响应中的 message 已经有 id，使用它；否则使用新生成的 id
+							if existingID, hasID := message["id"].(string); hasID && existingID != "" {
+								msgID = existingID
+							} else {
+								message["id"] = msgID
+								firstChoice["message"] = message
+								choices[0] = firstChoice
+								response["choices"] = choices
 							}
+
+							messages = append(messages, map[string]interface{}{
+								"id":      msgID,
+								"role":    "assistant",
+								"content": content,
+							})
+							logger.Printf("[%s] ✅ 已将最终响应添加到 messages 历史，id: %s", requestID, msgID)
 						}
 					}
 				}
 			}
 		}
+	}
 
-		// 扣除token（如果需要）
-		s.deductTokensIfNeeded(response, userID, requestID)
-
-		logger.Printf("[%s] Claude请求完成", requestID)
-
-		// 统一的错误检测和日志记录
-		if checkAndLogResponseError(response, requestID, "Claude") {
-			return response, nil // 返回错误响应，让上层处理
-		}
-
-		// 过滤响应中的服务端调用，并确保 message 有 id
-		filteredResponse := s.filterServerCallsInResponse(response, messages)
-		return filteredResponse, nil
-	} else {
-		// 处理OpenAI非流式请求
-		logger.Printf("[%s] 处理OpenAI非流式请求", requestID)
-
-		// 使用格式转换器规范化 OpenAI 请求
-		normalizedData, err := s.formatConverter.NormalizeOpenAIRequest(data)
-		if err != nil {
-			logger.Printf("[%s] OpenAI 请求规范化失败: %v", requestID, err)
-			return nil, fmt.Errorf("请求格式规范化失败: %v", err)
-		}
-		logger.Printf("[%s] OpenAI 请求已规范化", requestID)
-
-		// 使用规范化后的数据
-		data = normalizedData
-
-		// 调用OpenAI API
-		response := s.openaiService.CreateChatCompletionNonStream(c.Request.Context(), data)
-
-		// 获取原始 messages 并确保都有 id（用于过滤响应）
-		messages, _ := data["messages"].([]interface{})
-		messages = ensureMessagesHaveID(messages)
+	// 扣除token（如果需要）
+	s.deductTokensIfNeeded(response, billing)
 
-		// 扣除token（如果需要）
-		s.deductTokensIfNeeded(response, userID, requestID)
+	logger.Printf("[%s] %s请求完成", requestID, adapter.Name())
 
-		logger.Printf("[%s] OpenAI请求完成", requestID)
+	// 统一的错误检测和日志记录
+	if checkAndLogResponseError(response, requestID, adapter.Name()) {
+		return response, nil // 返回错误响应，让上层处理
+	}
 
-		// 统一的错误检测和日志记录
-		if checkAndLogResponseError(response, requestID, "OpenAI") {
-			return response, nil // 返回错误响应，让上层处理
-		}
+	// 过滤响应中的服务端调用，并确保 message 有 id
+	filteredResponse := s.filterServerCallsInResponse(response, messages)
 
-		// 过滤响应中的服务端调用，并确保 message 有 id
-		filteredResponse := s.filterServerCallsInResponse(response, messages)
-		return filteredResponse, nil
+	// 执行过服务端调用的回复依赖调用结果，不缓存
+	if iteration == 1 {
+		s.storeCachedResponse(cache, filteredResponse, requestID)
 	}
+	return filteredResponse, nil
 }
 
 // HandleHTTPRequestNonStream 处理所有模型的HTTP非流式请求
 func (s *SilicoIDInterceptor) HandleHTTPRequestNonStream(c *gin.Context, requestID string, userID string, data map[string]interface{}) {
 	logger.Printf("[%s] 处理HTTP非流式请求", requestID)
+	stripInternalFields(data)
+	s.respondHTTPNonStream(c, requestID, userID, data)
+}
 
+// respondHTTPNonStream 创建非流式响应并写回客户端，data 中的内部字段由服务端写入
+func (s *SilicoIDInterceptor) respondHTTPNonStream(c *gin.Context, requestID string, userID string, data map[string]interface{}) {
 	// 创建AI响应
 	response, err := s.CreateHTTPNonStreamResponse(c, requestID, userID, data)
 	if err != nil {
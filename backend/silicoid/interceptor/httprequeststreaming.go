@@ -21,6 +21,9 @@ func (s *SilicoIDInterceptor) CreateHTTPStreamResponse(c *gin.Context, requestID
 		logger.Printf("[%s] ⚠️ 获取模型配置失败: %v", requestID, err)
 		return nil, fmt.Errorf("获取模型配置失败: %v", err)
 	}
+	if modelConfig.IsEmbedding() {
+		return nil, fmt.Errorf("模型 %s 是向量模型，请使用 /v1/embeddings 接口", modelName)
+	}
 
 	// 将获取到的配置存储到requestData中
 	modelCode := modelConfig.ModelCode
@@ -32,86 +35,75 @@ func (s *SilicoIDInterceptor) CreateHTTPStreamResponse(c *gin.Context, requestID
 	logger.Printf("[%s] ✅ 成功获取模型配置: model_code=%s, base_url=%s, endpoint=%s",
 		requestID, modelCode, baseURL, endpoint)
 
-	// 判断是否是 Claude 模型
-	isClaudeModel := s.isClaudeModel(modelName)
-	logger.Printf("[%s] 创建HTTP流式响应，模型: %s, Claude模型: %v", requestID, modelName, isClaudeModel)
+	// 根据模型配置的提供商选择适配器
+	adapter := s.adapterForProvider(modelConfig.Provider)
+	logger.Printf("[%s] 创建HTTP流式响应，模型: %s, 适配器: %s", requestID, modelName, adapter.Name())
 
 	// 将 userId 添加到请求数据中，供 formatconverter 使用
 	data["_user_id"] = userID
+	useUserKey := authenticatedUsesOwnKey(c)
+	applyOwnKeyAuth(data, useUserKey)
+	// 流式请求不执行服务端工具循环，工具循环限制字段不发送给模型
+	dropToolBudgetFields(data)
+
+	// temperature=0 的确定性请求命中响应缓存时按 SSE 格式回放，不调用模型、不扣费
+	ctx := c.Request.Context()
+	cache := s.responseCacheFor(data, userID, modelConfig, requestID)
+	cached := s.lookupCachedResponse(cache, requestID)
+	if cached == nil {
+		// 语义缓存按用户（或平台 Key）和角色隔离，命中近似问题时同样按 SSE 格式回放
+		data, _ = s.processSemanticCache(data, userID, requestID)
+		var semantic *semanticCacheEntry
+		cached, semantic = takeSemanticCache(data)
+		cache = withSemanticCache(cache, semantic)
+	}
+	if cached != nil {
+		streamOptions, _ := data["stream_options"].(map[string]interface{})
+		includeUsage, _ := streamOptions["include_usage"].(bool)
+		return cachedResponseStream(ctx, cached, includeUsage), nil
+	}
 
-	// 根据模型类型选择服务
-	var streamChan chan string
-
-	if isClaudeModel {
-		// 处理Claude流式请求
-		logger.Printf("[%s] 处理Claude流式请求", requestID)
-
-		// 检查并纠正模型名称
-		if modelName == "claude-3-7-sonnet-20250222" {
-			data["model"] = "claude-3-7-sonnet-20250219"
-			logger.Printf("[%s] 模型名称更正: claude-3-7-sonnet-20250222 -> claude-3-7-sonnet-20250219", requestID)
-		}
-
-		// 处理思考模式参数
-		thinkingEnabled, _ := data["thinking_enabled"].(bool)
-		if thinkingEnabled {
-			thinkingBudget := 16000
-			if budget, ok := data["thinking_budget"].(float64); ok {
-				thinkingBudget = int(budget)
-			}
-			logger.Printf("[%s] 已启用Claude思考模式，预算令牌数: %d", requestID, thinkingBudget)
-		}
-
-		// 将OpenAI格式转换为Claude格式
-		claudeData, err := s.formatConverter.RequestOpenAIToClaude(data)
-		if err != nil {
-			logger.Printf("[%s] OpenAI转Claude格式转换失败: %v", requestID, err)
-			return nil, fmt.Errorf("模型格式转换失败: %v", err)
-		}
-		logger.Printf("[%s] 请求已转换为Claude格式", requestID)
-
-		// 使用通道来接收流式响应
-		claudeStream := s.claudeService.CreateChatCompletionStream(c.Request.Context(), claudeData)
-
-		// 将Claude流式响应转换为OpenAI格式
-		openaiStream, err := s.formatConverter.HandleResponseClaudeStream(claudeStream)
-		if err != nil {
-			logger.Printf("[%s] Claude流转OpenAI流格式转换失败: %v", requestID, err)
-			return nil, fmt.Errorf("流格式转换失败: %v", err)
-		}
-
-		streamChan = openaiStream
-	} else {
-		// 处理OpenAI流式请求
-		logger.Printf("[%s] 处理OpenAI流式请求", requestID)
-
-		// 使用格式转换器规范化 OpenAI 请求
-		// 这会处理：1) system prompt 的注入和拼接  2) 将数组格式的 content 转换为字符串
-		normalizedData, err := s.formatConverter.NormalizeOpenAIRequest(data)
-		if err != nil {
-			logger.Printf("[%s] OpenAI 请求规范化失败: %v", requestID, err)
-			return nil, fmt.Errorf("请求格式规范化失败: %v", err)
-		}
-		logger.Printf("[%s] OpenAI 请求已规范化", requestID)
-
-		// 使用规范化后的数据
-		data = normalizedData
+	// 按 max_tokens 预占余额，流结束时按实际用量结算，客户端断开时按已转发的内容结算
+	billing := &billingContext{
+		RequestID:  requestID,
+		UserID:     userID,
+		APIKeyID:   platformAPIKeyID(data),
+		UseUserKey: useUserKey,
+		Model:      modelConfig,
+	}
+	if err := s.reserveTokens(billing, data); err != nil {
+		return nil, fmt.Errorf("令牌余额不足: %v", err)
+	}
+	requestStreamUsage(data, billing)
 
-		// 使用通道来接收流式响应
-		streamChan = s.openaiService.CreateChatCompletionStream(c.Request.Context(), data)
+	// 适配器负责请求格式转换，并统一返回 OpenAI 流式格式（输出内容前失败时按降级链重试）
+	streamChan, err := s.chatCompletionStreamWithFallback(ctx, data, modelConfig, requestID)
+	if err != nil {
+		s.releaseReservation(billing)
+		logger.Printf("[%s] %s 流式请求创建失败: %v", requestID, adapter.Name(), err)
+		return nil, fmt.Errorf("模型格式转换失败: %v", err)
 	}
 
 	// 包装流式响应 channel，检测并处理错误（特别是 401 认证错误）
 	wrappedChan := wrapStreamResponseWithErrorDetection(streamChan, modelName, requestID)
+	// response_format 要求结构化输出时在流结束时校验回复
+	if spec := structuredOutputFor(data); spec != nil {
+		wrappedChan = structuredOutputStream(ctx, wrappedChan, spec, requestID)
+	}
 
-	return wrappedChan, nil
+	return s.cacheStream(ctx, s.billStream(ctx, wrappedChan, billing), cache, requestID), nil
 }
 
 
 // HandleHTTPRequestStream 处理所有模型的HTTP流式请求
 func (s *SilicoIDInterceptor) HandleHTTPRequestStream(c *gin.Context, requestID string, userID string, data map[string]interface{}) {
 	logger.Printf("[%s] 处理HTTP流式请求", requestID)
+	stripInternalFields(data)
+	s.respondHTTPStream(c, requestID, userID, data)
+}
 
+// respondHTTPStream 创建流式响应并写回客户端，data 中的内部字段由服务端写入
+func (s *SilicoIDInterceptor) respondHTTPStream(c *gin.Context, requestID string, userID string, data map[string]interface{}) {
 	// 创建AI流式响应
 	streamChan, err := s.CreateHTTPStreamResponse(c, requestID, userID, data)
 	if err != nil {
@@ -0,0 +1,133 @@
+package interceptor
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleHTTPMessages 处理 Anthropic Messages API 格式的请求（/v1/messages）
+// 请求转换为内部的 OpenAI 格式后与聊天接口走相同的认证、路由、降级、缓存和计费流程，
+// 因此可以路由到任意提供商；响应和流式事件再转换回 Claude 格式
+func (s *SilicoIDInterceptor) HandleHTTPMessages(c *gin.Context) {
+	authData, err := s.authenticateAndPreprocessRequest(c)
+	if err != nil {
+		logger.Printf("Messages 请求认证失败: %v", err)
+		claudeError(c, authErrorStatus(err), err.Error())
+		return
+	}
+	requestID := authData.RequestID
+	claudeRequest := authData.Data
+
+	data, err := s.formatConverter.RequestClaudeToOpenAI(claudeRequest)
+	if err != nil {
+		logger.Printf("[%s] Claude请求转换失败: %v", requestID, err)
+		claudeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	// 保留预处理阶段写入的内部字段（模型路由、用户 Key、语义缓存等）
+	for key, value := range claudeRequest {
+		if strings.HasPrefix(key, "_") || key == "model_code" || key == "role_name" {
+			data[key] = value
+		}
+	}
+
+	model, _ := claudeRequest["model"].(string)
+	if stream, _ := data["stream"].(bool); stream {
+		streamChan, err := s.CreateHTTPStreamResponse(c, requestID, authData.UserID, data)
+		if err != nil {
+			logger.Printf("[%s] 创建Messages流式响应失败: %v", requestID, err)
+			claudeError(c, createErrorStatus(err), err.Error())
+			return
+		}
+		claudeStream := s.formatConverter.HandleResponseOpenAIStreamToClaude(c.Request.Context(), streamChan, model)
+		s.processHTTPStreamResponse(c, claudeStream, requestID)
+		return
+	}
+
+	response, err := s.CreateHTTPNonStreamResponse(c, requestID, authData.UserID, data)
+	if err != nil {
+		logger.Printf("[%s] 创建Messages响应失败: %v", requestID, err)
+		claudeError(c, createErrorStatus(err), err.Error())
+		return
+	}
+	if errObj, hasError := response["error"]; hasError {
+		logger.Printf("[%s] AI响应包含错误: %v", requestID, errObj)
+		message := fmt.Sprintf("%v", errObj)
+		status := http.StatusBadRequest
+		if errMap, ok := errObj.(map[string]interface{}); ok {
+			if msg, ok := errMap["message"].(string); ok {
+				message = msg
+			}
+			status = responseErrorStatus(errMap)
+		}
+		claudeError(c, status, message)
+		return
+	}
+
+	claudeResponse, err := s.formatConverter.ResponseOpenAIToClaude(response, claudeRequest)
+	if err != nil {
+		logger.Printf("[%s] 转换Claude响应失败: %v", requestID, err)
+		claudeError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, field := range []string{servedByField, responseCacheField} {
+		if value, ok := response[field]; ok {
+			claudeResponse[field] = value
+		}
+	}
+
+	logger.Printf("[%s] Messages 请求处理完成", requestID)
+	c.JSON(http.StatusOK, claudeResponse)
+}
+
+// createErrorStatus 创建响应失败时返回的 HTTP 状态码
+// 与认证失败一致：余额不足返回 402，请求或模型参数有误返回 400，其它（上游或服务端）错误返回 500
+func createErrorStatus(err error) int {
+	message := err.Error()
+	switch {
+	case strings.HasPrefix(message, "令牌余额不足"):
+		return http.StatusPaymentRequired
+	case strings.HasPrefix(message, "缺少模型参数"), strings.HasPrefix(message, "获取模型配置失败"),
+		strings.Contains(message, "是向量模型"), strings.Contains(message, "格式转换失败"):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// responseErrorStatus 模型返回错误时的 HTTP 状态码：速率限制返回 429，上游认证失败返回 401，其它返回 400
+func responseErrorStatus(errObj map[string]interface{}) int {
+	code, _ := errObj["code"].(string)
+	errorType, _ := errObj["type"].(string)
+	switch {
+	case code == "rate_limit_exceeded" || errorType == "rate_limit_error":
+		return http.StatusTooManyRequests
+	case code == "invalid_api_key" || errorType == "authentication_error":
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+// claudeError 返回 Anthropic 格式的错误
+func claudeError(c *gin.Context, status int, message string) {
+	errorType := "api_error"
+	switch status {
+	case http.StatusBadRequest:
+		errorType = "invalid_request_error"
+	case http.StatusUnauthorized:
+		errorType = "authentication_error"
+	case http.StatusPaymentRequired:
+		errorType = "billing_error"
+	case http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	}
+	c.JSON(status, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errorType,
+			"message": message,
+		},
+	})
+}
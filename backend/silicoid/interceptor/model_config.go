@@ -175,18 +175,8 @@ func (s *SilicoIDInterceptor) GetModelsFromAPI(ctx context.Context, provider str
 		modelsEndpoint = cfg.ModelsEndpoint
 	}
 	
-	switch provider {
-	case "Anthropic":
-		// 使用 Claude 服务
-		rawResponse, err = s.claudeService.GetModels(ctx, baseURL, apiKey, modelsEndpoint)
-	case "Gemini":
-		// Gemini 使用特殊的认证方式，暂时使用 OpenAI 兼容方式
-		// TODO: 如果需要，可以为 Gemini 创建专门的服务
-		rawResponse, err = s.openaiService.GetModels(ctx, baseURL, apiKey, modelsEndpoint)
-	default:
-		// OpenAI 兼容 API（OpenAI, DeepSeek, MoonShot, xAI, Meta, Qwen, Doubao 等）
-		rawResponse, err = s.openaiService.GetModels(ctx, baseURL, apiKey, modelsEndpoint)
-	}
+	// 根据提供商选择适配器（Gemini 等未单独注册的提供商使用 OpenAI 兼容方式）
+	rawResponse, err = s.adapterForProvider(provider).ListModels(ctx, baseURL, apiKey, modelsEndpoint)
 	
 	// 如果获取失败，直接返回错误
 	if err != nil {
@@ -0,0 +1,272 @@
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"digitalsingularity/backend/silicoid/formatconverter"
+	"digitalsingularity/backend/silicoid/models/claude"
+	"digitalsingularity/backend/silicoid/models/openai"
+)
+
+// ProviderAdapter 模型提供商适配器
+// 拦截器内部统一使用 OpenAI 格式的请求/响应，适配器负责与具体提供商之间的格式转换和调用
+type ProviderAdapter interface {
+	// Name 适配器名称（用于日志）
+	Name() string
+	// ChatCompletion 非流式聊天，入参和返回值均为 OpenAI 格式
+	ChatCompletion(ctx context.Context, data map[string]interface{}) (map[string]interface{}, error)
+	// ChatCompletionStream 流式聊天，返回 OpenAI SSE 格式的数据块（data: {...}\n\n），以 data: [DONE]\n\n 结束
+	ChatCompletionStream(ctx context.Context, data map[string]interface{}) (chan string, error)
+	// Embeddings 向量请求，入参和返回值均为 OpenAI 格式（/v1/embeddings）
+	Embeddings(ctx context.Context, data map[string]interface{}) (map[string]interface{}, error)
+	// ListModels 获取提供商的模型列表（原始响应，由 formatConverter 负责规范化）
+	ListModels(ctx context.Context, baseURL string, apiKey string, modelsEndpoint string) (map[string]interface{}, error)
+	// UploadFile 上传文件到提供商的文件接口，返回提供商侧的 file_id
+	UploadFile(ctx context.Context, fileBytes []byte, filename string, mimeType string, apiKey string) (string, error)
+}
+
+// serverCallsLooper 可选接口：HTTP 非流式请求在服务端循环执行模型返回的 ServerCalls 调用
+// 未实现该接口的适配器只调用一次模型，服务端调用从响应中过滤掉
+type serverCallsLooper interface {
+	ServerCallsLoop() bool
+}
+
+// runsServerCallsLoop 适配器是否在 HTTP 非流式请求中执行 ServerCalls 循环
+func runsServerCallsLoop(adapter ProviderAdapter) bool {
+	looper, ok := adapter.(serverCallsLooper)
+	return ok && looper.ServerCallsLoop()
+}
+
+// errEmbeddingsNotSupported 提供商没有向量接口
+var errEmbeddingsNotSupported = errors.New("适配器不支持向量请求")
+
+// defaultProviderName 未匹配到适配器时使用的提供商（OpenAI 兼容接口）
+const defaultProviderName = "openai"
+
+// claudeProviderName Claude 适配器注册的提供商名称，名称中包含 claude 的提供商（如 Claude-xxx）也使用该适配器
+const claudeProviderName = "claude"
+
+// providerAdapterRegistry 提供商适配器注册表，按 ModelConfig.Provider（小写）索引
+type providerAdapterRegistry struct {
+	mu       sync.RWMutex
+	adapters map[string]ProviderAdapter
+}
+
+func newProviderAdapterRegistry() *providerAdapterRegistry {
+	return &providerAdapterRegistry{
+		adapters: make(map[string]ProviderAdapter),
+	}
+}
+
+// Register 注册适配器，providers 为该适配器负责的提供商名称（大小写不敏感）
+func (r *providerAdapterRegistry) Register(adapter ProviderAdapter, providers ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, provider := range providers {
+		r.adapters[strings.ToLower(strings.TrimSpace(provider))] = adapter
+	}
+}
+
+// Get 按提供商名称获取适配器，未注册的提供商回退到 OpenAI 兼容适配器
+func (r *providerAdapterRegistry) Get(provider string) ProviderAdapter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	provider = strings.ToLower(strings.TrimSpace(provider))
+	if adapter, ok := r.adapters[provider]; ok {
+		return adapter
+	}
+	if strings.Contains(provider, claudeProviderName) {
+		if adapter, ok := r.adapters[claudeProviderName]; ok {
+			return adapter
+		}
+	}
+	return r.adapters[defaultProviderName]
+}
+
+// RegisterProviderAdapter 注册自定义提供商适配器
+func (s *SilicoIDInterceptor) RegisterProviderAdapter(adapter ProviderAdapter, providers ...string) {
+	s.providerAdapters.Register(adapter, providers...)
+	logger.Printf("✅ 已注册提供商适配器 %s: %v", adapter.Name(), providers)
+}
+
+// adapterForProvider 根据提供商名称获取适配器
+func (s *SilicoIDInterceptor) adapterForProvider(provider string) ProviderAdapter {
+	return s.providerAdapters.Get(provider)
+}
+
+// adapterForModel 根据模型名称获取适配器
+// 通过查询数据库/Redis中的模型配置，根据provider字段选择
+func (s *SilicoIDInterceptor) adapterForModel(modelName string) ProviderAdapter {
+	modelConfig, err := s.modelManager.GetModelConfig(modelName)
+	if err == nil && modelConfig != nil {
+		adapter := s.adapterForProvider(modelConfig.Provider)
+		logger.Printf("✅ 模型 %s 使用 %s 适配器 (provider: %s)", modelName, adapter.Name(), modelConfig.Provider)
+		return adapter
+	}
+
+	// 如果数据库中没有找到，尝试模糊匹配常见的模型名称前缀
+	// 这是降级方案，当数据库不可用或模型未配置时使用
+	if strings.Contains(strings.ToLower(modelName), "claude") {
+		logger.Printf("⚠️  通过模型名称模糊匹配识别为 Claude 模型: %s (数据库查询失败: %v)", modelName, err)
+		return s.adapterForProvider("anthropic")
+	}
+
+	logger.Printf("⚠️  模型 %s 未找到配置，使用 OpenAI 兼容适配器 (数据库查询失败: %v)", modelName, err)
+	return s.adapterForProvider(defaultProviderName)
+}
+
+// ClaudeAdapter Claude（Anthropic Messages API）适配器
+type ClaudeAdapter struct {
+	service         *claude.ClaudeService
+	formatConverter *formatconverter.SilicoidFormatConverterService
+}
+
+// NewClaudeAdapter 创建Claude适配器
+func NewClaudeAdapter(service *claude.ClaudeService, formatConverter *formatconverter.SilicoidFormatConverterService) *ClaudeAdapter {
+	return &ClaudeAdapter{
+		service:         service,
+		formatConverter: formatConverter,
+	}
+}
+
+func (a *ClaudeAdapter) Name() string {
+	return "Claude"
+}
+
+// ServerCallsLoop Claude 模型的 HTTP 非流式请求在服务端执行 ServerCalls 循环
+func (a *ClaudeAdapter) ServerCallsLoop() bool {
+	return true
+}
+
+// prepare 处理Claude特有的请求参数并转换为Claude格式
+func (a *ClaudeAdapter) prepare(data map[string]interface{}) (map[string]interface{}, error) {
+	// 检查并纠正模型名称
+	if modelName, _ := data["model"].(string); modelName == "claude-3-7-sonnet-20250222" {
+		data["model"] = "claude-3-7-sonnet-20250219"
+		logger.Printf("模型名称更正: claude-3-7-sonnet-20250222 -> claude-3-7-sonnet-20250219")
+	}
+
+	// 处理思考模式参数
+	if thinkingEnabled, _ := data["thinking_enabled"].(bool); thinkingEnabled {
+		thinkingBudget := 16000
+		if budget, ok := data["thinking_budget"].(float64); ok {
+			thinkingBudget = int(budget)
+		}
+		logger.Printf("已启用Claude思考模式，预算令牌数: %d", thinkingBudget)
+	}
+
+	claudeData, err := a.formatConverter.RequestOpenAIToClaude(data)
+	if err != nil {
+		return nil, fmt.Errorf("OpenAI转Claude格式转换失败: %v", err)
+	}
+	return claudeData, nil
+}
+
+func (a *ClaudeAdapter) ChatCompletion(ctx context.Context, data map[string]interface{}) (map[string]interface{}, error) {
+	claudeData, err := a.prepare(data)
+	if err != nil {
+		return nil, err
+	}
+
+	claudeResponse := a.service.CreateChatCompletionNonStream(ctx, claudeData)
+
+	// 将Claude响应转换为OpenAI格式
+	response, err := a.formatConverter.ResponseClaudeToOpenAI(claudeResponse, data)
+	if err != nil {
+		return nil, fmt.Errorf("Claude转OpenAI格式转换失败: %v", err)
+	}
+	if keyID, ok := claudeResponse[keyIDField]; ok {
+		response[keyIDField] = keyID
+	}
+	return response, nil
+}
+
+func (a *ClaudeAdapter) ChatCompletionStream(ctx context.Context, data map[string]interface{}) (chan string, error) {
+	claudeData, err := a.prepare(data)
+	if err != nil {
+		return nil, err
+	}
+
+	claudeStream := a.service.CreateChatCompletionStream(ctx, claudeData)
+
+	// 将Claude流式事件转换为OpenAI格式
+	openaiStream, err := a.formatConverter.HandleResponseClaudeStream(claudeStream)
+	if err != nil {
+		return nil, fmt.Errorf("Claude流转OpenAI流格式转换失败: %v", err)
+	}
+	return openaiStream, nil
+}
+
+func (a *ClaudeAdapter) Embeddings(ctx context.Context, data map[string]interface{}) (map[string]interface{}, error) {
+	// Anthropic 没有提供向量接口
+	return nil, fmt.Errorf("Claude %w", errEmbeddingsNotSupported)
+}
+
+func (a *ClaudeAdapter) ListModels(ctx context.Context, baseURL string, apiKey string, modelsEndpoint string) (map[string]interface{}, error) {
+	return a.service.GetModels(ctx, baseURL, apiKey, modelsEndpoint)
+}
+
+func (a *ClaudeAdapter) UploadFile(ctx context.Context, fileBytes []byte, filename string, mimeType string, apiKey string) (string, error) {
+	return a.service.UploadFile(ctx, fileBytes, filename, mimeType, apiKey)
+}
+
+// OpenAIAdapter OpenAI 兼容接口适配器（OpenAI, DeepSeek, MoonShot, xAI, Qwen, Doubao 等）
+type OpenAIAdapter struct {
+	service         *openai.OpenAIService
+	formatConverter *formatconverter.SilicoidFormatConverterService
+}
+
+// NewOpenAIAdapter 创建OpenAI兼容适配器
+func NewOpenAIAdapter(service *openai.OpenAIService, formatConverter *formatconverter.SilicoidFormatConverterService) *OpenAIAdapter {
+	return &OpenAIAdapter{
+		service:         service,
+		formatConverter: formatConverter,
+	}
+}
+
+func (a *OpenAIAdapter) Name() string {
+	return "OpenAI"
+}
+
+// prepare 规范化 OpenAI 请求
+// 这会处理：1) system prompt 的注入和拼接  2) 将数组格式的 content 转换为字符串
+func (a *OpenAIAdapter) prepare(data map[string]interface{}) (map[string]interface{}, error) {
+	normalizedData, err := a.formatConverter.NormalizeOpenAIRequest(data)
+	if err != nil {
+		return nil, fmt.Errorf("OpenAI 请求规范化失败: %v", err)
+	}
+	return normalizedData, nil
+}
+
+func (a *OpenAIAdapter) ChatCompletion(ctx context.Context, data map[string]interface{}) (map[string]interface{}, error) {
+	normalizedData, err := a.prepare(data)
+	if err != nil {
+		return nil, err
+	}
+	return a.service.CreateChatCompletionNonStream(ctx, normalizedData), nil
+}
+
+func (a *OpenAIAdapter) ChatCompletionStream(ctx context.Context, data map[string]interface{}) (chan string, error) {
+	normalizedData, err := a.prepare(data)
+	if err != nil {
+		return nil, err
+	}
+	return a.service.CreateChatCompletionStream(ctx, normalizedData), nil
+}
+
+func (a *OpenAIAdapter) Embeddings(ctx context.Context, data map[string]interface{}) (map[string]interface{}, error) {
+	return a.service.CreateEmbeddings(ctx, data), nil
+}
+
+func (a *OpenAIAdapter) ListModels(ctx context.Context, baseURL string, apiKey string, modelsEndpoint string) (map[string]interface{}, error) {
+	return a.service.GetModels(ctx, baseURL, apiKey, modelsEndpoint)
+}
+
+func (a *OpenAIAdapter) UploadFile(ctx context.Context, fileBytes []byte, filename string, mimeType string, apiKey string) (string, error) {
+	// OpenAI 兼容接口的文件内容由 formatConverter 以内联方式传递，不走提供商文件接口
+	return "", fmt.Errorf("OpenAI 兼容适配器不支持文件上传")
+}
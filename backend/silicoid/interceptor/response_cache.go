@@ -0,0 +1,490 @@
+package interceptor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"digitalsingularity/backend/silicoid/database"
+	"digitalsingularity/backend/silicoid/models/manager"
+)
+
+// 响应缓存：temperature=0 的确定性请求按请求方、原始请求字段和模型代码缓存最终回复
+// 只对在 response_cache_policies 中启用的角色生效，命中缓存时不调用模型、不扣费
+const (
+	responseCacheKeyPrefix    = "silicoid:response_cache:"
+	responseCachePolicyPrefix = "silicoid:response_cache_policy:"
+	// responseCachePolicyExpire 角色缓存策略在 Redis 中的缓存时间
+	responseCachePolicyExpire = 5 * time.Minute
+	// defaultResponseCacheTTL 策略未配置有效期时的默认缓存有效期
+	defaultResponseCacheTTL = time.Hour
+	// responseCacheField 命中缓存的响应中标记缓存状态的字段
+	responseCacheField = "x_silicoid_cache"
+)
+
+// responseCacheIgnoredFields 不影响模型输出、不参与缓存键计算的请求字段
+var responseCacheIgnoredFields = map[string]bool{
+	"model":          true, // 使用 model_code 区分模型
+	"stream":         true, // 流式和非流式请求共享缓存
+	"stream_options": true,
+	"user":           true,
+	"user_id":        true,
+	"api_key":        true,
+	"auth_token":     true,
+	"request_id":     true,
+	// 请求方单独作为缓存键的一部分，用户自己的 Key 不参与计算
+	"_user_id":            true,
+	apiKeyIDField:         true,
+	"_user_openai_key":    true,
+	"_user_claude_key":    true,
+	semanticCacheField:    true,
+	semanticCacheHitField: true,
+}
+
+// systemPromptTimePattern system prompt 中注入的当前时间，计算缓存键时忽略
+var systemPromptTimePattern = regexp.MustCompile(`当前时间：\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`)
+
+// responseCacheEntry 一次请求的缓存位置
+type responseCacheEntry struct {
+	Key      string // 精确匹配缓存键，为空表示不使用精确匹配缓存
+	TTL      time.Duration
+	Semantic *semanticCacheEntry // 语义缓存位置，回复完成时一并写入
+}
+
+// responseCacheFor 判断请求是否可以使用响应缓存，可以时返回缓存位置
+// 只缓存显式指定 temperature=0 且只要求一个回复（n=1）的请求；无法确定请求方（用户或平台 Key）时不缓存
+func (s *SilicoIDInterceptor) responseCacheFor(data map[string]interface{}, userID string, modelConfig *manager.ModelConfig, requestID string) *responseCacheEntry {
+	if s.readWrite == nil || modelConfig == nil {
+		return nil
+	}
+	scope := cacheScope(data, userID)
+	if scope == "" {
+		return nil
+	}
+	temperature, ok := data["temperature"]
+	if !ok || toFloat(temperature) != 0 {
+		return nil
+	}
+	if n, ok := data["n"]; ok && toInt(n) > 1 {
+		return nil
+	}
+
+	roleName, _ := data["role_name"].(string)
+	if roleName == "" {
+		roleName = "general_assistant"
+	}
+	policy := s.responseCachePolicy(roleName, requestID)
+	if policy == nil || !policy.Enabled {
+		return nil
+	}
+
+	key, err := responseCacheKey(data, scope, modelConfig.ModelCode)
+	if err != nil {
+		logger.Printf("[%s] ⚠️ 计算响应缓存键失败，跳过缓存: %v", requestID, err)
+		return nil
+	}
+
+	ttl := defaultResponseCacheTTL
+	if policy.TTLSeconds > 0 {
+		ttl = time.Duration(policy.TTLSeconds) * time.Second
+	}
+	return &responseCacheEntry{Key: key, TTL: ttl}
+}
+
+// responseCachePolicy 获取角色的缓存策略（先读 Redis，未命中时查数据库并写回）
+func (s *SilicoIDInterceptor) responseCachePolicy(roleName string, requestID string) *database.ResponseCachePolicy {
+	policyKey := responseCachePolicyPrefix + roleName
+	if result := s.readWrite.GetRedis(policyKey); result.IsSuccess() {
+		if jsonStr, _ := result.Data.(string); jsonStr != "" {
+			var policy database.ResponseCachePolicy
+			if err := json.Unmarshal([]byte(jsonStr), &policy); err == nil {
+				return &policy
+			}
+		}
+	}
+
+	if s.dataService == nil {
+		return nil
+	}
+	policy, err := s.dataService.GetResponseCachePolicy(roleName)
+	if err != nil {
+		logger.Printf("[%s] ⚠️ %v", requestID, err)
+		return nil
+	}
+	if jsonData, err := json.Marshal(policy); err == nil {
+		s.readWrite.SetRedis(policyKey, string(jsonData), responseCachePolicyExpire)
+	}
+	return policy
+}
+
+// cacheScope 返回缓存的隔离范围：认证用户ID，没有用户ID时使用平台 Key 的ID
+// 用户自己的 Key 没有真实的用户ID，返回空字符串表示不使用缓存
+func cacheScope(data map[string]interface{}, userID string) string {
+	if useUserKey, _ := data["_use_user_key"].(bool); useUserKey {
+		return ""
+	}
+	if userID != "" {
+		return userID
+	}
+	if apiKeyID := platformAPIKeyID(data); apiKeyID > 0 {
+		return fmt.Sprintf("key:%d", apiKeyID)
+	}
+	return ""
+}
+
+// responseCacheKey 按请求方、模型代码和原始请求字段计算缓存键
+// 消息 id 每次请求都不同，system prompt 中注入了当前时间，都不参与缓存键计算
+func responseCacheKey(data map[string]interface{}, scope string, modelCode string) (string, error) {
+	keyData := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		if !responseCacheIgnoredFields[key] {
+			keyData[key] = value
+		}
+	}
+	keyData["model_code"] = modelCode
+
+	var messages []map[string]interface{}
+	switch value := data["messages"].(type) {
+	case []map[string]interface{}:
+		messages = value
+	case []interface{}:
+		for _, item := range value {
+			if msg, ok := item.(map[string]interface{}); ok {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	if messages != nil {
+		keyMessages := make([]map[string]interface{}, 0, len(messages))
+		for _, msg := range messages {
+			keyMsg := make(map[string]interface{}, len(msg))
+			for k, v := range msg {
+				if k != "id" {
+					keyMsg[k] = v
+				}
+			}
+			if role, _ := keyMsg["role"].(string); role == "system" {
+				if content, ok := keyMsg["content"].(string); ok {
+					keyMsg["content"] = systemPromptTimePattern.ReplaceAllString(content, "当前时间：")
+				}
+			}
+			keyMessages = append(keyMessages, keyMsg)
+		}
+		keyData["messages"] = keyMessages
+	}
+
+	keyJSON, err := json.Marshal(keyData)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(keyJSON)
+	return fmt.Sprintf("%s%s:%s:%s", responseCacheKeyPrefix, modelCode, scope, hex.EncodeToString(sum[:])), nil
+}
+
+// lookupCachedResponse 读取缓存的响应，未命中时返回 nil
+func (s *SilicoIDInterceptor) lookupCachedResponse(cache *responseCacheEntry, requestID string) map[string]interface{} {
+	if cache == nil || cache.Key == "" {
+		return nil
+	}
+	result := s.readWrite.GetRedis(cache.Key)
+	if !result.IsSuccess() {
+		return nil
+	}
+	jsonStr, _ := result.Data.(string)
+	if jsonStr == "" {
+		return nil
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonStr), &response); err != nil {
+		logger.Printf("[%s] ⚠️ 缓存的响应格式错误，忽略: %v", requestID, err)
+		return nil
+	}
+	logger.Printf("[%s] ✅ 命中响应缓存: %s", requestID, cache.Key)
+	return prepareCachedResponse(response, "hit")
+}
+
+// prepareCachedResponse 为命中的缓存回复生成新的消息 id 并标记缓存状态
+func prepareCachedResponse(response map[string]interface{}, status string) map[string]interface{} {
+	// 每次命中都使用新的消息 id，避免客户端将不同请求的回复视为同一条消息
+	if choices, ok := response["choices"].([]interface{}); ok {
+		for _, choice := range choices {
+			if choiceMap, ok := choice.(map[string]interface{}); ok {
+				if message, ok := choiceMap["message"].(map[string]interface{}); ok {
+					message["id"] = generateMessageID()
+				}
+			}
+		}
+	}
+	response[responseCacheField] = status
+	return response
+}
+
+// storeCachedResponse 缓存正常结束（stop / length / tool_calls）的响应，出错的响应不缓存
+func (s *SilicoIDInterceptor) storeCachedResponse(cache *responseCacheEntry, response map[string]interface{}, requestID string) {
+	if cache == nil || response == nil {
+		return
+	}
+	if _, hasError := response["error"]; hasError {
+		return
+	}
+	choices, _ := response["choices"].([]interface{})
+	if len(choices) == 0 {
+		return
+	}
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]interface{})
+		finishReason, _ := choiceMap["finish_reason"].(string)
+		if finishReason != "stop" && finishReason != "length" && finishReason != "tool_calls" {
+			return
+		}
+	}
+
+	stored := make(map[string]interface{}, len(response))
+	for key, value := range response {
+		if strings.HasPrefix(key, "_") || key == responseCacheField {
+			continue
+		}
+		stored[key] = value
+	}
+	jsonData, err := json.Marshal(stored)
+	if err != nil {
+		return
+	}
+	if cache.Semantic != nil {
+		s.storeSemanticCache(cache.Semantic, jsonData, requestID)
+	}
+	if cache.Key == "" {
+		return
+	}
+	if result := s.readWrite.SetRedis(cache.Key, string(jsonData), cache.TTL); !result.IsSuccess() {
+		logger.Printf("[%s] ⚠️ 写入响应缓存失败: %v", requestID, result.Error)
+		return
+	}
+	logger.Printf("[%s] 已写入响应缓存: %s (有效期 %s)", requestID, cache.Key, cache.TTL)
+}
+
+// cachedResponseStream 将缓存的非流式响应按 OpenAI SSE 格式回放
+// includeUsage 为 true 时在结束前追加 usage 数据块（与 stream_options.include_usage 一致）
+func cachedResponseStream(ctx context.Context, response map[string]interface{}, includeUsage bool) chan string {
+	stream := make(chan string)
+
+	go func() {
+		defer close(stream)
+
+		base := map[string]interface{}{
+			"id":               response["id"],
+			"object":           "chat.completion.chunk",
+			"created":          response["created"],
+			"model":            response["model"],
+			responseCacheField: response[responseCacheField],
+		}
+		if servedBy, ok := response[servedByField]; ok {
+			base[servedByField] = servedBy
+		}
+		emit := func(choices []interface{}, usage interface{}) bool {
+			chunk := make(map[string]interface{}, len(base)+2)
+			for k, v := range base {
+				chunk[k] = v
+			}
+			chunk["choices"] = choices
+			if usage != nil {
+				chunk["usage"] = usage
+			}
+			jsonBytes, err := json.Marshal(chunk)
+			if err != nil {
+				return true
+			}
+			select {
+			case stream <- fmt.Sprintf("data: %s\n\n", string(jsonBytes)):
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		choices, _ := response["choices"].([]interface{})
+		for i, choice := range choices {
+			choiceMap, _ := choice.(map[string]interface{})
+			message, _ := choiceMap["message"].(map[string]interface{})
+			index := choiceMap["index"]
+			if index == nil {
+				index = i
+			}
+
+			delta := map[string]interface{}{"role": "assistant"}
+			if reasoning, ok := message["reasoning_content"].(string); ok && reasoning != "" {
+				delta["reasoning_content"] = reasoning
+			}
+			if content, ok := message["content"].(string); ok && content != "" {
+				delta["content"] = content
+			}
+			if toolCalls, ok := message["tool_calls"].([]interface{}); ok && len(toolCalls) > 0 {
+				deltaToolCalls := make([]interface{}, 0, len(toolCalls))
+				for j, toolCall := range toolCalls {
+					toolCallMap, ok := toolCall.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					deltaToolCall := map[string]interface{}{"index": j}
+					for k, v := range toolCallMap {
+						deltaToolCall[k] = v
+					}
+					deltaToolCalls = append(deltaToolCalls, deltaToolCall)
+				}
+				delta["tool_calls"] = deltaToolCalls
+			}
+			if id, ok := message["id"]; ok {
+				delta["id"] = id
+			}
+			if !emit([]interface{}{map[string]interface{}{"index": index, "delta": delta, "finish_reason": nil}}, nil) ||
+				!emit([]interface{}{map[string]interface{}{"index": index, "delta": map[string]interface{}{}, "finish_reason": choiceMap["finish_reason"]}}, nil) {
+				return
+			}
+		}
+
+		if usage, ok := response["usage"]; ok && includeUsage {
+			if !emit([]interface{}{}, usage) {
+				return
+			}
+		}
+		select {
+		case stream <- "data: [DONE]\n\n":
+		case <-ctx.Done():
+		}
+	}()
+
+	return stream
+}
+
+// cacheStream 转发流式响应，同时拼接完整回复；流正常结束时写入响应缓存
+// 包含工具调用或错误的流式响应不缓存
+func (s *SilicoIDInterceptor) cacheStream(ctx context.Context, stream chan string, cache *responseCacheEntry, requestID string) chan string {
+	if cache == nil {
+		return stream
+	}
+	outputChan := make(chan string)
+
+	go func() {
+		defer close(outputChan)
+
+		response := map[string]interface{}{"object": "chat.completion"}
+		var content, reasoning strings.Builder
+		finishReason := ""
+		cacheable := true
+		done := false
+
+		for chunk := range stream {
+			select {
+			case outputChan <- chunk:
+			case <-ctx.Done():
+				// 排空上游，避免上游 goroutine 阻塞
+				go func() {
+					for range stream {
+					}
+				}()
+				return
+			}
+
+			if !cacheable {
+				continue
+			}
+			data := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(chunk), "data:"))
+			if data == "" {
+				continue
+			}
+			if data == "[DONE]" {
+				done = true
+				continue
+			}
+			var payload struct {
+				ID       string                 `json:"id"`
+				Created  interface{}            `json:"created"`
+				Model    string                 `json:"model"`
+				ServedBy string                 `json:"x_silicoid_served_by"`
+				Usage    map[string]interface{} `json:"usage"`
+				Error    interface{}            `json:"error"`
+				Choices  []struct {
+					Index int `json:"index"`
+					Delta struct {
+						Content          string        `json:"content"`
+						ReasoningContent string        `json:"reasoning_content"`
+						ToolCalls        []interface{} `json:"tool_calls"`
+					} `json:"delta"`
+					FinishReason *string `json:"finish_reason"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal([]byte(data), &payload); err != nil || payload.Error != nil {
+				cacheable = false
+				continue
+			}
+			if payload.ID != "" {
+				response["id"] = payload.ID
+			}
+			if payload.Created != nil {
+				response["created"] = payload.Created
+			}
+			if payload.Model != "" {
+				response["model"] = payload.Model
+			}
+			if payload.ServedBy != "" {
+				response[servedByField] = payload.ServedBy
+			}
+			if payload.Usage != nil {
+				response["usage"] = payload.Usage
+			}
+			for _, choice := range payload.Choices {
+				if choice.Index != 0 || len(choice.Delta.ToolCalls) > 0 {
+					cacheable = false
+					break
+				}
+				content.WriteString(choice.Delta.Content)
+				reasoning.WriteString(choice.Delta.ReasoningContent)
+				if choice.FinishReason != nil && *choice.FinishReason != "" {
+					finishReason = *choice.FinishReason
+				}
+			}
+		}
+
+		// 流被中断时没有 [DONE]，不缓存不完整的回复
+		if !cacheable || !done {
+			return
+		}
+		message := map[string]interface{}{
+			"role":    "assistant",
+			"content": content.String(),
+		}
+		if reasoning.Len() > 0 {
+			message["reasoning_content"] = reasoning.String()
+		}
+		response["choices"] = []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"message":       message,
+				"finish_reason": finishReason,
+			},
+		}
+		s.storeCachedResponse(cache, response, requestID)
+	}()
+
+	return outputChan
+}
+
+// toFloat 将 JSON 数值转换为 float64，非数值返回 -1
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return -1
+}
@@ -0,0 +1,183 @@
+package interceptor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"digitalsingularity/backend/silicoid/formatconverter"
+)
+
+// responseStateExpire Responses API 响应状态在 Redis 中的保存时间（previous_response_id 的有效期）
+const responseStateExpire = 24 * time.Hour
+
+// HandleHTTPResponses 处理 OpenAI Responses API 格式的请求（/v1/responses）
+// input 条目（以及 previous_response_id 对应的历史会话）转换为 messages 后走聊天接口的处理流程，
+// 响应转换为 response 对象或带类型的流式事件；store 不为 false 时保存会话状态
+func (s *SilicoIDInterceptor) HandleHTTPResponses(c *gin.Context) {
+	authData, err := s.authenticateAndPreprocessRequest(c)
+	if err != nil {
+		logger.Printf("Responses 请求认证失败: %v", err)
+		status := authErrorStatus(err)
+		openAIError(c, status, err.Error(), responsesErrorType(status), "request_rejected")
+		return
+	}
+	requestID := authData.RequestID
+	request := authData.Data
+	owner := responseStateOwner(authData)
+
+	// previous_response_id 延续对话：只能使用自己的响应
+	var history []interface{}
+	if previousID, _ := request["previous_response_id"].(string); previousID != "" {
+		state, err := s.LoadResponseState(previousID)
+		if err != nil || state["owner"] != owner {
+			logger.Printf("[%s] 加载响应状态失败: %s, %v", requestID, previousID, err)
+			openAIError(c, http.StatusNotFound, fmt.Sprintf("未找到响应: %s", previousID), "invalid_request_error", "previous_response_not_found")
+			return
+		}
+		history, _ = state["messages"].([]interface{})
+		logger.Printf("[%s] 延续响应 %s 的会话，历史消息数: %d", requestID, previousID, len(history))
+	}
+
+	data, err := s.formatConverter.RequestResponsesToOpenAI(request, history)
+	if err != nil {
+		logger.Printf("[%s] Responses请求转换失败: %v", requestID, err)
+		openAIError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	// 保留预处理阶段写入的内部字段（模型路由、用户 Key 等）
+	for key, value := range request {
+		if strings.HasPrefix(key, "_") || key == "model_code" || key == "role_name" {
+			data[key] = value
+		}
+	}
+
+	// 本轮结束后的会话 = 历史 + 本次 input + 本次 output（instructions 不延续）
+	conversation := append(append([]interface{}{}, history...), formatconverter.ResponsesInputToMessages(request["input"])...)
+	store := true
+	if value, ok := request["store"].(bool); ok {
+		store = value
+	}
+	saveState := func(response map[string]interface{}) {
+		if !store || response["status"] == "failed" {
+			return
+		}
+		messages := append(conversation, formatconverter.ResponsesInputToMessages(response["output"])...)
+		if err := s.SaveResponseState(owner, request, messages, response); err != nil {
+			logger.Printf("[%s] ⚠️ 保存响应状态失败: %v", requestID, err)
+		}
+	}
+
+	if stream, _ := data["stream"].(bool); stream {
+		streamChan, err := s.CreateHTTPStreamResponse(c, requestID, authData.UserID, data)
+		if err != nil {
+			logger.Printf("[%s] 创建Responses流式响应失败: %v", requestID, err)
+			openAIError(c, http.StatusInternalServerError, err.Error(), "server_error", "stream_response_creation_failed")
+			return
+		}
+		eventStream := s.formatConverter.HandleResponseOpenAIStreamToResponses(c.Request.Context(), streamChan, request, saveState)
+		s.processHTTPStreamResponse(c, eventStream, requestID)
+		return
+	}
+
+	response, err := s.CreateHTTPNonStreamResponse(c, requestID, authData.UserID, data)
+	if err != nil {
+		logger.Printf("[%s] 创建Responses响应失败: %v", requestID, err)
+		openAIError(c, http.StatusInternalServerError, err.Error(), "server_error", "response_creation_failed")
+		return
+	}
+	if errObj, hasError := response["error"]; hasError {
+		logger.Printf("[%s] AI响应包含错误: %v", requestID, errObj)
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	result, err := s.formatConverter.ResponseOpenAIToResponses(response, request)
+	if err != nil {
+		logger.Printf("[%s] 转换Responses响应失败: %v", requestID, err)
+		openAIError(c, http.StatusInternalServerError, err.Error(), "server_error", "response_processing_failed")
+		return
+	}
+	for _, field := range []string{servedByField, responseCacheField} {
+		if value, ok := response[field]; ok {
+			result[field] = value
+		}
+	}
+	saveState(result)
+
+	logger.Printf("[%s] Responses 请求处理完成: %v", requestID, result["id"])
+	c.JSON(http.StatusOK, result)
+}
+
+// HandleHTTPGetResponse 获取已保存的 response 对象（GET /v1/responses/{response_id}）
+func (s *SilicoIDInterceptor) HandleHTTPGetResponse(c *gin.Context, responseID string) {
+	owner, err := s.requestOwner(c)
+	if err != nil {
+		openAIError(c, http.StatusUnauthorized, err.Error(), "authentication_error", "invalid_api_key")
+		return
+	}
+
+	state, err := s.LoadResponseState(responseID)
+	if err != nil || state["owner"] != owner {
+		openAIError(c, http.StatusNotFound, fmt.Sprintf("未找到响应: %s", responseID), "invalid_request_error", "response_not_found")
+		return
+	}
+	c.JSON(http.StatusOK, state["response"])
+}
+
+// responseStateOwner 响应状态的所有者：平台用户ID，使用用户自己的 Key 时为 Key 的哈希
+func responseStateOwner(authData *AuthenticatedRequestData) string {
+	if authData.UserOwnOpenAIKey != "" {
+		return userOwnKeyOwner(authData.UserOwnOpenAIKey)
+	}
+	if authData.UserOwnClaudeKey != "" {
+		return userOwnKeyOwner(authData.UserOwnClaudeKey)
+	}
+	return authData.UserID
+}
+
+// userOwnKeyOwner 用户自己的 Key 没有用户ID，按 Key 的哈希区分所有者
+func userOwnKeyOwner(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return "key:" + hex.EncodeToString(sum[:8])
+}
+
+// requestOwner 没有请求体的接口按请求头中的 API Key 或查询参数中的 Token 确定所有者
+func (s *SilicoIDInterceptor) requestOwner(c *gin.Context) (string, error) {
+	if apiKey := s.extractApiKey(c); apiKey != "" {
+		if strings.HasPrefix(apiKey, "sk-") && !strings.HasPrefix(apiKey, "sk-potagi-") {
+			return userOwnKeyOwner(apiKey), nil
+		}
+		valid, userID, errorMessage := s.verifyApiKey(apiKey)
+		if !valid {
+			return "", fmt.Errorf("API密钥验证失败: %s", errorMessage)
+		}
+		return userID, nil
+	}
+	if authToken := c.Query("auth_token"); authToken != "" {
+		valid, userID, errorMessage := s.verifyAuthToken(authToken)
+		if !valid {
+			return "", fmt.Errorf("AuthToken验证失败: %s", errorMessage)
+		}
+		return userID, nil
+	}
+	return "", fmt.Errorf("请提供有效的API密钥或Token")
+}
+
+// responsesErrorType 按 HTTP 状态码确定 OpenAI 错误类型
+func responsesErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusPaymentRequired:
+		return "insufficient_quota"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	}
+	return "server_error"
+}
@@ -0,0 +1,363 @@
+package interceptor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 语义缓存：对最后一条用户消息做向量化，按余弦相似度查找近似重复的问题并返回已缓存的回复
+// 缓存按 用户（或平台 Key）+ 角色 + 模型 + 向量化实现 + 之前的上下文 隔离，不同租户、不同对话之间不会共享回复
+const (
+	semanticCacheKeyPrefix = "silicoid:semantic_cache:"
+	// semanticCacheMaxEntries 每个隔离范围最多保留的缓存条数（超出时淘汰最早的）
+	semanticCacheMaxEntries = 200
+	// semanticEmbedTimeout 向量化的超时时间
+	semanticEmbedTimeout = 5 * time.Second
+
+	// 请求数据中的内部字段：processSemanticCache 的查找结果，分发前由 takeSemanticCache 取出
+	semanticCacheField    = "_semantic_cache"     // 未命中时待写入的缓存位置
+	semanticCacheHitField = "_semantic_cache_hit" // 命中的缓存回复
+)
+
+// SemanticEmbedder 语义缓存使用的文本向量化接口
+// 默认使用本地 n-gram 哈希向量化，可通过 SetSemanticEmbedder 替换为调用向量模型的实现
+type SemanticEmbedder interface {
+	// Name 向量化实现的标识，不同实现的向量不可比较，标识会作为缓存隔离范围的一部分
+	Name() string
+	// Embed 将文本转换为向量
+	Embed(ctx context.Context, text string) ([]float64, error)
+}
+
+// NGramEmbedder 本地字符 n-gram 哈希向量化
+// 将文本的字符 n-gram 哈希到固定维度并归一化，不需要调用模型，适合识别字面上近似重复的问题
+type NGramEmbedder struct {
+	N          int // n-gram 长度
+	Dimensions int // 向量维度
+}
+
+// NewNGramEmbedder 创建 n-gram 哈希向量化实现
+func NewNGramEmbedder(n int, dimensions int) *NGramEmbedder {
+	if n <= 0 {
+		n = 3
+	}
+	if dimensions <= 0 {
+		dimensions = 512
+	}
+	return &NGramEmbedder{N: n, Dimensions: dimensions}
+}
+
+func (e *NGramEmbedder) Name() string {
+	return fmt.Sprintf("ngram%d-%d", e.N, e.Dimensions)
+}
+
+func (e *NGramEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	// 统一大小写并合并空白，避免格式差异影响相似度
+	runes := []rune(strings.ToLower(strings.Join(strings.FieldsFunc(text, unicode.IsSpace), " ")))
+	vector := make([]float64, e.Dimensions)
+	if len(runes) == 0 {
+		return vector, nil
+	}
+
+	n := e.N
+	if len(runes) < n {
+		n = len(runes)
+	}
+	for i := 0; i+n <= len(runes); i++ {
+		h := fnv.New32a()
+		h.Write([]byte(string(runes[i : i+n])))
+		vector[h.Sum32()%uint32(e.Dimensions)]++
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector, nil
+}
+
+// SetSemanticEmbedder 替换语义缓存使用的向量化实现
+func (s *SilicoIDInterceptor) SetSemanticEmbedder(embedder SemanticEmbedder) {
+	s.semanticEmbedder = embedder
+}
+
+// semanticCacheEntry 一次请求在语义缓存中的查找/写入位置
+type semanticCacheEntry struct {
+	ScopeKey  string
+	Threshold float64
+	TTL       time.Duration
+	Prompt    string
+	Embedding []float64
+}
+
+// semanticCacheRecord 语义缓存中保存的一条记录
+type semanticCacheRecord struct {
+	Prompt    string          `json:"prompt"`
+	Embedding []float64       `json:"embedding"`
+	Response  json.RawMessage `json:"response"`
+	ExpiresAt int64           `json:"expires_at"`
+}
+
+// processSemanticCache 语义缓存预处理（在精确匹配的响应缓存未命中后、分发前执行）
+// 命中时将缓存的回复记录在请求数据中，未命中时记录待写入的缓存位置；查找失败不影响请求
+func (s *SilicoIDInterceptor) processSemanticCache(data map[string]interface{}, userId string, requestID string) (map[string]interface{}, error) {
+	if s.semanticEmbedder == nil || s.readWrite == nil {
+		return data, nil
+	}
+	// 用户自己的 Key 没有真实的用户ID，无法隔离，不使用语义缓存
+	if useUserKey, _ := data["_use_user_key"].(bool); useUserKey {
+		return data, nil
+	}
+
+	scope := userId
+	if scope == "" {
+		apiKeyID := platformAPIKeyID(data)
+		if apiKeyID <= 0 {
+			return data, nil
+		}
+		scope = fmt.Sprintf("key:%d", apiKeyID)
+	}
+
+	modelCode, _ := data["model_code"].(string)
+	if modelCode == "" {
+		return data, nil
+	}
+	roleName, _ := data["role_name"].(string)
+	if roleName == "" {
+		roleName = "general_assistant"
+	}
+	policy := s.responseCachePolicy(roleName, requestID)
+	if policy == nil || policy.SemanticThreshold <= 0 {
+		return data, nil
+	}
+
+	prompt := lastUserMessageText(data["messages"])
+	if prompt == "" {
+		return data, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), semanticEmbedTimeout)
+	defer cancel()
+	embedding, err := s.semanticEmbedder.Embed(ctx, prompt)
+	if err != nil {
+		logger.Printf("[%s] ⚠️ 语义缓存向量化失败，跳过: %v", requestID, err)
+		return data, nil
+	}
+
+	ttl := defaultResponseCacheTTL
+	if policy.TTLSeconds > 0 {
+		ttl = time.Duration(policy.TTLSeconds) * time.Second
+	}
+	contextHash, err := semanticContextHash(data)
+	if err != nil {
+		logger.Printf("[%s] ⚠️ 计算语义缓存上下文失败，跳过: %v", requestID, err)
+		return data, nil
+	}
+	entry := &semanticCacheEntry{
+		ScopeKey:  fmt.Sprintf("%s%s:%s:%s:%s:%s", semanticCacheKeyPrefix, s.semanticEmbedder.Name(), scope, roleName, modelCode, contextHash),
+		Threshold: policy.SemanticThreshold,
+		TTL:       ttl,
+		Prompt:    prompt,
+		Embedding: embedding,
+	}
+
+	if hit := s.lookupSemanticCache(entry, requestID); hit != nil {
+		data[semanticCacheHitField] = hit
+	} else {
+		data[semanticCacheField] = entry
+	}
+	return data, nil
+}
+
+// takeSemanticCache 取出并移除预处理阶段记录在请求数据中的语义缓存结果
+func takeSemanticCache(data map[string]interface{}) (map[string]interface{}, *semanticCacheEntry) {
+	hit, _ := data[semanticCacheHitField].(map[string]interface{})
+	entry, _ := data[semanticCacheField].(*semanticCacheEntry)
+	delete(data, semanticCacheHitField)
+	delete(data, semanticCacheField)
+	return hit, entry
+}
+
+// withSemanticCache 将语义缓存位置附加到响应缓存，回复完成时一并写入
+func withSemanticCache(cache *responseCacheEntry, semantic *semanticCacheEntry) *responseCacheEntry {
+	if semantic == nil {
+		return cache
+	}
+	if cache == nil {
+		cache = &responseCacheEntry{TTL: semantic.TTL}
+	}
+	cache.Semantic = semantic
+	return cache
+}
+
+// lookupSemanticCache 查找相似度最高且不低于阈值的缓存回复，未命中时返回 nil
+func (s *SilicoIDInterceptor) lookupSemanticCache(entry *semanticCacheEntry, requestID string) map[string]interface{} {
+	result := s.readWrite.GetRedisList(entry.ScopeKey)
+	if !result.IsSuccess() {
+		return nil
+	}
+	values, _ := result.Data.([]string)
+
+	now := time.Now().Unix()
+	var best *semanticCacheRecord
+	bestScore := 0.0
+	for _, value := range values {
+		var record semanticCacheRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			continue
+		}
+		if record.ExpiresAt > 0 && record.ExpiresAt < now {
+			continue
+		}
+		score := cosineSimilarity(entry.Embedding, record.Embedding)
+		if score >= entry.Threshold && score > bestScore {
+			best = &record
+			bestScore = score
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(best.Response, &response); err != nil {
+		logger.Printf("[%s] ⚠️ 语义缓存的响应格式错误，忽略: %v", requestID, err)
+		return nil
+	}
+	logger.Printf("[%s] ✅ 命中语义缓存: 相似度=%.4f, 缓存的问题=%s", requestID, bestScore, truncateString(best.Prompt, 100))
+	return prepareCachedResponse(response, "semantic_hit")
+}
+
+// storeSemanticCache 写入一条语义缓存记录
+func (s *SilicoIDInterceptor) storeSemanticCache(entry *semanticCacheEntry, response []byte, requestID string) {
+	record, err := json.Marshal(&semanticCacheRecord{
+		Prompt:    entry.Prompt,
+		Embedding: entry.Embedding,
+		Response:  response,
+		ExpiresAt: time.Now().Add(entry.TTL).Unix(),
+	})
+	if err != nil {
+		return
+	}
+	if result := s.readWrite.PushRedisList(entry.ScopeKey, string(record), semanticCacheMaxEntries, entry.TTL); !result.IsSuccess() {
+		logger.Printf("[%s] ⚠️ 写入语义缓存失败: %v", requestID, result.Error)
+		return
+	}
+	logger.Printf("[%s] 已写入语义缓存: %s", requestID, entry.ScopeKey)
+}
+
+// semanticOutputParams 影响回复内容和格式的请求参数，参数不同时不能复用回复
+var semanticOutputParams = []string{"response_format", "max_tokens", "max_completion_tokens", "stop", "n", "seed", "logit_bias", "presence_penalty", "frequency_penalty", "top_p"}
+
+// semanticContextHash 计算最后一条用户消息之外的上下文（之前的消息、system prompt、工具定义、输出参数）的哈希
+// 同样的问题在不同的对话上下文中回答不同，只在上下文相同时比较相似度
+func semanticContextHash(data map[string]interface{}) (string, error) {
+	messages, _ := data["messages"].([]interface{})
+	lastUser := -1
+	for i := len(messages) - 1; i >= 0; i-- {
+		if msg, ok := messages[i].(map[string]interface{}); ok {
+			if role, _ := msg["role"].(string); role == "user" {
+				lastUser = i
+				break
+			}
+		}
+	}
+
+	prior := make([]map[string]interface{}, 0, len(messages))
+	for i, item := range messages {
+		msg, ok := item.(map[string]interface{})
+		if !ok || i == lastUser {
+			continue
+		}
+		keyMsg := make(map[string]interface{}, len(msg))
+		for k, v := range msg {
+			if k != "id" {
+				keyMsg[k] = v
+			}
+		}
+		// system prompt 中注入的当前时间每次请求都不同
+		if role, _ := keyMsg["role"].(string); role == "system" {
+			if content, ok := keyMsg["content"].(string); ok {
+				keyMsg["content"] = systemPromptTimePattern.ReplaceAllString(content, "当前时间：")
+			}
+		}
+		prior = append(prior, keyMsg)
+	}
+
+	keyData := map[string]interface{}{
+		"messages":    prior,
+		"system":      data["system"],
+		"tools":       data["tools"],
+		"tool_choice": data["tool_choice"],
+		"functions":   data["functions"],
+	}
+	for _, param := range semanticOutputParams {
+		keyData[param] = data[param]
+	}
+	contextJSON, err := json.Marshal(keyData)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(contextJSON)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// lastUserMessageText 提取最后一条用户消息的文本内容（包含非文本内容时返回空字符串）
+func lastUserMessageText(messagesValue interface{}) string {
+	messages, _ := messagesValue.([]interface{})
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg, ok := messages[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if role, _ := msg["role"].(string); role != "user" {
+			continue
+		}
+		switch content := msg["content"].(type) {
+		case string:
+			return strings.TrimSpace(content)
+		case []interface{}:
+			// 包含文件、图片等非文本内容时，仅凭文本无法判断问题是否相同
+			var parts []string
+			for _, part := range content {
+				partMap, _ := part.(map[string]interface{})
+				if partType, _ := partMap["type"].(string); partType != "text" {
+					return ""
+				}
+				if text, ok := partMap["text"].(string); ok && text != "" {
+					parts = append(parts, text)
+				}
+			}
+			return strings.TrimSpace(strings.Join(parts, "\n"))
+		}
+		return ""
+	}
+	return ""
+}
+
+// cosineSimilarity 计算两个向量的余弦相似度，维度不同时返回 0
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
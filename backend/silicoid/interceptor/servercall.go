@@ -3,14 +3,25 @@ package interceptor
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 
+	"digitalsingularity/backend/common/utils/parallelhandle"
 	"digitalsingularity/backend/silicoid/mcp"
 )
 
+const (
+	// maxParallelServerCalls 同一轮中同时执行的服务端调用数上限
+	maxParallelServerCalls = 4
+	// serverCallTimeout 单个服务端调用的超时时间
+	serverCallTimeout = 60 * time.Second
+)
+
 // ExecuteServerCall 执行单个服务端调用（统一入口）
 // 支持 server_executor 类型的服务端工具
 func (s *SilicoIDInterceptor) ExecuteServerCall(ctx context.Context, call *ServerCall, requestID string) (string, error) {
@@ -60,10 +71,6 @@ func (s *SilicoIDInterceptor) executeMCPTool(ctx context.Context, call ServerCal
 	}
 
 	serverName := parts[1]
-	// 使用完整的工具名称（包括mcp_前缀），因为MCP服务器现在直接处理完整名称
-	toolName := call.Name
-
-	logger.Printf("[%s] 执行MCP工具: server=%s, tool=%s", requestID, serverName, toolName)
 
 	// 加载MCP服务器配置
 	serverConfigs, err := s.loadMCPServerConfigs()
@@ -84,9 +91,22 @@ func (s *SilicoIDInterceptor) executeMCPTool(ctx context.Context, call ServerCal
 		return "", fmt.Errorf("未找到MCP服务器配置: %s", serverName)
 	}
 
+	// 发起调用的用户只传给自有服务器，不向第三方服务器泄露内部用户 id
+	if !serverConfig.FirstParty {
+		ctx = mcp.WithUserID(ctx, "")
+	}
+
 	// 获取或创建MCP客户端
 	client := s.mcpClientManager.GetClient(serverName, serverConfig)
 
+	// 自有MCP服务器直接处理完整名称（包括mcp_前缀），第三方服务器使用去掉 mcp_{server_name}_ 前缀的原始工具名
+	toolName := call.Name
+	if !client.HasTool(ctx, toolName) && client.HasTool(ctx, parts[2]) {
+		toolName = parts[2]
+	}
+
+	logger.Printf("[%s] 执行MCP工具: server=%s, tool=%s", requestID, serverName, toolName)
+
 	// 执行工具调用
 	mcpToolCall := &mcp.MCPToolCall{
 		Name:      toolName,
@@ -98,12 +118,97 @@ func (s *SilicoIDInterceptor) executeMCPTool(ctx context.Context, call ServerCal
 		logger.Printf("[%s] MCP工具调用失败: %v", requestID, err)
 		return "", fmt.Errorf("MCP工具调用失败: %v", err)
 	}
+	if result.IsError {
+		logger.Printf("[%s] MCP工具返回错误: %s", requestID, result.Text())
+		return "", fmt.Errorf("MCP工具返回错误: %s", result.Text())
+	}
 
 	logger.Printf("[%s] MCP工具调用成功: %s", requestID, toolName)
-	return fmt.Sprintf("%v", result), nil
+	return result.Text(), nil
+}
+
+// withRequestUser 把发起请求的用户放入上下文，MCP工具调用时传给自有服务器，服务器据此按用户限制工具（如扫描目标白名单）
+// 只取服务端写入的认证用户（_user_id），请求体中的 user_id 由客户端提供，不能作为身份
+func withRequestUser(ctx context.Context, requestData map[string]interface{}) context.Context {
+	if userID, ok := requestData["_user_id"].(string); ok && userID != "" {
+		return mcp.WithUserID(ctx, userID)
+	}
+	return ctx
 }
+
+// executeServerCallsInParallel 并发执行模型同一轮发出的多个服务端调用，结果按调用的原始顺序返回
+// 每个调用单独超时，失败的调用以"执行失败"作为结果返回给模型，不影响其他调用；请求上下文取消后未开始的调用不再执行
+func (s *SilicoIDInterceptor) executeServerCallsInParallel(
+	ctx context.Context,
+	calls []ServerCall,
+	requestID string,
+	execute func(ctx context.Context, call ServerCall) (string, error),
+) []string {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	results := make([]string, len(calls))
+	var failed int64
+
+	items := make([]interface{}, len(calls))
+	for i := range calls {
+		items[i] = i
+	}
+	parallelhandle.Service.ForEachInParallel(items, func(item interface{}) {
+		i := item.(int)
+		call := calls[i]
+		if err := ctx.Err(); err != nil {
+			results[i] = fmt.Sprintf("执行失败: 请求已取消 (%v)", err)
+			atomic.AddInt64(&failed, 1)
+			return
+		}
+
+		// 每个调用使用自己的 ctx，超时或请求取消时单独取消，不影响同一轮的其他调用
+		callCtx, cancel := context.WithTimeout(ctx, serverCallTimeout)
+		defer cancel()
+		start := time.Now()
+		logger.Printf("[%s] 执行调用 %d/%d: %s", requestID, i+1, len(calls), call.Name)
+		// 工具实现不一定响应 ctx，超时或取消后取消调用的 ctx 并不再等待其返回
+		type outcome struct {
+			result string
+			err    error
+		}
+		done := make(chan outcome, 1)
+		go func() {
+			result, err := execute(callCtx, call)
+			done <- outcome{result, err}
+		}()
+		var result string
+		var err error
+		select {
+		case o := <-done:
+			result, err = o.result, o.err
+		case <-callCtx.Done():
+			cancel()
+			err = callCtx.Err()
+		}
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				err = fmt.Errorf("执行超时（超过 %v）", serverCallTimeout)
+			}
+			logger.Printf("[%s] ❌ 服务器调用 %s 执行失败 (%v): %v", requestID, call.Name, time.Since(start), err)
+			results[i] = fmt.Sprintf("执行失败: %v", err)
+			atomic.AddInt64(&failed, 1)
+			return
+		}
+		logger.Printf("[%s] ✅ 服务器调用 %s 执行成功 (%v)", requestID, call.Name, time.Since(start))
+		results[i] = result
+	}, maxParallelServerCalls, 0)
+
+	if len(calls) > 1 {
+		logger.Printf("[%s] 🔧 %d 个服务器调用执行完成，失败 %d 个", requestID, len(calls), failed)
+	}
+	return results
+}
+
 // ProcessAIResponseWithStructuredServerCalls 处理包含结构化服务器调用的AI响应
-// 这个方法接收已经提取的服务器调用列表，直接执行这些调用
+// 这个方法接收已经提取的服务器调用列表，直接执行这些调用；模型基于结果继续发出服务端调用时循环执行，
+// 循环受工具循环预算（轮数、工具耗时、token）限制。返回最终回答和 finish_reason（stop 或 tool_budget_exceeded）
 func (s *SilicoIDInterceptor) ProcessAIResponseWithStructuredServerCalls(
 	ctx context.Context,
 	requestData map[string]interface{},
@@ -111,13 +216,13 @@ func (s *SilicoIDInterceptor) ProcessAIResponseWithStructuredServerCalls(
 	response map[string]interface{}, // 完整的AI响应，包含choices[0].message等
 	isClaudeModel bool,
 	requestID string,
-	maxIterations int,
 	enableTTS bool,
 	voiceGender string,
 	ttsCallback SynthesisResultCallback,
 	tagCallback TagCallback,
-) (string, error) {
+) (string, string, error) {
 	logger.Printf("[%s] 🔍 开始处理结构化服务器调用，调用数量: %d", requestID, len(serverCalls))
+	ctx = withRequestUser(ctx, requestData)
 
 	if len(serverCalls) == 0 {
 		// 如果没有服务器调用，直接从响应中提取内容并返回
@@ -126,122 +231,134 @@ func (s *SilicoIDInterceptor) ProcessAIResponseWithStructuredServerCalls(
 				if message, ok := choice["message"].(map[string]interface{}); ok {
 					if content, ok := message["content"].(string); ok {
 						logger.Printf("[%s] ✅ 没有服务器调用，直接返回AI内容", requestID)
-						return s.filterServerCalls(content), nil
+						return s.filterServerCalls(content), "stop", nil
 					}
 				}
 			}
 		}
-		return "", fmt.Errorf("无法从响应中提取内容")
+		return "", "", fmt.Errorf("无法从响应中提取内容")
 	}
 
 	// 获取当前的 messages
 	messages, ok := requestData["messages"].([]interface{})
 	if !ok {
 		logger.Printf("[%s] ❌ 无效的 messages 格式", requestID)
-		return "", fmt.Errorf("无效的 messages 格式")
+		return "", "", fmt.Errorf("无效的 messages 格式")
 	}
 
 	// 保存原始的 role_name
 	originalRoleName, _ := requestData["role_name"].(string)
 	logger.Printf("[%s] 📌 保存原始 role_name: %s", requestID, originalRoleName)
 
-	// 执行服务器调用
-	logger.Printf("[%s] 🔧 开始执行 %d 个服务器调用", requestID, len(serverCalls))
-	results := make([]string, len(serverCalls))
+	// 工具循环预算，第一次模型调用的用量也计入
+	budget := s.toolLoopBudgetFor(requestData, requestID)
+	budget.addUsage(response)
 
-	for i, call := range serverCalls {
-		logger.Printf("[%s] 执行调用 %d: %s", requestID, i+1, call.Name)
-		result, err := s.ExecuteServerCall(ctx, &call, requestID)
-		if err != nil {
-			logger.Printf("[%s] ❌ 服务器调用 %s 执行失败: %v", requestID, call.Name, err)
-			results[i] = fmt.Sprintf("执行失败: %v", err)
-		} else {
-			logger.Printf("[%s] ✅ 服务器调用 %s 执行成功", requestID, call.Name)
-			results[i] = result
+	for {
+		// 超出工具循环预算时不再执行，返回说明原因的最终回答
+		if reason := budget.exceeded(); reason != "" {
+			content, _ := openAIResponseMessage(response)["content"].(string)
+			logger.Printf("[%s] ⚠️ 工具循环超出限制，停止调用工具: %s", requestID, reason)
+			return s.toolBudgetExceededContent(content, reason), finishReasonToolBudgetExceeded, nil
 		}
-	}
 
-	// 将服务器调用结果添加到消息链中
-	// 首先添加AI的assistant消息（保留tool_calls，因为tool消息需要对应的tool_call）
-	if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
-		if choice, ok := choices[0].(map[string]interface{}); ok {
-			if message, ok := choice["message"].(map[string]interface{}); ok {
-				// 构建完整的assistant消息，保留tool_calls
-				assistantMsg := map[string]interface{}{
-					"role":    "assistant",
-					"content": "",
-				}
-				if content, ok := message["content"].(string); ok {
-					assistantMsg["content"] = content
-				}
-				// 保留tool_calls，因为tool消息需要有对应的tool_call_id引用
-				if toolCalls, ok := message["tool_calls"]; ok {
-					assistantMsg["tool_calls"] = toolCalls
-				}
-				if functionCall, ok := message["function_call"]; ok {
-					assistantMsg["function_call"] = functionCall
-				}
+		// 执行服务器调用
+		logger.Printf("[%s] 🔧 开始执行 %d 个服务器调用 (第 %d 轮)", requestID, len(serverCalls), budget.Iterations+1)
+		results := s.executeBudgetedServerCalls(ctx, budget, serverCalls, requestID, func(ctx context.Context, call ServerCall) (string, error) {
+			return s.ExecuteServerCall(ctx, &call, requestID)
+		})
 
-				messages = append(messages, assistantMsg)
-				logger.Printf("[%s] 已添加assistant消息到消息链（保留tool_calls）", requestID)
+		// 将服务器调用结果添加到消息链中
+		// 首先添加AI的assistant消息（保留tool_calls，因为tool消息需要对应的tool_call）
+		if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
+			if choice, ok := choices[0].(map[string]interface{}); ok {
+				if message, ok := choice["message"].(map[string]interface{}); ok {
+					// 构建完整的assistant消息，保留tool_calls
+					assistantMsg := map[string]interface{}{
+						"role":    "assistant",
+						"content": "",
+					}
+					if content, ok := message["content"].(string); ok {
+						assistantMsg["content"] = content
+					}
+					// 保留tool_calls，因为tool消息需要有对应的tool_call_id引用
+					if toolCalls, ok := message["tool_calls"]; ok {
+						assistantMsg["tool_calls"] = toolCalls
+					}
+					if functionCall, ok := message["function_call"]; ok {
+						assistantMsg["function_call"] = functionCall
+					}
+
+					messages = append(messages, assistantMsg)
+					logger.Printf("[%s] 已添加assistant消息到消息链（保留tool_calls）", requestID)
+				}
 			}
 		}
-	}
 
-	// 添加工具执行结果
-	for i, call := range serverCalls {
-		toolCallID := call.ID
-		if toolCallID == "" {
-			// 向后兼容：如果没有ID，生成一个
-			toolCallID = fmt.Sprintf("%s:%d", call.Name, i)
-		}
+		// 添加工具执行结果
+		for i, call := range serverCalls {
+			toolCallID := call.ID
+			if toolCallID == "" {
+				// 向后兼容：如果没有ID，生成一个
+				toolCallID = fmt.Sprintf("%s:%d", call.Name, i)
+			}
 
-		toolMsg := map[string]interface{}{
-			"role":         "tool",
-			"tool_call_id": toolCallID,
-			"content":      fmt.Sprintf("工具调用结果：\n\n### %s\n%s", call.Name, results[i]),
+			toolMsg := map[string]interface{}{
+				"role":         "tool",
+				"tool_call_id": toolCallID,
+				"content":      fmt.Sprintf("工具调用结果：\n\n### %s\n%s", call.Name, results[i]),
+			}
+			messages = append(messages, toolMsg)
+			logger.Printf("[%s] 已添加工具结果消息到消息链: %s (tool_call_id=%s)", requestID, call.Name, toolCallID)
 		}
-		messages = append(messages, toolMsg)
-		logger.Printf("[%s] 已添加工具结果消息到消息链: %s (tool_call_id=%s)", requestID, call.Name, toolCallID)
-	}
 
-	// 更新requestData中的messages
-	requestData["messages"] = messages
+		// 更新requestData中的messages
+		requestData["messages"] = messages
 
-	// 清除tools参数，避免FormatConverter重复添加工具
-	// 因为消息链中已经包含了工具执行结果，不需要再次提供工具定义
-	delete(requestData, "tools")
-	delete(requestData, "_mcp_servers")
+		// 清除tools参数，避免FormatConverter重复添加工具
+		// 因为消息链中已经包含了工具执行结果，不需要再次提供工具定义
+		delete(requestData, "tools")
+		delete(requestData, "_mcp_servers")
 
-	// 重新调用AI获取最终回答
-	logger.Printf("[%s] 🔄 重新调用AI获取基于工具结果的最终回答", requestID)
+		// 重新调用AI获取最终回答
+		logger.Printf("[%s] 🔄 重新调用AI获取基于工具结果的回答", requestID)
 
-	// 恢复原始role_name
-	if originalRoleName != "" {
-		requestData["role_name"] = originalRoleName
-	}
+		// 恢复原始role_name
+		if originalRoleName != "" {
+			requestData["role_name"] = originalRoleName
+		}
 
-	// 再次调用AI
-	finalResponse, err := s.CreateWebSocketNonStreamResponse(ctx, requestData, requestID)
-	if err != nil {
-		logger.Printf("[%s] ❌ 重新调用AI失败: %v", requestID, err)
-		return "", fmt.Errorf("重新调用AI失败: %v", err)
-	}
+		// 再次调用AI
+		finalResponse, err := s.CreateWebSocketNonStreamResponse(ctx, requestData, requestID)
+		if err != nil {
+			logger.Printf("[%s] ❌ 重新调用AI失败: %v", requestID, err)
+			return "", "", fmt.Errorf("重新调用AI失败: %v", err)
+		}
+		budget.addUsage(finalResponse)
+
+		// 模型继续发出服务端调用时进入下一轮
+		serverCalls = s.extractStructuredCallsFromResponse(finalResponse, requestID)
+		if len(serverCalls) > 0 {
+			logger.Printf("[%s] 🔁 模型继续发出 %d 个服务器调用", requestID, len(serverCalls))
+			response = finalResponse
+			continue
+		}
 
-	// 从最终响应中提取内容
-	if choices, ok := finalResponse["choices"].([]interface{}); ok && len(choices) > 0 {
-		if choice, ok := choices[0].(map[string]interface{}); ok {
-			if message, ok := choice["message"].(map[string]interface{}); ok {
-				if content, ok := message["content"].(string); ok {
-					logger.Printf("[%s] ✅ 获取到最终回答，长度: %d", requestID, len(content))
-					return s.filterServerCalls(content), nil
+		// 从最终响应中提取内容
+		if choices, ok := finalResponse["choices"].([]interface{}); ok && len(choices) > 0 {
+			if choice, ok := choices[0].(map[string]interface{}); ok {
+				if message, ok := choice["message"].(map[string]interface{}); ok {
+					if content, ok := message["content"].(string); ok {
+						logger.Printf("[%s] ✅ 获取到最终回答，长度: %d", requestID, len(content))
+						return s.filterServerCalls(content), "stop", nil
+					}
 				}
 			}
 		}
-	}
 
-	logger.Printf("[%s] ❌ 无法从最终响应中提取内容", requestID)
-	return "", fmt.Errorf("无法从最终响应中提取内容")
+		logger.Printf("[%s] ❌ 无法从最终响应中提取内容", requestID)
+		return "", "", fmt.Errorf("无法从最终响应中提取内容")
+	}
 }
 
 func (s *SilicoIDInterceptor) ProcessAIResponseWithServerCalls(
@@ -257,6 +374,7 @@ func (s *SilicoIDInterceptor) ProcessAIResponseWithServerCalls(
 	tagCallback TagCallback,
 ) (string, error) {
 	logger.Printf("[%s] 🔍 开始执行循环处理，响应长度: %d", requestID, len(initialResponse))
+	ctx = withRequestUser(ctx, requestData)
 
 	currentResponse := initialResponse
 	iteration := 0
@@ -288,29 +406,8 @@ func (s *SilicoIDInterceptor) ProcessAIResponseWithServerCalls(
 	for iteration < maxIterations {
 		// 检查当前响应是否包含执行调用
 		logger.Printf("[%s] 🔍 第 %d 次迭代，检查执行调用...", requestID, iteration)
-		// 尝试从 requestData 中提取 initiator（优先），否则从 messages 中获取最后一条 user 消息的 id 或内容片段
-		initiator := ""
-		if uid, ok := requestData["user_id"].(string); ok && uid != "" {
-			initiator = uid
-		} else {
-			// 尝试从 messages 中找到最后一个 role=user 的消息并使用其 id 或前50字符作为 initiator
-			for i := len(messages) - 1; i >= 0; i-- {
-				if msg, ok := messages[i].(map[string]interface{}); ok {
-					if role, _ := msg["role"].(string); role == "user" {
-						if id, ok := msg["id"].(string); ok && id != "" {
-							initiator = id
-						} else if content, ok := msg["content"].(string); ok && content != "" {
-							if len(content) > 50 {
-								initiator = content[:50]
-							} else {
-								initiator = content
-							}
-						}
-						break
-					}
-				}
-			}
-		}
+		// initiator 只取认证时写入的用户ID（客户端不能设置 _ 开头的字段），没有时不保存调用上下文
+		initiator, _ := requestData["_user_id"].(string)
 		serverCall, prefixText, hasCall := s.ExtractServerCall(currentResponse, initiator, requestID)
 		if !hasCall {
 			// 没有执行调用，返回最终响应（过滤掉任何残留的标签）
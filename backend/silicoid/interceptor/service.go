@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"strings"
 	"time"
 
@@ -171,8 +172,7 @@ type SilicoIDInterceptor struct {
 	apiKeyManageService        *apikeymanage.ApiKeyManageService
 	authTokenService           *tokenmanage.CommonAuthTokenService
 	formatConverter            *formatconverter.SilicoidFormatConverterService
-	openaiService              *openai.OpenAIService
-	claudeService              *claude.ClaudeService
+	providerAdapters           *providerAdapterRegistry                  // 模型提供商适配器注册表
 	readWrite                  *datahandle.CommonReadWriteService
 	dataService                *database.SilicoidDataService              // 数据库服务
 	aiPlatformDataService      *aibasicplatformdatabase.AIBasicPlatformDataService
@@ -180,6 +180,9 @@ type SilicoIDInterceptor struct {
 	ttsService                 *speechsysteminterceptor.TTSService       // TTS 服务
 	fileService                *userfiles.FileService                    // 文件服务
 	mcpClientManager           *mcp.MCPClientManager                     // MCP 客户端管理器
+	semanticEmbedder           SemanticEmbedder                          // 语义缓存向量化实现
+	contextPolicy              ContextPolicy                             // 上下文窗口策略
+	tokenEstimators            map[string]TokenEstimator                 // 按提供商的 token 估算实现
 }
 
 // 创建拦截器实例
@@ -237,16 +240,20 @@ func CreateInterceptor() *SilicoIDInterceptor {
 	// 设置 Claude 文件上传器到格式转换器（支持 Claude Files API）
 	formatConverter.SetClaudeFileUploader(claudeService)
 
+	// 注册模型提供商适配器（按 ModelConfig.Provider 路由，未匹配的提供商使用 OpenAI 兼容适配器）
+	providerAdapters := newProviderAdapterRegistry()
+	providerAdapters.Register(NewClaudeAdapter(claudeService, formatConverter), "anthropic", claudeProviderName)
+	providerAdapters.Register(NewOpenAIAdapter(openai.NewOpenAIService(), formatConverter), defaultProviderName)
+
 	// 初始化 MCP 客户端管理器
 	mcpClientManager := mcp.NewMCPClientManager()
 	logger.Printf("✅ MCP 客户端管理器已成功初始化")
 
-	return &SilicoIDInterceptor{
+	interceptorInstance := &SilicoIDInterceptor{
 		apiKeyManageService:        apiKeyManageService,
 		authTokenService:           tokenmanage.NewCommonAuthTokenService(adapter),
 		formatConverter:            formatConverter,
-		openaiService:              openai.NewOpenAIService(),
-		claudeService:              claudeService,
+		providerAdapters:           providerAdapters,
 		readWrite:                  readWrite,
 		dataService:                 dataService,
 		aiPlatformDataService:       aiPlatformDataService,
@@ -254,7 +261,15 @@ func CreateInterceptor() *SilicoIDInterceptor {
 		ttsService:                    ttsService,
 		fileService:                   fileService,
 		mcpClientManager:             mcpClientManager,
+		semanticEmbedder:             NewNGramEmbedder(3, 512),
+		contextPolicy:                DefaultContextPolicy(),
+		tokenEstimators:              defaultTokenEstimators(),
 	}
+
+	// 启动熔断探测任务（冷却结束后自动探测被熔断的密钥和 base_url）
+	interceptorInstance.startBreakerProber()
+
+	return interceptorInstance
 }
 
 
@@ -401,38 +416,6 @@ func (s *SilicoIDInterceptor) uploadFileToUserfiles(userId string, base64Data st
 	return result.FileId, nil
 }
 
-// isClaudeModel 判断模型是否为Claude模型
-// 通过查询数据库/Redis中的模型配置，根据provider字段判断
-func (s *SilicoIDInterceptor) isClaudeModel(modelName string) bool {
-	// 尝试从模型管理器获取模型配置
-	// 首先尝试直接匹配 model_code
-	modelConfig, err := s.modelManager.GetModelConfig(modelName)
-	if err == nil && modelConfig != nil {
-		// 根据 provider 字段判断
-		provider := strings.ToLower(modelConfig.Provider)
-		isClaude := provider == "anthropic" || strings.Contains(provider, "claude")
-		if isClaude {
-			logger.Printf("✅ 模型 %s 识别为 Claude 模型 (provider: %s)", modelName, modelConfig.Provider)
-		} else {
-			logger.Printf("✅ 模型 %s 识别为非 Claude 模型 (provider: %s)", modelName, modelConfig.Provider)
-		}
-		return isClaude
-	}
-	
-	// 如果数据库中没有找到，尝试模糊匹配常见的模型名称前缀
-	// 这是降级方案，当数据库不可用或模型未配置时使用
-	modelLower := strings.ToLower(modelName)
-	
-	// Claude 模型特征：包含 "claude" 或以 "sk-ant-" 开头的API Key使用的模型
-	if strings.Contains(modelLower, "claude") {
-		logger.Printf("⚠️  通过模型名称模糊匹配识别为 Claude 模型: %s (数据库查询失败: %v)", modelName, err)
-		return true
-	}
-	
-	logger.Printf("⚠️  通过模型名称模糊匹配识别为非 Claude 模型: %s (数据库查询失败: %v)", modelName, err)
-	return false
-}
-
 // extractApiKey 从请求中提取API密钥
 func (s *SilicoIDInterceptor) extractApiKey(c *gin.Context) string {
 	// 从Authorization头中提取
@@ -441,6 +424,11 @@ func (s *SilicoIDInterceptor) extractApiKey(c *gin.Context) string {
 		return authHeader[7:]
 	}
 	
+	// Anthropic SDK 使用 x-api-key 头
+	if apiKey := c.GetHeader("x-api-key"); apiKey != "" {
+		return apiKey
+	}
+
 	// 如果没有在Authorization头中找到，尝试从查询参数中提取
 	apiKey := c.Query("api_key")
 	if apiKey != "" {
@@ -509,13 +497,107 @@ type AuthenticatedRequestData struct {
 	UserID         string
 	UserOwnOpenAIKey string
 	UserOwnClaudeKey string
+	APIKey         string // 平台认证 Key
+	APIKeyID       int    // 平台认证 Key 的ID，用于按 Key 统计用量（不保存明文）
 	Data           map[string]interface{}
 	RequestID      string
 }
 
+// UsesOwnKey 是否使用用户自己的提供商 Key（不扣平台令牌）
+func (a *AuthenticatedRequestData) UsesOwnKey() bool {
+	return a.UserOwnOpenAIKey != "" || a.UserOwnClaudeKey != ""
+}
+
+// authDataContextKey 认证结果在 gin.Context 中的键
+const authDataContextKey = "silicoid_auth_data"
+
+// authenticatedUsesOwnKey 本次 HTTP 请求在认证阶段是否判定为使用用户自己的 Key；未经过认证的请求视为否
+func authenticatedUsesOwnKey(c *gin.Context) bool {
+	value, ok := c.Get(authDataContextKey)
+	if !ok {
+		return false
+	}
+	authData, _ := value.(*AuthenticatedRequestData)
+	return authData != nil && authData.UsesOwnKey()
+}
+
+// stripInternalFields 删除客户端请求中以 _ 开头的字段
+// _use_user_key、_user_id、_base_url 等是服务端内部标记，只能由服务端写入
+func stripInternalFields(data map[string]interface{}) {
+	for key := range data {
+		if strings.HasPrefix(key, "_") {
+			delete(data, key)
+		}
+	}
+}
+
+// applyOwnKeyAuth 按认证结果统一请求中的用户 Key 标记，降级、缓存和模型服务都据此判断
+// 不是用户自己的 Key 时移除所有相关字段，请求数据中的标记不能让平台 Key 请求免于计费
+func applyOwnKeyAuth(data map[string]interface{}, useUserKey bool) {
+	if useUserKey {
+		data["_use_user_key"] = true
+		return
+	}
+	for _, field := range []string{"_use_user_key", "_user_openai_key", "_user_claude_key"} {
+		delete(data, field)
+	}
+}
+
+// authErrorStatus 认证和预处理失败时返回的 HTTP 状态码
+func authErrorStatus(err error) int {
+	message := err.Error()
+	switch {
+	case strings.HasPrefix(message, "令牌余额不足"):
+		return http.StatusPaymentRequired
+	case strings.HasPrefix(message, "无效的请求数据"), strings.HasPrefix(message, "缺少模型参数"), strings.HasPrefix(message, "模型配置不存在"):
+		return http.StatusBadRequest
+	}
+	return http.StatusUnauthorized
+}
+
+// openAIAuthError 按认证失败的原因返回 OpenAI 格式的错误
+func openAIAuthError(c *gin.Context, err error) {
+	switch status := authErrorStatus(err); status {
+	case http.StatusPaymentRequired:
+		openAIError(c, status, err.Error(), "insufficient_quota", "insufficient_quota")
+	case http.StatusBadRequest:
+		openAIError(c, status, err.Error(), "invalid_request", "invalid_request")
+	default:
+		openAIError(c, http.StatusUnauthorized, err.Error(), "authentication_error", "invalid_api_key")
+	}
+}
+
+// openAIError 返回 OpenAI 格式的错误
+func openAIError(c *gin.Context, status int, message string, errorType string, code string) {
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    errorType,
+			"code":    code,
+		},
+	})
+}
+
+// HandleHTTPChatCompletions 处理 OpenAI 兼容的聊天请求（/v1/chat/completions）
+// 与其它 /v1 接口相同先认证（平台 Key、用户自己的 Key 或 AuthToken），按认证的用户和平台 Key 计费、统计用量
+func (s *SilicoIDInterceptor) HandleHTTPChatCompletions(c *gin.Context) {
+	authData, err := s.authenticateAndPreprocessRequest(c)
+	if err != nil {
+		logger.Printf("聊天请求认证失败: %v", err)
+		openAIAuthError(c, err)
+		return
+	}
+	if stream, _ := authData.Data["stream"].(bool); stream {
+		s.respondHTTPStream(c, authData.RequestID, authData.UserID, authData.Data)
+		return
+	}
+	s.respondHTTPNonStream(c, authData.RequestID, authData.UserID, authData.Data)
+}
+
 // authenticateAndPreprocessRequest HTTP请求的通用认证和预处理逻辑
 func (s *SilicoIDInterceptor) authenticateAndPreprocessRequest(c *gin.Context) (*AuthenticatedRequestData, error) {
-	requestID := fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond))
+	// 请求ID同时用作工具调用会话ID，使用随机值避免并发请求冲突和被猜测
+	requestID := strings.ReplaceAll(uuid.New().String(), "-", "")
 	logger.Printf("[%s] 开始认证和预处理HTTP请求 (IP: %s)", requestID, c.ClientIP())
 	
 	// 获取数据
@@ -524,47 +606,10 @@ func (s *SilicoIDInterceptor) authenticateAndPreprocessRequest(c *gin.Context) (
 		logger.Printf("[%s] 解析请求数据失败: %v", requestID, err)
 		return nil, fmt.Errorf("无效的请求数据: %v", err)
 	}
+	stripInternalFields(data)
 	
 	logger.Printf("[%s] 从请求中获取数据", requestID)
 
-	// 在对话发起时保存初始上下文到 Redis，便于后续从工具调用或格式转换器中查找
-	func() {
-		svc, err := datahandle.NewCommonReadWriteService("database")
-		if err != nil {
-			logger.Printf("[%s] ⚠️ 无法初始化 CommonReadWriteService 保存初始上下文: %v", requestID, err)
-			return
-		}
-		defer func() {
-			// svc 可能没有需要关闭的方法，这里是占位以便未来扩展
-		}()
-
-		modelVal, _ := data["model"].(string)
-		roleNameVal, _ := data["role_name"].(string)
-		userIdVal, _ := data["user_id"].(string)
-
-		storeObj := map[string]interface{}{
-			"request_id": requestID,
-			"model":      modelVal,
-			"role_name":  roleNameVal,
-			"user_id":    userIdVal,
-			"created_at": time.Now().Unix(),
-		}
-
-		key := fmt.Sprintf("tools_call_context:%s", requestID)
-		res := svc.RedisWrite(key, storeObj, 5*time.Minute)
-		if res == nil || res.Status != datahandle.StatusSuccess {
-			var errDetail interface{}
-			if res != nil {
-				errDetail = res.Error
-			} else {
-				errDetail = "nil result"
-			}
-			logger.Printf("[%s] ⚠️ 保存初始 tools_call_context 到 Redis 失败: %v", requestID, errDetail)
-		} else {
-			logger.Printf("[%s] ✅ 已将对话初始上下文存入 Redis key=%s", requestID, key)
-		}
-	}()
-	
 	// 提取认证信息
 	apiKey := s.extractApiKey(c)
 	authToken, authTokenExists := data["auth_token"].(string)
@@ -573,6 +618,8 @@ func (s *SilicoIDInterceptor) authenticateAndPreprocessRequest(c *gin.Context) (
 	}
 	
 	var userId string
+	var platformKey string      // 平台认证 Key
+	var platformKeyID int       // 平台认证 Key 的ID
 	var userOwnOpenAIKey string // 用户自己的 OpenAI Key
 	var userOwnClaudeKey string // 用户自己的 Claude Key
 	
@@ -584,13 +631,15 @@ func (s *SilicoIDInterceptor) authenticateAndPreprocessRequest(c *gin.Context) (
 		case strings.HasPrefix(apiKey, "sk-potagi-"):
 			// 场景1: 平台认证 Key (sk-potagi-xxx)
 			// ✅ 需要验证用户身份和余额
-			valid, id, errorMessage := s.apiKeyManageService.VerifyApiKey(apiKey)
+			valid, id, keyID, errorMessage := s.apiKeyManageService.VerifyApiKeyWithID(apiKey)
 			if !valid {
 				logger.Printf("[%s] 平台API密钥验证失败: %s", requestID, errorMessage)
 				return nil, fmt.Errorf("API密钥验证失败: %s", errorMessage)
 			}
 			
 			userId = id
+			platformKey = apiKey
+			platformKeyID = keyID
 			logger.Printf("[%s] 平台API密钥验证成功，用户ID: %s (需扣费)", requestID, userId)
 			
 		case strings.HasPrefix(apiKey, "sk-ant-"):
@@ -617,13 +666,15 @@ func (s *SilicoIDInterceptor) authenticateAndPreprocessRequest(c *gin.Context) (
 			
 		default:
 			// 场景4: 未知格式的 key，作为平台认证 key 验证
-			valid, id, errorMessage := s.apiKeyManageService.VerifyApiKey(apiKey)
+			valid, id, keyID, errorMessage := s.apiKeyManageService.VerifyApiKeyWithID(apiKey)
 			if !valid {
 				logger.Printf("[%s] API密钥验证失败: %s", requestID, errorMessage)
 				return nil, fmt.Errorf("API密钥验证失败: %s", errorMessage)
 			}
 			
 			userId = id
+			platformKey = apiKey
+			platformKeyID = keyID
 			logger.Printf("[%s] API密钥验证成功，用户ID: %s", requestID, userId)
 		}
 		
@@ -649,6 +700,17 @@ func (s *SilicoIDInterceptor) authenticateAndPreprocessRequest(c *gin.Context) (
 		return nil, fmt.Errorf("请提供有效的API密钥或Token")
 	}
 	
+	// 计费流水按 Key 的ID统计用量
+	if platformKeyID > 0 {
+		data[apiKeyIDField] = platformKeyID
+	}
+
+	// 在对话发起时保存初始上下文到 Redis，便于后续从工具调用或格式转换器中查找
+	// 发起者取认证得到的用户ID；用户自己的 Key 没有真实的用户ID，不保存
+	if userOwnOpenAIKey == "" && userOwnClaudeKey == "" {
+		s.saveInitialToolCallContext(requestID, userId, data)
+	}
+
 	// 如果不是使用用户自己的 Key，才检查令牌余额
 	if userOwnOpenAIKey == "" && userOwnClaudeKey == "" {
 		hasTokens, _, err, _ := s.apiKeyManageService.CheckUserTokens(userId)
@@ -676,7 +738,7 @@ func (s *SilicoIDInterceptor) authenticateAndPreprocessRequest(c *gin.Context) (
 	logger.Printf("[%s] 请求模型: %s (前端传入的可能是 model_name)", requestID, model)
 	
 	// 如果使用平台 API Key，需要根据 model 获取对应的 model_code 和 API Key
-	useUserKey, _ := data["_use_user_key"].(bool)
+	useUserKey := userOwnOpenAIKey != "" || userOwnClaudeKey != ""
 	if !useUserKey {
 		// 使用平台 Key，需要从数据库获取对应的 model_code 和 API Key
 		modelConfig, err := s.modelManager.GetModelConfig(model)
@@ -702,13 +764,17 @@ func (s *SilicoIDInterceptor) authenticateAndPreprocessRequest(c *gin.Context) (
 		return nil, fmt.Errorf("处理文件失败: %v", err)
 	}
 
-	return &AuthenticatedRequestData{
+	authData := &AuthenticatedRequestData{
 		UserID:           userId,
 		UserOwnOpenAIKey: userOwnOpenAIKey,
 		UserOwnClaudeKey: userOwnClaudeKey,
+		APIKey:           platformKey,
+		APIKeyID:         platformKeyID,
 		Data:             data,
 		RequestID:        requestID,
-	}, nil
+	}
+	c.Set(authDataContextKey, authData)
+	return authData, nil
 }
 
 
@@ -3,6 +3,7 @@ package interceptor
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -13,6 +14,7 @@ import (
 	"github.com/google/uuid"
 
 	datahandle "digitalsingularity/backend/common/utils/datahandle"
+	"digitalsingularity/backend/silicoid/database"
 	"digitalsingularity/backend/silicoid/mcp"
 )
 
@@ -426,12 +428,27 @@ func (s *SilicoIDInterceptor) loadMCPServerConfigsFromFile() ([]mcp.MCPServerCon
 			continue
 		}
 
+		// url 和 authorization_token 支持 ${ENV_NAME} 形式的环境变量
 		config := mcp.MCPServerConfig{
 			Type:               getStringValue(serverMap["type"]),
-			URL:                getStringValue(serverMap["url"]),
+			URL:                os.ExpandEnv(getStringValue(serverMap["url"])),
 			Name:               getStringValue(serverMap["name"]),
 			Description:        getStringValue(serverMap["description"]),
-			AuthorizationToken: getStringValue(serverMap["authorization_token"]),
+			AuthorizationToken: os.ExpandEnv(getStringValue(serverMap["authorization_token"])),
+			Command:            getStringValue(serverMap["command"]),
+		}
+		config.FirstParty, _ = serverMap["first_party"].(bool)
+		// stdio 类型：args 为参数列表，env 为追加的环境变量（值同样支持 ${ENV_NAME}，启动进程时展开）
+		if args, ok := serverMap["args"].([]interface{}); ok {
+			for _, arg := range args {
+				config.Args = append(config.Args, getStringValue(arg))
+			}
+		}
+		if env, ok := serverMap["env"].(map[string]interface{}); ok {
+			config.Env = make(map[string]string, len(env))
+			for key, value := range env {
+				config.Env[key] = getStringValue(value)
+			}
 		}
 
 		mcpServers = append(mcpServers, config)
@@ -503,13 +520,8 @@ func (s *SilicoIDInterceptor) RemoveThinkTags(content string) string {
 	return strings.TrimSpace(re.ReplaceAllString(content, ""))
 }
 
-// SaveToolCallContext 保存工具调用上下文到Redis
+// SaveToolCallContext 保存工具调用上下文，有效期按本次调用的工具配置（tool_session_policies）计算
 func (s *SilicoIDInterceptor) SaveToolCallContext(userID string, requestID string, requestData map[string]interface{}, aiResponse map[string]interface{}) error {
-	svc, err := datahandle.NewCommonReadWriteService("database")
-	if err != nil {
-		return fmt.Errorf("创建数据库服务失败: %v", err)
-	}
-
 	currentModelName, _ := requestData["model"].(string)
 	currentRoleName, _ := requestData["role_name"].(string)
 
@@ -530,23 +542,21 @@ func (s *SilicoIDInterceptor) SaveToolCallContext(userID string, requestID strin
 		storeObj["ai_response"] = aiResponse
 	}
 
-	key := fmt.Sprintf("tools_call_context:%s", requestID)
-	if res := svc.RedisWrite(key, storeObj, 5*time.Minute); res == nil || res.Status != datahandle.StatusSuccess {
-		return fmt.Errorf("保存client_executor_call上下文到Redis失败")
+	if err := s.storeToolCallContext(requestID, storeObj, s.toolSessionTTL(aiResponse, requestID)); err != nil {
+		return fmt.Errorf("保存client_executor_call上下文失败: %v", err)
 	}
-
-	logger.Printf("[%s] 已保存client_executor_call上下文到Redis (key=%s)", requestID, key)
 	return nil
 }
 
-// LoadToolCallContext 从Redis加载工具调用上下文
+// LoadToolCallContext 加载工具调用上下文，Redis 中没有时从 MySQL 恢复长时间等待的会话
+// 会话已取消或已结束时返回 errToolSessionClosed
 func (s *SilicoIDInterceptor) LoadToolCallContext(sessionID string) (map[string]interface{}, error) {
 	svc, err := datahandle.NewCommonReadWriteService("database")
 	if err != nil {
 		return nil, fmt.Errorf("创建数据库服务失败: %v", err)
 	}
 
-	if res := svc.RedisRead(fmt.Sprintf("tools_call_context:%s", sessionID)); res.IsSuccess() {
+	if res := svc.RedisRead(toolCallContextKey(sessionID)); res.IsSuccess() {
 		var storedCtx map[string]interface{}
 		switch v := res.Data.(type) {
 		case map[string]interface{}:
@@ -554,30 +564,88 @@ func (s *SilicoIDInterceptor) LoadToolCallContext(sessionID string) (map[string]
 		case string:
 			_ = json.Unmarshal([]byte(v), &storedCtx)
 		}
+		if status, _ := storedCtx["status"].(string); status != "" && status != database.ToolSessionPending {
+			return nil, fmt.Errorf("%w: %s", errToolSessionClosed, status)
+		}
 		return storedCtx, nil
 	}
 
-	return nil, fmt.Errorf("未找到会话上下文")
+	return s.loadDurableToolCallContext(sessionID)
 }
 
-// UpdateToolCallContext 更新工具调用上下文
-func (s *SilicoIDInterceptor) UpdateToolCallContext(sessionID string, messages []interface{}, aiResponse map[string]interface{}) error {
+// SaveResponseState 保存 Responses API 的响应状态到Redis，供后续请求通过 previous_response_id 延续对话
+// messages 为本轮结束后的完整会话（不含 instructions），owner 为响应所属的用户（或用户自己的 Key）
+func (s *SilicoIDInterceptor) SaveResponseState(owner string, requestData map[string]interface{}, messages []interface{}, response map[string]interface{}) error {
 	svc, err := datahandle.NewCommonReadWriteService("database")
 	if err != nil {
 		return fmt.Errorf("创建数据库服务失败: %v", err)
 	}
 
-	updateCtx := map[string]interface{}{
-		"messages_snapshot": messages,
-		"ai_response":       aiResponse,
+	responseID, _ := response["id"].(string)
+	currentRoleName, _ := requestData["role_name"].(string)
+
+	storeObj := map[string]interface{}{
+		"response_id": responseID,
+		"owner":       owner,
+		"model":       response["model"],
+		"role_name":   currentRoleName,
+		"messages":    messages,
+		"response":    response,
+		"created_at":  time.Now().Unix(),
 	}
 
-	key := fmt.Sprintf("tools_call_context:%s", sessionID)
-	if res := svc.RedisWrite(key, updateCtx, 5*time.Minute); res == nil || res.Status != datahandle.StatusSuccess {
-		return fmt.Errorf("更新会话上下文到Redis失败")
+	key := fmt.Sprintf("responses_context:%s", responseID)
+	if res := svc.RedisWrite(key, storeObj, responseStateExpire); res == nil || res.Status != datahandle.StatusSuccess {
+		return fmt.Errorf("保存响应状态到Redis失败")
 	}
 
-	logger.Printf("[%s] 已更新会话上下文到Redis (key=%s)", sessionID, key)
+	logger.Printf("已保存响应状态到Redis (key=%s, 消息数=%d)", key, len(messages))
+	return nil
+}
+
+// LoadResponseState 从Redis加载 Responses API 的响应状态
+func (s *SilicoIDInterceptor) LoadResponseState(responseID string) (map[string]interface{}, error) {
+	svc, err := datahandle.NewCommonReadWriteService("database")
+	if err != nil {
+		return nil, fmt.Errorf("创建数据库服务失败: %v", err)
+	}
+
+	if res := svc.RedisRead(fmt.Sprintf("responses_context:%s", responseID)); res.IsSuccess() {
+		var storedState map[string]interface{}
+		switch v := res.Data.(type) {
+		case map[string]interface{}:
+			storedState = v
+		case string:
+			_ = json.Unmarshal([]byte(v), &storedState)
+		}
+		if storedState != nil {
+			return storedState, nil
+		}
+	}
+
+	return nil, fmt.Errorf("未找到响应: %s", responseID)
+}
+
+// UpdateToolCallContext 更新工具调用上下文（保留会话的发起者、模型和角色），有效期按新的工具调用重新计算
+// 原上下文已过期时以 initiator 为发起者重建
+func (s *SilicoIDInterceptor) UpdateToolCallContext(initiator string, sessionID string, messages []interface{}, aiResponse map[string]interface{}) error {
+	if initiator == "" {
+		return fmt.Errorf("缺少会话发起者")
+	}
+	updateCtx, err := s.LoadToolCallContext(sessionID)
+	if err != nil || updateCtx == nil {
+		updateCtx = map[string]interface{}{
+			"user_id":    initiator,
+			"request_id": sessionID,
+		}
+	}
+	updateCtx["initiator"] = initiator
+	updateCtx["messages_snapshot"] = messages
+	updateCtx["ai_response"] = aiResponse
+
+	if err := s.storeToolCallContext(sessionID, updateCtx, s.toolSessionTTL(aiResponse, sessionID)); err != nil {
+		return fmt.Errorf("更新会话上下文失败: %v", err)
+	}
 	return nil
 }
 
@@ -645,7 +713,7 @@ func (s *SilicoIDInterceptor) ExtractServerCall(response string, initiator strin
 								"request_id":  reqID,
 							}
 							key := fmt.Sprintf("tools_call_context:%s", reqID)
-							res := svc.RedisWrite(key, storeObj, 5*time.Minute)
+							res := svc.RedisWrite(key, storeObj, defaultToolSessionTTL)
 							if res == nil || res.Status != datahandle.StatusSuccess {
 								var errDetail interface{}
 								if res != nil {
@@ -711,7 +779,7 @@ func (s *SilicoIDInterceptor) ExtractServerCall(response string, initiator strin
 									"request_id":  reqID,
 								}
 								key := fmt.Sprintf("tools_call_context:%s", reqID)
-								res := svc.RedisWrite(key, storeObj, 5*time.Minute)
+								res := svc.RedisWrite(key, storeObj, defaultToolSessionTTL)
 								if res == nil || res.Status != datahandle.StatusSuccess {
 									var errDetail interface{}
 									if res != nil {
@@ -816,9 +884,17 @@ func (s *SilicoIDInterceptor) ProcessClientExecutorResult(
 	if origRequestID != "" {
 		var err error
 		storedCtx, err = s.LoadToolCallContext(origRequestID)
+		if errors.Is(err, errToolSessionClosed) {
+			logger.Printf("[%s] 会话 %s 已结束，忽略工具执行结果: %v", requestID, origRequestID, err)
+			return err
+		}
 		if err != nil {
 			logger.Printf("[%s] 加载会话上下文失败: %v", requestID, err)
 		} else if storedCtx != nil {
+			// 没有记录发起者的上下文无法确认归属，一律拒绝
+			if initiator, _ := storedCtx["initiator"].(string); initiator == "" || initiator != userID {
+				return fmt.Errorf("无权访问会话: %s", origRequestID)
+			}
 			logger.Printf("[%s] 成功从Redis加载上下文，包含键: %v", requestID, getMapKeys(storedCtx))
 			if m, ok := storedCtx["model"].(string); ok && m != "" {
 				requestData["model"] = m
@@ -989,7 +1065,7 @@ func (s *SilicoIDInterceptor) ProcessClientExecutorResult(
 			// 保存新的assistant消息到Redis
 			if newAssistantMessage != nil {
 				go func() {
-					err := s.UpdateToolCallContext(origRequestID, messages, newAssistantMessage)
+					err := s.UpdateToolCallContext(userID, origRequestID, messages, newAssistantMessage)
 					if err != nil {
 						logger.Printf("[%s] 更新会话上下文失败: %v", requestID, err)
 					}
@@ -1046,6 +1122,7 @@ func (s *SilicoIDInterceptor) ProcessClientExecutorResult(
 
 		if origRequestID != "" {
 			finalData["session_id"] = origRequestID
+			s.closeToolCallContext(origRequestID, userID, database.ToolSessionCompleted)
 		}
 
 		return sendMessage("chat_complete", finalData)
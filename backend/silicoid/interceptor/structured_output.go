@@ -0,0 +1,657 @@
+package interceptor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"digitalsingularity/backend/silicoid/formatconverter"
+	"digitalsingularity/backend/silicoid/models/manager"
+)
+
+// 结构化输出：请求带 response_format（json_object / json_schema）时校验最终回复，
+// 非流式请求校验失败时把错误反馈给模型重新生成，超过修复次数后返回 structured_output_invalid 错误
+const (
+	// maxStructuredOutputRepairs 校验失败后最多重新生成的次数
+	maxStructuredOutputRepairs = 2
+	// maxStructuredOutputErrors 反馈给模型和返回给客户端的校验错误条数上限
+	maxStructuredOutputErrors = 10
+	// maxSchemaDepth schema 的最大嵌套层数（包括 $ref 展开），超过时视为 schema 错误（如循环引用）
+	maxSchemaDepth = 64
+)
+
+// structuredOutputSpec 请求要求的结构化输出
+type structuredOutputSpec struct {
+	Name   string
+	Schema map[string]interface{} // json_object 时为 nil，只要求是合法的 JSON 对象
+}
+
+// StructuredOutputError 结构化输出校验失败
+type StructuredOutputError struct {
+	Attempts int      // 包含修复在内的生成次数
+	Errors   []string // 最后一次生成的校验错误
+}
+
+func (e *StructuredOutputError) Error() string {
+	return fmt.Sprintf("模型输出经过 %d 次生成仍不符合 response_format: %s", e.Attempts, strings.Join(e.Errors, "; "))
+}
+
+// responseError 转换为 OpenAI 格式的错误字段
+func (e *StructuredOutputError) responseError() map[string]interface{} {
+	return map[string]interface{}{
+		"message":           e.Error(),
+		"type":              "invalid_response_error",
+		"code":              "structured_output_invalid",
+		"attempts":          e.Attempts,
+		"validation_errors": e.Errors,
+	}
+}
+
+// structuredOutputFor 解析请求中的 response_format，未要求 JSON 输出时返回 nil
+func structuredOutputFor(data map[string]interface{}) *structuredOutputSpec {
+	schema, name, ok := formatconverter.ResponseFormatSchema(data)
+	if !ok {
+		return nil
+	}
+	return &structuredOutputSpec{Name: name, Schema: schema}
+}
+
+// validate 校验回复内容，返回校验错误（为空表示通过）
+func (spec *structuredOutputSpec) validate(content string) []string {
+	var value interface{}
+	if err := json.Unmarshal([]byte(stripJSONFence(content)), &value); err != nil {
+		return []string{fmt.Sprintf("输出不是合法的 JSON: %v", err)}
+	}
+	if spec.Schema == nil {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return []string{"输出必须是 JSON 对象"}
+		}
+		return nil
+	}
+	validator := &jsonSchemaValidator{root: spec.Schema}
+	validator.validate(value, spec.Schema, "$")
+	return validator.errors
+}
+
+// stripJSONFence 去掉模型经常附加的 Markdown 代码块标记
+func stripJSONFence(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "```") {
+		return content
+	}
+	content = strings.TrimPrefix(content, "```")
+	if newline := strings.IndexByte(content, '\n'); newline >= 0 {
+		content = content[newline+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "```"))
+}
+
+// enforceStructuredOutput 校验非流式回复，不符合要求时带着校验错误重新生成
+// 返回通过校验的回复（内容已去掉代码块标记），或带 structured_output_invalid 错误的响应；
+// 每次生成的用量都累加到返回的响应中，按实际消耗计费
+func (s *SilicoIDInterceptor) enforceStructuredOutput(ctx context.Context, data map[string]interface{}, response map[string]interface{}, modelConfig *manager.ModelConfig, requestID string) map[string]interface{} {
+	spec := structuredOutputFor(data)
+	if spec == nil || response == nil {
+		return response
+	}
+	if _, hasError := response["error"]; hasError {
+		return response
+	}
+
+	originalMessages, _ := data["messages"].([]interface{})
+	defer func() { data["messages"] = originalMessages }()
+	messages := append([]interface{}{}, originalMessages...)
+	usage := map[string]interface{}{}
+
+	for attempt := 1; ; attempt++ {
+		mergeUsage(usage, response["usage"])
+		message := openAIResponseMessage(response)
+		content, _ := message["content"].(string)
+
+		// 工具调用和工具循环预算耗尽的说明不是最终回答，与流式处理一致不校验
+		if !requiresStructuredOutput(response, message) {
+			response["usage"] = usage
+			return response
+		}
+
+		errs := spec.validate(content)
+		if len(errs) == 0 {
+			message["content"] = stripJSONFence(content)
+			response["usage"] = usage
+			if attempt > 1 {
+				logger.Printf("[%s] ✅ 结构化输出经过 %d 次生成通过校验", requestID, attempt)
+			}
+			return response
+		}
+		if len(errs) > maxStructuredOutputErrors {
+			errs = errs[:maxStructuredOutputErrors]
+		}
+		logger.Printf("[%s] ⚠️ 第 %d 次生成的结构化输出校验失败: %v", requestID, attempt, errs)
+
+		if attempt > maxStructuredOutputRepairs {
+			return structuredOutputFailure(response, &StructuredOutputError{Attempts: attempt, Errors: errs}, usage)
+		}
+
+		// 把错误的输出和校验错误追加到对话中，让模型修正
+		messages = append(messages,
+			map[string]interface{}{"id": generateMessageID(), "role": "assistant", "content": content},
+			map[string]interface{}{"id": generateMessageID(), "role": "user", "content": structuredOutputRepairPrompt(spec, errs)},
+		)
+		data["messages"] = messages
+		repaired, err := s.chatCompletionWithFallback(ctx, data, modelConfig, requestID)
+		if err != nil || repaired == nil {
+			logger.Printf("[%s] 结构化输出修复请求失败: %v", requestID, err)
+			return structuredOutputFailure(response, &StructuredOutputError{Attempts: attempt, Errors: errs}, usage)
+		}
+		if _, hasError := repaired["error"]; hasError {
+			mergeUsage(usage, repaired["usage"])
+			repaired["usage"] = usage
+			return repaired
+		}
+		response = repaired
+	}
+}
+
+// requiresStructuredOutput 回复是否需要按 response_format 校验
+// 带 tool_calls 的回复（内容通常为空）和 finish_reason 为 tool_budget_exceeded 的说明不校验
+func requiresStructuredOutput(response map[string]interface{}, message map[string]interface{}) bool {
+	for _, toolCalls := range []interface{}{message["tool_calls"], response["tool_calls"]} {
+		switch calls := toolCalls.(type) {
+		case []interface{}:
+			if len(calls) > 0 {
+				return false
+			}
+		case []map[string]interface{}:
+			if len(calls) > 0 {
+				return false
+			}
+		}
+	}
+	if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
+		if choice, ok := choices[0].(map[string]interface{}); ok && choice["finish_reason"] == finishReasonToolBudgetExceeded {
+			return false
+		}
+	}
+	return true
+}
+
+// structuredOutputFailure 生成校验失败的错误响应，保留最后一次生成的计费字段和累计用量
+func structuredOutputFailure(response map[string]interface{}, failed *StructuredOutputError, usage map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{"error": failed.responseError(), "usage": usage}
+	for _, field := range []string{keyIDField, modelCodeField, servedByField} {
+		if value, ok := response[field]; ok {
+			result[field] = value
+		}
+	}
+	return result
+}
+
+// structuredOutputRepairPrompt 生成让模型修正输出的提示
+func structuredOutputRepairPrompt(spec *structuredOutputSpec, errs []string) string {
+	var prompt strings.Builder
+	prompt.WriteString("上一次的输出不符合要求的格式，错误如下：\n")
+	for _, e := range errs {
+		prompt.WriteString("- " + e + "\n")
+	}
+	prompt.WriteString("请重新输出完整的回答，只输出一个合法的 JSON 值，不要包含 Markdown 代码块或解释文字。")
+	if spec.Schema != nil {
+		if schemaJSON, err := json.Marshal(spec.Schema); err == nil {
+			prompt.WriteString("\n输出必须符合以下 JSON Schema：\n" + string(schemaJSON))
+		}
+	}
+	return prompt.String()
+}
+
+// openAIResponseMessage 返回 OpenAI 响应第一个 choice 的 message（不存在时返回空 map）
+func openAIResponseMessage(response map[string]interface{}) map[string]interface{} {
+	var first interface{}
+	switch choices := response["choices"].(type) {
+	case []interface{}:
+		if len(choices) > 0 {
+			first = choices[0]
+		}
+	case []map[string]interface{}:
+		if len(choices) > 0 {
+			first = choices[0]
+		}
+	}
+	choice, _ := first.(map[string]interface{})
+	message, _ := choice["message"].(map[string]interface{})
+	if message == nil {
+		return map[string]interface{}{}
+	}
+	return message
+}
+
+// mergeUsage 将一次生成的 OpenAI usage 累加到 total（含缓存命中和写入缓存的 token，计费按二者分别计价）
+func mergeUsage(total map[string]interface{}, value interface{}) {
+	usage, _ := value.(map[string]interface{})
+	for _, field := range []string{"prompt_tokens", "completion_tokens", "total_tokens"} {
+		total[field] = toInt(total[field]) + toInt(usage[field])
+	}
+	details, _ := usage["prompt_tokens_details"].(map[string]interface{})
+	for _, field := range []string{"cached_tokens", "cache_creation_tokens"} {
+		tokens := toInt(details[field])
+		if tokens == 0 {
+			continue
+		}
+		totalDetails, _ := total["prompt_tokens_details"].(map[string]interface{})
+		if totalDetails == nil {
+			totalDetails = map[string]interface{}{}
+			total["prompt_tokens_details"] = totalDetails
+		}
+		totalDetails[field] = toInt(totalDetails[field]) + tokens
+	}
+}
+
+// structuredOutputStream 转发流式响应并拼接回复内容，结束时校验结构化输出
+// 流式内容已经发给客户端，无法重新生成，校验失败时在 [DONE] 前发送 structured_output_invalid 错误块
+func structuredOutputStream(ctx context.Context, stream chan string, spec *structuredOutputSpec, requestID string) chan string {
+	outputChan := make(chan string)
+
+	go func() {
+		defer close(outputChan)
+
+		var content strings.Builder
+		hasToolCalls := false
+		failed := false
+		forward := func(chunk string) bool {
+			select {
+			case outputChan <- chunk:
+				return true
+			case <-ctx.Done():
+				// 排空上游，避免上游 goroutine 阻塞
+				go func() {
+					for range stream {
+					}
+				}()
+				return false
+			}
+		}
+
+		for chunk := range stream {
+			data := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(chunk), "data:"))
+			if data == "[DONE]" && !failed && !hasToolCalls {
+				if errs := spec.validate(content.String()); len(errs) > 0 {
+					if len(errs) > maxStructuredOutputErrors {
+						errs = errs[:maxStructuredOutputErrors]
+					}
+					logger.Printf("[%s] ⚠️ 流式结构化输出校验失败: %v", requestID, errs)
+					errorJSON, _ := json.Marshal(map[string]interface{}{
+						"error": (&StructuredOutputError{Attempts: 1, Errors: errs}).responseError(),
+					})
+					if !forward(fmt.Sprintf("data: %s\n\n", string(errorJSON))) {
+						return
+					}
+				}
+			} else if data != "" && data != "[DONE]" {
+				var payload struct {
+					Error   interface{} `json:"error"`
+					Choices []struct {
+						Delta struct {
+							Content   string        `json:"content"`
+							ToolCalls []interface{} `json:"tool_calls"`
+						} `json:"delta"`
+					} `json:"choices"`
+				}
+				if err := json.Unmarshal([]byte(data), &payload); err == nil {
+					if payload.Error != nil {
+						// 上游错误已经透传，不再重复报告校验错误
+						failed = true
+					}
+					for _, choice := range payload.Choices {
+						content.WriteString(choice.Delta.Content)
+						if len(choice.Delta.ToolCalls) > 0 {
+							hasToolCalls = true
+						}
+					}
+				}
+			}
+
+			if !forward(chunk) {
+				return
+			}
+		}
+	}()
+
+	return outputChan
+}
+
+// jsonSchemaValidator JSON Schema 校验（覆盖结构化输出常用的关键字）
+// 支持 type、enum、const、properties、required、additionalProperties、items、prefixItems、
+// 长度/数量/数值范围、pattern、anyOf/oneOf/allOf/not，以及指向 #/$defs 或 #/definitions 的 $ref
+type jsonSchemaValidator struct {
+	root         map[string]interface{}
+	errors       []string
+	schemaErrors []string // schema 本身的错误（无效的 pattern、嵌套过深），同时包含在 errors 中
+	depth        int
+}
+
+func (v *jsonSchemaValidator) fail(path string, format string, args ...interface{}) {
+	v.errors = append(v.errors, path+": "+fmt.Sprintf(format, args...))
+}
+
+// failSchema 记录 schema 本身的错误，校验不能因为 schema 无法使用而通过
+func (v *jsonSchemaValidator) failSchema(path string, format string, args ...interface{}) {
+	message := path + ": " + fmt.Sprintf(format, args...)
+	for _, existing := range v.schemaErrors {
+		if existing == message {
+			return
+		}
+	}
+	v.schemaErrors = append(v.schemaErrors, message)
+	v.errors = append(v.errors, message)
+}
+
+// check 在独立的校验器中校验（anyOf/oneOf/not 只需要知道是否通过）
+// schema 本身的错误不能被 anyOf/oneOf/not 吞掉，合并到当前校验器
+func (v *jsonSchemaValidator) check(value interface{}, schema map[string]interface{}, path string) bool {
+	sub := &jsonSchemaValidator{root: v.root, depth: v.depth}
+	sub.validate(value, schema, path)
+	for _, message := range sub.schemaErrors {
+		v.failSchema(path, "%s", strings.TrimPrefix(message, path+": "))
+	}
+	return len(sub.errors) == 0
+}
+
+func (v *jsonSchemaValidator) validate(value interface{}, schema map[string]interface{}, path string) {
+	if schema == nil {
+		return
+	}
+	// 防止循环引用导致无限递归
+	if v.depth > maxSchemaDepth {
+		v.failSchema(path, "schema 嵌套超过 %d 层（可能存在循环引用）", maxSchemaDepth)
+		return
+	}
+	v.depth++
+	defer func() { v.depth-- }()
+
+	if ref, ok := schema["$ref"].(string); ok {
+		target := v.resolveRef(ref)
+		if target == nil {
+			v.fail(path, "无法解析 $ref %s", ref)
+			return
+		}
+		v.validate(value, target, path)
+	}
+
+	if !v.checkType(value, schema["type"], path) {
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		matched := false
+		for _, candidate := range enum {
+			if jsonEqual(value, candidate) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "值必须是 %s 之一", compactJSON(enum))
+		}
+	}
+	if constValue, ok := schema["const"]; ok && !jsonEqual(value, constValue) {
+		v.fail(path, "值必须等于 %s", compactJSON(constValue))
+	}
+
+	for _, sub := range schemaList(schema["allOf"]) {
+		v.validate(value, sub, path)
+	}
+	if anyOf := schemaList(schema["anyOf"]); len(anyOf) > 0 {
+		matched := false
+		for _, sub := range anyOf {
+			if v.check(value, sub, path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "不符合 anyOf 中的任何一个 schema")
+		}
+	}
+	if oneOf := schemaList(schema["oneOf"]); len(oneOf) > 0 {
+		matches := 0
+		for _, sub := range oneOf {
+			if v.check(value, sub, path) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			v.fail(path, "必须恰好符合 oneOf 中的一个 schema（符合 %d 个）", matches)
+		}
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok && v.check(value, not, path) {
+		v.fail(path, "不能符合 not 中的 schema")
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(typed, schema, path)
+	case []interface{}:
+		v.validateArray(typed, schema, path)
+	case string:
+		length := len([]rune(typed))
+		if min, ok := schemaNumber(schema["minLength"]); ok && float64(length) < min {
+			v.fail(path, "字符串长度不能小于 %v", min)
+		}
+		if max, ok := schemaNumber(schema["maxLength"]); ok && float64(length) > max {
+			v.fail(path, "字符串长度不能大于 %v", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err != nil {
+				v.failSchema(path, "schema 中的 pattern %s 无效: %v", pattern, err)
+			} else if !re.MatchString(typed) {
+				v.fail(path, "字符串不匹配 pattern %s", pattern)
+			}
+		}
+	case float64:
+		if min, ok := schemaNumber(schema["minimum"]); ok && typed < min {
+			v.fail(path, "数值不能小于 %v", min)
+		}
+		if max, ok := schemaNumber(schema["maximum"]); ok && typed > max {
+			v.fail(path, "数值不能大于 %v", max)
+		}
+		if min, ok := schemaNumber(schema["exclusiveMinimum"]); ok && typed <= min {
+			v.fail(path, "数值必须大于 %v", min)
+		}
+		if max, ok := schemaNumber(schema["exclusiveMaximum"]); ok && typed >= max {
+			v.fail(path, "数值必须小于 %v", max)
+		}
+		if multiple, ok := schemaNumber(schema["multipleOf"]); ok && multiple > 0 {
+			if quotient := typed / multiple; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+				v.fail(path, "数值必须是 %v 的倍数", multiple)
+			}
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateObject(object map[string]interface{}, schema map[string]interface{}, path string) {
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			key, _ := name.(string)
+			if _, exists := object[key]; key != "" && !exists {
+				v.fail(path, "缺少必需的字段 %q", key)
+			}
+		}
+	}
+	if min, ok := schemaNumber(schema["minProperties"]); ok && float64(len(object)) < min {
+		v.fail(path, "字段数不能少于 %v", min)
+	}
+	if max, ok := schemaNumber(schema["maxProperties"]); ok && float64(len(object)) > max {
+		v.fail(path, "字段数不能多于 %v", max)
+	}
+
+	// 按字段名排序，保证错误信息顺序稳定
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		childPath := path + "." + key
+		if propertySchema, ok := properties[key].(map[string]interface{}); ok {
+			v.validate(object[key], propertySchema, childPath)
+			continue
+		}
+		if _, declared := properties[key]; declared {
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(path, "不允许的字段 %q", key)
+			}
+		case map[string]interface{}:
+			v.validate(object[key], additional, childPath)
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateArray(array []interface{}, schema map[string]interface{}, path string) {
+	if min, ok := schemaNumber(schema["minItems"]); ok && float64(len(array)) < min {
+		v.fail(path, "元素个数不能少于 %v", min)
+	}
+	if max, ok := schemaNumber(schema["maxItems"]); ok && float64(len(array)) > max {
+		v.fail(path, "元素个数不能多于 %v", max)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if jsonEqual(array[i], array[j]) {
+					v.fail(path, "第 %d 和第 %d 个元素重复", i, j)
+				}
+			}
+		}
+	}
+
+	prefixItems := schemaList(schema["prefixItems"])
+	for i, item := range array {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if i < len(prefixItems) {
+			v.validate(item, prefixItems[i], itemPath)
+			continue
+		}
+		switch items := schema["items"].(type) {
+		case map[string]interface{}:
+			v.validate(item, items, itemPath)
+		case bool:
+			if !items {
+				v.fail(path, "元素个数不能多于 %d", len(prefixItems))
+				return
+			}
+		}
+	}
+}
+
+// checkType 校验 type 关键字（支持类型数组），不符合时记录错误并返回 false
+func (v *jsonSchemaValidator) checkType(value interface{}, typeValue interface{}, path string) bool {
+	var types []string
+	switch t := typeValue.(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+	}
+	if len(types) == 0 {
+		return true
+	}
+	actual := jsonTypeName(value)
+	for _, expected := range types {
+		if expected == actual || (expected == "number" && actual == "integer") {
+			return true
+		}
+	}
+	v.fail(path, "类型应为 %s，实际为 %s", strings.Join(types, " 或 "), actual)
+	return false
+}
+
+// resolveRef 解析文档内的 $ref（#、#/$defs/x、#/definitions/x 等 JSON Pointer）
+func (v *jsonSchemaValidator) resolveRef(ref string) map[string]interface{} {
+	if !strings.HasPrefix(ref, "#") {
+		return nil
+	}
+	var current interface{} = v.root
+	for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		node, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = node[token]
+	}
+	schema, _ := current.(map[string]interface{})
+	return schema
+}
+
+// jsonTypeName 返回 JSON 值的 JSON Schema 类型名
+func jsonTypeName(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if typed == math.Trunc(typed) && !math.IsInf(typed, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// schemaList 读取 schema 数组关键字（allOf/anyOf/oneOf/prefixItems）
+func schemaList(value interface{}) []map[string]interface{} {
+	list, _ := value.([]interface{})
+	schemas := make([]map[string]interface{}, 0, len(list))
+	for _, item := range list {
+		if schema, ok := item.(map[string]interface{}); ok {
+			schemas = append(schemas, schema)
+		}
+	}
+	return schemas
+}
+
+// schemaNumber 读取 schema 中的数值关键字
+func schemaNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case int:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+// jsonEqual 按 JSON 语义比较两个值
+func jsonEqual(a, b interface{}) bool {
+	return compactJSON(a) == compactJSON(b)
+}
+
+// compactJSON 序列化为紧凑的 JSON（map 的键按字典序，可用于比较）
+func compactJSON(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
@@ -0,0 +1,200 @@
+package interceptor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"digitalsingularity/backend/silicoid/database"
+)
+
+// 服务端工具循环预算：模型持续发出服务端工具调用时，按轮数、工具执行耗时和循环中消耗的 token 限制循环，
+// 超出限制时不再执行工具，返回说明原因的最终回复，finish_reason 为 tool_budget_exceeded
+const (
+	toolLoopPolicyPrefix = "silicoid:tool_loop_policy:"
+	// toolLoopPolicyExpire 角色的工具循环限制在 Redis 中的缓存时间
+	toolLoopPolicyExpire = 5 * time.Minute
+	// defaultMaxToolIterations 角色未配置时最多执行的工具调用轮数
+	defaultMaxToolIterations = 5
+	// finishReasonToolBudgetExceeded 工具循环超出限制时最终回复的 finish_reason
+	finishReasonToolBudgetExceeded = "tool_budget_exceeded"
+
+	// toolBudgetField 请求数据中的内部字段：本次请求的循环预算（不发送给模型）
+	toolBudgetField = "_tool_budget"
+)
+
+// toolBudgetRequestFields 请求中收紧工具循环限制的字段，分发前从请求中移除
+var toolBudgetRequestFields = []string{"max_tool_iterations", "max_tool_seconds", "max_loop_tokens"}
+
+// toolLoopBudget 一次请求的服务端工具循环预算及已用量
+type toolLoopBudget struct {
+	MaxIterations int           // 最多执行的工具调用轮数
+	MaxToolTime   time.Duration // 工具执行的累计耗时上限，0 表示不限制
+	MaxTokens     int           // 循环中模型调用累计消耗的 token 上限，0 表示不限制
+
+	Iterations int           // 已执行的工具调用轮数
+	ToolTime   time.Duration // 工具已执行的累计耗时
+	Tokens     int           // 已消耗的 token
+}
+
+// toolLoopBudgetFor 获取请求的工具循环预算，第一次调用时按角色限制和请求中的限制创建并记录在请求数据中
+// 请求中的限制只能收紧角色的限制，不能放宽
+func (s *SilicoIDInterceptor) toolLoopBudgetFor(data map[string]interface{}, requestID string) *toolLoopBudget {
+	if budget, ok := data[toolBudgetField].(*toolLoopBudget); ok {
+		return budget
+	}
+
+	roleName, _ := data["role_name"].(string)
+	if roleName == "" {
+		roleName = "general_assistant"
+	}
+	budget := &toolLoopBudget{MaxIterations: defaultMaxToolIterations}
+	if policy := s.toolLoopPolicy(roleName, requestID); policy != nil {
+		if policy.MaxToolIterations > 0 {
+			budget.MaxIterations = policy.MaxToolIterations
+		}
+		budget.MaxToolTime = time.Duration(policy.MaxToolSeconds) * time.Second
+		budget.MaxTokens = policy.MaxLoopTokens
+	}
+
+	budget.MaxIterations = tightenLimit(budget.MaxIterations, toInt(data["max_tool_iterations"]))
+	budget.MaxToolTime = time.Duration(tightenLimit(int(budget.MaxToolTime/time.Second), toInt(data["max_tool_seconds"]))) * time.Second
+	budget.MaxTokens = tightenLimit(budget.MaxTokens, toInt(data["max_loop_tokens"]))
+	dropToolBudgetFields(data)
+
+	data[toolBudgetField] = budget
+	logger.Printf("[%s] 工具循环限制: 最多 %d 轮, 工具耗时 %v, token %d (角色: %s，0 表示不限制)",
+		requestID, budget.MaxIterations, budget.MaxToolTime, budget.MaxTokens, roleName)
+	return budget
+}
+
+// tightenLimit 用请求中的值收紧限制（limit 为 0 表示不限制）
+func tightenLimit(limit int, requested int) int {
+	if requested <= 0 {
+		return limit
+	}
+	if limit <= 0 || requested < limit {
+		return requested
+	}
+	return limit
+}
+
+// dropToolBudgetFields 移除请求中的工具循环限制字段（这些字段不是模型参数）
+func dropToolBudgetFields(data map[string]interface{}) {
+	for _, field := range toolBudgetRequestFields {
+		delete(data, field)
+	}
+}
+
+// toolLoopPolicy 获取角色的工具循环限制（先读 Redis，未命中时查数据库并写回）
+func (s *SilicoIDInterceptor) toolLoopPolicy(roleName string, requestID string) *database.ToolLoopPolicy {
+	if s.readWrite == nil {
+		return nil
+	}
+	policyKey := toolLoopPolicyPrefix + roleName
+	if result := s.readWrite.GetRedis(policyKey); result.IsSuccess() {
+		if jsonStr, _ := result.Data.(string); jsonStr != "" {
+			var policy database.ToolLoopPolicy
+			if err := json.Unmarshal([]byte(jsonStr), &policy); err == nil {
+				return &policy
+			}
+		}
+	}
+
+	if s.dataService == nil {
+		return nil
+	}
+	policy, err := s.dataService.GetToolLoopPolicy(roleName)
+	if err != nil {
+		logger.Printf("[%s] ⚠️ %v", requestID, err)
+		return nil
+	}
+	if jsonData, err := json.Marshal(policy); err == nil {
+		s.readWrite.SetRedis(policyKey, string(jsonData), toolLoopPolicyExpire)
+	}
+	return policy
+}
+
+// addUsage 累计一次模型调用消耗的 token
+func (b *toolLoopBudget) addUsage(response map[string]interface{}) {
+	usage, _ := response["usage"].(map[string]interface{})
+	b.Tokens += toInt(usage["total_tokens"])
+}
+
+// exceeded 检查是否还能执行下一轮工具调用，不能时返回原因
+func (b *toolLoopBudget) exceeded() string {
+	switch {
+	case b.Iterations >= b.MaxIterations:
+		return fmt.Sprintf("工具调用已达到 %d 轮的上限", b.MaxIterations)
+	case b.MaxToolTime > 0 && b.ToolTime >= b.MaxToolTime:
+		return fmt.Sprintf("工具执行时间已达到 %v 的上限", b.MaxToolTime)
+	case b.MaxTokens > 0 && b.Tokens >= b.MaxTokens:
+		return fmt.Sprintf("本次请求已消耗 %d tokens，达到 %d 的上限", b.Tokens, b.MaxTokens)
+	}
+	return ""
+}
+
+// executeBudgetedServerCalls 执行一轮服务端调用并计入预算
+// 设置了工具耗时上限时，本轮最多执行剩余的时间，未完成的调用以超时失败返回给模型
+func (s *SilicoIDInterceptor) executeBudgetedServerCalls(
+	ctx context.Context,
+	budget *toolLoopBudget,
+	calls []ServerCall,
+	requestID string,
+	execute func(ctx context.Context, call ServerCall) (string, error),
+) []string {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	budget.Iterations++
+	if budget.MaxToolTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget.MaxToolTime-budget.ToolTime)
+		defer cancel()
+	}
+
+	start := time.Now()
+	results := s.executeServerCallsInParallel(ctx, calls, requestID, execute)
+	budget.ToolTime += time.Since(start)
+	return results
+}
+
+// toolBudgetExceededResponse 将模型最后一次（仍包含工具调用的）响应改写为最终回复：
+// 去掉不再执行的工具调用，保留模型已输出的文字并说明停止的原因，finish_reason 为 tool_budget_exceeded
+func (s *SilicoIDInterceptor) toolBudgetExceededResponse(response map[string]interface{}, reason string, requestID string) map[string]interface{} {
+	logger.Printf("[%s] ⚠️ 工具循环超出限制，停止调用工具: %s", requestID, reason)
+	delete(response, "tool_calls")
+
+	choices, _ := response["choices"].([]interface{})
+	if len(choices) == 0 {
+		choices = []interface{}{map[string]interface{}{"index": 0}}
+		response["choices"] = choices
+	}
+	choice, _ := choices[0].(map[string]interface{})
+	if choice == nil {
+		choice = map[string]interface{}{"index": 0}
+		choices[0] = choice
+	}
+	message, _ := choice["message"].(map[string]interface{})
+	if message == nil {
+		message = map[string]interface{}{"role": "assistant"}
+		choice["message"] = message
+	}
+	content, _ := message["content"].(string)
+	message["content"] = s.toolBudgetExceededContent(content, reason)
+	delete(message, "tool_calls")
+	delete(message, "function_call")
+	choice["finish_reason"] = finishReasonToolBudgetExceeded
+	return response
+}
+
+// toolBudgetExceededContent 超出工具循环限制时的最终回复内容
+func (s *SilicoIDInterceptor) toolBudgetExceededContent(content string, reason string) string {
+	content = strings.TrimSpace(s.filterServerCalls(content))
+	if content == "" {
+		return fmt.Sprintf("%s，已停止继续调用工具，未能完成回答。请缩小问题范围后重试。", reason)
+	}
+	return fmt.Sprintf("%s\n\n（%s，已停止继续调用工具，以上为目前的结果。）", content, reason)
+}
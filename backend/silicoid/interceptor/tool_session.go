@@ -0,0 +1,270 @@
+package interceptor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"digitalsingularity/backend/common/utils/datahandle"
+	"digitalsingularity/backend/silicoid/database"
+)
+
+// 客户端工具调用会话：client_executor_call 发出后，会话上下文按工具配置的有效期保存，
+// 等待时间超过默认有效期的会话同时写入 MySQL，Redis 过期或丢失后仍可恢复
+const (
+	toolCallContextPrefix = "tools_call_context:"
+
+	toolSessionPolicyPrefix = "silicoid:tool_session_policy:"
+	// toolSessionPolicyExpire 工具会话有效期配置在 Redis 中的缓存时间
+	toolSessionPolicyExpire = 5 * time.Minute
+	// defaultToolSessionTTL 工具未配置有效期时等待客户端回传结果的时间
+	defaultToolSessionTTL = 5 * time.Minute
+)
+
+// errToolSessionClosed 会话已取消或已结束，不能再继续
+var errToolSessionClosed = errors.New("工具调用会话已结束")
+
+// toolCallContextKey 工具调用上下文在 Redis 中的 key
+func toolCallContextKey(sessionID string) string {
+	return toolCallContextPrefix + sessionID
+}
+
+// toolSessionTTL 计算一组工具调用的会话有效期：取各工具配置中最长的一个
+func (s *SilicoIDInterceptor) toolSessionTTL(aiResponse map[string]interface{}, requestID string) time.Duration {
+	ttl := time.Duration(0)
+	for _, name := range toolCallNames(aiResponse) {
+		if toolTTL := s.toolSessionPolicyTTL(name, requestID); toolTTL > ttl {
+			ttl = toolTTL
+		}
+	}
+	if ttl <= 0 {
+		ttl = defaultToolSessionTTL
+	}
+	return ttl
+}
+
+// toolSessionPolicyTTL 获取工具配置的会话有效期（先读 Redis，未命中时查数据库并写回），未配置时返回 0
+func (s *SilicoIDInterceptor) toolSessionPolicyTTL(toolName string, requestID string) time.Duration {
+	if s.readWrite == nil {
+		return 0
+	}
+	policyKey := toolSessionPolicyPrefix + toolName
+	if result := s.readWrite.GetRedis(policyKey); result.IsSuccess() {
+		if jsonStr, _ := result.Data.(string); jsonStr != "" {
+			var policy database.ToolSessionPolicy
+			if err := json.Unmarshal([]byte(jsonStr), &policy); err == nil {
+				return time.Duration(policy.TTLSeconds) * time.Second
+			}
+		}
+	}
+
+	if s.dataService == nil {
+		return 0
+	}
+	policy, err := s.dataService.GetToolSessionPolicy(toolName)
+	if err != nil {
+		logger.Printf("[%s] ⚠️ %v", requestID, err)
+		return 0
+	}
+	if jsonData, err := json.Marshal(policy); err == nil {
+		s.readWrite.SetRedis(policyKey, string(jsonData), toolSessionPolicyExpire)
+	}
+	return time.Duration(policy.TTLSeconds) * time.Second
+}
+
+// toolCallNames 提取 assistant 消息中调用的工具名
+func toolCallNames(aiResponse map[string]interface{}) []string {
+	var names []string
+	if toolCalls, ok := aiResponse["tool_calls"].([]interface{}); ok {
+		for _, tc := range toolCalls {
+			tcMap, _ := tc.(map[string]interface{})
+			fn, _ := tcMap["function"].(map[string]interface{})
+			if name, _ := fn["name"].(string); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	if fc, ok := aiResponse["function_call"].(map[string]interface{}); ok {
+		if name, _ := fc["name"].(string); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// pendingToolCalls 会话中等待客户端执行的工具调用
+func pendingToolCalls(storedCtx map[string]interface{}) []interface{} {
+	aiResp, _ := storedCtx["ai_response"].(map[string]interface{})
+	if toolCalls, ok := aiResp["tool_calls"].([]interface{}); ok {
+		return toolCalls
+	}
+	if fc, ok := aiResp["function_call"]; ok && fc != nil {
+		return []interface{}{fc}
+	}
+	return nil
+}
+
+// saveInitialToolCallContext 在对话发起时保存初始上下文，发起者为认证得到的用户ID
+func (s *SilicoIDInterceptor) saveInitialToolCallContext(requestID string, userID string, data map[string]interface{}) {
+	if userID == "" {
+		return
+	}
+	svc, err := datahandle.NewCommonReadWriteService("database")
+	if err != nil {
+		logger.Printf("[%s] ⚠️ 无法初始化 CommonReadWriteService 保存初始上下文: %v", requestID, err)
+		return
+	}
+
+	modelVal, _ := data["model"].(string)
+	roleNameVal, _ := data["role_name"].(string)
+	storeObj := map[string]interface{}{
+		"initiator":  userID,
+		"request_id": requestID,
+		"model":      modelVal,
+		"role_name":  roleNameVal,
+		"user_id":    userID,
+		"created_at": time.Now().Unix(),
+	}
+
+	key := toolCallContextKey(requestID)
+	if res := svc.RedisWrite(key, storeObj, defaultToolSessionTTL); res == nil || res.Status != datahandle.StatusSuccess {
+		var errDetail interface{} = "nil result"
+		if res != nil {
+			errDetail = res.Error
+		}
+		logger.Printf("[%s] ⚠️ 保存初始 tools_call_context 到 Redis 失败: %v", requestID, errDetail)
+		return
+	}
+	logger.Printf("[%s] ✅ 已将对话初始上下文存入 Redis key=%s", requestID, key)
+}
+
+// storeToolCallContext 按有效期保存工具调用上下文，超过默认有效期的会话同时写入 MySQL
+func (s *SilicoIDInterceptor) storeToolCallContext(sessionID string, storeObj map[string]interface{}, ttl time.Duration) error {
+	svc, err := datahandle.NewCommonReadWriteService("database")
+	if err != nil {
+		return fmt.Errorf("创建数据库服务失败: %v", err)
+	}
+
+	storeObj["status"] = database.ToolSessionPending
+	storeObj["expires_at"] = time.Now().Add(ttl).Unix()
+
+	key := toolCallContextKey(sessionID)
+	if res := svc.RedisWrite(key, storeObj, ttl); res == nil || res.Status != datahandle.StatusSuccess {
+		return fmt.Errorf("保存工具调用上下文到Redis失败")
+	}
+
+	if ttl > defaultToolSessionTTL && s.dataService != nil {
+		contextJSON, err := json.Marshal(storeObj)
+		if err != nil {
+			return fmt.Errorf("序列化工具调用上下文失败: %v", err)
+		}
+		userID, _ := storeObj["initiator"].(string)
+		if err := s.dataService.SaveToolCallSession(&database.ToolCallSession{
+			SessionID: sessionID,
+			UserID:    userID,
+			Status:    database.ToolSessionPending,
+			Context:   string(contextJSON),
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	logger.Printf("[%s] 已保存工具调用上下文 (key=%s, 有效期=%v)", sessionID, key, ttl)
+	return nil
+}
+
+// loadDurableToolCallContext 从 MySQL 恢复工具调用上下文，并按剩余有效期写回 Redis
+func (s *SilicoIDInterceptor) loadDurableToolCallContext(sessionID string) (map[string]interface{}, error) {
+	if s.dataService == nil {
+		return nil, fmt.Errorf("未找到会话上下文")
+	}
+	session, err := s.dataService.GetToolCallSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, fmt.Errorf("未找到会话上下文")
+	}
+	if session.Status != database.ToolSessionPending {
+		return nil, fmt.Errorf("%w: %s", errToolSessionClosed, session.Status)
+	}
+	remaining := time.Until(time.Unix(session.ExpiresAt, 0))
+	if remaining <= 0 {
+		return nil, fmt.Errorf("会话上下文已过期")
+	}
+
+	var storedCtx map[string]interface{}
+	if err := json.Unmarshal([]byte(session.Context), &storedCtx); err != nil {
+		return nil, fmt.Errorf("解析会话上下文失败: %v", err)
+	}
+	if svc, err := datahandle.NewCommonReadWriteService("database"); err == nil {
+		svc.RedisWrite(toolCallContextKey(sessionID), storedCtx, remaining)
+	}
+	logger.Printf("[%s] 已从MySQL恢复工具调用上下文 (剩余有效期=%v)", sessionID, remaining.Round(time.Second))
+	return storedCtx, nil
+}
+
+// closeToolCallContext 结束工具调用会话：Redis 中的上下文替换为只记录状态的标记（之后回传的结果不再处理），
+// 并更新 MySQL 中的状态
+func (s *SilicoIDInterceptor) closeToolCallContext(sessionID string, initiator string, status string) {
+	if svc, err := datahandle.NewCommonReadWriteService("database"); err == nil {
+		closed := map[string]interface{}{
+			"initiator": initiator,
+			"status":    status,
+		}
+		svc.RedisWrite(toolCallContextKey(sessionID), closed, defaultToolSessionTTL)
+	}
+	if s.dataService != nil {
+		if err := s.dataService.UpdateToolCallSessionStatus(sessionID, status); err != nil {
+			logger.Printf("[%s] ⚠️ %v", sessionID, err)
+		}
+	}
+}
+
+// loadOwnedToolCallContext 加载属于用户的工具调用上下文，没有记录发起者的上下文一律拒绝
+func (s *SilicoIDInterceptor) loadOwnedToolCallContext(userID string, sessionID string) (map[string]interface{}, error) {
+	if sessionID == "" {
+		return nil, fmt.Errorf("缺少 session_id")
+	}
+	storedCtx, err := s.LoadToolCallContext(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if initiator, _ := storedCtx["initiator"].(string); initiator == "" || initiator != userID {
+		return nil, fmt.Errorf("无权访问该会话")
+	}
+	return storedCtx, nil
+}
+
+// ResumeToolCall 客户端重连后重新获取等待执行的工具调用
+// 返回与 client_executor_call 相同结构的数据，客户端执行后按原流程回传 client_executor_result
+func (s *SilicoIDInterceptor) ResumeToolCall(userID string, sessionID string) (map[string]interface{}, error) {
+	storedCtx, err := s.loadOwnedToolCallContext(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	calls := pendingToolCalls(storedCtx)
+	if len(calls) == 0 {
+		return nil, fmt.Errorf("会话中没有等待执行的工具调用")
+	}
+
+	logger.Printf("[%s] 用户 %s 恢复工具调用会话，待执行调用 %d 个", sessionID, userID, len(calls))
+	return map[string]interface{}{
+		"type":       "client_executor_call",
+		"calls":      calls,
+		"session_id": sessionID,
+		"expires_at": storedCtx["expires_at"],
+	}, nil
+}
+
+// CancelToolCall 客户端取消等待执行的工具调用，之后该会话的执行结果不再被处理
+func (s *SilicoIDInterceptor) CancelToolCall(userID string, sessionID string) error {
+	if _, err := s.loadOwnedToolCallContext(userID, sessionID); err != nil {
+		return err
+	}
+	s.closeToolCallContext(sessionID, userID, database.ToolSessionCancelled)
+	logger.Printf("[%s] 用户 %s 取消了工具调用会话", sessionID, userID)
+	return nil
+}
@@ -46,6 +46,9 @@ func (s *SilicoIDInterceptor) CreateWebSocketNonStreamResponse(ctx context.Conte
 		logger.Printf("[%s] ⚠️ 获取模型配置失败: %v", requestID, err)
 		return nil, fmt.Errorf("获取模型配置失败: %v", err)
 	}
+	if modelConfig.IsEmbedding() {
+		return nil, fmt.Errorf("模型 %s 是向量模型，请使用 /v1/embeddings 接口", modelName)
+	}
 
 	// 将获取到的配置存储到requestData中
 	modelCode := modelConfig.ModelCode
@@ -57,55 +60,41 @@ func (s *SilicoIDInterceptor) CreateWebSocketNonStreamResponse(ctx context.Conte
 	logger.Printf("[%s] ✅ 成功获取模型配置: model_code=%s, base_url=%s, endpoint=%s",
 		requestID, modelCode, baseURL, endpoint)
 
-	// 判断是否是 Claude 模型
-	isClaudeModel := s.isClaudeModel(modelName)
+	// 根据模型配置的提供商选择适配器
+	adapter := s.adapterForProvider(modelConfig.Provider)
 
-	logger.Printf("[%s] 📡 创建非流式响应，模型: %s, Claude模型: %v", requestID, modelName, isClaudeModel)
+	logger.Printf("[%s] 📡 创建非流式响应，模型: %s, 适配器: %s", requestID, modelName, adapter.Name())
 
 	// 保存原始的 role_name，防止被 formatConverter 删除
 	originalRoleName, _ := requestData["role_name"].(string)
 	logger.Printf("[%s] 📌 保存原始 role_name: %s", requestID, originalRoleName)
 
+	// 按 max_tokens 预占余额，拿到回复后按实际用量结算，提前返回时释放预占
+	billing := s.webSocketBillingContext(userID, apiKey, modelConfig, requestID)
+	if err := s.reserveTokens(billing, requestData); err != nil {
+		return nil, fmt.Errorf("用户资产不足: %v", err)
+	}
+	defer s.releaseReservation(billing)
+
 	// 为所有模型添加工具支持（包括MCP和客户端执行器工具）
 	if err := s.formatConverter.AddExecutorTools(requestData); err != nil {
 		logger.Printf("[%s] ⚠️ 添加执行器工具失败: %v", requestID, err)
 	}
 
-	var response map[string]interface{}
-
-	if isClaudeModel {
-		// 使用 Claude 服务
-		logger.Printf("[%s] 使用 Claude 服务处理非流式请求", requestID)
-
-		// 先将 OpenAI 格式转换为 Claude 格式
-		claudeData, err := s.formatConverter.RequestOpenAIToClaude(requestData)
-		if err != nil {
-			return nil, fmt.Errorf("格式转换失败: %v", err)
-		}
-
-		claudeResponse := s.claudeService.CreateChatCompletionNonStream(ctx, claudeData)
-
-		// 将 Claude 响应转换为 OpenAI 格式
-		response, err = s.formatConverter.ResponseClaudeToOpenAI(claudeResponse, requestData)
-		if err != nil {
-			return nil, fmt.Errorf("响应格式转换失败: %v", err)
-		}
-
-		// 统一的错误检测和日志记录
-		if checkAndLogResponseError(response, requestID, "Claude") {
-			return response, nil // 返回错误响应，让上层处理
-		}
-	} else {
-		// 使用 OpenAI 服务
-		logger.Printf("[%s] 使用 OpenAI 兼容服务处理非流式请求", requestID)
+	logger.Printf("[%s] 使用 %s 适配器处理非流式请求", requestID, adapter.Name())
 
-		// 直接传递请求数据，让 OpenAI 服务自己处理规范化
-		response = s.openaiService.CreateChatCompletionNonStream(ctx, requestData)
-
-		// 统一的错误检测和日志记录
-		if checkAndLogResponseError(response, requestID, "OpenAI") {
-			return response, nil // 返回错误响应，让上层处理
-		}
+	response, err := s.chatCompletionWithFallback(ctx, requestData, modelConfig, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("格式转换失败: %v", err)
+	}
+	// response_format 要求结构化输出时校验回复，不符合时带着校验错误重新生成
+	response = s.enforceStructuredOutput(ctx, requestData, response, modelConfig, requestID)
+	// 按实际提供服务的模型计费（同时移除内部计费字段）
+	s.deductTokensIfNeeded(response, billing)
+
+	// 统一的错误检测和日志记录
+	if checkAndLogResponseError(response, requestID, adapter.Name()) {
+		return response, nil // 返回错误响应，让上层处理
 	}
 	// 打印模型返回的原始非流式响应，便于排查格式/解析问题
 	if response != nil {
@@ -187,6 +176,9 @@ func (s *SilicoIDInterceptor) HandleWebSocketRequestNonStream(
 ) error {
 	logger.Printf("[%s] 处理AI聊天请求 (user=%s)", requestID, userID)
 
+	// 工具循环预算在第一次调用模型前创建（同时移除请求中的 max_tool_iterations 等字段）
+	s.toolLoopBudgetFor(requestData, requestID)
+
 	// 发起AI请求
 	response, err := s.CreateWebSocketNonStreamResponse(ctx, requestData, requestID)
 	if err != nil {
@@ -275,8 +267,8 @@ func (s *SilicoIDInterceptor) processWebSocketNonStreamResponse(
 			logger.Printf("[%s] 发现 %d 个服务器端执行器调用，使用结构化服务器端处理流程", requestID, len(serverCalls))
 
 			// 使用新的方法处理结构化的服务器调用
-			finalResponse, err := s.ProcessAIResponseWithStructuredServerCalls(
-				ctx, requestData, serverCalls, response, false, requestID, 5, false, "", nil, nil)
+			finalResponse, finishReason, err := s.ProcessAIResponseWithStructuredServerCalls(
+				ctx, requestData, serverCalls, response, false, requestID, false, "", nil, nil)
 
 			if err != nil {
 				logger.Printf("[%s] 结构化服务器端调用处理失败: %v", requestID, err)
@@ -287,9 +279,10 @@ func (s *SilicoIDInterceptor) processWebSocketNonStreamResponse(
 			logger.Printf("[%s] 结构化服务器端调用处理完成，发送最终回答", requestID)
 
 			finalData := map[string]interface{}{
-				"type":      "chat_complete",
-				"content":   finalResponse,
-				"timestamp": time.Now().Unix(),
+				"type":          "chat_complete",
+				"content":       finalResponse,
+				"finish_reason": finishReason,
+				"timestamp":     time.Now().Unix(),
 			}
 
 			if requestID != "" {
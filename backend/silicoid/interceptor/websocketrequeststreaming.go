@@ -6,6 +6,8 @@ import (
 	"strings"
 	"time"
 
+	"digitalsingularity/backend/silicoid/models/manager"
+
 	"github.com/google/uuid"
 )
 // CreateWebSocketStreamResponse 创建WebSocket流式 AI 响应
@@ -44,6 +46,9 @@ func (s *SilicoIDInterceptor) CreateWebSocketStreamResponse(
 		logger.Printf("[%s] ⚠️ 获取模型配置失败: %v", requestID, err)
 		return nil, "", fmt.Errorf("获取模型配置失败: %v", err)
 	}
+	if modelConfig.IsEmbedding() {
+		return nil, "", fmt.Errorf("模型 %s 是向量模型，请使用 /v1/embeddings 接口", modelName)
+	}
 	
 	// 将获取到的配置存储到requestData中
 	modelCode := modelConfig.ModelCode
@@ -55,39 +60,67 @@ func (s *SilicoIDInterceptor) CreateWebSocketStreamResponse(
 	logger.Printf("[%s] ✅ 成功获取模型配置: model_code=%s, base_url=%s, endpoint=%s", 
 		requestID, modelCode, baseURL, endpoint)
 	
-	// 判断是否是 Claude 模型
-	isClaudeModel := s.isClaudeModel(modelName)
+	// 根据模型配置的提供商选择适配器
+	adapter := s.adapterForProvider(modelConfig.Provider)
 	
-	logger.Printf("[%s] 📡 创建流式响应，模型: %s, Claude模型: %v", requestID, modelName, isClaudeModel)
+	logger.Printf("[%s] 📡 创建流式响应，模型: %s, 适配器: %s", requestID, modelName, adapter.Name())
 	
 	// 工具添加由 formatConverter 自动处理
 	
-	// 根据模型类型选择服务
-	var streamChan chan string
+	// 流式请求不执行服务端工具循环，工具循环限制字段不发送给模型
+	dropToolBudgetFields(requestData)
+
+	// 语义缓存按用户（或平台 Key）和角色隔离，命中近似问题时回放缓存的回复，不调用模型、不扣费
+	requestData, _ = s.processSemanticCache(requestData, userID, requestID)
+	semanticHit, semantic := takeSemanticCache(requestData)
+	if semanticHit != nil {
+		return cachedResponseStream(ctx, semanticHit, false), sessionID, nil
+	}
+	
+	// 按 max_tokens 预占余额，流结束时按实际用量结算，WebSocket 断开（ctx 取消）时释放
+	billing := s.webSocketBillingContext(userID, apiKey, modelConfig, requestID)
+	if err := s.reserveTokens(billing, requestData); err != nil {
+		return nil, "", fmt.Errorf("用户资产不足: %v", err)
+	}
+	requestStreamUsage(requestData, billing)
 	
-	if isClaudeModel {
-		// 使用 Claude 服务
-		logger.Printf("[%s] 使用 Claude 服务处理流式请求", requestID)
-		
-		// 先将 OpenAI 格式转换为 Claude 格式
-		claudeData, err := s.formatConverter.RequestOpenAIToClaude(requestData)
-		if err != nil {
-			return nil, "", fmt.Errorf("格式转换失败: %v", err)
-		}
-		
-		streamChan = s.claudeService.CreateChatCompletionStream(ctx, claudeData)
-	} else {
-		// 使用 OpenAI 服务（支持 DeepSeek、OpenAI 等兼容 OpenAI API 的模型）
-		logger.Printf("[%s] 使用 OpenAI 兼容服务处理流式请求", requestID)
-		
-		// 直接传递请求数据，让 OpenAI 服务自己处理规范化
-		streamChan = s.openaiService.CreateChatCompletionStream(ctx, requestData)
+	// 适配器负责请求格式转换，并统一返回 OpenAI 流式格式（输出内容前失败时按降级链重试）
+	streamChan, err := s.chatCompletionStreamWithFallback(ctx, requestData, modelConfig, requestID)
+	if err != nil {
+		s.releaseReservation(billing)
+		return nil, "", fmt.Errorf("格式转换失败: %v", err)
 	}
 	
 	// 包装流式响应 channel，检测并处理错误（特别是 401 认证错误）
 	wrappedChan := wrapStreamResponseWithErrorDetection(streamChan, modelName, requestID)
+	// response_format 要求结构化输出时在流结束时校验回复
+	if spec := structuredOutputFor(requestData); spec != nil {
+		wrappedChan = structuredOutputStream(ctx, wrappedChan, spec, requestID)
+	}
 	
-	return wrappedChan, sessionID, nil
+	return s.cacheStream(ctx, s.billStream(ctx, wrappedChan, billing), withSemanticCache(nil, semantic), requestID), sessionID, nil
+}
+
+// webSocketBillingContext 构造 WebSocket 请求的计费上下文
+// 与 checkUserAssets 一致：未提供 api_key 时按 user_id 计费，平台 Key 按其所属用户计费，用户自己的 Key 不计费
+func (s *SilicoIDInterceptor) webSocketBillingContext(userID string, apiKey string, modelConfig *manager.ModelConfig, requestID string) *billingContext {
+	billing := &billingContext{
+		RequestID: requestID,
+		UserID:    userID,
+		Model:     modelConfig,
+	}
+	if apiKey == "" {
+		return billing
+	}
+	if !strings.HasPrefix(apiKey, "sk-potagi-") {
+		billing.UseUserKey = true
+		return billing
+	}
+	if valid, id, keyID, _ := s.apiKeyManageService.VerifyApiKeyWithID(apiKey); valid {
+		billing.UserID = id
+		billing.APIKeyID = keyID
+	}
+	return billing
 }
 // HandleWebSocketRequestStream 处理所有模型的WebSocket流式请求
 // ProcessStreamChat 处理流式AI聊天（WebSocket接口）
@@ -98,6 +131,10 @@ func (s *SilicoIDInterceptor) ProcessStreamChat(ctx context.Context, requestID s
 func (s *SilicoIDInterceptor) HandleWebSocketRequestStream(ctx context.Context, requestID string, userID string, requestData map[string]interface{}, sendMessage func(messageType string, data map[string]interface{}) error, sendChunk func(chunk string) error) error {
 	logger.Printf("[%s] 处理流式AI聊天会话管理 (user=%s)", requestID, userID)
 
+	// WebSocket 断开或处理提前结束时取消上游请求，并释放余额预占
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// 发起流式AI请求
 	streamChan, sessionID, err := s.CreateWebSocketStreamResponse(ctx, requestData, requestID)
 	if err != nil {
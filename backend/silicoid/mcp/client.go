@@ -1,254 +1,681 @@
 package mcp
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+)
+
+const (
+	// requestTimeout 调用方没有设置截止时间时单个请求的超时时间
+	requestTimeout = 30 * time.Second
+	// maxListPages 列表分页的最大页数，防止服务器返回循环的 nextCursor
+	maxListPages = 100
+
+	clientName    = "digitalsingularity-silicoid"
+	clientVersion = "1.0.0"
 
-	"github.com/google/uuid"
+	// UserMetaKey tools/call 的 _meta 中发起调用的用户 id
+	UserMetaKey = "digitalsingularity/user_id"
 )
 
+type userIDContextKey struct{}
+
+// WithUserID 设置发起工具调用的用户，CallTool 通过 _meta 传给服务器
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDContextKey{}, userID)
+}
+
+// UserIDFromContext 取出发起工具调用的用户，没有时返回空字符串
+func UserIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDContextKey{}).(string)
+	return userID
+}
+
 // MCPServerConfig MCP服务器配置
 type MCPServerConfig struct {
-	Type               string `json:"type"`               // "url" 或 "sse"
-	URL                string `json:"url"`                // 服务器URL
-	Name               string `json:"name"`               // 服务器名称
+	Type               string `json:"type"`                          // "url"（Streamable HTTP）、"sse"（旧版 HTTP+SSE）或 "stdio"（本地子进程）
+	URL                string `json:"url"`                           // 服务器URL
+	Name               string `json:"name"`                          // 服务器名称
 	AuthorizationToken string `json:"authorization_token,omitempty"` // 认证令牌
-	Description        string `json:"description,omitempty"`          // 描述
+	Description        string `json:"description,omitempty"`         // 描述
+	FirstParty         bool   `json:"first_party,omitempty"`         // 自有服务器：工具调用时通过 _meta 传递发起调用的用户
+
+	// stdio 类型：启动的命令、参数和额外的环境变量（在当前进程的环境变量基础上追加）
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
 }
 
 // MCPTool MCP工具定义
 type MCPTool struct {
-	Name        string                 `json:"name"`
-	Description string                 `json:"description"`
-	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Name         string                 `json:"name"`
+	Title        string                 `json:"title,omitempty"`
+	Description  string                 `json:"description"`
+	Parameters   map[string]interface{} `json:"inputSchema,omitempty"` // 输入参数的 JSON Schema
+	OutputSchema map[string]interface{} `json:"outputSchema,omitempty"`
+	Annotations  map[string]interface{} `json:"annotations,omitempty"`
+}
+
+// MCPToolCall MCP工具调用
+type MCPToolCall struct {
+	Name      string                 `json:"name"`
+	Arguments map[string]interface{} `json:"arguments"`
+}
+
+// MCPContent 工具结果或提示词消息中的一段内容（text / image / audio / resource / resource_link）
+type MCPContent struct {
+	Type     string            `json:"type"`
+	Text     string            `json:"text,omitempty"`
+	Data     string            `json:"data,omitempty"` // 图片、音频的 base64 数据
+	MimeType string            `json:"mimeType,omitempty"`
+	URI      string            `json:"uri,omitempty"`  // resource_link
+	Name     string            `json:"name,omitempty"` // resource_link
+	Resource *ResourceContents `json:"resource,omitempty"`
+}
+
+// CallToolResult 工具调用结果
+type CallToolResult struct {
+	Content           []MCPContent `json:"content"`
+	StructuredContent interface{}  `json:"structuredContent,omitempty"`
+	IsError           bool         `json:"isError,omitempty"`
+}
+
+// Text 将结果转换为文本（供模型阅读），非文本内容以占位说明代替
+func (r *CallToolResult) Text() string {
+	var parts []string
+	for _, content := range r.Content {
+		switch content.Type {
+		case "text":
+			parts = append(parts, content.Text)
+		case "resource":
+			if content.Resource != nil && content.Resource.Text != "" {
+				parts = append(parts, content.Resource.Text)
+			} else if content.Resource != nil {
+				parts = append(parts, fmt.Sprintf("[资源: %s]", content.Resource.URI))
+			}
+		case "resource_link":
+			parts = append(parts, fmt.Sprintf("[资源链接: %s %s]", content.Name, content.URI))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s: %s]", content.Type, content.MimeType))
+		}
+	}
+	if len(parts) == 0 && r.StructuredContent != nil {
+		if data, err := json.Marshal(r.StructuredContent); err == nil {
+			return string(data)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// MCPResource 资源
+type MCPResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+// MCPResourceTemplate 参数化资源的 URI 模板
+type MCPResourceTemplate struct {
+	URITemplate string `json:"uriTemplate"`
+	Name        string `json:"name"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+// ResourceContents 资源内容（文本资源为 Text，二进制资源为 base64 的 Blob）
+type ResourceContents struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Blob     string `json:"blob,omitempty"`
+}
+
+// MCPPrompt 提示词模板
+type MCPPrompt struct {
+	Name        string           `json:"name"`
+	Title       string           `json:"title,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Arguments   []PromptArgument `json:"arguments,omitempty"`
+}
+
+// PromptArgument 提示词模板的参数
+type PromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// PromptMessage 提示词展开后的一条消息
+type PromptMessage struct {
+	Role    string     `json:"role"`
+	Content MCPContent `json:"content"`
+}
+
+// GetPromptResult 提示词展开结果
+type GetPromptResult struct {
+	Description string          `json:"description,omitempty"`
+	Messages    []PromptMessage `json:"messages"`
+}
+
+// ImplementationInfo 客户端或服务器的名称和版本
+type ImplementationInfo struct {
+	Name    string `json:"name"`
+	Title   string `json:"title,omitempty"`
+	Version string `json:"version"`
+}
+
+// ListChangedCapability 支持列表变更通知的能力
+type ListChangedCapability struct {
+	ListChanged bool `json:"listChanged,omitempty"`
 }
 
-// MCPClient MCP客户端
+// ResourcesCapability 资源能力
+type ResourcesCapability struct {
+	Subscribe   bool `json:"subscribe,omitempty"`
+	ListChanged bool `json:"listChanged,omitempty"`
+}
+
+// ServerCapabilities initialize 时服务器声明的能力，未声明的功能不会调用
+type ServerCapabilities struct {
+	Tools     *ListChangedCapability `json:"tools,omitempty"`
+	Resources *ResourcesCapability   `json:"resources,omitempty"`
+	Prompts   *ListChangedCapability `json:"prompts,omitempty"`
+	Logging   map[string]interface{} `json:"logging,omitempty"`
+}
+
+// InitializeResult initialize 的结果
+type InitializeResult struct {
+	ProtocolVersion string             `json:"protocolVersion"`
+	Capabilities    ServerCapabilities `json:"capabilities"`
+	ServerInfo      ImplementationInfo `json:"serverInfo"`
+	Instructions    string             `json:"instructions,omitempty"`
+}
+
+// MCPClient MCP客户端（JSON-RPC 2.0），第一次调用时自动完成 initialize 握手，会话失效后自动重新初始化
 type MCPClient struct {
-	config     *MCPServerConfig
-	httpClient *http.Client
-	logger     *log.Logger
+	config       *MCPServerConfig
+	transport    Transport
+	transportErr error
+	logger       *log.Logger
+	nextID       int64
+
+	pendingMutex sync.Mutex
+	pending      map[string]chan *JSONRPCMessage
+
+	initMutex   sync.Mutex
+	initialized bool
+	initResult  *InitializeResult
+
+	toolsMutex sync.RWMutex
+	tools      []*MCPTool // tools/list 的缓存，收到 notifications/tools/list_changed 后清空
 }
 
 // NewMCPClient 创建MCP客户端
 func NewMCPClient(config *MCPServerConfig) *MCPClient {
+	logger := log.New(log.Writer(), "[MCP-Client] ", log.LstdFlags)
+	transport, err := newTransport(config, logger)
 	return &MCPClient{
-		config: config,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-		logger: log.New(log.Writer(), "[MCP-Client] ", log.LstdFlags),
+		config:       config,
+		transport:    transport,
+		transportErr: err,
+		logger:       logger,
+		pending:      make(map[string]chan *JSONRPCMessage),
 	}
 }
 
-// MCPRequest MCP请求结构
-type MCPRequest struct {
-	ID      string      `json:"id"`
-	Method  string      `json:"method"`
-	Params  interface{} `json:"params,omitempty"`
+// Initialize 建立连接并完成 initialize 握手（已初始化时直接返回）
+func (c *MCPClient) Initialize(ctx context.Context) error {
+	c.initMutex.Lock()
+	defer c.initMutex.Unlock()
+
+	if c.initialized {
+		return nil
+	}
+	if c.transportErr != nil {
+		return c.transportErr
+	}
+	if err := c.transport.Start(ctx, c.handleMessage); err != nil {
+		return fmt.Errorf("连接MCP服务器 %s 失败: %v", c.config.Name, err)
+	}
+
+	params := map[string]interface{}{
+		"protocolVersion": LatestProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      ImplementationInfo{Name: clientName, Version: clientVersion},
+	}
+	var result InitializeResult
+	if err := c.request(ctx, "initialize", params, &result); err != nil {
+		c.transport.Reset()
+		return fmt.Errorf("MCP服务器 %s 初始化失败: %v", c.config.Name, err)
+	}
+	if !isSupportedProtocolVersion(result.ProtocolVersion) {
+		c.transport.Reset()
+		return fmt.Errorf("MCP服务器 %s 使用不支持的协议版本: %s", c.config.Name, result.ProtocolVersion)
+	}
+
+	c.transport.SetProtocolVersion(result.ProtocolVersion)
+	if err := c.notify(ctx, "notifications/initialized", nil); err != nil {
+		c.transport.Reset()
+		return fmt.Errorf("MCP服务器 %s 初始化失败: %v", c.config.Name, err)
+	}
+
+	c.initResult = &result
+	c.initialized = true
+	c.logger.Printf("✅ 已连接MCP服务器 %s (%s %s, 协议版本 %s)",
+		c.config.Name, result.ServerInfo.Name, result.ServerInfo.Version, result.ProtocolVersion)
+	return nil
 }
 
-// MCPResponse MCP响应结构
-type MCPResponse struct {
-	ID     string      `json:"id"`
-	Result interface{} `json:"result,omitempty"`
-	Error  *MCPError   `json:"error,omitempty"`
+// isSupportedProtocolVersion 是否为客户端支持的协议版本
+func isSupportedProtocolVersion(version string) bool {
+	for _, supported := range SupportedProtocolVersions {
+		if version == supported {
+			return true
+		}
+	}
+	return false
 }
 
-// MCPError MCP错误结构
-type MCPError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+// ServerInfo 返回 initialize 的结果（未初始化时返回 nil）
+func (c *MCPClient) ServerInfo() *InitializeResult {
+	c.initMutex.Lock()
+	defer c.initMutex.Unlock()
+	return c.initResult
 }
 
-// MCPToolCall MCP工具调用
-type MCPToolCall struct {
-	Name      string                 `json:"name"`
-	Arguments map[string]interface{} `json:"arguments"`
+// reset 丢弃当前会话，下次调用时重新初始化
+func (c *MCPClient) reset() {
+	c.initMutex.Lock()
+	defer c.initMutex.Unlock()
+	c.transport.Reset()
+	c.initialized = false
+	c.initResult = nil
+	c.clearToolsCache()
 }
 
-// ConnectSSE 连接到SSE服务器并监听消息
-func (c *MCPClient) ConnectSSE(ctx context.Context) (<-chan *MCPResponse, <-chan error, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", c.config.URL, nil)
-	if err != nil {
-		return nil, nil, fmt.Errorf("创建SSE请求失败: %v", err)
+// Close 结束会话并断开连接（stdio 服务器的进程会被关闭）
+func (c *MCPClient) Close() error {
+	c.initMutex.Lock()
+	defer c.initMutex.Unlock()
+	c.initialized = false
+	c.initResult = nil
+	if c.transport == nil {
+		return nil
+	}
+	return c.transport.Close()
+}
+
+// call 在已初始化的会话上发送请求，会话失效时重新初始化并重试一次
+func (c *MCPClient) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	if err := c.Initialize(ctx); err != nil {
+		return err
 	}
+	err := c.request(ctx, method, params, result)
+	if errors.Is(err, ErrSessionExpired) {
+		c.logger.Printf("MCP服务器 %s 会话已失效，重新初始化", c.config.Name)
+		c.reset()
+		if err := c.Initialize(ctx); err != nil {
+			return err
+		}
+		err = c.request(ctx, method, params, result)
+	}
+	return err
+}
 
-	// 设置认证头
-	if c.config.AuthorizationToken != "" {
-		req.Header.Set("Authorization", "Bearer "+c.config.AuthorizationToken)
+// request 发送请求并等待响应
+func (c *MCPClient) request(ctx context.Context, method string, params interface{}, result interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
 	}
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("Cache-Control", "no-cache")
 
-	resp, err := c.httpClient.Do(req)
+	id := atomic.AddInt64(&c.nextID, 1)
+	msg, err := NewRequest(id, method, params)
 	if err != nil {
-		return nil, nil, fmt.Errorf("连接SSE失败: %v", err)
+		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, nil, fmt.Errorf("SSE连接失败, 状态码: %d", resp.StatusCode)
+	responseChan := make(chan *JSONRPCMessage, 1)
+	c.pendingMutex.Lock()
+	c.pending[msg.IDKey()] = responseChan
+	c.pendingMutex.Unlock()
+	defer func() {
+		c.pendingMutex.Lock()
+		delete(c.pending, msg.IDKey())
+		c.pendingMutex.Unlock()
+	}()
+
+	if err := c.transport.Send(ctx, msg); err != nil {
+		if ctx.Err() != nil {
+			c.cancelRequest(id, ctx.Err())
+		}
+		return err
 	}
 
-	responseChan := make(chan *MCPResponse, 10)
-	errorChan := make(chan error, 10)
+	select {
+	case response := <-responseChan:
+		if response.Error != nil {
+			return response.Error
+		}
+		if result != nil && len(response.Result) > 0 {
+			if err := json.Unmarshal(response.Result, result); err != nil {
+				return fmt.Errorf("解析 %s 响应失败: %v", method, err)
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		c.cancelRequest(id, ctx.Err())
+		return fmt.Errorf("等待 %s 响应失败: %v", method, ctx.Err())
+	}
+}
 
+// cancelRequest 通知服务器放弃已超时或被取消的请求
+func (c *MCPClient) cancelRequest(id int64, reason error) {
 	go func() {
-		defer resp.Body.Close()
-		defer close(responseChan)
-		defer close(errorChan)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.notify(ctx, "notifications/cancelled", map[string]interface{}{
+			"requestId": id,
+			"reason":    reason.Error(),
+		})
+	}()
+}
 
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
+// notify 发送通知
+func (c *MCPClient) notify(ctx context.Context, method string, params interface{}) error {
+	msg, err := NewNotification(method, params)
+	if err != nil {
+		return err
+	}
+	return c.transport.Send(ctx, msg)
+}
+
+// handleMessage 处理服务器发来的消息：响应交给等待中的请求，通知记录日志或刷新缓存，请求（ping）直接回复
+func (c *MCPClient) handleMessage(msg *JSONRPCMessage) {
+	switch {
+	case msg.IsResponse():
+		c.pendingMutex.Lock()
+		responseChan, ok := c.pending[msg.IDKey()]
+		c.pendingMutex.Unlock()
+		if ok {
 			select {
-			case <-ctx.Done():
-				return
+			case responseChan <- msg:
 			default:
-				line := strings.TrimSpace(scanner.Text())
-				if strings.HasPrefix(line, "data: ") {
-					data := strings.TrimPrefix(line, "data: ")
-					if data == "" {
-						continue
-					}
-
-					var response MCPResponse
-					if err := json.Unmarshal([]byte(data), &response); err != nil {
-						errorChan <- fmt.Errorf("解析SSE数据失败: %v, 数据: %s", err, data)
-						continue
-					}
-
-					select {
-					case responseChan <- &response:
-					case <-ctx.Done():
-						return
-					}
-				}
 			}
 		}
+	case msg.IsNotification():
+		c.handleNotification(msg)
+	case msg.IsRequest():
+		go c.respond(msg)
+	}
+}
 
-		if err := scanner.Err(); err != nil {
-			errorChan <- fmt.Errorf("SSE扫描错误: %v", err)
+// handleNotification 处理服务器通知
+func (c *MCPClient) handleNotification(msg *JSONRPCMessage) {
+	switch msg.Method {
+	case "notifications/tools/list_changed":
+		c.clearToolsCache()
+		c.logger.Printf("MCP服务器 %s 的工具列表已变更", c.config.Name)
+	case "notifications/message":
+		var params struct {
+			Level  string      `json:"level"`
+			Logger string      `json:"logger"`
+			Data   interface{} `json:"data"`
 		}
-	}()
-
-	return responseChan, errorChan, nil
+		json.Unmarshal(msg.Params, &params)
+		c.logger.Printf("[%s] %s %s: %v", c.config.Name, params.Level, params.Logger, params.Data)
+	default:
+		c.logger.Printf("[%s] 收到通知 %s: %s", c.config.Name, msg.Method, string(msg.Params))
+	}
 }
 
-// CallTool 调用MCP工具
-func (c *MCPClient) CallTool(ctx context.Context, toolCall *MCPToolCall) (interface{}, error) {
-	request := MCPRequest{
-		ID:     uuid.New().String(),
-		Method: "tools/call",
-		Params: map[string]interface{}{
-			"name":      toolCall.Name,
-			"arguments": toolCall.Arguments,
-		},
+// respond 回复服务器发来的请求，目前只支持 ping
+func (c *MCPClient) respond(msg *JSONRPCMessage) {
+	var response *JSONRPCMessage
+	if msg.Method == "ping" {
+		response, _ = NewResultResponse(msg.ID, map[string]interface{}{})
+	} else {
+		response = NewErrorResponse(msg.ID, ErrCodeMethodNotFound, fmt.Sprintf("不支持的方法: %s", msg.Method))
 	}
 
-	return c.sendRequest(ctx, &request)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := c.transport.Send(ctx, response); err != nil {
+		c.logger.Printf("⚠️ 回复MCP服务器 %s 的 %s 请求失败: %v", c.config.Name, msg.Method, err)
+	}
 }
 
-// ListTools 获取可用工具列表
-func (c *MCPClient) ListTools(ctx context.Context) ([]*MCPTool, error) {
-	request := MCPRequest{
-		ID:     uuid.New().String(),
-		Method: "tools/list",
+// requireCapability 检查服务器是否声明了某项能力
+func (c *MCPClient) requireCapability(ctx context.Context, name string) error {
+	if err := c.Initialize(ctx); err != nil {
+		return err
 	}
-
-	result, err := c.sendRequest(ctx, &request)
-	if err != nil {
-		return nil, err
+	info := c.ServerInfo()
+	if info == nil {
+		return fmt.Errorf("MCP服务器 %s 未初始化", c.config.Name)
 	}
-
-	// 解析工具列表
-	toolsData, ok := result.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("无效的工具列表响应")
+	supported := false
+	switch name {
+	case "tools":
+		supported = info.Capabilities.Tools != nil
+	case "resources":
+		supported = info.Capabilities.Resources != nil
+	case "prompts":
+		supported = info.Capabilities.Prompts != nil
 	}
-
-	tools, ok := toolsData["tools"].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("响应中没有tools字段")
+	if !supported {
+		return fmt.Errorf("MCP服务器 %s 不支持 %s", c.config.Name, name)
 	}
+	return nil
+}
 
-	var mcpTools []*MCPTool
-	for _, tool := range tools {
-		toolMap, ok := tool.(map[string]interface{})
-		if !ok {
-			continue
+// listAll 按 nextCursor 读取分页列表的所有页，每页的 field 字段交给 each 解析
+func (c *MCPClient) listAll(ctx context.Context, method string, field string, each func(items json.RawMessage) error) error {
+	cursor := ""
+	for page := 0; page < maxListPages; page++ {
+		var params interface{}
+		if cursor != "" {
+			params = map[string]interface{}{"cursor": cursor}
 		}
-
-		name, _ := toolMap["name"].(string)
-		description, _ := toolMap["description"].(string)
-
-		mcpTool := &MCPTool{
-			Name:        name,
-			Description: description,
+		var result map[string]json.RawMessage
+		if err := c.call(ctx, method, params, &result); err != nil {
+			return err
+		}
+		if items, ok := result[field]; ok {
+			if err := each(items); err != nil {
+				return fmt.Errorf("解析 %s 响应失败: %v", method, err)
+			}
 		}
 
-		if inputSchema, ok := toolMap["inputSchema"].(map[string]interface{}); ok {
-			mcpTool.Parameters = inputSchema
+		cursor = ""
+		if next, ok := result["nextCursor"]; ok {
+			json.Unmarshal(next, &cursor)
+		}
+		if cursor == "" {
+			return nil
 		}
+	}
+	return fmt.Errorf("%s 超过 %d 页", method, maxListPages)
+}
 
-		mcpTools = append(mcpTools, mcpTool)
+// Ping 检查服务器是否可用
+func (c *MCPClient) Ping(ctx context.Context) error {
+	return c.call(ctx, "ping", nil, nil)
+}
+
+// ListTools 获取可用工具列表（读取所有分页，结果缓存到工具列表变更为止）
+func (c *MCPClient) ListTools(ctx context.Context) ([]*MCPTool, error) {
+	c.toolsMutex.RLock()
+	cached := c.tools
+	c.toolsMutex.RUnlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	if err := c.requireCapability(ctx, "tools"); err != nil {
+		return nil, err
+	}
+	mcpTools := []*MCPTool{}
+	err := c.listAll(ctx, "tools/list", "tools", func(items json.RawMessage) error {
+		var page []*MCPTool
+		if err := json.Unmarshal(items, &page); err != nil {
+			return err
+		}
+		mcpTools = append(mcpTools, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	c.toolsMutex.Lock()
+	c.tools = mcpTools
+	c.toolsMutex.Unlock()
 	return mcpTools, nil
 }
 
-// sendRequest 发送HTTP请求到MCP服务器
-func (c *MCPClient) sendRequest(ctx context.Context, request *MCPRequest) (interface{}, error) {
-	jsonData, err := json.Marshal(request)
+// clearToolsCache 清空工具列表缓存
+func (c *MCPClient) clearToolsCache() {
+	c.toolsMutex.Lock()
+	c.tools = nil
+	c.toolsMutex.Unlock()
+}
+
+// HasTool 服务器是否提供指定名称的工具
+func (c *MCPClient) HasTool(ctx context.Context, name string) bool {
+	tools, err := c.ListTools(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("序列化请求失败: %v", err)
+		return false
+	}
+	for _, tool := range tools {
+		if tool.Name == name {
+			return true
+		}
 	}
+	return false
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", c.config.URL, bytes.NewBuffer(jsonData))
+// CallTool 调用MCP工具
+func (c *MCPClient) CallTool(ctx context.Context, toolCall *MCPToolCall) (*CallToolResult, error) {
+	arguments := toolCall.Arguments
+	if arguments == nil {
+		arguments = map[string]interface{}{}
+	}
+	params := map[string]interface{}{
+		"name":      toolCall.Name,
+		"arguments": arguments,
+	}
+	if userID := UserIDFromContext(ctx); userID != "" {
+		params["_meta"] = map[string]interface{}{UserMetaKey: userID}
+	}
+	var result CallToolResult
+	err := c.call(ctx, "tools/call", params, &result)
 	if err != nil {
-		return nil, fmt.Errorf("创建HTTP请求失败: %v", err)
+		return nil, err
 	}
+	return &result, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	if c.config.AuthorizationToken != "" {
-		req.Header.Set("Authorization", "Bearer "+c.config.AuthorizationToken)
+// ListResources 获取资源列表
+func (c *MCPClient) ListResources(ctx context.Context) ([]*MCPResource, error) {
+	if err := c.requireCapability(ctx, "resources"); err != nil {
+		return nil, err
 	}
-
-	resp, err := c.httpClient.Do(req)
+	resources := []*MCPResource{}
+	err := c.listAll(ctx, "resources/list", "resources", func(items json.RawMessage) error {
+		var page []*MCPResource
+		if err := json.Unmarshal(items, &page); err != nil {
+			return err
+		}
+		resources = append(resources, page...)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("发送请求失败: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return resources, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("请求失败, 状态码: %d, 响应: %s", resp.StatusCode, string(body))
+// ListResourceTemplates 获取资源模板列表
+func (c *MCPClient) ListResourceTemplates(ctx context.Context) ([]*MCPResourceTemplate, error) {
+	if err := c.requireCapability(ctx, "resources"); err != nil {
+		return nil, err
 	}
-
-	body, err := io.ReadAll(resp.Body)
+	templates := []*MCPResourceTemplate{}
+	err := c.listAll(ctx, "resources/templates/list", "resourceTemplates", func(items json.RawMessage) error {
+		var page []*MCPResourceTemplate
+		if err := json.Unmarshal(items, &page); err != nil {
+			return err
+		}
+		templates = append(templates, page...)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("读取响应失败: %v", err)
+		return nil, err
 	}
+	return templates, nil
+}
 
-	var response MCPResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("解析响应失败: %v, 响应: %s", err, string(body))
+// ReadResource 读取资源内容
+func (c *MCPClient) ReadResource(ctx context.Context, uri string) ([]ResourceContents, error) {
+	if err := c.requireCapability(ctx, "resources"); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Contents []ResourceContents `json:"contents"`
+	}
+	if err := c.call(ctx, "resources/read", map[string]interface{}{"uri": uri}, &result); err != nil {
+		return nil, err
 	}
+	return result.Contents, nil
+}
 
-	if response.Error != nil {
-		return nil, fmt.Errorf("MCP错误: %s (代码: %d)", response.Error.Message, response.Error.Code)
+// ListPrompts 获取提示词模板列表
+func (c *MCPClient) ListPrompts(ctx context.Context) ([]*MCPPrompt, error) {
+	if err := c.requireCapability(ctx, "prompts"); err != nil {
+		return nil, err
+	}
+	prompts := []*MCPPrompt{}
+	err := c.listAll(ctx, "prompts/list", "prompts", func(items json.RawMessage) error {
+		var page []*MCPPrompt
+		if err := json.Unmarshal(items, &page); err != nil {
+			return err
+		}
+		prompts = append(prompts, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return prompts, nil
+}
 
-	return response.Result, nil
+// GetPrompt 按参数展开提示词模板
+func (c *MCPClient) GetPrompt(ctx context.Context, name string, arguments map[string]string) (*GetPromptResult, error) {
+	if err := c.requireCapability(ctx, "prompts"); err != nil {
+		return nil, err
+	}
+	params := map[string]interface{}{"name": name}
+	if len(arguments) > 0 {
+		params["arguments"] = arguments
+	}
+	var result GetPromptResult
+	if err := c.call(ctx, "prompts/get", params, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
 }
 
 // MCPClientManager MCP客户端管理器
@@ -277,18 +704,24 @@ func (m *MCPClientManager) GetClient(serverName string, config *MCPServerConfig)
 
 	client := NewMCPClient(config)
 	m.clients[serverName] = client
-	m.logger.Printf("创建MCP客户端: %s -> %s", serverName, config.URL)
+	target := config.URL
+	if config.Type == "stdio" {
+		target = strings.TrimSpace(config.Command + " " + strings.Join(config.Args, " "))
+	}
+	m.logger.Printf("创建MCP客户端: %s -> %s", serverName, target)
 
 	return client
 }
 
-// RemoveClient 移除客户端
+// RemoveClient 移除客户端并结束其会话（stdio 服务器的进程会被关闭）
 func (m *MCPClientManager) RemoveClient(serverName string) {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	client, exists := m.clients[serverName]
+	delete(m.clients, serverName)
+	m.mutex.Unlock()
 
-	if _, exists := m.clients[serverName]; exists {
-		delete(m.clients, serverName)
+	if exists {
+		client.Close()
 		m.logger.Printf("移除MCP客户端: %s", serverName)
 	}
 }
@@ -0,0 +1,136 @@
+package mcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MCP 协议版本（initialize 时协商，优先使用最新版本）
+const (
+	JSONRPCVersion        = "2.0"
+	LatestProtocolVersion = "2025-06-18"
+)
+
+// SupportedProtocolVersions 客户端支持的协议版本，服务器返回其他版本时断开
+var SupportedProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+// JSON-RPC 2.0 标准错误码
+const (
+	ErrCodeParseError     = -32700
+	ErrCodeInvalidRequest = -32600
+	ErrCodeMethodNotFound = -32601
+	ErrCodeInvalidParams  = -32602
+	ErrCodeInternalError  = -32603
+)
+
+// JSONRPCMessage 一条 JSON-RPC 2.0 消息：请求（有 id 和 method）、通知（只有 method）或响应（有 id 和 result/error）
+type JSONRPCMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *MCPError       `json:"error,omitempty"`
+}
+
+// MCPError JSON-RPC 错误对象
+type MCPError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Error 实现 error 接口
+func (e *MCPError) Error() string {
+	return fmt.Sprintf("MCP错误: %s (代码: %d)", e.Message, e.Code)
+}
+
+// NewRequest 创建请求消息
+func NewRequest(id int64, method string, params interface{}) (*JSONRPCMessage, error) {
+	msg := &JSONRPCMessage{
+		JSONRPC: JSONRPCVersion,
+		ID:      json.RawMessage(strconv.FormatInt(id, 10)),
+		Method:  method,
+	}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, fmt.Errorf("序列化请求参数失败: %v", err)
+		}
+		msg.Params = data
+	}
+	return msg, nil
+}
+
+// NewNotification 创建通知消息（没有 id，不需要响应）
+func NewNotification(method string, params interface{}) (*JSONRPCMessage, error) {
+	msg, err := NewRequest(0, method, params)
+	if err != nil {
+		return nil, err
+	}
+	msg.ID = nil
+	return msg, nil
+}
+
+// NewResultResponse 创建成功响应
+func NewResultResponse(id json.RawMessage, result interface{}) (*JSONRPCMessage, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("序列化响应结果失败: %v", err)
+	}
+	return &JSONRPCMessage{JSONRPC: JSONRPCVersion, ID: id, Result: data}, nil
+}
+
+// NewErrorResponse 创建错误响应
+func NewErrorResponse(id json.RawMessage, code int, message string) *JSONRPCMessage {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &JSONRPCMessage{
+		JSONRPC: JSONRPCVersion,
+		ID:      id,
+		Error:   &MCPError{Code: code, Message: message},
+	}
+}
+
+// IsRequest 是否为请求
+func (m *JSONRPCMessage) IsRequest() bool {
+	return m.Method != "" && len(m.ID) > 0
+}
+
+// IsNotification 是否为通知
+func (m *JSONRPCMessage) IsNotification() bool {
+	return m.Method != "" && len(m.ID) == 0
+}
+
+// IsResponse 是否为响应
+func (m *JSONRPCMessage) IsResponse() bool {
+	return m.Method == "" && len(m.ID) > 0
+}
+
+// IDKey 消息 id 的规范化字符串，用于匹配请求和响应（数字和字符串形式的 id 视为相同）
+func (m *JSONRPCMessage) IDKey() string {
+	return strings.Trim(strings.TrimSpace(string(m.ID)), `"`)
+}
+
+// decodeMessages 解析一条或一批（数组）JSON-RPC 消息
+func decodeMessages(data []byte) ([]*JSONRPCMessage, error) {
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[0] == '[' {
+		var batch []*JSONRPCMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return nil, fmt.Errorf("解析JSON-RPC消息失败: %v", err)
+		}
+		return batch, nil
+	}
+	var msg JSONRPCMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("解析JSON-RPC消息失败: %v", err)
+	}
+	return []*JSONRPCMessage{&msg}, nil
+}
@@ -0,0 +1,473 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSessionExpired 服务器不再识别当前会话（或连接已断开），需要重新 initialize
+var ErrSessionExpired = errors.New("MCP会话已失效")
+
+const (
+	// sessionIDHeader Streamable HTTP 的会话 ID 头
+	sessionIDHeader = "Mcp-Session-Id"
+	// protocolVersionHeader 初始化后每个请求携带的协议版本头
+	protocolVersionHeader = "MCP-Protocol-Version"
+	// endpointTimeout 旧版 SSE 传输等待 endpoint 事件的时间
+	endpointTimeout = 10 * time.Second
+	// listenRetryDelay 服务器推送流断开后重连的间隔
+	listenRetryDelay = 5 * time.Second
+)
+
+// Transport MCP 消息的传输层
+// 收到的所有消息（请求的响应、服务器的通知和请求）都交给 Start 时传入的 handler 处理
+type Transport interface {
+	// Start 建立连接，可在 Close 之后再次调用重新连接
+	Start(ctx context.Context, handler func(*JSONRPCMessage)) error
+	// Send 发送一条消息
+	Send(ctx context.Context, msg *JSONRPCMessage) error
+	// SetProtocolVersion 初始化完成后设置协商的协议版本
+	SetProtocolVersion(version string)
+	// Reset 丢弃当前会话（会话失效或初始化失败时调用），之后重新 Start；可复用的连接（如 stdio 进程）保持不变
+	Reset()
+	// Close 关闭连接并结束会话
+	Close() error
+}
+
+// newTransport 按服务器配置的类型创建传输层
+func newTransport(config *MCPServerConfig, logger *log.Logger) (Transport, error) {
+	switch config.Type {
+	case "", "url", "http", "streamable_http":
+		return &streamableHTTPTransport{config: config, httpClient: &http.Client{}, logger: logger}, nil
+	case "sse":
+		return &sseTransport{config: config, httpClient: &http.Client{}, logger: logger}, nil
+	case "stdio":
+		if config.Command == "" {
+			return nil, fmt.Errorf("stdio 类型的MCP服务器 %s 缺少 command", config.Name)
+		}
+		return &stdioTransport{config: config, logger: logger}, nil
+	default:
+		return nil, fmt.Errorf("不支持的MCP服务器类型: %s", config.Type)
+	}
+}
+
+// sseEvent 一个 Server-Sent Events 事件
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readSSE 逐个读取 SSE 事件，onEvent 返回 false 时停止读取
+func readSSE(r io.Reader, onEvent func(*sseEvent) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	event := &sseEvent{}
+	var data []string
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			if len(data) > 0 || event.Event != "" {
+				event.Data = strings.Join(data, "\n")
+				if !onEvent(event) {
+					return nil
+				}
+			}
+			event = &sseEvent{}
+			data = nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			event.ID = value
+		}
+	}
+	return scanner.Err()
+}
+
+// setAuthorization 设置认证头
+func setAuthorization(req *http.Request, config *MCPServerConfig) {
+	if config.AuthorizationToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.AuthorizationToken)
+	}
+}
+
+// streamableHTTPTransport Streamable HTTP 传输：每条消息 POST 到同一个端点，
+// 响应为 application/json 或 text/event-stream，会话由 Mcp-Session-Id 头标识
+type streamableHTTPTransport struct {
+	config     *MCPServerConfig
+	httpClient *http.Client
+	logger     *log.Logger
+	handler    func(*JSONRPCMessage)
+
+	mutex           sync.RWMutex
+	sessionID       string
+	protocolVersion string
+	listenCancel    context.CancelFunc
+}
+
+// Start Streamable HTTP 不需要预先建立连接
+func (t *streamableHTTPTransport) Start(ctx context.Context, handler func(*JSONRPCMessage)) error {
+	t.handler = handler
+	return nil
+}
+
+// SetProtocolVersion 记录协议版本，并打开接收服务器主动推送消息的 GET 流
+func (t *streamableHTTPTransport) SetProtocolVersion(version string) {
+	t.mutex.Lock()
+	t.protocolVersion = version
+	if t.listenCancel != nil {
+		t.listenCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.listenCancel = cancel
+	t.mutex.Unlock()
+
+	go t.listen(ctx)
+}
+
+// setHeaders 设置会话相关的请求头
+func (t *streamableHTTPTransport) setHeaders(req *http.Request) {
+	setAuthorization(req, t.config)
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.sessionID != "" {
+		req.Header.Set(sessionIDHeader, t.sessionID)
+	}
+	if t.protocolVersion != "" {
+		req.Header.Set(protocolVersionHeader, t.protocolVersion)
+	}
+}
+
+// Send POST 一条消息，请求的响应（以及同一个流中的通知）交给 handler
+func (t *streamableHTTPTransport) Send(ctx context.Context, msg *JSONRPCMessage) error {
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("序列化请求失败: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.config.URL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("创建HTTP请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	t.setHeaders(req)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("发送请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if sessionID := resp.Header.Get(sessionIDHeader); sessionID != "" {
+		t.mutex.Lock()
+		t.sessionID = sessionID
+		t.mutex.Unlock()
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return nil
+	case resp.StatusCode == http.StatusNotFound && t.hasSession():
+		t.clearSession()
+		return ErrSessionExpired
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("请求失败, 状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+
+	if !msg.IsRequest() {
+		return nil
+	}
+
+	received := false
+	deliver := func(data []byte) bool {
+		messages, err := decodeMessages(data)
+		if err != nil {
+			t.logger.Printf("⚠️ %v, 数据: %s", err, string(data))
+			return true
+		}
+		for _, m := range messages {
+			t.handler(m)
+			if m.IsResponse() && m.IDKey() == msg.IDKey() {
+				received = true
+			}
+		}
+		return !received
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		err = readSSE(resp.Body, func(event *sseEvent) bool {
+			if event.Event != "" && event.Event != "message" {
+				return true
+			}
+			return deliver([]byte(event.Data))
+		})
+		if err != nil && !received {
+			return fmt.Errorf("读取SSE响应失败: %v", err)
+		}
+	} else {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("读取响应失败: %v", err)
+		}
+		deliver(body)
+	}
+
+	if !received {
+		return fmt.Errorf("服务器未返回请求 %s 的响应", msg.Method)
+	}
+	return nil
+}
+
+// listen 通过 GET 打开服务器推送流（服务器不支持时返回 405，不再重试），断开后带 Last-Event-ID 重连
+func (t *streamableHTTPTransport) listen(ctx context.Context) {
+	lastEventID := ""
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", t.config.URL, nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		t.setHeaders(req)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		resp, err := t.httpClient.Do(req)
+		if err == nil {
+			if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+				resp.Body.Close()
+				return
+			}
+			readSSE(resp.Body, func(event *sseEvent) bool {
+				if event.ID != "" {
+					lastEventID = event.ID
+				}
+				if messages, err := decodeMessages([]byte(event.Data)); err == nil {
+					for _, m := range messages {
+						t.handler(m)
+					}
+				}
+				return true
+			})
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+// hasSession 是否已建立会话
+func (t *streamableHTTPTransport) hasSession() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.sessionID != ""
+}
+
+// clearSession 清除会话状态并停止推送流
+func (t *streamableHTTPTransport) clearSession() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sessionID = ""
+	t.protocolVersion = ""
+	if t.listenCancel != nil {
+		t.listenCancel()
+		t.listenCancel = nil
+	}
+}
+
+// Reset 结束当前会话
+func (t *streamableHTTPTransport) Reset() {
+	t.Close()
+}
+
+// Close 用 DELETE 通知服务器结束会话
+func (t *streamableHTTPTransport) Close() error {
+	hadSession := t.hasSession()
+	if hadSession {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if req, err := http.NewRequestWithContext(ctx, "DELETE", t.config.URL, nil); err == nil {
+			t.setHeaders(req)
+			if resp, err := t.httpClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	t.clearSession()
+	return nil
+}
+
+// sseTransport 旧版 HTTP+SSE 传输（2024-11-05）：GET 建立 SSE 流，服务器通过 endpoint 事件告知 POST 地址，
+// 所有响应和通知都从 SSE 流返回
+type sseTransport struct {
+	config     *MCPServerConfig
+	httpClient *http.Client
+	logger     *log.Logger
+
+	mutex    sync.RWMutex
+	endpoint string
+	cancel   context.CancelFunc
+}
+
+// Start 建立 SSE 流并等待 endpoint 事件
+func (t *sseTransport) Start(ctx context.Context, handler func(*JSONRPCMessage)) error {
+	streamCtx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(streamCtx, "GET", t.config.URL, nil)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("创建SSE请求失败: %v", err)
+	}
+	setAuthorization(req, t.config)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("连接SSE失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return fmt.Errorf("SSE连接失败, 状态码: %d", resp.StatusCode)
+	}
+
+	endpointChan := make(chan string, 1)
+	go func() {
+		defer resp.Body.Close()
+		err := readSSE(resp.Body, func(event *sseEvent) bool {
+			switch event.Event {
+			case "endpoint":
+				select {
+				case endpointChan <- event.Data:
+				default:
+				}
+			case "", "message":
+				messages, err := decodeMessages([]byte(event.Data))
+				if err != nil {
+					t.logger.Printf("⚠️ %v, 数据: %s", err, event.Data)
+					return true
+				}
+				for _, m := range messages {
+					handler(m)
+				}
+			}
+			return true
+		})
+		if streamCtx.Err() != nil {
+			return // 已由 Close 关闭
+		}
+		if err != nil {
+			t.logger.Printf("⚠️ SSE流读取错误: %v", err)
+		}
+		// 流意外断开后后续请求返回 ErrSessionExpired，由客户端重新连接
+		t.mutex.Lock()
+		t.endpoint = ""
+		t.mutex.Unlock()
+	}()
+
+	select {
+	case endpoint := <-endpointChan:
+		base, err := url.Parse(t.config.URL)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("解析SSE地址失败: %v", err)
+		}
+		ref, err := url.Parse(strings.TrimSpace(endpoint))
+		if err != nil {
+			cancel()
+			return fmt.Errorf("解析endpoint失败: %v", err)
+		}
+		t.mutex.Lock()
+		t.endpoint = base.ResolveReference(ref).String()
+		t.cancel = cancel
+		t.mutex.Unlock()
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	case <-time.After(endpointTimeout):
+		cancel()
+		return fmt.Errorf("等待SSE endpoint事件超时")
+	}
+}
+
+// Send POST 消息到 endpoint，响应从 SSE 流返回
+func (t *sseTransport) Send(ctx context.Context, msg *JSONRPCMessage) error {
+	t.mutex.RLock()
+	endpoint := t.endpoint
+	t.mutex.RUnlock()
+	if endpoint == "" {
+		return ErrSessionExpired
+	}
+
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("序列化请求失败: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("创建HTTP请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAuthorization(req, t.config)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("发送请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("请求失败, 状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// SetProtocolVersion 旧版 SSE 传输不需要协议版本头
+func (t *sseTransport) SetProtocolVersion(version string) {}
+
+// Reset 关闭 SSE 流，重新 Start 时建立新的流
+func (t *sseTransport) Reset() {
+	t.Close()
+}
+
+// Close 关闭 SSE 流
+func (t *sseTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+	t.endpoint = ""
+	return nil
+}
@@ -0,0 +1,253 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// stdioRestartMinDelay 进程意外退出后第一次重启前的等待时间，之后每次加倍
+	stdioRestartMinDelay = 1 * time.Second
+	// stdioRestartMaxDelay 重启等待时间的上限
+	stdioRestartMaxDelay = 1 * time.Minute
+	// stdioStableRuntime 进程运行超过该时间后退出，重启等待时间从头计算
+	stdioStableRuntime = 1 * time.Minute
+	// stdioShutdownTimeout 关闭 stdin 后等待进程退出的时间，超时后依次向进程组发送 SIGTERM、SIGKILL
+	stdioShutdownTimeout = 3 * time.Second
+)
+
+// stdioTransport stdio 传输：由本服务启动并托管 MCP 服务器进程，每行一条 JSON-RPC 消息
+// 进程意外退出后按退避时间自动重启，重启后原会话失效，客户端下一次请求时重新 initialize
+// 并发请求共用同一个进程，按 id 匹配响应
+type stdioTransport struct {
+	config  *MCPServerConfig
+	logger  *log.Logger
+	handler func(*JSONRPCMessage)
+
+	mutex        sync.Mutex
+	stdin        io.WriteCloser
+	process      *os.Process
+	exited       chan struct{} // 当前进程退出时关闭
+	generation   int           // 进程启动次数，用于判断会话是否属于当前进程
+	sessionGen   int           // 当前会话所属进程的 generation，0 表示没有会话
+	stopped      bool          // Close 之后不再重启
+	restartDelay time.Duration
+	inflight     map[string]json.RawMessage // 已发送、尚未收到响应的请求 id，进程退出时以错误响应结束
+
+	writeMutex sync.Mutex
+}
+
+// Start 确保进程在运行，并将会话绑定到当前进程
+func (t *stdioTransport) Start(ctx context.Context, handler func(*JSONRPCMessage)) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.handler = handler
+	t.stopped = false
+	if t.process == nil {
+		if err := t.launch(); err != nil {
+			return err
+		}
+	}
+	t.sessionGen = t.generation
+	return nil
+}
+
+// launch 启动进程（调用方持有 mutex）
+func (t *stdioTransport) launch() error {
+	cmd := exec.Command(t.config.Command, t.config.Args...)
+	// 在独立的进程组中启动，关闭时连同服务器启动的子进程一起结束
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = os.Environ()
+	for key, value := range t.config.Env {
+		cmd.Env = append(cmd.Env, key+"="+os.ExpandEnv(value))
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("创建stdin管道失败: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("创建stdout管道失败: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("创建stderr管道失败: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("启动MCP服务器进程 %s 失败: %v", t.config.Command, err)
+	}
+
+	t.generation++
+	t.stdin = stdin
+	t.process = cmd.Process
+	exited := make(chan struct{})
+	t.exited = exited
+	t.logger.Printf("✅ 已启动MCP服务器进程 %s (pid=%d)", t.config.Name, cmd.Process.Pid)
+
+	// 管道读完后才能调用 cmd.Wait，否则 Wait 关闭管道会丢失进程最后的输出
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		t.readStdout(stdout)
+	}()
+	go func() {
+		defer readers.Done()
+		t.readStderr(stderr)
+	}()
+	go t.wait(cmd, &readers, t.generation, exited)
+	return nil
+}
+
+// readStdout 逐行读取服务器发来的消息
+func (t *stdioTransport) readStdout(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		messages, err := decodeMessages(scanner.Bytes())
+		if err != nil {
+			t.logger.Printf("⚠️ [%s] %v, 数据: %s", t.config.Name, err, scanner.Text())
+			continue
+		}
+		for _, m := range messages {
+			if m.IsResponse() {
+				t.mutex.Lock()
+				delete(t.inflight, m.IDKey())
+				t.mutex.Unlock()
+			}
+			t.handler(m)
+		}
+	}
+}
+
+// readStderr 服务器的 stderr 输出记录到日志
+func (t *stdioTransport) readStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		t.logger.Printf("[%s stderr] %s", t.config.Name, scanner.Text())
+	}
+}
+
+// wait 等待输出读完、进程退出，非 Close 引起的退出按退避时间重启
+func (t *stdioTransport) wait(cmd *exec.Cmd, readers *sync.WaitGroup, generation int, exited chan struct{}) {
+	startedAt := time.Now()
+	readers.Wait()
+	err := cmd.Wait()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	defer close(exited)
+	if t.generation != generation {
+		return
+	}
+	t.process = nil
+	t.stdin = nil
+	for _, id := range t.inflight {
+		go t.handler(NewErrorResponse(id, ErrCodeInternalError, "MCP服务器进程已退出"))
+	}
+	t.inflight = nil
+	if t.stopped {
+		return
+	}
+
+	if time.Since(startedAt) >= stdioStableRuntime || t.restartDelay == 0 {
+		t.restartDelay = stdioRestartMinDelay
+	} else if t.restartDelay *= 2; t.restartDelay > stdioRestartMaxDelay {
+		t.restartDelay = stdioRestartMaxDelay
+	}
+	t.logger.Printf("⚠️ MCP服务器进程 %s 意外退出: %v，%v 后重启", t.config.Name, err, t.restartDelay)
+	time.AfterFunc(t.restartDelay, t.restart)
+}
+
+// restart 退避时间到后重启进程（期间已被 Start 拉起或已 Close 时跳过）
+func (t *stdioTransport) restart() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopped || t.process != nil {
+		return
+	}
+	if err := t.launch(); err != nil {
+		t.logger.Printf("⚠️ 重启MCP服务器进程 %s 失败: %v", t.config.Name, err)
+		if t.restartDelay *= 2; t.restartDelay > stdioRestartMaxDelay {
+			t.restartDelay = stdioRestartMaxDelay
+		}
+		time.AfterFunc(t.restartDelay, t.restart)
+	}
+}
+
+// Send 向进程的 stdin 写入一行消息；进程已退出或已重启时返回 ErrSessionExpired
+func (t *stdioTransport) Send(ctx context.Context, msg *JSONRPCMessage) error {
+	t.mutex.Lock()
+	stdin := t.stdin
+	valid := t.process != nil && t.sessionGen == t.generation
+	if valid && msg.IsRequest() {
+		if t.inflight == nil {
+			t.inflight = make(map[string]json.RawMessage)
+		}
+		t.inflight[msg.IDKey()] = msg.ID
+	}
+	t.mutex.Unlock()
+	if !valid {
+		return ErrSessionExpired
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("序列化请求失败: %v", err)
+	}
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	if _, err := stdin.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("写入MCP服务器进程失败: %v", err)
+	}
+	return nil
+}
+
+// SetProtocolVersion stdio 传输不需要协议版本头
+func (t *stdioTransport) SetProtocolVersion(version string) {}
+
+// Reset 丢弃当前会话，进程继续运行
+func (t *stdioTransport) Reset() {
+	t.mutex.Lock()
+	t.sessionGen = 0
+	t.mutex.Unlock()
+}
+
+// Close 停止进程：先关闭 stdin 等待进程自行退出，超时后向进程组发送 SIGTERM，仍未退出时强制结束整个进程组
+func (t *stdioTransport) Close() error {
+	t.mutex.Lock()
+	t.stopped = true
+	t.sessionGen = 0
+	stdin, process, exited := t.stdin, t.process, t.exited
+	t.mutex.Unlock()
+	if process == nil {
+		return nil
+	}
+
+	stdin.Close()
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(stdioShutdownTimeout):
+	}
+	// 进程以自己的 pid 作为进程组 id，负数 pid 表示向整个进程组发送信号
+	syscall.Kill(-process.Pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(stdioShutdownTimeout):
+	}
+	t.logger.Printf("⚠️ MCP服务器进程 %s 未响应 SIGTERM，强制结束", t.config.Name)
+	return syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
@@ -26,7 +26,6 @@ var logger = log.New(log.Writer(), "claude_service: ", log.LstdFlags)
 // ClaudeKeyManager Claude API密钥管理器，使用三层架构管理API密钥
 type ClaudeKeyManager struct {
 	modelManager *manager.ModelManager
-	currentIndex int
 	baseURL      string
 }
 
@@ -34,7 +33,6 @@ type ClaudeKeyManager struct {
 func NewClaudeKeyManager() *ClaudeKeyManager {
 	mgr := &ClaudeKeyManager{
 		modelManager: manager.NewModelManager(),
-		currentIndex: 0,
 		baseURL:      "https://api.anthropic.com",
 	}
 
@@ -44,40 +42,30 @@ func NewClaudeKeyManager() *ClaudeKeyManager {
 
 // GetNextKey 获取下一个可用的API密钥
 func (m *ClaudeKeyManager) GetNextKey() string {
-	// 从模型管理器获取可用密钥列表 (已按优先级排序)
-	apiKeys, err := m.modelManager.GetAvailableAPIKeys("Claude")
+	// 由密钥调度器按速率限制、优先级和近期成功率选择
+	key, err := m.modelManager.SelectAPIKey("Claude")
 	if err != nil {
 		logger.Printf("获取API密钥失败: %v", err)
 		return ""
 	}
 
-	if len(apiKeys) == 0 {
-		logger.Print("没有可用的API密钥")
-		return ""
-	}
-
-	// 使用轮询策略选择密钥
-	key := apiKeys[m.currentIndex%len(apiKeys)]
-	m.currentIndex = (m.currentIndex + 1) % len(apiKeys)
-
 	logger.Printf("使用API密钥: %s (优先级: %d)", key.KeyName, key.Priority)
 	return key.APIKey
 }
 
 // GetKeyWithID 获取API密钥及其ID (用于后续状态更新)
 func (m *ClaudeKeyManager) GetKeyWithID() (string, int, error) {
-	apiKeys, err := m.modelManager.GetAvailableAPIKeys("Claude")
+	return m.GetKeyForModel("Claude")
+}
+
+// GetKeyForModel 为指定 model_code 选择API密钥及其ID
+// excludeKeyIDs 为本次请求中已尝试失败的密钥
+func (m *ClaudeKeyManager) GetKeyForModel(modelCode string, excludeKeyIDs ...int) (string, int, error) {
+	key, err := m.modelManager.SelectAPIKey(modelCode, excludeKeyIDs...)
 	if err != nil {
 		return "", 0, err
 	}
 
-	if len(apiKeys) == 0 {
-		return "", 0, fmt.Errorf("没有可用的API密钥")
-	}
-
-	key := apiKeys[m.currentIndex%len(apiKeys)]
-	m.currentIndex = (m.currentIndex + 1) % len(apiKeys)
-
 	return key.APIKey, key.ID, nil
 }
 
@@ -92,6 +80,21 @@ func (m *ClaudeKeyManager) UpdateKeyStatus(keyID int, success bool, errMsg strin
 	return m.modelManager.UpdateKeyStatus(keyID, success, errMsg)
 }
 
+// RecordUpstreamFailure 记录上游故障（网络错误或 5xx），计入 base_url 熔断器
+func (m *ClaudeKeyManager) RecordUpstreamFailure(keyID int, errMsg string) {
+	m.modelManager.RecordUpstreamFailure(keyID, errMsg)
+}
+
+// RecordUpstreamSuccess 记录上游返回了非 5xx 的响应，关闭 base_url 熔断器
+func (m *ClaudeKeyManager) RecordUpstreamSuccess(keyID int) {
+	m.modelManager.RecordUpstreamSuccess(keyID)
+}
+
+// ReleaseKeyProbe 归还选择密钥时占用的探测名额
+func (m *ClaudeKeyManager) ReleaseKeyProbe(keyID int) {
+	m.modelManager.ReleaseKeyProbe(keyID)
+}
+
 // GetBaseURL 获取基础URL
 func (m *ClaudeKeyManager) GetBaseURL() string {
 	// 尝试从模型管理器获取
@@ -138,8 +141,9 @@ func NewClaudeService() *ClaudeService {
 }
 
 // initAPIKey 初始化API密钥
-func (s *ClaudeService) initAPIKey() bool {
-	key, keyID, err := s.keyManager.GetKeyWithID()
+// excludeKeyIDs 为本次请求中已尝试失败的密钥
+func (s *ClaudeService) initAPIKey(modelCode string, excludeKeyIDs ...int) bool {
+	key, keyID, err := s.keyManager.GetKeyForModel(modelCode, excludeKeyIDs...)
 	if err != nil {
 		logger.Printf("无法获取可用的API密钥: %v", err)
 		s.currentAPIKey = ""
@@ -211,9 +215,10 @@ func (s *ClaudeService) CreateChatCompletionNonStream(ctx context.Context, data
 			continue
 		}
 		
-		// 确保消息内容不为空且不只包含空白字符
+		// 确保消息内容不为空且不只包含空白字符，内容块列表（如带签名的 thinking 块）原样保留
 		content, _ := message["content"].(string)
-		if content != "" && strings.TrimSpace(content) != "" {
+		blocks, _ := message["content"].([]interface{})
+		if len(blocks) > 0 || (content != "" && strings.TrimSpace(content) != "") {
 			validMessages = append(validMessages, message)
 		} else {
 			// 用有效内容替换空白消息
@@ -298,8 +303,8 @@ func (s *ClaudeService) CreateChatCompletionNonStream(ctx context.Context, data
 			modelCode = "Claude" // 默认值
 		}
 		
-		apiKeys, err := s.keyManager.modelManager.GetAvailableAPIKeys(modelCode)
-		if err != nil || len(apiKeys) == 0 {
+		apiKey, keyID, err := s.keyManager.GetKeyForModel(modelCode)
+		if err != nil {
 			logger.Printf("获取平台API密钥失败 (模型代码: %s, 模型名: %s): %v", modelCode, model, err)
 			return map[string]interface{}{
 				"error": map[string]interface{}{
@@ -309,10 +314,10 @@ func (s *ClaudeService) CreateChatCompletionNonStream(ctx context.Context, data
 			}
 		}
 		
-		// 使用第一个可用的 API Key（已按优先级排序）
-		s.currentAPIKey = apiKeys[0].APIKey
-		s.currentKeyID = apiKeys[0].ID
-		logger.Printf("使用平台 Claude API Key (模型代码: %s, 模型名: %s, KeyID: %d)", modelCode, model, apiKeys[0].ID)
+		// 使用调度器选择的 API Key
+		s.currentAPIKey = apiKey
+		s.currentKeyID = keyID
+		logger.Printf("使用平台 Claude API Key (模型代码: %s, 模型名: %s, KeyID: %d)", modelCode, model, keyID)
 	}
 	
 	// 获取可用密钥数量（用于重试）
@@ -325,6 +330,9 @@ func (s *ClaudeService) CreateChatCompletionNonStream(ctx context.Context, data
 		}
 	}
 	
+	// 本次请求中已失败的密钥，重试时由调度器排除
+	var triedKeyIDs []int
+	
 	// 尝试所有可用的API密钥
 	for attempt := 0; attempt < maxAttempts; attempt++ {
 		
@@ -373,12 +381,8 @@ func (s *ClaudeService) CreateChatCompletionNonStream(ctx context.Context, data
 		response, err := s.sendRequest(ctx, messageParams)
 		
 		// 处理错误
+		// 密钥状态由 sendRequest 按响应状态码记录，请求本身的错误不计入密钥失败
 		if err != nil {
-			// 更新密钥失败状态
-			if s.currentKeyID > 0 {
-				s.keyManager.UpdateKeyStatus(s.currentKeyID, false, err.Error())
-			}
-			
 			// 记录当前使用的API密钥
 			if s.currentAPIKey != "" {
 				keyPreview := s.currentAPIKey
@@ -395,7 +399,8 @@ func (s *ClaudeService) CreateChatCompletionNonStream(ctx context.Context, data
 			
 			// 尝试使用下一个密钥
 			logger.Printf("尝试使用下一个API密钥 (尝试 %d/%d)", attempt+1, maxAttempts)
-			if !s.initAPIKey() {
+			triedKeyIDs = append(triedKeyIDs, s.currentKeyID)
+			if !s.initAPIKey(modelCode, triedKeyIDs...) {
 				logger.Print("无法获取下一个可用的API密钥")
 				return map[string]interface{}{
 					"error": "所有API密钥都已耗尽",
@@ -405,11 +410,6 @@ func (s *ClaudeService) CreateChatCompletionNonStream(ctx context.Context, data
 			continue
 		}
 		
-		// 更新密钥成功状态
-		if s.currentKeyID > 0 {
-			s.keyManager.UpdateKeyStatus(s.currentKeyID, true, "")
-		}
-		
 		// 记录请求时间
 		elapsedTime := time.Since(startTime)
 		logger.Printf("Claude响应时间: %.2f秒", elapsedTime.Seconds())
@@ -466,9 +466,10 @@ func (s *ClaudeService) CreateChatCompletionStream(ctx context.Context, data map
 				continue
 			}
 			
-			// 确保消息内容不为空且不只包含空白字符
+			// 确保消息内容不为空且不只包含空白字符，内容块列表（如带签名的 thinking 块）原样保留
 			content, _ := message["content"].(string)
-			if content != "" && strings.TrimSpace(content) != "" {
+			blocks, _ := message["content"].([]interface{})
+			if len(blocks) > 0 || (content != "" && strings.TrimSpace(content) != "") {
 				validMessages = append(validMessages, message)
 			} else {
 				// 用有效内容替换空白消息
@@ -572,17 +573,16 @@ func (s *ClaudeService) CreateChatCompletionStream(ctx context.Context, data map
 				modelCode = "Claude" // 默认值
 			}
 			
-			apiKeys, err := s.keyManager.modelManager.GetAvailableAPIKeys(modelCode)
-			if err != nil || len(apiKeys) == 0 {
+			var err error
+			currentAPIKey, currentKeyID, err = s.keyManager.GetKeyForModel(modelCode)
+			if err != nil {
 				logger.Printf("流式请求获取平台API密钥失败 (模型代码: %s, 模型名: %s): %v", modelCode, model, err)
 				outputChan <- createErrorChunk(fmt.Sprintf("无法获取API密钥: %v", err))
 				return
 			}
 			
-			// 使用第一个可用的 API Key（已按优先级排序）
-			currentAPIKey = apiKeys[0].APIKey
-			currentKeyID = apiKeys[0].ID
-			logger.Printf("流式请求使用平台 Claude API Key (模型代码: %s, 模型名: %s, KeyID: %d)", modelCode, model, apiKeys[0].ID)
+			// 使用调度器选择的 API Key
+			logger.Printf("流式请求使用平台 Claude API Key (模型代码: %s, 模型名: %s, KeyID: %d)", modelCode, model, currentKeyID)
 		}
 		
 		// 获取可用密钥数量（用于重试）
@@ -595,16 +595,23 @@ func (s *ClaudeService) CreateChatCompletionStream(ctx context.Context, data map
 			}
 		}
 		
+		// 本次请求中已失败的密钥，重试时由调度器排除
+		var triedKeyIDs []int
+		
 		// 尝试所有可用的API密钥
 		for attempt := 0; attempt < maxAttempts; attempt++ {
 			// 如果需要重试，获取下一个可用的 API Key
 			if attempt > 0 && !useUserKey && modelCode != "" {
-				apiKeys, _ := s.keyManager.modelManager.GetAvailableAPIKeys(modelCode)
-				if attempt < len(apiKeys) {
-					currentAPIKey = apiKeys[attempt].APIKey
-					currentKeyID = apiKeys[attempt].ID
-					logger.Printf("流式请求重试使用 API Key (KeyID: %d)", currentKeyID)
+				triedKeyIDs = append(triedKeyIDs, currentKeyID)
+				apiKey, keyID, err := s.keyManager.GetKeyForModel(modelCode, triedKeyIDs...)
+				if err != nil {
+					logger.Printf("流式请求无法获取下一个可用的API密钥: %v", err)
+					outputChan <- createErrorChunk("所有API密钥都已尝试，但请求仍然失败")
+					return
 				}
+				currentAPIKey = apiKey
+				currentKeyID = keyID
+				logger.Printf("流式请求重试使用 API Key (KeyID: %d)", currentKeyID)
 			}
 			
 			// 准备请求参数
@@ -651,13 +658,9 @@ func (s *ClaudeService) CreateChatCompletionStream(ctx context.Context, data map
 			streamParams["_key_id"] = currentKeyID
 			
 			// 创建流式请求
+			// 密钥状态由 sendStreamRequest 按响应状态码和流的读取结果记录
 			stream, err := s.sendStreamRequest(ctx, streamParams)
 			if err != nil {
-				// 更新密钥失败状态
-				if currentKeyID > 0 {
-					s.keyManager.UpdateKeyStatus(currentKeyID, false, err.Error())
-				}
-				
 				// 记录当前使用的API密钥
 				if currentAPIKey != "" {
 					keyPreview := currentAPIKey
@@ -687,11 +690,6 @@ func (s *ClaudeService) CreateChatCompletionStream(ctx context.Context, data map
 				}
 			}
 			
-			// 更新密钥成功状态
-			if currentKeyID > 0 {
-				s.keyManager.UpdateKeyStatus(currentKeyID, true, "")
-			}
-			
 			logger.Print("成功创建Claude Messages API流式请求")
 			
 			// 处理流式响应
@@ -770,6 +768,7 @@ func (s *ClaudeService) sendRequest(ctx context.Context, params map[string]inter
 	jsonData, err := json.Marshal(params)
 	if err != nil {
 		logger.Printf("序列化请求参数失败: %v", err)
+		s.releaseKeyProbe(keyID)
 		return map[string]interface{}{
 			"error": map[string]interface{}{
 				"message": fmt.Sprintf("序列化请求失败: %v", err),
@@ -784,6 +783,7 @@ func (s *ClaudeService) sendRequest(ctx context.Context, params map[string]inter
 	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(jsonData))
 	if err != nil {
 		logger.Printf("创建HTTP请求失败: %v", err)
+		s.releaseKeyProbe(keyID)
 		return map[string]interface{}{
 			"error": map[string]interface{}{
 				"message": fmt.Sprintf("创建请求失败: %v", err),
@@ -808,10 +808,7 @@ func (s *ClaudeService) sendRequest(ctx context.Context, params map[string]inter
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		logger.Printf("发送HTTP请求失败: %v", err)
-		// 更新密钥状态为失败
-		if keyID > 0 {
-			s.keyManager.UpdateKeyStatus(keyID, false, fmt.Sprintf("请求失败: %v", err))
-		}
+		s.recordRequestError(ctx, keyID, err)
 		return map[string]interface{}{
 			"error": map[string]interface{}{
 				"message": fmt.Sprintf("请求失败: %v", err),
@@ -825,6 +822,7 @@ func (s *ClaudeService) sendRequest(ctx context.Context, params map[string]inter
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		logger.Printf("读取响应失败: %v", err)
+		s.recordRequestError(ctx, keyID, err)
 		return map[string]interface{}{
 			"error": map[string]interface{}{
 				"message": fmt.Sprintf("读取响应失败: %v", err),
@@ -836,10 +834,7 @@ func (s *ClaudeService) sendRequest(ctx context.Context, params map[string]inter
 	// 检查HTTP状态码
 	if resp.StatusCode != http.StatusOK {
 		logger.Printf("Claude API 返回错误状态码: %d, 响应: %s", resp.StatusCode, string(body))
-		// 更新密钥状态为失败
-		if keyID > 0 {
-			s.keyManager.UpdateKeyStatus(keyID, false, fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(body)))
-		}
+		s.recordKeyResult(keyID, resp.StatusCode, string(body))
 		
 		var errorResp map[string]interface{}
 		if err := json.Unmarshal(body, &errorResp); err == nil {
@@ -878,6 +873,8 @@ func (s *ClaudeService) sendRequest(ctx context.Context, params map[string]inter
 	// 请求成功，更新密钥状态
 	if keyID > 0 {
 		s.keyManager.UpdateKeyStatus(keyID, true, "")
+		// 记录实际使用的密钥，供拦截器写入计费流水
+		response["_key_id"] = keyID
 	}
 	
 	logger.Printf("Claude API 请求成功，响应长度: %d", len(body))
@@ -944,6 +941,7 @@ func (s *ClaudeService) sendStreamRequest(ctx context.Context, params map[string
 		jsonData, err := json.Marshal(params)
 		if err != nil {
 			logger.Printf("序列化流式请求参数失败: %v", err)
+			s.releaseKeyProbe(keyID)
 			streamChan <- createErrorChunk(fmt.Sprintf("序列化请求失败: %v", err))
 			return
 		}
@@ -954,6 +952,7 @@ func (s *ClaudeService) sendStreamRequest(ctx context.Context, params map[string
 		req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(jsonData))
 		if err != nil {
 			logger.Printf("创建流式HTTP请求失败: %v", err)
+			s.releaseKeyProbe(keyID)
 			streamChan <- createErrorChunk(fmt.Sprintf("创建请求失败: %v", err))
 			return
 		}
@@ -977,10 +976,7 @@ func (s *ClaudeService) sendStreamRequest(ctx context.Context, params map[string
 		resp, err := httpClient.Do(req)
 		if err != nil {
 			logger.Printf("发送流式HTTP请求失败: %v", err)
-			// 更新密钥状态为失败
-			if keyID > 0 {
-				s.keyManager.UpdateKeyStatus(keyID, false, fmt.Sprintf("请求失败: %v", err))
-			}
+			s.recordRequestError(ctx, keyID, err)
 			streamChan <- createErrorChunk(fmt.Sprintf("请求失败: %v", err))
 			return
 		}
@@ -990,10 +986,7 @@ func (s *ClaudeService) sendStreamRequest(ctx context.Context, params map[string
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
 			logger.Printf("流式 Claude API 返回错误状态码: %d, 响应: %s", resp.StatusCode, string(body))
-			// 更新密钥状态为失败
-			if keyID > 0 {
-				s.keyManager.UpdateKeyStatus(keyID, false, fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(body)))
-			}
+			s.recordKeyResult(keyID, resp.StatusCode, string(body))
 			streamChan <- createErrorChunk(fmt.Sprintf("API错误 (状态码 %d): %s", resp.StatusCode, string(body)))
 			return
 		}
@@ -1049,6 +1042,50 @@ func (s *ClaudeService) sendStreamRequest(ctx context.Context, params map[string
 	return streamChan, nil
 }
 
+// recordKeyResult 记录平台密钥的调用结果（keyID 为 0 表示用户自己的 Key，不记录），与 OpenAI 服务的规则一致
+// 网络错误（statusCode 为 0）、认证/限流错误和 5xx 计为失败；其它 4xx 是请求本身的问题，不计入密钥状态
+func (s *ClaudeService) recordKeyResult(keyID int, statusCode int, errMsg string) {
+	if keyID <= 0 {
+		return
+	}
+	
+	switch {
+	case statusCode == http.StatusOK:
+		s.keyManager.UpdateKeyStatus(keyID, true, "")
+	case statusCode == 0 || statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden ||
+		statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		if statusCode != 0 {
+			errMsg = fmt.Sprintf("HTTP %d: %s", statusCode, errMsg)
+		}
+		s.keyManager.UpdateKeyStatus(keyID, false, errMsg)
+		if statusCode == 0 || statusCode >= 500 {
+			s.keyManager.RecordUpstreamFailure(keyID, errMsg)
+		} else {
+			s.keyManager.RecordUpstreamSuccess(keyID)
+		}
+	default:
+		s.keyManager.RecordUpstreamSuccess(keyID)
+		s.keyManager.ReleaseKeyProbe(keyID)
+	}
+}
+
+// recordRequestError 记录请求没有得到响应的结果：调用方取消时不计入密钥和上游状态，只归还探测名额
+func (s *ClaudeService) recordRequestError(ctx context.Context, keyID int, err error) {
+	if ctx.Err() != nil {
+		s.releaseKeyProbe(keyID)
+		return
+	}
+	s.recordKeyResult(keyID, 0, fmt.Sprintf("请求失败: %v", err))
+}
+
+// releaseKeyProbe 归还平台密钥占用的探测名额，选择密钥后请求没有发出时调用
+func (s *ClaudeService) releaseKeyProbe(keyID int) {
+	if keyID <= 0 {
+		return
+	}
+	s.keyManager.ReleaseKeyProbe(keyID)
+}
+
 // createErrorChunk 创建错误响应块
 func createErrorChunk(message string) string {
 	errorChunk := map[string]interface{}{
@@ -0,0 +1,211 @@
+// 上游熔断器
+// 按API密钥和 base_url 分别熔断：closed -> open -> half_open，状态保存在Redis中，多个网关实例共享
+
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"digitalsingularity/backend/common/utils/datahandle"
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+const (
+	// breakerFailureThreshold 连续失败多少次后熔断
+	breakerFailureThreshold = 5
+	// breakerBaseCooldown 首次熔断的冷却时间，每次探测失败后翻倍
+	breakerBaseCooldown = 30 * time.Second
+	// breakerMaxCooldown 冷却时间上限
+	breakerMaxCooldown = 30 * time.Minute
+	// breakerProbeTimeout 半开状态下探测请求的占用时间，从占用时起计算，超时未上报结果则允许再次探测
+	breakerProbeTimeout = 60 * time.Second
+	// breakerStateExpire 熔断状态在Redis中的保留时间
+	breakerStateExpire = 24 * time.Hour
+)
+
+// BreakerState 熔断器状态
+type BreakerState struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenCount           int       `json:"open_count"` // 连续熔断次数，用于计算指数冷却时间
+	OpenedAt            time.Time `json:"opened_at"`
+	CooldownUntil       time.Time `json:"cooldown_until"`
+	LastError           string    `json:"last_error"`
+}
+
+// CircuitBreaker 熔断器
+// scope 区分熔断对象（key: API密钥, url: base_url）
+type CircuitBreaker struct {
+	readWrite *datahandle.CommonReadWriteService
+	logger    *log.Logger
+	scope     string
+}
+
+// NewCircuitBreaker 创建熔断器
+func NewCircuitBreaker(readWrite *datahandle.CommonReadWriteService, logger *log.Logger, scope string) *CircuitBreaker {
+	return &CircuitBreaker{
+		readWrite: readWrite,
+		logger:    logger,
+		scope:     scope,
+	}
+}
+
+func (b *CircuitBreaker) stateKey(id string) string {
+	return fmt.Sprintf("model:breaker:%s:%s", b.scope, id)
+}
+
+func (b *CircuitBreaker) failsKey(id string) string {
+	return fmt.Sprintf("model:breaker:%s:%s:fails", b.scope, id)
+}
+
+func (b *CircuitBreaker) probeKey(id string) string {
+	return fmt.Sprintf("model:breaker:%s:%s:probe", b.scope, id)
+}
+
+// breakerCooldown 计算第 openCount 次连续熔断的冷却时间
+func breakerCooldown(openCount int) time.Duration {
+	cooldown := breakerBaseCooldown
+	for i := 0; i < openCount && cooldown < breakerMaxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > breakerMaxCooldown {
+		cooldown = breakerMaxCooldown
+	}
+	return cooldown
+}
+
+// load 从Redis读取熔断状态，不存在时为 closed
+func (b *CircuitBreaker) load(id string) *BreakerState {
+	state := &BreakerState{State: BreakerClosed}
+	result := b.readWrite.GetRedis(b.stateKey(id))
+	if result.IsSuccess() {
+		jsonStr, _ := result.Data.(string)
+		if err := json.Unmarshal([]byte(jsonStr), state); err != nil {
+			state = &BreakerState{State: BreakerClosed}
+		}
+	}
+	return state
+}
+
+func (b *CircuitBreaker) save(id string, state *BreakerState) {
+	jsonData, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	b.readWrite.SetRedis(b.stateKey(id), string(jsonData), breakerStateExpire)
+}
+
+// probeInFlight 判断是否已有探测请求在进行
+func (b *CircuitBreaker) probeInFlight(id string) bool {
+	return b.readWrite.GetRedis(b.probeKey(id)).IsSuccess()
+}
+
+// State 获取熔断状态（冷却结束的 open 状态视为 half_open）
+func (b *CircuitBreaker) State(id string) *BreakerState {
+	state := b.load(id)
+	if state.State == BreakerClosed {
+		// closed 状态下的连续失败次数单独计数
+		state.ConsecutiveFailures = readRedisCounter(b.readWrite, b.failsKey(id))
+	}
+	if state.State == BreakerOpen && !time.Now().Before(state.CooldownUntil) {
+		state.State = BreakerHalfOpen
+	}
+	return state
+}
+
+// Available 判断是否可以向该对象发送请求（不占用探测名额）
+func (b *CircuitBreaker) Available(id string) bool {
+	state := b.State(id)
+	switch state.State {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		return !b.probeInFlight(id)
+	}
+	return false
+}
+
+// Acquire 在发送请求前调用：closed 直接放行；冷却结束后只放行一个探测请求
+func (b *CircuitBreaker) Acquire(id string) bool {
+	state := b.State(id)
+	switch state.State {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		return false
+	}
+
+	// half_open：只允许一个探测请求（多个网关实例通过 SETNX 竞争，过期时间只在占用时设置一次）
+	result := b.readWrite.SetRedisNX(b.probeKey(id), "1", breakerProbeTimeout)
+	if !result.IsSuccess() {
+		return false
+	}
+	if claimed, _ := result.Data.(bool); !claimed {
+		return false
+	}
+	b.logger.Printf("熔断器半开，发送探测请求: %s=%s", b.scope, id)
+	return true
+}
+
+// Release 归还 Acquire 占用的探测名额，Acquire 放行后没有得到可判断的结果时调用（closed 状态下无需归还）
+func (b *CircuitBreaker) Release(id string) {
+	if b.State(id).State == BreakerHalfOpen {
+		b.readWrite.DeleteRedis(b.probeKey(id))
+	}
+}
+
+// RecordSuccess 记录成功：关闭熔断器并重置计数
+func (b *CircuitBreaker) RecordSuccess(id string) {
+	state := b.load(id)
+	if state.State != BreakerClosed {
+		b.logger.Printf("熔断器恢复: %s=%s", b.scope, id)
+		b.readWrite.DeleteRedis(b.stateKey(id))
+		b.readWrite.DeleteRedis(b.probeKey(id))
+	}
+	b.readWrite.DeleteRedis(b.failsKey(id))
+}
+
+// RecordFailure 记录失败：连续失败达到阈值时熔断，探测失败时以更长的冷却时间重新熔断
+func (b *CircuitBreaker) RecordFailure(id string, errMsg string) {
+	state := b.load(id)
+	now := time.Now()
+
+	if state.State == BreakerOpen {
+		if now.Before(state.CooldownUntil) {
+			// 冷却期内的失败（熔断前已发出的请求），不延长冷却时间
+			return
+		}
+		// 探测请求失败，重新熔断
+		state.OpenCount++
+	} else {
+		result := b.readWrite.IncrRedis(b.failsKey(id), 1, breakerStateExpire)
+		failures := 0
+		if count, ok := result.Data.(int64); ok {
+			failures = int(count)
+		}
+		if failures < breakerFailureThreshold {
+			return
+		}
+		state.ConsecutiveFailures = failures
+		state.OpenCount = 0
+	}
+
+	cooldown := breakerCooldown(state.OpenCount)
+	state.State = BreakerOpen
+	state.OpenedAt = now
+	state.CooldownUntil = now.Add(cooldown)
+	state.LastError = errMsg
+	b.save(id, state)
+	b.readWrite.DeleteRedis(b.probeKey(id))
+	b.readWrite.DeleteRedis(b.failsKey(id))
+	b.logger.Printf("熔断器打开: %s=%s, 冷却 %v, 原因: %s", b.scope, id, cooldown, errMsg)
+}
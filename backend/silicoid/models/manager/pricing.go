@@ -0,0 +1,58 @@
+// 模型计费
+// 按 ModelConfig 中配置的每千token价格分别计算输入、缓存命中输入和输出的费用
+
+package manager
+
+import "math"
+
+// 模型价格表（silicoid_models）未配置缓存折扣时使用的默认比例
+const (
+	defaultCachedInputRatio = 0.5  // 缓存命中的输入
+	defaultCacheWriteRatio  = 1.25 // 写入缓存的输入（与 Claude 5 分钟缓存的写入价格一致）
+)
+
+// HasPricing 判断模型是否配置了价格
+func (c *ModelConfig) HasPricing() bool {
+	return c.CostPer1kInput > 0 || c.CostPer1kOutput > 0
+}
+
+// cachedInputRatio 缓存命中输入相对于输入价格的比例
+func (c *ModelConfig) cachedInputRatio() float64 {
+	if c.CachedInputRatio > 0 {
+		return c.CachedInputRatio
+	}
+	return defaultCachedInputRatio
+}
+
+// cacheWriteRatio 写入缓存的输入相对于输入价格的比例
+func (c *ModelConfig) cacheWriteRatio() float64 {
+	if c.CacheWriteRatio > 0 {
+		return c.CacheWriteRatio
+	}
+	return defaultCacheWriteRatio
+}
+
+// CalculateCost 计算一次调用的费用（向上取整）
+// promptTokens 包含 cachedTokens 和 cacheWriteTokens（与 OpenAI usage 的口径一致），
+// 缓存命中部分按折扣价、写入缓存部分按写入价计费
+// 模型未配置价格时按总token数计费，保持与按token扣费一致
+func (c *ModelConfig) CalculateCost(promptTokens, cachedTokens, cacheWriteTokens, completionTokens int) int {
+	if !c.HasPricing() {
+		return promptTokens + completionTokens
+	}
+
+	if cachedTokens > promptTokens {
+		cachedTokens = promptTokens
+	}
+	if cacheWriteTokens > promptTokens-cachedTokens {
+		cacheWriteTokens = promptTokens - cachedTokens
+	}
+	uncachedTokens := promptTokens - cachedTokens - cacheWriteTokens
+
+	cost := float64(uncachedTokens)/1000*c.CostPer1kInput +
+		float64(cachedTokens)/1000*c.CostPer1kInput*c.cachedInputRatio() +
+		float64(cacheWriteTokens)/1000*c.CostPer1kInput*c.cacheWriteRatio() +
+		float64(completionTokens)/1000*c.CostPer1kOutput
+
+	return int(math.Ceil(cost))
+}
@@ -0,0 +1,256 @@
+// API密钥调度器
+// 使用Redis记录每个密钥的分钟/天调用次数和近期成功率，多个网关实例共享同一份状态
+
+package manager
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"digitalsingularity/backend/common/utils/datahandle"
+)
+
+const (
+	// keyStatsWindow 近期成功率统计窗口
+	keyStatsWindow = 10 * time.Minute
+	// minSuccessRateWeight 成功率权重下限，避免密钥因短时失败完全不被选中
+	minSuccessRateWeight = 0.05
+)
+
+// KeyUsage 密钥当前的调用次数统计
+type KeyUsage struct {
+	MinuteCount int `json:"minute_count"`
+	DayCount    int `json:"day_count"`
+	// RecentSuccess/RecentFail 当前和上一个统计窗口内的成功/失败次数
+	RecentSuccess int `json:"recent_success"`
+	RecentFail    int `json:"recent_fail"`
+}
+
+// KeyScheduler API密钥调度器
+// 跳过已熔断或已达到 RateLimitPerMin / RateLimitPerDay 的密钥，并按 Priority 和近期成功率加权随机选择
+type KeyScheduler struct {
+	readWrite *datahandle.CommonReadWriteService
+	logger    *log.Logger
+	breaker   *CircuitBreaker // 密钥熔断器
+	mu        sync.Mutex
+	rnd       *rand.Rand
+}
+
+// NewKeyScheduler 创建API密钥调度器
+func NewKeyScheduler(readWrite *datahandle.CommonReadWriteService, logger *log.Logger, breaker *CircuitBreaker) *KeyScheduler {
+	return &KeyScheduler{
+		readWrite: readWrite,
+		logger:    logger,
+		breaker:   breaker,
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// minuteKey 分钟调用计数的Redis键
+func minuteKey(keyID int, now time.Time) string {
+	return fmt.Sprintf("model:keyusage:min:%d:%s", keyID, now.Format("200601021504"))
+}
+
+// dayKey 天调用计数的Redis键
+func dayKey(keyID int, now time.Time) string {
+	return fmt.Sprintf("model:keyusage:day:%d:%s", keyID, now.Format("20060102"))
+}
+
+// statsKey 近期成功/失败计数的Redis键（按统计窗口分桶）
+func statsKey(keyID int, result string, bucket int64) string {
+	return fmt.Sprintf("model:keystats:%d:%s:%d", keyID, result, bucket)
+}
+
+// readCounter 读取Redis计数器，读取失败视为0
+func (s *KeyScheduler) readCounter(key string) int {
+	return readRedisCounter(s.readWrite, key)
+}
+
+// readRedisCounter 读取Redis计数器，读取失败视为0
+func readRedisCounter(readWrite *datahandle.CommonReadWriteService, key string) int {
+	result := readWrite.GetRedis(key)
+	if !result.IsSuccess() {
+		return 0
+	}
+	str, _ := result.Data.(string)
+	count, _ := strconv.Atoi(str)
+	return count
+}
+
+// GetKeyUsage 获取密钥当前的调用次数和近期成功/失败次数
+func (s *KeyScheduler) GetKeyUsage(keyID int) *KeyUsage {
+	now := time.Now()
+	bucket := now.Unix() / int64(keyStatsWindow/time.Second)
+
+	usage := &KeyUsage{
+		MinuteCount: s.readCounter(minuteKey(keyID, now)),
+		DayCount:    s.readCounter(dayKey(keyID, now)),
+	}
+	for _, b := range []int64{bucket, bucket - 1} {
+		usage.RecentSuccess += s.readCounter(statsKey(keyID, "success", b))
+		usage.RecentFail += s.readCounter(statsKey(keyID, "fail", b))
+	}
+	return usage
+}
+
+// atLimit 判断密钥是否已达到速率限制（限额为0表示不限制）
+func atLimit(key *APIKeyConfig, usage *KeyUsage) bool {
+	if key.RateLimitPerMin > 0 && usage.MinuteCount >= key.RateLimitPerMin {
+		return true
+	}
+	if key.RateLimitPerDay > 0 && usage.DayCount >= key.RateLimitPerDay {
+		return true
+	}
+	return false
+}
+
+// keyWeight 计算密钥的选择权重
+// 优先级越高权重越大（相对于候选中的最低优先级），再乘以近期成功率（拉普拉斯平滑）
+func keyWeight(key *APIKeyConfig, usage *KeyUsage, minPriority int) float64 {
+	priorityWeight := float64(key.Priority-minPriority) + 1
+	successRate := float64(usage.RecentSuccess+1) / float64(usage.RecentSuccess+usage.RecentFail+2)
+	if successRate < minSuccessRateWeight {
+		successRate = minSuccessRateWeight
+	}
+	return priorityWeight * successRate
+}
+
+// SelectKey 从候选密钥中选择一个并占用一次调用额度
+// excludeKeyIDs 中的密钥（如本次请求已失败的密钥）不参与选择
+func (s *KeyScheduler) SelectKey(apiKeys []*APIKeyConfig, excludeKeyIDs ...int) (*APIKeyConfig, error) {
+	excluded := make(map[int]bool, len(excludeKeyIDs))
+	for _, id := range excludeKeyIDs {
+		excluded[id] = true
+	}
+
+	type candidate struct {
+		key    *APIKeyConfig
+		weight float64
+	}
+
+	var usable []*APIKeyConfig
+	usages := make(map[int]*KeyUsage)
+	limited := 0
+	broken := 0
+	for _, key := range apiKeys {
+		if key == nil || excluded[key.ID] {
+			continue
+		}
+		if !s.breaker.Available(strconv.Itoa(key.ID)) {
+			broken++
+			s.logger.Printf("密钥已熔断，跳过: ID=%d", key.ID)
+			continue
+		}
+		usage := s.GetKeyUsage(key.ID)
+		if atLimit(key, usage) {
+			limited++
+			s.logger.Printf("密钥已达到速率限制，跳过: ID=%d, 分钟=%d/%d, 天=%d/%d",
+				key.ID, usage.MinuteCount, key.RateLimitPerMin, usage.DayCount, key.RateLimitPerDay)
+			continue
+		}
+		usable = append(usable, key)
+		usages[key.ID] = usage
+	}
+
+	if len(usable) == 0 {
+		if limited > 0 || broken > 0 {
+			return nil, fmt.Errorf("没有可用的API密钥: %d 个密钥已达到速率限制, %d 个密钥已熔断", limited, broken)
+		}
+		return nil, fmt.Errorf("没有可用的API密钥")
+	}
+
+	minPriority := usable[0].Priority
+	for _, key := range usable {
+		if key.Priority < minPriority {
+			minPriority = key.Priority
+		}
+	}
+
+	candidates := make([]candidate, 0, len(usable))
+	for _, key := range usable {
+		candidates = append(candidates, candidate{key: key, weight: keyWeight(key, usages[key.ID], minPriority)})
+	}
+
+	for len(candidates) > 0 {
+		total := 0.0
+		for _, c := range candidates {
+			total += c.weight
+		}
+
+		s.mu.Lock()
+		target := s.rnd.Float64() * total
+		s.mu.Unlock()
+
+		index := len(candidates) - 1
+		for i, c := range candidates {
+			target -= c.weight
+			if target < 0 {
+				index = i
+				break
+			}
+		}
+
+		selected := candidates[index].key
+		if id := strconv.Itoa(selected.ID); s.breaker.Acquire(id) {
+			if s.reserve(selected) {
+				s.logger.Printf("调度选择密钥: ID=%d, 优先级=%d, 权重=%.3f", selected.ID, selected.Priority, candidates[index].weight)
+				return selected, nil
+			}
+			s.breaker.Release(id)
+		}
+
+		// 其他网关实例抢先用完了额度或占用了探测名额，换下一个候选
+		candidates = append(candidates[:index], candidates[index+1:]...)
+	}
+
+	return nil, fmt.Errorf("没有可用的API密钥: 所有密钥均已达到速率限制或已熔断")
+}
+
+// reserve 占用一次分钟/天调用额度，超出限额时回滚并返回 false
+// Redis 不可用时放行，避免因统计失败导致请求不可用
+func (s *KeyScheduler) reserve(key *APIKeyConfig) bool {
+	now := time.Now()
+	minKey := minuteKey(key.ID, now)
+	dKey := dayKey(key.ID, now)
+
+	minResult := s.readWrite.IncrRedis(minKey, 1, 2*time.Minute)
+	if !minResult.IsSuccess() {
+		s.logger.Printf("密钥分钟计数失败，放行: ID=%d, 错误=%v", key.ID, minResult.Error)
+		return true
+	}
+	if count, ok := minResult.Data.(int64); ok && key.RateLimitPerMin > 0 && int(count) > key.RateLimitPerMin {
+		s.readWrite.IncrRedis(minKey, -1, 2*time.Minute)
+		return false
+	}
+
+	dayResult := s.readWrite.IncrRedis(dKey, 1, 25*time.Hour)
+	if !dayResult.IsSuccess() {
+		s.logger.Printf("密钥天计数失败，放行: ID=%d, 错误=%v", key.ID, dayResult.Error)
+		return true
+	}
+	if count, ok := dayResult.Data.(int64); ok && key.RateLimitPerDay > 0 && int(count) > key.RateLimitPerDay {
+		s.readWrite.IncrRedis(dKey, -1, 25*time.Hour)
+		s.readWrite.IncrRedis(minKey, -1, 2*time.Minute)
+		return false
+	}
+
+	return true
+}
+
+// RecordResult 记录密钥调用结果，用于计算近期成功率
+func (s *KeyScheduler) RecordResult(keyID int, success bool) {
+	if keyID <= 0 {
+		return
+	}
+	result := "fail"
+	if success {
+		result = "success"
+	}
+	bucket := time.Now().Unix() / int64(keyStatsWindow/time.Second)
+	// 保留两个窗口，读取时合并当前和上一个窗口
+	s.readWrite.IncrRedis(statsKey(keyID, result, bucket), 1, 2*keyStatsWindow)
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,6 +34,20 @@ type ModelConfig struct {
 	MaxTokens       int     `json:"max_tokens"`
 	CostPer1kInput  float64 `json:"cost_per_1k_input"`
 	CostPer1kOutput float64 `json:"cost_per_1k_output"`
+	// 缓存输入相对于输入价格的比例，未配置（0）时使用默认值
+	CachedInputRatio float64 `json:"cached_input_ratio"` // 缓存命中的输入
+	CacheWriteRatio  float64 `json:"cache_write_ratio"`  // 写入缓存的输入（Claude cache_creation_input_tokens）
+}
+
+// 模型类型（ModelConfig.ModelType），未配置时视为聊天模型
+const (
+	ModelTypeChat      = "chat"
+	ModelTypeEmbedding = "embedding"
+)
+
+// IsEmbedding 判断是否为向量（embedding）模型
+func (c *ModelConfig) IsEmbedding() bool {
+	return strings.EqualFold(strings.TrimSpace(c.ModelType), ModelTypeEmbedding)
 }
 
 // APIKeyConfig API密钥配置结构
@@ -60,6 +76,19 @@ type ModelManager struct {
 	dbService       *database.SilicoidDataService
 	cacheExpire     time.Duration // Redis缓存过期时间
 	logger          *log.Logger
+	keyScheduler    *KeyScheduler   // API密钥调度器
+	keyBreaker      *CircuitBreaker // API密钥熔断器
+	urlBreaker      *CircuitBreaker // base_url 熔断器
+	keyBaseURLs     sync.Map        // 密钥ID -> 选择该密钥时模型的 base_url，用于上报 base_url 熔断结果
+}
+
+// ProbeTarget 熔断器探测目标
+// ProbeKey/ProbeURL 表示本次探测对应的是密钥熔断器还是 base_url 熔断器
+type ProbeTarget struct {
+	Model    *ModelConfig
+	Key      *APIKeyConfig
+	ProbeKey bool
+	ProbeURL bool
 }
 
 var (
@@ -84,12 +113,17 @@ func GetModelManager() *ModelManager {
 		}
 		
 		dbService := database.NewSilicoidDataService(readWrite)
+		managerLogger := log.New(io.Discard, "", 0) // 禁用日志输出
+		keyBreaker := NewCircuitBreaker(readWrite, managerLogger, "key")
 		
 		modelManagerInstance = &ModelManager{
 			readWrite:     readWrite,
 			dbService:    dbService,
 			cacheExpire:   1 * time.Hour, // 缓存1小时
-			logger:        log.New(io.Discard, "", 0), // 禁用日志输出
+			logger:        managerLogger,
+			keyScheduler:  NewKeyScheduler(readWrite, managerLogger, keyBreaker),
+			keyBreaker:    keyBreaker,
+			urlBreaker:    NewCircuitBreaker(readWrite, managerLogger, "url"),
 		}
 		
 		// 启动时预加载所有模型配置（只执行一次）
@@ -233,6 +267,24 @@ func getIntValue(value interface{}) int {
 	return 0
 }
 
+// 辅助函数：安全获取浮点数值（兼容 DECIMAL 列返回的字符串）
+func getFloatValue(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
+
 // findModelCodeByModelName 通过 model_name 查找对应的 model_code
 func (m *ModelManager) findModelCodeByModelName(modelName string) (string, error) {
 	if m.dbService == nil {
@@ -297,6 +349,25 @@ func (m *ModelManager) GetModelConfig(modelCodeOrName string) (*ModelConfig, err
 	return modelConfig, nil
 }
 
+// GetContextWindow 获取模型的上下文窗口（token 数）
+// 使用提供商模型表同步的 context_window；未同步时返回 0（max_tokens 是输出上限，不能代替上下文窗口）
+func (m *ModelManager) GetContextWindow(modelName string) int {
+	cacheKey := fmt.Sprintf("model:context_window:%s", modelName)
+	if result := m.readWrite.GetRedis(cacheKey); result.IsSuccess() {
+		if value, err := strconv.Atoi(fmt.Sprint(result.Data)); err == nil && value > 0 {
+			return value
+		}
+	}
+
+	if m.dbService != nil {
+		if contextWindow, err := m.dbService.GetContextWindowByModelName(modelName); err == nil {
+			m.readWrite.SetRedis(cacheKey, strconv.Itoa(contextWindow), m.cacheExpire)
+			return contextWindow
+		}
+	}
+	return 0
+}
+
 // GetAvailableAPIKeys 获取模型的可用API密钥列表 (按优先级排序)
 func (m *ModelManager) GetAvailableAPIKeys(modelCode string) ([]*APIKeyConfig, error) {
 	// 先获取模型配置（验证模型是否存在）
@@ -346,6 +417,167 @@ func (m *ModelManager) GetAvailableAPIKeys(modelCode string) ([]*APIKeyConfig, e
 	return nil, fmt.Errorf("无可用API密钥: Redis缓存和数据库都无数据")
 }
 
+// SelectAPIKey 为模型选择一个API密钥
+// 由密钥调度器按熔断状态、速率限制、优先级和近期成功率选择，excludeKeyIDs 为本次请求中已尝试失败的密钥
+func (m *ModelManager) SelectAPIKey(modelCode string, excludeKeyIDs ...int) (*APIKeyConfig, error) {
+	apiKeys, err := m.GetAvailableAPIKeys(modelCode)
+	if err != nil {
+		return nil, err
+	}
+	
+	// base_url 熔断时该模型的所有密钥都不可用
+	var baseURL string
+	if modelConfig, err := m.GetModelConfig(modelCode); err == nil {
+		baseURL = modelConfig.BaseURL
+	}
+	if baseURL != "" && !m.urlBreaker.Acquire(baseURL) {
+		return nil, fmt.Errorf("没有可用的API密钥: 上游 %s 已熔断", baseURL)
+	}
+	
+	key, err := m.keyScheduler.SelectKey(apiKeys, excludeKeyIDs...)
+	if err != nil {
+		// 没有发出请求，归还 base_url 的探测名额
+		if baseURL != "" {
+			m.urlBreaker.Release(baseURL)
+		}
+		return nil, err
+	}
+	if baseURL != "" {
+		m.keyBaseURLs.Store(key.ID, baseURL)
+	}
+	return key, nil
+}
+
+// GetKeyBreakerState 获取API密钥的熔断状态
+func (m *ModelManager) GetKeyBreakerState(keyID int) *BreakerState {
+	return m.keyBreaker.State(strconv.Itoa(keyID))
+}
+
+// GetBaseURLBreakerState 获取 base_url 的熔断状态
+func (m *ModelManager) GetBaseURLBreakerState(baseURL string) *BreakerState {
+	return m.urlBreaker.State(baseURL)
+}
+
+// ProbeTargets 获取冷却结束、需要发送探测请求的密钥和 base_url，并占用探测名额
+// 调用方需要通过 ReportProbeResult 上报每个目标的探测结果
+func (m *ModelManager) ProbeTargets() []*ProbeTarget {
+	models, err := m.GetAllModels()
+	if err != nil {
+		m.logger.Printf("获取熔断探测目标失败: %v", err)
+		return nil
+	}
+	
+	var targets []*ProbeTarget
+	probedURLs := make(map[string]bool)
+	for _, model := range models {
+		modelConfig, err := m.GetModelConfig(model.ModelCode)
+		if err != nil {
+			continue
+		}
+		apiKeys, err := m.GetAvailableAPIKeys(model.ModelCode)
+		if err != nil || len(apiKeys) == 0 {
+			continue
+		}
+		
+		// base_url 半开：用一个未熔断的密钥探测
+		baseURL := modelConfig.BaseURL
+		if baseURL != "" && !probedURLs[baseURL] && m.urlBreaker.State(baseURL).State == BreakerHalfOpen {
+			for _, key := range apiKeys {
+				if m.keyBreaker.State(strconv.Itoa(key.ID)).State == BreakerClosed {
+					if m.urlBreaker.Acquire(baseURL) {
+						targets = append(targets, &ProbeTarget{Model: modelConfig, Key: key, ProbeURL: true})
+					}
+					probedURLs[baseURL] = true
+					break
+				}
+			}
+		}
+		
+		// 密钥半开：base_url 未熔断时逐个探测
+		if baseURL != "" && m.urlBreaker.State(baseURL).State != BreakerClosed {
+			continue
+		}
+		for _, key := range apiKeys {
+			id := strconv.Itoa(key.ID)
+			if m.keyBreaker.State(id).State == BreakerHalfOpen && m.keyBreaker.Acquire(id) {
+				targets = append(targets, &ProbeTarget{Model: modelConfig, Key: key, ProbeKey: true})
+			}
+		}
+	}
+	
+	return targets
+}
+
+// ReportProbeResult 上报探测结果（只更新熔断状态，不计入密钥使用统计）
+func (m *ModelManager) ReportProbeResult(target *ProbeTarget, probeErr error) {
+	if target.ProbeKey {
+		id := strconv.Itoa(target.Key.ID)
+		if probeErr == nil {
+			m.keyBreaker.RecordSuccess(id)
+		} else {
+			m.keyBreaker.RecordFailure(id, probeErr.Error())
+		}
+	}
+	if target.ProbeURL {
+		if probeErr == nil {
+			m.urlBreaker.RecordSuccess(target.Model.BaseURL)
+		} else {
+			m.urlBreaker.RecordFailure(target.Model.BaseURL, probeErr.Error())
+		}
+	}
+}
+
+// GetKeyUsage 获取API密钥当前的调用次数统计
+func (m *ModelManager) GetKeyUsage(keyID int) *KeyUsage {
+	return m.keyScheduler.GetKeyUsage(keyID)
+}
+
+// GetFallbackChain 获取模型的降级链 (不包含模型本身)
+// 降级链按 model_code 配置，链中的模型按 ModelConfig.Priority 升序排列
+// 缓存策略与模型配置一致：先从Redis缓存获取，缓存未命中则从数据库加载
+func (m *ModelManager) GetFallbackChain(modelCode string) ([]*ModelConfig, error) {
+	if m.dbService == nil {
+		return nil, fmt.Errorf("数据库服务未初始化")
+	}
+
+	var fallbackCodes []string
+	cacheKey := fmt.Sprintf("model:fallback:%s", modelCode)
+	result := m.readWrite.GetRedis(cacheKey)
+	if result.IsSuccess() {
+		jsonStr, _ := result.Data.(string)
+		if err := json.Unmarshal([]byte(jsonStr), &fallbackCodes); err != nil {
+			fallbackCodes = nil
+		}
+	}
+
+	if fallbackCodes == nil {
+		codes, err := m.dbService.GetModelFallbackChain(modelCode)
+		if err != nil {
+			return nil, err
+		}
+		fallbackCodes = codes
+		if jsonData, err := json.Marshal(fallbackCodes); err == nil {
+			m.readWrite.SetRedis(cacheKey, string(jsonData), m.cacheExpire)
+		}
+	}
+
+	chain := make([]*ModelConfig, 0, len(fallbackCodes))
+	for _, code := range fallbackCodes {
+		config, err := m.GetModelConfig(code)
+		if err != nil {
+			m.logger.Printf("降级模型 %s 配置加载失败，跳过: %v", code, err)
+			continue
+		}
+		chain = append(chain, config)
+	}
+
+	sort.SliceStable(chain, func(i, j int) bool {
+		return chain[i].Priority < chain[j].Priority
+	})
+
+	return chain, nil
+}
+
 // loadModelFromDatabase 从数据库加载模型配置
 func (m *ModelManager) loadModelFromDatabase(modelCode string) (*ModelConfig, error) {
 	if m.dbService == nil {
@@ -381,12 +613,11 @@ func (m *ModelManager) loadModelFromDatabase(modelCode string) (*ModelConfig, er
 	} else if val, ok := row["max_tokens"].(int); ok {
 		modelConfig.MaxTokens = val
 	}
-	if val, ok := row["cost_per_1k_input"].(float64); ok {
-		modelConfig.CostPer1kInput = val
-	}
-	if val, ok := row["cost_per_1k_output"].(float64); ok {
-		modelConfig.CostPer1kOutput = val
-	}
+	// DECIMAL 列由数据库驱动以字符串返回
+	modelConfig.CostPer1kInput = getFloatValue(row["cost_per_1k_input"])
+	modelConfig.CostPer1kOutput = getFloatValue(row["cost_per_1k_output"])
+	modelConfig.CachedInputRatio = getFloatValue(row["cached_input_ratio"])
+	modelConfig.CacheWriteRatio = getFloatValue(row["cache_write_ratio"])
 	
 	return modelConfig, nil
 }
@@ -487,6 +718,10 @@ func (m *ModelManager) cacheAPIKeys(modelCode string, apiKeys []*APIKeyConfig) {
 func (m *ModelManager) clearModelCache(modelCode string) {
 	configKey := fmt.Sprintf("model:config:%s", modelCode)
 	apiKeysKey := fmt.Sprintf("model:apikeys:%s", modelCode)
+	fallbackKey := fmt.Sprintf("model:fallback:%s", modelCode)
+
+	// 删除降级链缓存
+	m.readWrite.DeleteRedis(fallbackKey)
 	
 	// 删除模型配置缓存
 	result1 := m.readWrite.DeleteRedis(configKey)
@@ -551,46 +786,65 @@ func (m *ModelManager) UpdateKeyStatus(keyID int, success bool, errMsg string) e
 	
 	m.logger.Printf("更新密钥状态: ID=%d, 成功=%v", keyID, success)
 	
-	// 如果失败次数过多，自动禁用密钥
-	if !success {
-		m.checkAndDisableKey(keyID)
-	}
+	// 记录调用结果，供调度器计算近期成功率
+	m.keyScheduler.RecordResult(keyID, success)
+	
+	// 更新熔断状态（取代原来的永久禁用，熔断后冷却结束会自动探测恢复）
+	m.recordBreakerResult(keyID, success, errMsg)
 	
 	return nil
 }
 
-// checkAndDisableKey 检查并禁用失败次数过多的密钥
-func (m *ModelManager) checkAndDisableKey(keyID int) {
-	if m.dbService == nil {
+// recordBreakerResult 将调用结果上报给密钥熔断器；成功时同时关闭 base_url 熔断器
+// 失败只计入密钥熔断器，上游本身的故障由 RecordUpstreamFailure 计入 base_url 熔断器
+func (m *ModelManager) recordBreakerResult(keyID int, success bool, errMsg string) {
+	id := strconv.Itoa(keyID)
+	baseURL, _ := m.keyBaseURLs.Load(keyID)
+	url, _ := baseURL.(string)
+	
+	if success {
+		m.keyBreaker.RecordSuccess(id)
+		if url != "" {
+			m.urlBreaker.RecordSuccess(url)
+		}
 		return
 	}
 	
-	// 使用 database 包的方法获取密钥信息
-	keyInfo, err := m.dbService.GetModelApiKeyByID(keyID)
-	if err != nil {
-		return
+	m.keyBreaker.RecordFailure(id, errMsg)
+}
+
+// RecordUpstreamSuccess 记录上游返回了非 5xx 的响应：上游本身可用，关闭密钥所属 base_url 的熔断器
+// 认证、限流和请求错误只说明密钥或请求有问题，不影响 base_url 的探测结果
+func (m *ModelManager) RecordUpstreamSuccess(keyID int) {
+	baseURL, _ := m.keyBaseURLs.Load(keyID)
+	if url, _ := baseURL.(string); url != "" {
+		m.urlBreaker.RecordSuccess(url)
 	}
-	
-	failCount := getIntValue(keyInfo["fail_count"])
-	successCount := getIntValue(keyInfo["success_count"])
-	
-	// 如果连续失败超过10次，或失败率超过50%，则禁用密钥
-	if failCount >= 10 || (failCount > 5 && float64(failCount)/float64(failCount+successCount) > 0.5) {
-		updates := map[string]interface{}{
-			"status":     0,
-			"fail_reason": "连续失败次数过多，已自动禁用",
-		}
-		err := m.dbService.UpdateModelApiKey(keyID, updates)
-		if err != nil {
-			m.logger.Printf("禁用密钥失败: ID=%d, 错误=%v", keyID, err)
-		} else {
-			m.logger.Printf("密钥已自动禁用: ID=%d, 失败次数=%d", keyID, failCount)
-		}
+}
+
+// ReleaseKeyProbe 归还选择密钥时占用的探测名额，请求没有发出、被取消或结果不能说明密钥好坏时调用
+func (m *ModelManager) ReleaseKeyProbe(keyID int) {
+	m.keyBreaker.Release(strconv.Itoa(keyID))
+	baseURL, _ := m.keyBaseURLs.Load(keyID)
+	if url, _ := baseURL.(string); url != "" {
+		m.urlBreaker.Release(url)
+	}
+}
+
+// RecordUpstreamFailure 记录上游本身的故障（网络错误或 5xx），计入密钥所属 base_url 的熔断器
+// 认证、限流和请求错误只与单个密钥或请求有关，不能让整个上游对所有用户熔断
+func (m *ModelManager) RecordUpstreamFailure(keyID int, errMsg string) {
+	baseURL, _ := m.keyBaseURLs.Load(keyID)
+	if url, _ := baseURL.(string); url != "" {
+		m.urlBreaker.RecordFailure(url, errMsg)
 	}
 }
 
 // InvalidateCache 使缓存失效 (当数据库更新时调用)
 func (m *ModelManager) InvalidateCache(modelCode string) {
+	// 删除降级链缓存
+	m.readWrite.DeleteRedis(fmt.Sprintf("model:fallback:%s", modelCode))
+
 	// 删除模型配置缓存
 	configKey := fmt.Sprintf("model:config:%s", modelCode)
 	result1 := m.readWrite.DeleteRedis(configKey)
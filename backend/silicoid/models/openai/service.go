@@ -177,6 +177,23 @@ func (s *OpenAIService) CreateChatCompletionStream(ctx context.Context, data map
 	return outputChan
 }
 
+// CreateEmbeddings 创建向量（embeddings）请求
+// 与聊天请求共用 Key 选择和错误处理，模型未配置 endpoint 时使用 /v1/embeddings
+func (s *OpenAIService) CreateEmbeddings(ctx context.Context, data map[string]interface{}) map[string]interface{} {
+	if endpoint, _ := data["_endpoint"].(string); endpoint == "" {
+		data["_endpoint"] = "/v1/embeddings"
+	}
+
+	model, _ := data["model"].(string)
+	logger.Printf("发送OpenAI向量请求，模型: %s", model)
+
+	startTime := time.Now()
+	response := s.sendRequest(ctx, data)
+	logger.Printf("OpenAI向量响应时间: %.2f秒", time.Since(startTime).Seconds())
+
+	return response
+}
+
 // sendRequest 发送请求到OpenAI API
 func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]interface{}) map[string]interface{} {
 	// 获取模型名称
@@ -187,6 +204,7 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 	
 	// 处理 API Key：根据拦截器传来的标记决定使用哪个 Key
 	var apiKey string
+	var keyID int
 	
 	// 检查是否使用用户自己的 OpenAI Key（拦截器设置的标记）
 	useUserKey, _ := params["_use_user_key"].(bool)
@@ -237,8 +255,8 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 		
 	default:
 		// 场景2: 使用平台的 OpenAI Key
-		apiKeys, err := s.modelManager.GetAvailableAPIKeys(modelCode)
-		if err != nil || len(apiKeys) == 0 {
+		selectedKey, err := s.modelManager.SelectAPIKey(modelCode)
+		if err != nil {
 			logger.Printf("获取平台API密钥失败 (模型代码: %s, 模型名: %s): %v", modelCode, model, err)
 			return map[string]interface{}{
 				"error": map[string]interface{}{
@@ -248,14 +266,15 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 			}
 		}
 		
-		apiKey = apiKeys[0].APIKey
+		apiKey = selectedKey.APIKey
+		keyID = selectedKey.ID
 		// 显示 API Key 的前几个字符和长度用于调试（不显示完整密钥）
 		keyPreview := apiKey
 		if len(keyPreview) > 10 {
 			keyPreview = keyPreview[:10] + "..."
 		}
 		logger.Printf("使用平台API Key (模型代码: %s, 模型名: %s, KeyID: %d, Key预览: %s, 长度: %d)", 
-			modelCode, model, apiKeys[0].ID, keyPreview, len(apiKey))
+			modelCode, model, keyID, keyPreview, len(apiKey))
 	}
 	
 	// 检查并记录工具信息（用于验证工具传递）
@@ -283,6 +302,7 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 	jsonData, err := json.Marshal(params)
 	if err != nil {
 		logger.Printf("序列化请求参数失败: %v", err)
+		s.releaseKeyProbe(keyID)
 		return map[string]interface{}{
 			"error": map[string]interface{}{
 				"message": fmt.Sprintf("序列化请求失败: %v", err),
@@ -295,6 +315,7 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(jsonData))
 	if err != nil {
 		logger.Printf("创建HTTP请求失败: %v", err)
+		s.releaseKeyProbe(keyID)
 		return map[string]interface{}{
 			"error": map[string]interface{}{
 				"message": fmt.Sprintf("创建请求失败: %v", err),
@@ -311,6 +332,7 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		logger.Printf("发送HTTP请求失败: %v", err)
+		s.recordRequestError(ctx, keyID, err)
 		return map[string]interface{}{
 			"error": map[string]interface{}{
 				"message": fmt.Sprintf("请求失败: %v", err),
@@ -324,6 +346,7 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		logger.Printf("读取响应失败: %v", err)
+		s.recordRequestError(ctx, keyID, err)
 		return map[string]interface{}{
 			"error": map[string]interface{}{
 				"message": fmt.Sprintf("读取响应失败: %v", err),
@@ -333,16 +356,24 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 	}
 	
 	// 检查HTTP状态码
+	s.recordKeyResult(keyID, resp.StatusCode, string(body))
 	if resp.StatusCode != http.StatusOK {
 		logger.Printf("API返回错误状态码: %d, 响应: %s", resp.StatusCode, string(body))
 		var errorResp map[string]interface{}
 		if err := json.Unmarshal(body, &errorResp); err == nil {
+			// 记录上游状态码，供拦截器判断是否需要降级
+			if errObj, ok := errorResp["error"].(map[string]interface{}); ok {
+				errObj["status_code"] = resp.StatusCode
+			} else {
+				errorResp["status_code"] = resp.StatusCode
+			}
 			return errorResp
 		}
 		return map[string]interface{}{
 			"error": map[string]interface{}{
-				"message": fmt.Sprintf("API错误 (状态码 %d): %s", resp.StatusCode, string(body)),
-				"type":    "api_error",
+				"message":     fmt.Sprintf("API错误 (状态码 %d): %s", resp.StatusCode, string(body)),
+				"type":        "api_error",
+				"status_code": resp.StatusCode,
 			},
 		}
 	}
@@ -359,6 +390,11 @@ func (s *OpenAIService) sendRequest(ctx context.Context, params map[string]inter
 		}
 	}
 	
+	// 记录实际使用的平台密钥，供拦截器写入计费流水
+	if keyID > 0 {
+		response["_key_id"] = keyID
+	}
+	
 	return response
 }
 
@@ -377,6 +413,7 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 		
 		// 处理 API Key：根据拦截器传来的标记决定使用哪个 Key
 		var apiKey string
+		var keyID int
 		
 		// 检查是否使用用户自己的 OpenAI Key（拦截器设置的标记）
 		useUserKey, _ := params["_use_user_key"].(bool)
@@ -427,8 +464,8 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 			
 		default:
 			// 场景2: 使用平台的 OpenAI Key
-			apiKeys, err := s.modelManager.GetAvailableAPIKeys(modelCode)
-			if err != nil || len(apiKeys) == 0 {
+			selectedKey, err := s.modelManager.SelectAPIKey(modelCode)
+			if err != nil {
 				logger.Printf("获取平台API密钥失败 (模型代码: %s, 模型名: %s, 流式): %v", modelCode, model, err)
 				errorData := map[string]interface{}{
 					"error": map[string]interface{}{
@@ -441,8 +478,9 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 				return
 			}
 			
-			apiKey = apiKeys[0].APIKey
-			logger.Printf("使用平台API Key (模型代码: %s, 模型名: %s, KeyID: %d, 流式)", modelCode, model, apiKeys[0].ID)
+			apiKey = selectedKey.APIKey
+			keyID = selectedKey.ID
+			logger.Printf("使用平台API Key (模型代码: %s, 模型名: %s, KeyID: %d, 流式)", modelCode, model, keyID)
 		}
 		
 		// 检查并记录工具信息（用于验证工具传递）
@@ -470,6 +508,7 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 		jsonData, err := json.Marshal(params)
 		if err != nil {
 			logger.Printf("序列化流式请求参数失败: %v", err)
+			s.releaseKeyProbe(keyID)
 			errorData := map[string]interface{}{
 				"error": map[string]interface{}{
 					"message": fmt.Sprintf("序列化请求失败: %v", err),
@@ -485,6 +524,7 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 		req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(jsonData))
 		if err != nil {
 			logger.Printf("创建流式HTTP请求失败: %v", err)
+			s.releaseKeyProbe(keyID)
 			errorData := map[string]interface{}{
 				"error": map[string]interface{}{
 					"message": fmt.Sprintf("创建请求失败: %v", err),
@@ -507,6 +547,7 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 		resp, err := s.httpClient.Do(req)
 		if err != nil {
 			logger.Printf("发送流式HTTP请求失败: %v", err)
+			s.recordRequestError(ctx, keyID, err)
 			errorData := map[string]interface{}{
 				"error": map[string]interface{}{
 					"message": fmt.Sprintf("请求失败: %v", err),
@@ -523,10 +564,12 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
 			logger.Printf("流式API返回错误状态码: %d, 响应: %s", resp.StatusCode, string(body))
+			s.recordKeyResult(keyID, resp.StatusCode, string(body))
 			errorData := map[string]interface{}{
 				"error": map[string]interface{}{
-					"message": fmt.Sprintf("API错误 (状态码 %d): %s", resp.StatusCode, string(body)),
-					"type":    "api_error",
+					"message":     fmt.Sprintf("API错误 (状态码 %d): %s", resp.StatusCode, string(body)),
+					"type":        "api_error",
+					"status_code": resp.StatusCode,
 				},
 			}
 			errorJSON, _ := json.Marshal(errorData)
@@ -534,6 +577,8 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 			return
 		}
 		
+		s.recordKeyResult(keyID, resp.StatusCode, "")
+		
 		// 读取SSE流式响应
 		reader := bufio.NewReader(resp.Body)
 		for {
@@ -571,6 +616,51 @@ func (s *OpenAIService) sendStreamRequest(ctx context.Context, params map[string
 return streamChan
 }
 
+// recordKeyResult 记录平台密钥的调用结果（keyID 为 0 表示用户自己的 Key，不记录）
+// 网络错误（statusCode 为 0）、认证/限流错误和 5xx 计为失败；其它 4xx 是请求本身的问题，不计入密钥状态
+// 每种结果都会结束熔断器的探测：上游有非 5xx 的响应即视为 base_url 可用，不能说明密钥好坏时归还密钥的探测名额
+func (s *OpenAIService) recordKeyResult(keyID int, statusCode int, errMsg string) {
+	if keyID <= 0 || s.modelManager == nil {
+		return
+	}
+	
+	switch {
+	case statusCode == http.StatusOK:
+		s.modelManager.UpdateKeyStatus(keyID, true, "")
+	case statusCode == 0 || statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden ||
+		statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		if statusCode != 0 {
+			errMsg = fmt.Sprintf("HTTP %d: %s", statusCode, errMsg)
+		}
+		s.modelManager.UpdateKeyStatus(keyID, false, errMsg)
+		if statusCode == 0 || statusCode >= 500 {
+			s.modelManager.RecordUpstreamFailure(keyID, errMsg)
+		} else {
+			s.modelManager.RecordUpstreamSuccess(keyID)
+		}
+	default:
+		s.modelManager.RecordUpstreamSuccess(keyID)
+		s.modelManager.ReleaseKeyProbe(keyID)
+	}
+}
+
+// recordRequestError 记录请求没有得到响应的结果：调用方取消时不计入密钥和上游状态，只归还探测名额
+func (s *OpenAIService) recordRequestError(ctx context.Context, keyID int, err error) {
+	if ctx.Err() != nil {
+		s.releaseKeyProbe(keyID)
+		return
+	}
+	s.recordKeyResult(keyID, 0, fmt.Sprintf("请求失败: %v", err))
+}
+
+// releaseKeyProbe 归还平台密钥占用的探测名额，选择密钥后请求没有发出时调用
+func (s *OpenAIService) releaseKeyProbe(keyID int) {
+	if keyID <= 0 || s.modelManager == nil {
+		return
+	}
+	s.modelManager.ReleaseKeyProbe(keyID)
+}
+
 // normalizeBaseURL 规范化 baseURL，去除末尾的 /v1 或 /
 func normalizeBaseURL(baseURL string) string {
 	baseURL = strings.TrimRight(baseURL, "/")